@@ -0,0 +1,83 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of muxfys.
+//
+//  muxfys is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  muxfys is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with muxfys. If not, see <http://www.gnu.org/licenses/>.
+
+package muxfys
+
+// This file implements a simple growable bitmap, used by CacheTracker to
+// record which fixed-size blocks of a file have been cached when a cache block
+// size has been configured.
+
+// bitmap records which of a set of non-negative indexes are set. The zero value
+// is an empty bitmap ready to use.
+type bitmap struct {
+	words []uint64
+}
+
+// set marks index i as set, growing the bitmap if necessary.
+func (b *bitmap) set(i int64) {
+	w := int(i / 64)
+	if w >= len(b.words) {
+		words := make([]uint64, w+1)
+		copy(words, b.words)
+		b.words = words
+	}
+	b.words[w] |= 1 << uint(i%64)
+}
+
+// setRange marks all indexes from first to last inclusive as set.
+func (b *bitmap) setRange(first, last int64) {
+	for i := first; i <= last; i++ {
+		b.set(i)
+	}
+}
+
+// isSet tells you if index i has been set.
+func (b *bitmap) isSet(i int64) bool {
+	w := int(i / 64)
+	if w >= len(b.words) {
+		return false
+	}
+	return b.words[w]&(1<<uint(i%64)) != 0
+}
+
+// truncate unsets all indexes from n onwards.
+func (b *bitmap) truncate(n int64) {
+	if n <= 0 {
+		b.words = nil
+		return
+	}
+	w := int((n - 1) / 64)
+	if w >= len(b.words) {
+		return
+	}
+	b.words = b.words[:w+1]
+	if rem := uint(n % 64); rem != 0 {
+		b.words[w] &= (1 << rem) - 1
+	}
+}
+
+// count returns the number of indexes that are set.
+func (b *bitmap) count() int {
+	var n int
+	for _, word := range b.words {
+		for ; word != 0; word &= word - 1 {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,98 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of muxfys.
+//
+//  muxfys is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  muxfys is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with muxfys. If not, see <http://www.gnu.org/licenses/>.
+
+package muxfys
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestBitmap(t *testing.T) {
+	Convey("A bitmap grows as indexes are set", t, func() {
+		b := &bitmap{}
+		So(b.isSet(0), ShouldBeFalse)
+		So(b.isSet(1000), ShouldBeFalse)
+
+		b.set(3)
+		b.setRange(62, 130)
+		So(b.isSet(3), ShouldBeTrue)
+		So(b.isSet(4), ShouldBeFalse)
+		So(b.isSet(61), ShouldBeFalse)
+		So(b.isSet(62), ShouldBeTrue)
+		So(b.isSet(130), ShouldBeTrue)
+		So(b.isSet(131), ShouldBeFalse)
+		So(b.count(), ShouldEqual, 70)
+
+		Convey("It can be truncated", func() {
+			b.truncate(100)
+			So(b.isSet(99), ShouldBeTrue)
+			So(b.isSet(100), ShouldBeFalse)
+			So(b.count(), ShouldEqual, 39)
+
+			b.truncate(64)
+			So(b.isSet(63), ShouldBeTrue)
+			So(b.isSet(64), ShouldBeFalse)
+			So(b.count(), ShouldEqual, 3)
+
+			b.truncate(0)
+			So(b.count(), ShouldEqual, 0)
+			So(b.isSet(3), ShouldBeFalse)
+		})
+	})
+
+	Convey("A block CacheTracker tracks whole aligned blocks", t, func() {
+		c := NewBlockCacheTracker(10)
+		So(c.CacheBlockSize(), ShouldEqual, 10)
+		So(NewBlockCacheTracker(0).CacheBlockSize(), ShouldEqual, 0)
+
+		So(c.Uncached("a", NewInterval(5, 3)), ShouldResemble, Intervals{NewInterval(0, 10)})
+		So(c.Uncached("a", NewInterval(5, 20)), ShouldResemble, Intervals{NewInterval(0, 30)})
+
+		c.Cached("a", NewInterval(10, 10))
+		c.Cached("a", NewInterval(40, 5))
+		So(c.Uncached("a", NewInterval(5, 45)), ShouldResemble, Intervals{NewInterval(0, 10), NewInterval(20, 20)})
+		So(c.Uncached("a", NewInterval(12, 5)), ShouldBeEmpty)
+		So(c.Uncached("a", NewInterval(41, 2)), ShouldBeEmpty)
+
+		Convey("Truncation keeps blocks with data before the offset", func() {
+			c.CacheTruncate("a", 41)
+			So(c.Uncached("a", NewInterval(40, 1)), ShouldBeEmpty)
+			c.CacheTruncate("a", 40)
+			So(c.Uncached("a", NewInterval(40, 1)), ShouldResemble, Intervals{NewInterval(40, 10)})
+			So(c.Uncached("a", NewInterval(10, 1)), ShouldBeEmpty)
+		})
+
+		Convey("Override, rename, delete and wipe work", func() {
+			c.CacheOverride("a", NewInterval(0, 5))
+			So(c.Uncached("a", NewInterval(0, 20)), ShouldResemble, Intervals{NewInterval(10, 10)})
+
+			c.CacheRename("a", "b")
+			So(c.Uncached("a", NewInterval(0, 1)), ShouldResemble, Intervals{NewInterval(0, 10)})
+			So(c.Uncached("b", NewInterval(0, 1)), ShouldBeEmpty)
+
+			c.CacheDelete("b")
+			So(c.Uncached("b", NewInterval(0, 1)), ShouldResemble, Intervals{NewInterval(0, 10)})
+
+			c.Cached("c", NewInterval(0, 1))
+			c.CacheWipe()
+			So(c.Uncached("c", NewInterval(0, 1)), ShouldResemble, Intervals{NewInterval(0, 10)})
+		})
+	})
+}
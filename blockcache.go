@@ -0,0 +1,342 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of muxfys.
+//
+//  muxfys is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  muxfys is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with muxfys. If not, see <http://www.gnu.org/licenses/>.
+
+package muxfys
+
+// This file implements an optional size-bounded in-memory cache of file data,
+// held as fixed-size aligned blocks, that sits in front of the on-disk cache of
+// cachedFile, or in front of remote reads by remoteFile when not caching on
+// disk.
+
+import (
+	"container/list"
+	"math"
+	"sync"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+const memBlockSize = int64(1048576) // 1MB
+
+// CacheStats struct describes the performance of the in-memory block cache
+// enabled with Config.MemoryCacheSize.
+type CacheStats struct {
+	// Hits is the number of reads that were entirely satisfied from memory.
+	Hits uint64
+
+	// Misses is the number of reads that needed at least one block to be
+	// read from the disk cache or remote.
+	Misses uint64
+
+	// Evictions is the number of blocks dropped to stay within the size
+	// limit. Blocks dropped because the underlying data changed are not
+	// counted.
+	Evictions uint64
+
+	// Bytes is the amount of data currently held in memory.
+	Bytes int64
+
+	// Limit is the configured maximum for Bytes.
+	Limit int64
+}
+
+// memBlock is an entry in a blockCache.
+type memBlock struct {
+	key   string
+	index int64
+	data  []byte
+}
+
+// blockFetch is a fetch of a block by blockCache.readThrough() that is in
+// progress. It is marked stale if the block is evicted while being fetched, so
+// that the fetched data, which may predate a write, doesn't get stored.
+type blockFetch struct {
+	index int64
+	stale bool
+}
+
+// blockFetcher is a function that fills dest with the data found at offset in
+// some file, returning the number of bytes filled. It's used by
+// blockCache.readThrough() to get blocks it does not have.
+type blockFetcher func(dest []byte, offset int64) (int, fuse.Status)
+
+// blockCache is an LRU cache of memBlocks keyed on file and block index. All
+// methods are safe to call on a nil *blockCache, which behaves like a cache
+// that is disabled.
+type blockCache struct {
+	mutex   sync.Mutex
+	limit   int64
+	lru     *list.List
+	blocks  map[string]map[int64]*list.Element
+	fetches map[string][]*blockFetch
+	stats   CacheStats
+}
+
+// newBlockCache creates a blockCache that will hold up to limit bytes. Returns
+// nil if limit is not positive.
+func newBlockCache(limit int64) *blockCache {
+	if limit <= 0 {
+		return nil
+	}
+	return &blockCache{
+		limit:   limit,
+		lru:     list.New(),
+		blocks:  make(map[string]map[int64]*list.Element),
+		fetches: make(map[string][]*blockFetch),
+		stats:   CacheStats{Limit: limit},
+	}
+}
+
+// readThrough fills buf with the data at offset of the file identified by key,
+// which has the given size. Blocks we don't have in memory are got by calling
+// fetch with whole aligned blocks (truncated at size), and then stored. Returns
+// the number of bytes of buf that were filled. Fetched blocks that were evicted
+// while being fetched are returned but not stored.
+func (c *blockCache) readThrough(key string, buf []byte, offset, size int64, fetch blockFetcher) (int, fuse.Status) {
+	end := offset + int64(len(buf))
+	if end > size {
+		end = size
+	}
+	if offset >= end {
+		return 0, fuse.OK
+	}
+	first := offset / memBlockSize
+	last := (end - 1) / memBlockSize
+
+	c.mutex.Lock()
+	hit := true
+	for i := first; i <= last; i++ {
+		if c.get(key, i, size) == nil {
+			hit = false
+			break
+		}
+	}
+	if hit {
+		c.stats.Hits++
+		for i := first; i <= last; i++ {
+			copyBlock(buf, offset, end, i, c.get(key, i, size))
+		}
+		c.mutex.Unlock()
+		return int(end - offset), fuse.OK
+	}
+	c.stats.Misses++
+	c.mutex.Unlock()
+
+	for i := first; i <= last; i++ {
+		c.mutex.Lock()
+		data := c.get(key, i, size)
+		var bf *blockFetch
+		if data == nil {
+			bf = c.startFetch(key, i)
+		}
+		c.mutex.Unlock()
+
+		if data == nil {
+			start := i * memBlockSize
+			length := memBlockSize
+			if start+length > size {
+				length = size - start
+			}
+			data = make([]byte, length)
+			n, status := fetch(data, start)
+			c.mutex.Lock()
+			c.endFetch(key, bf)
+			if status == fuse.OK && int64(n) == length && !bf.stale {
+				c.put(key, i, data)
+			}
+			c.mutex.Unlock()
+			if status != fuse.OK {
+				return 0, status
+			}
+			if int64(n) < length {
+				// the file is shorter than we were told; only return what we
+				// actually got, and don't cache the partial block
+				copyBlock(buf, offset, end, i, data[:n])
+				if got := start + int64(n) - offset; got > 0 {
+					return int(got), fuse.OK
+				}
+				return 0, fuse.OK
+			}
+		}
+
+		copyBlock(buf, offset, end, i, data)
+	}
+	return int(end - offset), fuse.OK
+}
+
+// startFetch records that we're about to fetch the block with the given index of
+// the given file. Must be called while you have the mutex Locked.
+func (c *blockCache) startFetch(key string, index int64) *blockFetch {
+	bf := &blockFetch{index: index}
+	c.fetches[key] = append(c.fetches[key], bf)
+	return bf
+}
+
+// endFetch forgets a fetch started with startFetch(). Must be called while you
+// have the mutex Locked.
+func (c *blockCache) endFetch(key string, bf *blockFetch) {
+	fetches := c.fetches[key]
+	for i, other := range fetches {
+		if other == bf {
+			fetches = append(fetches[:i], fetches[i+1:]...)
+			break
+		}
+	}
+	if len(fetches) == 0 {
+		delete(c.fetches, key)
+		return
+	}
+	c.fetches[key] = fetches
+}
+
+// staleFetches marks the in-progress fetches of blocks of the given file with
+// indexes between first and last (inclusive) as stale. Must be called while
+// you have the mutex Locked.
+func (c *blockCache) staleFetches(key string, first, last int64) {
+	for _, bf := range c.fetches[key] {
+		if bf.index >= first && bf.index <= last {
+			bf.stale = true
+		}
+	}
+}
+
+// copyBlock copies the part of the data of the block with the given index that
+// lies between offset and end in to buf, which starts at offset.
+func copyBlock(buf []byte, offset, end, index int64, data []byte) {
+	copyBlockData(buf, offset, end, index*memBlockSize, data)
+}
+
+// get returns the data of the block with the given index for the given file of
+// the given size, marking it as recently used. Returns nil if we don't have it,
+// or if what we have is the wrong length for a file of that size. Must be
+// called while you have the mutex Locked.
+func (c *blockCache) get(key string, index, size int64) []byte {
+	elements, exists := c.blocks[key]
+	if !exists {
+		return nil
+	}
+	e, exists := elements[index]
+	if !exists {
+		return nil
+	}
+	b := e.Value.(*memBlock)
+	length := memBlockSize
+	if (index+1)*memBlockSize > size {
+		length = size - index*memBlockSize
+	}
+	if int64(len(b.data)) != length {
+		c.remove(e)
+		return nil
+	}
+	c.lru.MoveToFront(e)
+	return b.data
+}
+
+// put stores a block, evicting the least recently used blocks to stay within
+// our limit. Must be called while you have the mutex Locked.
+func (c *blockCache) put(key string, index int64, data []byte) {
+	if int64(len(data)) > c.limit {
+		return
+	}
+	elements, exists := c.blocks[key]
+	if !exists {
+		elements = make(map[int64]*list.Element)
+		c.blocks[key] = elements
+	} else if e, exists := elements[index]; exists {
+		c.remove(e)
+	}
+
+	elements[index] = c.lru.PushFront(&memBlock{key: key, index: index, data: data})
+	c.stats.Bytes += int64(len(data))
+
+	for c.stats.Bytes > c.limit {
+		c.remove(c.lru.Back())
+		c.stats.Evictions++
+	}
+}
+
+// remove forgets a block. Must be called while you have the mutex Locked.
+func (c *blockCache) remove(e *list.Element) {
+	b := c.lru.Remove(e).(*memBlock)
+	c.stats.Bytes -= int64(len(b.data))
+	elements := c.blocks[b.key]
+	delete(elements, b.index)
+	if len(elements) == 0 {
+		delete(c.blocks, b.key)
+	}
+}
+
+// evict forgets all blocks of the given file that hold data at or after
+// offset.
+func (c *blockCache) evict(key string, offset int64) {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	first := offset / memBlockSize
+	for index, e := range c.blocks[key] {
+		if index >= first {
+			c.remove(e)
+		}
+	}
+	c.staleFetches(key, first, math.MaxInt64)
+}
+
+// evictRange forgets all blocks of the given file that overlap the given
+// interval.
+func (c *blockCache) evictRange(key string, iv Interval) {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	first := iv.Start / memBlockSize
+	last := iv.End / memBlockSize
+	for index, e := range c.blocks[key] {
+		if index >= first && index <= last {
+			c.remove(e)
+		}
+	}
+	c.staleFetches(key, first, last)
+}
+
+// wipe forgets all blocks.
+func (c *blockCache) wipe() {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.lru.Init()
+	c.blocks = make(map[string]map[int64]*list.Element)
+	c.stats.Bytes = 0
+	for key := range c.fetches {
+		c.staleFetches(key, 0, math.MaxInt64)
+	}
+}
+
+// currentStats returns a copy of our current statistics.
+func (c *blockCache) currentStats() CacheStats {
+	if c == nil {
+		return CacheStats{}
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.stats
+}
@@ -0,0 +1,165 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of muxfys.
+//
+//  muxfys is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  muxfys is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with muxfys. If not, see <http://www.gnu.org/licenses/>.
+
+package muxfys
+
+import (
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestBlockCache(t *testing.T) {
+	Convey("A disabled blockCache is nil and safe to use", t, func() {
+		c := newBlockCache(0)
+		So(c, ShouldBeNil)
+		c.evict("a", 0)
+		c.evictRange("a", NewInterval(0, 10))
+		c.wipe()
+		So(c.currentStats(), ShouldResemble, CacheStats{})
+	})
+
+	Convey("A blockCache reads through to its fetcher on misses only", t, func() {
+		size := memBlockSize*2 + 10
+		file := make([]byte, size)
+		for i := range file {
+			file[i] = byte(i % 251)
+		}
+		var fetches []int64
+		fetch := func(dest []byte, offset int64) (int, fuse.Status) {
+			fetches = append(fetches, offset)
+			return copy(dest, file[offset:]), fuse.OK
+		}
+
+		c := newBlockCache(memBlockSize * 2)
+		So(c, ShouldNotBeNil)
+
+		buf := make([]byte, 100)
+		offset := memBlockSize - 50
+		n, status := c.readThrough("a", buf, offset, size, fetch)
+		So(status, ShouldEqual, fuse.OK)
+		So(n, ShouldEqual, 100)
+		So(buf, ShouldResemble, file[offset:offset+100])
+		So(fetches, ShouldResemble, []int64{0, memBlockSize})
+		stats := c.currentStats()
+		So(stats.Misses, ShouldEqual, 1)
+		So(stats.Hits, ShouldEqual, 0)
+		So(stats.Bytes, ShouldEqual, memBlockSize*2)
+
+		Convey("Repeated reads are hits", func() {
+			buf2 := make([]byte, 10)
+			n, status = c.readThrough("a", buf2, 5, size, fetch)
+			So(status, ShouldEqual, fuse.OK)
+			So(n, ShouldEqual, 10)
+			So(buf2, ShouldResemble, file[5:15])
+			So(len(fetches), ShouldEqual, 2)
+			So(c.currentStats().Hits, ShouldEqual, 1)
+		})
+
+		Convey("Reads at the end of the file are truncated", func() {
+			n, status = c.readThrough("a", buf, size-10, size, fetch)
+			So(status, ShouldEqual, fuse.OK)
+			So(n, ShouldEqual, 10)
+			So(buf[:n], ShouldResemble, file[size-10:])
+		})
+
+		Convey("Going over the limit evicts the least recently used block", func() {
+			c.readThrough("a", buf, 0, size, fetch)
+			c.readThrough("a", buf, size-10, size, fetch)
+			stats = c.currentStats()
+			So(stats.Evictions, ShouldEqual, 1)
+			So(stats.Bytes, ShouldEqual, memBlockSize+10)
+
+			fetches = nil
+			c.readThrough("a", buf, 0, size, fetch)
+			So(len(fetches), ShouldEqual, 0)
+			c.readThrough("a", buf, memBlockSize, size, fetch)
+			So(fetches, ShouldResemble, []int64{memBlockSize})
+		})
+
+		Convey("Evicting blocks makes the next read a miss", func() {
+			c.evictRange("a", NewInterval(memBlockSize+1, 1))
+			fetches = nil
+			c.readThrough("a", buf, offset, size, fetch)
+			So(fetches, ShouldResemble, []int64{memBlockSize})
+
+			c.evict("a", 0)
+			So(c.currentStats().Bytes, ShouldEqual, 0)
+		})
+
+		Convey("Blocks of the wrong length for the file size are not used", func() {
+			c.readThrough("a", buf, size-10, size, fetch)
+			fetches = nil
+			file = append(file, file...)
+			c.readThrough("a", buf, size-10, size*2, fetch)
+			So(fetches, ShouldResemble, []int64{memBlockSize * 2})
+		})
+
+		Convey("Short fetches return only what was got and aren't cached", func() {
+			c.wipe()
+			short := size - 5
+			shortFetch := func(dest []byte, offset int64) (int, fuse.Status) {
+				fetches = append(fetches, offset)
+				return copy(dest, file[offset:short]), fuse.OK
+			}
+			fetches = nil
+			n, status = c.readThrough("a", buf, size-10, size, shortFetch)
+			So(status, ShouldEqual, fuse.OK)
+			So(n, ShouldEqual, 5)
+			So(buf[:n], ShouldResemble, file[size-10:short])
+			So(c.currentStats().Bytes, ShouldEqual, 0)
+
+			n, status = c.readThrough("a", buf, size-10, size, shortFetch)
+			So(n, ShouldEqual, 5)
+			So(fetches, ShouldResemble, []int64{memBlockSize * 2, memBlockSize * 2})
+		})
+
+		Convey("Blocks written to while being fetched aren't cached", func() {
+			c.wipe()
+			racingFetch := func(dest []byte, offset int64) (int, fuse.Status) {
+				fetches = append(fetches, offset)
+				n := copy(dest, file[offset:])
+				file[offset] = 255
+				c.evictRange("a", NewInterval(offset, 1))
+				return n, fuse.OK
+			}
+			fetches = nil
+			n, status = c.readThrough("a", buf, 0, size, racingFetch)
+			So(status, ShouldEqual, fuse.OK)
+			So(n, ShouldEqual, 100)
+			So(buf[0], ShouldEqual, byte(0))
+			So(c.currentStats().Bytes, ShouldEqual, 0)
+
+			n, status = c.readThrough("a", buf, 0, size, fetch)
+			So(status, ShouldEqual, fuse.OK)
+			So(buf[0], ShouldEqual, byte(255))
+			So(fetches, ShouldResemble, []int64{0, 0})
+			So(c.currentStats().Bytes, ShouldEqual, memBlockSize)
+
+			racingWipe := func(dest []byte, offset int64) (int, fuse.Status) {
+				c.wipe()
+				return copy(dest, file[offset:]), fuse.OK
+			}
+			c.evict("a", 0)
+			c.readThrough("a", buf, 0, size, racingWipe)
+			So(c.currentStats().Bytes, ShouldEqual, 0)
+			So(c.fetches, ShouldBeEmpty)
+		})
+	})
+}
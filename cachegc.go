@@ -0,0 +1,541 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of muxfys.
+//
+//  muxfys is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  muxfys is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with muxfys. If not, see <http://www.gnu.org/licenses/>.
+
+package muxfys
+
+// This file implements inspection and garbage collection of permanent cache
+// directories (those specified with RemoteConfig.CacheDir), which can be
+// shared by many mounts over time.
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	lockFilePrefix    = ".muxfys_lock."
+	partialFileSuffix = ".part.minio"
+	cacheTargetDepth  = 2
+)
+
+// CacheEntry struct describes a single file found in a cache directory.
+type CacheEntry struct {
+	// Path is the absolute path to the file.
+	Path string
+
+	// Target is the directory relative to the cache directory that identifies
+	// the remote target this file was cached from. For S3Accessors (as per
+	// their LocalPath() implementation), this is "host/bucket".
+	Target string
+
+	// Size is the apparent size of the file in bytes.
+	Size int64
+
+	// DiskUsage is the number of bytes actually allocated on disk for the
+	// file, which will be less than Size for sparse files.
+	DiskUsage int64
+
+	// LastUsed is the later of the last access and modification times.
+	LastUsed time.Time
+
+	// Partial is true if this appears to be a partially cached file: either a
+	// sparse file or an incomplete download.
+	Partial bool
+
+	// Stale is true if LastUsed was longer ago than the staleness threshold
+	// given to InspectCache().
+	Stale bool
+}
+
+// CacheTargetUsage struct summarises the usage of a cache directory by a single
+// remote target.
+type CacheTargetUsage struct {
+	Target    string
+	Files     int
+	Size      int64
+	DiskUsage int64
+	LastUsed  time.Time
+	Partial   int
+	Stale     int
+}
+
+// CacheReport struct is returned by InspectCache() and PruneCache().
+type CacheReport struct {
+	// Dir is the cache directory that was inspected.
+	Dir string
+
+	// Targets summarises usage per remote target, sorted by Target.
+	Targets []*CacheTargetUsage
+
+	// Entries lists every cache file found (or for PruneCache(), removed),
+	// sorted by Path.
+	Entries []*CacheEntry
+
+	// Orphans lists lock files that do not have a corresponding cache file
+	// (or for PruneCache(), those that were removed). These are left behind
+	// when cache files are removed.
+	Orphans []string
+
+	// InUse lists files that PruneCache() wanted to remove, but didn't because
+	// a running mount held their lock, or because a journal says they still
+	// need to be uploaded (or for lock files, the cache file they protect
+	// does).
+	InUse []string
+}
+
+// CachePruneOptions struct lets you say what PruneCache() should remove. Files
+// meeting any of the criteria will be removed.
+type CachePruneOptions struct {
+	// OlderThan removes files that were last used longer ago than this.
+	OlderThan time.Duration
+
+	// MaxSize removes the least recently used files until the total disk usage
+	// of what remains is at most this many bytes.
+	MaxSize int64
+
+	// Targets removes everything cached for these targets (see
+	// CacheEntry.Target and CacheTarget()).
+	Targets []string
+
+	// Partial removes partially cached files.
+	Partial bool
+
+	// Orphans removes orphaned lock files.
+	Orphans bool
+
+	// KeepNewerThan prevents the removal of any file used more recently than
+	// this, regardless of the other options.
+	KeepNewerThan time.Duration
+
+	// DryRun reports what would be removed without removing anything.
+	DryRun bool
+}
+
+// CacheTarget returns the Target that cache files for the given accessor would
+// be reported as having in a CacheReport for the given cache directory.
+func CacheTarget(accessor RemoteAccessor, cacheDir string) (string, error) {
+	cacheDir, err := filepath.Abs(cacheDir)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Rel(cacheDir, accessor.LocalPath(cacheDir, ""))
+}
+
+// InspectCache reports on what is stored in the given permanent cache
+// directory. Entries last used longer ago than staleAfter are marked Stale
+// (supply 0 to not consider anything stale).
+//
+// Cache files are grouped in to targets according to the directory layout used
+// by S3Accessor.LocalPath(), ie. the first 2 directories below cacheDir.
+func InspectCache(cacheDir string, staleAfter time.Duration) (*CacheReport, error) {
+	cacheDir, err := filepath.Abs(cacheDir)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &CacheReport{Dir: cacheDir}
+	now := time.Now()
+	err = filepath.Walk(cacheDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || info.Mode()&os.ModeSymlink != 0 {
+			return nil
+		}
+
+		base := filepath.Base(path)
+		if strings.HasPrefix(base, lockFilePrefix) {
+			cached := orphanedPath(path)
+			if _, errs := os.Lstat(cached); errs != nil && os.IsNotExist(errs) {
+				report.Orphans = append(report.Orphans, path)
+			}
+			return nil
+		}
+		if strings.HasPrefix(base, ".muxfys_") {
+			// our own bookkeeping files, not cached data
+			return nil
+		}
+
+		rel, err := filepath.Rel(cacheDir, path)
+		if err != nil {
+			return err
+		}
+		parts := strings.Split(filepath.Dir(rel), string(filepath.Separator))
+		if len(parts) > cacheTargetDepth {
+			parts = parts[:cacheTargetDepth]
+		}
+
+		atime, allocated := statTimesAndBlocks(info)
+		lastUsed := info.ModTime()
+		if atime.After(lastUsed) {
+			lastUsed = atime
+		}
+
+		report.Entries = append(report.Entries, &CacheEntry{
+			Path:      path,
+			Target:    filepath.Join(parts...),
+			Size:      info.Size(),
+			DiskUsage: allocated,
+			LastUsed:  lastUsed,
+			Partial:   allocated < info.Size() || strings.HasSuffix(base, partialFileSuffix) || strings.HasSuffix(base, downloadPartialSuffix),
+			Stale:     staleAfter > 0 && now.Sub(lastUsed) > staleAfter,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	report.summarise()
+	return report, nil
+}
+
+// summarise fills in Targets based on Entries, and sorts everything.
+func (r *CacheReport) summarise() {
+	sort.Slice(r.Entries, func(i, j int) bool {
+		return r.Entries[i].Path < r.Entries[j].Path
+	})
+	sort.Strings(r.Orphans)
+	sort.Strings(r.InUse)
+
+	targets := make(map[string]*CacheTargetUsage)
+	r.Targets = nil
+	for _, e := range r.Entries {
+		t, exists := targets[e.Target]
+		if !exists {
+			t = &CacheTargetUsage{Target: e.Target}
+			targets[e.Target] = t
+			r.Targets = append(r.Targets, t)
+		}
+		t.Files++
+		t.Size += e.Size
+		t.DiskUsage += e.DiskUsage
+		if e.LastUsed.After(t.LastUsed) {
+			t.LastUsed = e.LastUsed
+		}
+		if e.Partial {
+			t.Partial++
+		}
+		if e.Stale {
+			t.Stale++
+		}
+	}
+	sort.Slice(r.Targets, func(i, j int) bool {
+		return r.Targets[i].Target < r.Targets[j].Target
+	})
+}
+
+// PruneCache removes files from the given permanent cache directory according
+// to the given options, returning a report of what was (or with DryRun, would
+// have been) removed.
+//
+// It is safe to use while other processes have mounts using the same cache
+// directory: each file is only removed while holding the same lock file that
+// mounts use when they create and download cache files, and files whose lock
+// is currently held are skipped and listed in the report's InUse. Files that
+// are open in a running mount stay readable by that mount after removal, and
+// will be downloaded again the next time they are opened. Files that a mount
+// (running or crashed) has written but not yet uploaded, according to the
+// journals in the cache directory, are never removed and are also listed in
+// InUse. Orphaned lock files are only removed while we hold their lock and
+// they are still orphaned; mounts notice if the lock file they were waiting on
+// was removed, and lock a new one.
+func PruneCache(cacheDir string, opts CachePruneOptions) (*CacheReport, error) {
+	inspection, err := InspectCache(cacheDir, opts.OlderThan)
+	if err != nil {
+		return nil, err
+	}
+	pending, err := pendingUploads(inspection.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	keep := func(e *CacheEntry) bool {
+		return opts.KeepNewerThan > 0 && now.Sub(e.LastUsed) < opts.KeepNewerThan
+	}
+
+	byTarget := make(map[string]bool)
+	for _, t := range opts.Targets {
+		byTarget[filepath.Clean(t)] = true
+	}
+
+	// decide what to remove
+	remove := make(map[*CacheEntry]bool)
+	var remaining []*CacheEntry
+	var remainingUsage int64
+	for _, e := range inspection.Entries {
+		if keep(e) {
+			remaining = append(remaining, e)
+			remainingUsage += e.DiskUsage
+			continue
+		}
+		if byTarget[e.Target] || e.Stale || (opts.Partial && e.Partial) {
+			remove[e] = true
+			continue
+		}
+		remaining = append(remaining, e)
+		remainingUsage += e.DiskUsage
+	}
+	if opts.MaxSize > 0 && remainingUsage > opts.MaxSize {
+		sort.SliceStable(remaining, func(i, j int) bool {
+			return remaining[i].LastUsed.Before(remaining[j].LastUsed)
+		})
+		for _, e := range remaining {
+			if remainingUsage <= opts.MaxSize {
+				break
+			}
+			if keep(e) {
+				continue
+			}
+			remove[e] = true
+			remainingUsage -= e.DiskUsage
+		}
+	}
+
+	// remove it
+	report := &CacheReport{Dir: inspection.Dir}
+	for _, e := range inspection.Entries {
+		if !remove[e] {
+			continue
+		}
+		if pending[e.Path] {
+			report.InUse = append(report.InUse, e.Path)
+			continue
+		}
+		if opts.DryRun {
+			report.Entries = append(report.Entries, e)
+			continue
+		}
+		removed, errr := removeCacheFile(e.Path)
+		if errr != nil {
+			return report, errr
+		}
+		if removed {
+			report.Entries = append(report.Entries, e)
+		} else {
+			report.InUse = append(report.InUse, e.Path)
+		}
+	}
+
+	if opts.Orphans {
+		for _, lockPath := range inspection.Orphans {
+			if pending[orphanedPath(lockPath)] {
+				report.InUse = append(report.InUse, lockPath)
+				continue
+			}
+			if opts.DryRun {
+				report.Orphans = append(report.Orphans, lockPath)
+				continue
+			}
+			removed, errr := removeOrphanedLock(inspection.Dir, lockPath)
+			if errr != nil {
+				return report, errr
+			}
+			if removed {
+				report.Orphans = append(report.Orphans, lockPath)
+			} else {
+				report.InUse = append(report.InUse, lockPath)
+			}
+		}
+	}
+
+	if !opts.DryRun {
+		removeEmptyDirs(inspection.Dir)
+	}
+
+	report.summarise()
+	return report, nil
+}
+
+// tryLockFile opens (creating if necessary) the given lock file and tries to
+// get an exclusive lock on it without blocking, in the same way that mounts
+// lock with a fileMutex. Returns nil
+// without error if the lock is currently held by someone else. Otherwise you
+// must Close() the returned file to release the lock.
+func tryLockFile(lockPath string) (*os.File, error) {
+	f, err := os.OpenFile(lockPath, os.O_RDONLY|os.O_CREATE, os.FileMode(fileMode))
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		errc := f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, errc
+		}
+		return nil, err
+	}
+	return f, nil
+}
+
+// pendingUploads returns the cache files below cacheDir that the journals there
+// say still need to be uploaded (including by mounts that are still running).
+func pendingUploads(cacheDir string) (map[string]bool, error) {
+	pending := make(map[string]bool)
+	err := filepath.Walk(cacheDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.HasPrefix(filepath.Base(path), journalPrefix) {
+			return nil
+		}
+		ops, err := readJournal(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				// a mount finished with it while we were looking
+				return nil
+			}
+			return err
+		}
+		for _, op := range ops {
+			if op.LocalPath != "" {
+				pending[filepath.Clean(op.LocalPath)] = true
+			}
+		}
+		return nil
+	})
+	return pending, err
+}
+
+// removeCacheFile deletes a cache file, as long as we can get its lock. Returns
+// true if the file was removed. The lock file itself is left alone, to be
+// removed by removeOrphanedLock().
+func removeCacheFile(path string) (removed bool, err error) {
+	// partial downloads are protected by the lock of the file they will become
+	dest := strings.TrimSuffix(strings.TrimSuffix(path, partialFileSuffix), downloadPartialSuffix)
+	lockPath := filepath.Join(filepath.Dir(dest), lockFilePrefix+filepath.Base(dest))
+	lock, err := tryLockFile(lockPath)
+	if err != nil || lock == nil {
+		return false, err
+	}
+	defer func() {
+		errc := lock.Close()
+		if errc != nil && err == nil {
+			err = errc
+		}
+	}()
+
+	err = os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	if dest != path {
+		err = os.Remove(downloadProgressPath(dest))
+		if err != nil && !os.IsNotExist(err) {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+// orphanedPath returns the path of the cache file that the given lock file
+// would protect.
+func orphanedPath(lockPath string) string {
+	return filepath.Join(filepath.Dir(lockPath), strings.TrimPrefix(filepath.Base(lockPath), lockFilePrefix))
+}
+
+// removeOrphanedLock deletes a lock file in the given cache directory as long as
+// we can get the lock and it is still orphaned (and not needed by a journal's
+// pending upload), and still the lock file at that path. A mount that
+// opened the file before we removed it will find that out once it gets the
+// lock after us (see fileMutex.Lock()), so won't use it. Returns true if the
+// file was removed.
+func removeOrphanedLock(cacheDir, lockPath string) (removed bool, err error) {
+	lock, err := tryLockFile(lockPath)
+	if err != nil || lock == nil {
+		return false, err
+	}
+	defer func() {
+		errc := lock.Close()
+		if errc != nil && err == nil {
+			err = errc
+		}
+	}()
+
+	m := &fileMutex{path: lockPath, f: lock}
+	linked, err := m.linked()
+	if err != nil || !linked {
+		return false, err
+	}
+
+	cached := orphanedPath(lockPath)
+	for _, path := range []string{cached, cached + partialFileSuffix, cached + downloadPartialSuffix} {
+		if _, errs := os.Lstat(path); errs == nil {
+			return false, nil
+		}
+	}
+	pending, err := pendingUploads(cacheDir)
+	if err != nil || pending[cached] {
+		return false, err
+	}
+
+	err = os.Remove(lockPath)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	return true, nil
+}
+
+// removeEmptyDirs removes all empty directories below (but not including) dir.
+// Errors are ignored, since directories may be in concurrent use by mounts.
+func removeEmptyDirs(dir string) {
+	var dirs []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() && path != dir {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	// deepest first; failure just means the dir wasn't empty
+	for i := len(dirs) - 1; i >= 0; i-- {
+		_ = syscall.Rmdir(dirs[i])
+	}
+}
+
+// String returns a human readable summary of the report.
+func (r *CacheReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\n", r.Dir)
+	for _, t := range r.Targets {
+		fmt.Fprintf(&b, "  %s: %d files, %d bytes (%d on disk), last used %s", t.Target, t.Files, t.Size, t.DiskUsage, t.LastUsed.Format(time.RFC3339))
+		if t.Partial > 0 {
+			fmt.Fprintf(&b, ", %d partial", t.Partial)
+		}
+		if t.Stale > 0 {
+			fmt.Fprintf(&b, ", %d stale", t.Stale)
+		}
+		b.WriteString("\n")
+	}
+	if len(r.Orphans) > 0 {
+		fmt.Fprintf(&b, "  %d orphaned lock files\n", len(r.Orphans))
+	}
+	if len(r.InUse) > 0 {
+		fmt.Fprintf(&b, "  %d files in use and skipped\n", len(r.InUse))
+	}
+	return b.String()
+}
@@ -0,0 +1,223 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of muxfys.
+//
+//  muxfys is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  muxfys is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with muxfys. If not, see <http://www.gnu.org/licenses/>.
+
+package muxfys
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alexflint/go-filemutex"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCacheGC(t *testing.T) {
+	Convey("Given a permanent cache dir used by 2 targets", t, func() {
+		cacheDir, err := ioutil.TempDir("", "muxfys_cachegc_testing")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(cacheDir)
+
+		write := func(rel string, content string, age time.Duration) string {
+			path := filepath.Join(cacheDir, rel)
+			errm := os.MkdirAll(filepath.Dir(path), os.FileMode(dirMode))
+			So(errm, ShouldBeNil)
+			errw := ioutil.WriteFile(path, []byte(content), os.FileMode(fileMode))
+			So(errw, ShouldBeNil)
+			then := time.Now().Add(-age)
+			errc := os.Chtimes(path, then, then)
+			So(errc, ShouldBeNil)
+			return path
+		}
+
+		old := write("host/bucketA/dir/old.file", "old", 48*time.Hour)
+		recent := write("host/bucketA/recent.file", "recent", 0)
+		other := write("host/bucketB/a/b/other.file", "other", 0)
+		lock := write("host/bucketA/dir/"+lockFilePrefix+"old.file", "", 0)
+		orphan := write("host/bucketB/a/"+lockFilePrefix+"gone.file", "", 0)
+
+		sparse := filepath.Join(cacheDir, "host/bucketB/sparse.file")
+		f, err := os.Create(sparse)
+		So(err, ShouldBeNil)
+		err = f.Truncate(1000000)
+		So(err, ShouldBeNil)
+		f.Close()
+
+		Convey("InspectCache() reports usage per target", func() {
+			report, err := InspectCache(cacheDir, 24*time.Hour)
+			So(err, ShouldBeNil)
+			So(len(report.Entries), ShouldEqual, 4)
+			So(len(report.Targets), ShouldEqual, 2)
+
+			a := report.Targets[0]
+			So(a.Target, ShouldEqual, "host/bucketA")
+			So(a.Files, ShouldEqual, 2)
+			So(a.Size, ShouldEqual, 9)
+			So(a.Stale, ShouldEqual, 1)
+			So(a.Partial, ShouldEqual, 0)
+
+			b := report.Targets[1]
+			So(b.Target, ShouldEqual, "host/bucketB")
+			So(b.Files, ShouldEqual, 2)
+			So(b.Size, ShouldEqual, 1000005)
+			So(b.Stale, ShouldEqual, 0)
+			So(b.Partial, ShouldEqual, 1)
+
+			So(report.Orphans, ShouldResemble, []string{orphan})
+			So(report.String(), ShouldContainSubstring, "host/bucketB: 2 files")
+		})
+
+		Convey("CacheTarget() tells you an accessor's target", func() {
+			target, err := CacheTarget(&localAccessor{}, cacheDir)
+			So(err, ShouldBeNil)
+			So(target, ShouldEqual, ".")
+		})
+
+		Convey("PruneCache() can remove old files", func() {
+			report, err := PruneCache(cacheDir, CachePruneOptions{OlderThan: 24 * time.Hour})
+			So(err, ShouldBeNil)
+			So(len(report.Entries), ShouldEqual, 1)
+			So(report.Entries[0].Path, ShouldEqual, old)
+			_, err = os.Stat(old)
+			So(err, ShouldNotBeNil)
+			_, err = os.Stat(lock)
+			So(err, ShouldBeNil)
+			_, err = os.Stat(recent)
+			So(err, ShouldBeNil)
+
+			report, err = InspectCache(cacheDir, 0)
+			So(err, ShouldBeNil)
+			So(report.Orphans, ShouldResemble, []string{lock, orphan})
+		})
+
+		Convey("PruneCache() won't remove files that are pending upload", func() {
+			j, err := newJournal(cacheDir, "target", pkgLogger)
+			So(err, ShouldBeNil)
+			j.begin(&JournalOp{Op: JournalUpload, Path: "/remote/old.file", LocalPath: old})
+
+			report, err := PruneCache(cacheDir, CachePruneOptions{OlderThan: 24 * time.Hour, MaxSize: 1})
+			So(err, ShouldBeNil)
+			So(report.InUse, ShouldResemble, []string{old})
+			_, err = os.Stat(old)
+			So(err, ShouldBeNil)
+
+			Convey("Even once the mount that wrote them has gone", func() {
+				j.close(false)
+				report, err = PruneCache(cacheDir, CachePruneOptions{OlderThan: 24 * time.Hour})
+				So(err, ShouldBeNil)
+				So(report.InUse, ShouldResemble, []string{old})
+				_, err = os.Stat(old)
+				So(err, ShouldBeNil)
+			})
+		})
+
+		Convey("PruneCache() won't remove files whose lock is held", func() {
+			fm, err := filemutex.New(lock)
+			So(err, ShouldBeNil)
+			err = fm.Lock()
+			So(err, ShouldBeNil)
+			defer fm.Close()
+
+			report, err := PruneCache(cacheDir, CachePruneOptions{OlderThan: 24 * time.Hour})
+			So(err, ShouldBeNil)
+			So(len(report.Entries), ShouldEqual, 0)
+			So(report.InUse, ShouldResemble, []string{old})
+			_, err = os.Stat(old)
+			So(err, ShouldBeNil)
+		})
+
+		Convey("PruneCache() can remove by target, partial and orphan", func() {
+			report, err := PruneCache(cacheDir, CachePruneOptions{Targets: []string{"host/bucketA"}, Partial: true, Orphans: true})
+			So(err, ShouldBeNil)
+			So(len(report.Entries), ShouldEqual, 3)
+			So(report.Orphans, ShouldResemble, []string{orphan})
+			_, err = os.Stat(other)
+			So(err, ShouldBeNil)
+			_, err = os.Stat(sparse)
+			So(err, ShouldNotBeNil)
+			_, err = os.Stat(orphan)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("PruneCache() won't remove orphaned locks that are held or pending upload", func() {
+			fm, err := newFileMutex(orphan)
+			So(err, ShouldBeNil)
+			err = fm.Lock()
+			So(err, ShouldBeNil)
+
+			report, err := PruneCache(cacheDir, CachePruneOptions{Orphans: true})
+			So(err, ShouldBeNil)
+			So(report.Orphans, ShouldBeEmpty)
+			So(report.InUse, ShouldResemble, []string{orphan})
+			err = fm.Close()
+			So(err, ShouldBeNil)
+
+			j, err := newJournal(cacheDir, "target", pkgLogger)
+			So(err, ShouldBeNil)
+			defer j.close(true)
+			j.begin(&JournalOp{Op: JournalUpload, Path: "/remote/gone.file", LocalPath: orphanedPath(orphan)})
+			report, err = PruneCache(cacheDir, CachePruneOptions{Orphans: true})
+			So(err, ShouldBeNil)
+			So(report.InUse, ShouldResemble, []string{orphan})
+			_, err = os.Stat(orphan)
+			So(err, ShouldBeNil)
+		})
+
+		Convey("Mounts waiting on an orphaned lock that gets removed lock a new one", func() {
+			fm, err := newFileMutex(orphan)
+			So(err, ShouldBeNil)
+			defer fm.Close()
+
+			report, err := PruneCache(cacheDir, CachePruneOptions{Orphans: true})
+			So(err, ShouldBeNil)
+			So(report.Orphans, ShouldResemble, []string{orphan})
+
+			err = fm.Lock()
+			So(err, ShouldBeNil)
+			_, err = os.Stat(orphan)
+			So(err, ShouldBeNil)
+			linked, err := fm.linked()
+			So(err, ShouldBeNil)
+			So(linked, ShouldBeTrue)
+
+			held, err := tryLockFile(orphan)
+			So(err, ShouldBeNil)
+			So(held, ShouldBeNil)
+		})
+
+		Convey("PruneCache() can remove least recently used files down to a size", func() {
+			report, err := PruneCache(cacheDir, CachePruneOptions{MaxSize: 8192, DryRun: true})
+			So(err, ShouldBeNil)
+			So(len(report.Entries), ShouldBeGreaterThanOrEqualTo, 1)
+			So(report.Entries[0].Path, ShouldEqual, old)
+			_, err = os.Stat(old)
+			So(err, ShouldBeNil)
+
+			Convey("But not files used more recently than KeepNewerThan", func() {
+				report, err := PruneCache(cacheDir, CachePruneOptions{MaxSize: 1, KeepNewerThan: time.Hour})
+				So(err, ShouldBeNil)
+				So(len(report.Entries), ShouldEqual, 1)
+				So(report.Entries[0].Path, ShouldEqual, old)
+				_, err = os.Stat(recent)
+				So(err, ShouldBeNil)
+			})
+		})
+	})
+}
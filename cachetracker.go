@@ -28,10 +28,18 @@ import (
 )
 
 // CacheTracker struct is used to track what parts of which files have been
-// cached.
+// cached. By default the exact intervals cached are tracked, but one made with
+// NewBlockCacheTracker() instead tracks fixed-size aligned blocks in a compact
+// bitmap. When used by a remote, any blocks of a file held in the in-memory
+// cache are also forgotten whenever you tell the tracker that the file on disk
+// has been truncated, overridden, renamed or deleted, so that both cache tiers
+// agree on what is valid.
 type CacheTracker struct {
 	sync.Mutex
-	cached map[string]Intervals
+	cached    map[string]Intervals
+	blocks    map[string]*bitmap
+	blockSize int64
+	mem       *blockCache
 }
 
 // NewCacheTracker creates a new *CacheTracker.
@@ -39,23 +47,81 @@ func NewCacheTracker() *CacheTracker {
 	return &CacheTracker{cached: make(map[string]Intervals)}
 }
 
+// NewBlockCacheTracker creates a new *CacheTracker that works in units of
+// blocks of the given size (in bytes), aligned to multiples of that size from
+// the start of each file. Uncached() will then always return whole blocks, and
+// Cached() will consider every block your interval touches to be cached, so
+// you should only tell it about whole blocks (where the last block of a file
+// may be short). A blockSize of 0 or less gives you the same thing as
+// NewCacheTracker().
+func NewBlockCacheTracker(blockSize int64) *CacheTracker {
+	if blockSize <= 0 {
+		return NewCacheTracker()
+	}
+	return &CacheTracker{
+		cached:    make(map[string]Intervals),
+		blocks:    make(map[string]*bitmap),
+		blockSize: blockSize,
+	}
+}
+
+// CacheBlockSize returns the block size this tracker was made with, or 0 if it
+// tracks exact intervals.
+func (c *CacheTracker) CacheBlockSize() int64 {
+	return c.blockSize
+}
+
 // Cached updates the tracker with what you have now cached. Once you have
 // stored bytes 0..9 in /abs/path/to/sparse.file, you would call:
 // Cached("/abs/path/to/sparse.file", NewInterval(0, 10)).
 func (c *CacheTracker) Cached(path string, iv Interval) {
 	c.Lock()
 	defer c.Unlock()
+	if c.blockSize > 0 {
+		c.bitmap(path).setRange(iv.Start/c.blockSize, iv.End/c.blockSize)
+		return
+	}
 	c.cached[path] = c.cached[path].Merge(iv)
 }
 
+// bitmap returns the bitmap for the given path, creating it if necessary. Must
+// be called while you have the lock.
+func (c *CacheTracker) bitmap(path string) *bitmap {
+	b, exists := c.blocks[path]
+	if !exists {
+		b = &bitmap{}
+		c.blocks[path] = b
+	}
+	return b
+}
+
 // Uncached tells you what parts of a file in the given interval you haven't
 // already cached (based on your prior Cached() calls). You would want to then
 // cache the data in each of the returned intervals and call Cached() on each
-// one afterwards.
+// one afterwards. For a block tracker, the returned intervals cover whole
+// blocks (with consecutive blocks combined in to a single interval), so may
+// extend beyond the given interval and beyond the end of the file.
 func (c *CacheTracker) Uncached(path string, iv Interval) Intervals {
 	c.Lock()
 	defer c.Unlock()
-	return c.cached[path].Difference(iv)
+	if c.blockSize <= 0 {
+		return c.cached[path].Difference(iv)
+	}
+
+	b := c.blocks[path]
+	var ivs Intervals
+	for i := iv.Start / c.blockSize; i <= iv.End/c.blockSize; i++ {
+		if b != nil && b.isSet(i) {
+			continue
+		}
+		start := i * c.blockSize
+		if n := len(ivs); n > 0 && ivs[n-1].End == start-1 {
+			ivs[n-1].End = start + c.blockSize - 1
+			continue
+		}
+		ivs = append(ivs, NewInterval(start, c.blockSize))
+	}
+	return ivs
 }
 
 // CacheTruncate should be used to update the tracker if you truncate a cache
@@ -64,7 +130,14 @@ func (c *CacheTracker) Uncached(path string, iv Interval) Intervals {
 func (c *CacheTracker) CacheTruncate(path string, offset int64) {
 	c.Lock()
 	defer c.Unlock()
-	c.cached[path] = c.cached[path].Truncate(offset)
+	if c.blockSize > 0 {
+		if b, exists := c.blocks[path]; exists {
+			b.truncate((offset + c.blockSize - 1) / c.blockSize)
+		}
+	} else {
+		c.cached[path] = c.cached[path].Truncate(offset)
+	}
+	c.mem.evict(path, offset)
 }
 
 // CacheOverride should be used if you do something like delete a cache file and
@@ -73,15 +146,33 @@ func (c *CacheTracker) CacheTruncate(path string, offset int64) {
 func (c *CacheTracker) CacheOverride(path string, iv Interval) {
 	c.Lock()
 	defer c.Unlock()
-	c.cached[path] = Intervals{iv}
+	if c.blockSize > 0 {
+		b := &bitmap{}
+		b.setRange(iv.Start/c.blockSize, iv.End/c.blockSize)
+		c.blocks[path] = b
+	} else {
+		c.cached[path] = Intervals{iv}
+	}
+	c.mem.evict(path, 0)
 }
 
 // CacheRename should be used if you rename a cache file on disk.
 func (c *CacheTracker) CacheRename(oldPath, newPath string) {
 	c.Lock()
 	defer c.Unlock()
-	c.cached[newPath] = c.cached[oldPath]
-	delete(c.cached, oldPath)
+	if c.blockSize > 0 {
+		if b, exists := c.blocks[oldPath]; exists {
+			c.blocks[newPath] = b
+		} else {
+			delete(c.blocks, newPath)
+		}
+		delete(c.blocks, oldPath)
+	} else {
+		c.cached[newPath] = c.cached[oldPath]
+		delete(c.cached, oldPath)
+	}
+	c.mem.evict(oldPath, 0)
+	c.mem.evict(newPath, 0)
 }
 
 // CacheDelete should be used if you delete a cache file.
@@ -89,11 +180,22 @@ func (c *CacheTracker) CacheDelete(path string) {
 	c.Lock()
 	defer c.Unlock()
 	delete(c.cached, path)
+	delete(c.blocks, path)
+	c.mem.evict(path, 0)
 }
 
 // CacheWipe should be used if you delete all your cache files.
 func (c *CacheTracker) CacheWipe() {
 	c.Lock()
 	defer c.Unlock()
+	for path := range c.cached {
+		c.mem.evict(path, 0)
+	}
+	for path := range c.blocks {
+		c.mem.evict(path, 0)
+	}
 	c.cached = make(map[string]Intervals)
+	if c.blockSize > 0 {
+		c.blocks = make(map[string]*bitmap)
+	}
 }
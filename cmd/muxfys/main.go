@@ -0,0 +1,177 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of muxfys.
+//
+//  muxfys is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  muxfys is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with muxfys. If not, see <http://www.gnu.org/licenses/>.
+
+/*
+Command muxfys provides maintenance utilities for things muxfys leaves on disk.
+
+Usage:
+
+	muxfys cache list -dir /path/to/CacheDir [-stale 720h] [-v]
+	muxfys cache prune -dir /path/to/CacheDir [-older 720h] [-max-size 100G]
+	  [-target host/bucket] [-partial] [-orphans] [-keep 1h] [-dry-run]
+
+The cache subcommand inspects or garbage collects a permanent CacheDir (as
+specified in a muxfys.RemoteConfig), grouping usage by remote target. Pruning is
+safe to do while other processes have the same CacheDir mounted.
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/VertebrateResequencing/muxfys"
+)
+
+// stringList is a flag.Value that can be specified multiple times.
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// byteSize is a flag.Value that understands K, M, G and T suffixes.
+type byteSize int64
+
+func (b *byteSize) String() string {
+	return strconv.FormatInt(int64(*b), 10)
+}
+
+func (b *byteSize) Set(value string) error {
+	multiplier := int64(1)
+	upper := strings.ToUpper(strings.TrimSuffix(strings.ToUpper(value), "B"))
+	if len(upper) > 0 {
+		switch upper[len(upper)-1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		case 'T':
+			multiplier = 1 << 40
+		}
+		if multiplier > 1 {
+			upper = upper[:len(upper)-1]
+		}
+	}
+	n, err := strconv.ParseInt(upper, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid size %s", value)
+	}
+	*b = byteSize(n * multiplier)
+	return nil
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	switch os.Args[1] {
+	case "cache":
+		cache(os.Args[2:])
+	default:
+		usage()
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s cache list|prune -dir <CacheDir> [options]\n", os.Args[0])
+	os.Exit(2)
+}
+
+// cache implements the cache subcommand.
+func cache(args []string) {
+	if len(args) < 1 {
+		usage()
+	}
+	action := args[0]
+
+	flags := flag.NewFlagSet("cache "+action, flag.ExitOnError)
+	dir := flags.String("dir", "", "the permanent cache directory")
+	verbose := flags.Bool("v", false, "list every cached file")
+
+	var report *muxfys.CacheReport
+	var err error
+	switch action {
+	case "list":
+		stale := flags.Duration("stale", 0, "report files not used for this long as stale")
+		parseOrExit(flags, args[1:])
+		report, err = muxfys.InspectCache(*dir, *stale)
+	case "prune":
+		var opts muxfys.CachePruneOptions
+		var targets stringList
+		var maxSize byteSize
+		flags.DurationVar(&opts.OlderThan, "older", 0, "remove files not used for this long")
+		flags.Var(&maxSize, "max-size", "remove least recently used files until at most this size (eg. 100G)")
+		flags.Var(&targets, "target", "remove everything for this target (repeatable)")
+		flags.BoolVar(&opts.Partial, "partial", false, "remove partially cached files")
+		flags.BoolVar(&opts.Orphans, "orphans", false, "remove orphaned lock files")
+		flags.DurationVar(&opts.KeepNewerThan, "keep", 0, "never remove files used more recently than this")
+		flags.BoolVar(&opts.DryRun, "dry-run", false, "only report what would be removed")
+		parseOrExit(flags, args[1:])
+		opts.MaxSize = int64(maxSize)
+		opts.Targets = targets
+		report, err = muxfys.PruneCache(*dir, opts)
+	default:
+		usage()
+	}
+
+	if report != nil {
+		fmt.Print(report)
+		if *verbose {
+			for _, e := range report.Entries {
+				fmt.Printf("%s\t%d\t%d\t%s\n", e.Path, e.Size, e.DiskUsage, e.LastUsed.Format(time.RFC3339))
+			}
+			for _, path := range report.Orphans {
+				fmt.Printf("%s\torphan\n", path)
+			}
+			for _, path := range report.InUse {
+				fmt.Printf("%s\tin use\n", path)
+			}
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+// parseOrExit parses args with the given flags, exiting if they're bad or if
+// -dir was not supplied.
+func parseOrExit(flags *flag.FlagSet, args []string) {
+	err := flags.Parse(args)
+	if err != nil {
+		os.Exit(2)
+	}
+	if flags.Lookup("dir").Value.String() == "" {
+		fmt.Fprintln(os.Stderr, "-dir is required")
+		flags.Usage()
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of muxfys.
+//
+//  muxfys is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  muxfys is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with muxfys. If not, see <http://www.gnu.org/licenses/>.
+
+package muxfys
+
+// This file implements detection of files that were changed remotely by
+// someone else between us first seeing them and us uploading our own version.
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// ErrUploadConflict is the error that ConditionalUploader.UploadFileIfMatch()
+// should return when the remote file did not have the expected ETag.
+var ErrUploadConflict = errors.New("remote file was changed by someone else")
+
+// ETagStater is an optional interface that a RemoteAccessor can also
+// implement, to allow RemoteConfig.ConflictSuffix to be used.
+type ETagStater interface {
+	// ETag returns the current ETag of the remote file at path. If the file
+	// does not exist it should return an error that ErrorIsNotExists()
+	// recognises.
+	ETag(path string) (string, error)
+}
+
+// ConditionalUploader is an optional interface that a RemoteAccessor which is
+// an ETagStater can also implement, if its remote supports conditional
+// uploads. Otherwise, when using RemoteConfig.ConflictSuffix, the ETag of the
+// remote file is checked just before uploading, which leaves a small window for
+// conflicting uploads to go undetected.
+type ConditionalUploader interface {
+	// UploadFileIfMatch is like UploadFile(), but should atomically only do
+	// the upload if the remote dest currently has the given ETag (or if etag
+	// is blank, if dest currently does not exist), returning
+	// ErrUploadConflict otherwise. It returns the ETag dest has after the
+	// upload.
+	UploadFileIfMatch(source, dest, contentType, etag string) (string, error)
+}
+
+// ETagUploader is an optional interface that a RemoteAccessor which is an
+// ETagStater can also implement, to tell us the ETag of the files it uploads.
+// Otherwise, when using RemoteConfig.ConflictSuffix, the ETag of each uploaded
+// file is asked for after its upload.
+type ETagUploader interface {
+	// UploadFileETag is like UploadFile(), but also returns the ETag dest has
+	// after the upload. If progress is not nil, it should be called with the
+	// number of bytes uploaded as the upload proceeds, like
+	// ProgressUploader.UploadFileWithProgress().
+	UploadFileETag(source, dest, contentType string, progress func(bytes int64)) (string, error)
+}
+
+// normalizeETag removes the quotes some remotes put around ETags.
+func normalizeETag(etag string) string {
+	return strings.Trim(etag, `"`)
+}
+
+// observeETag records the ETag of a remote file as it was when we first saw
+// it, for later comparison by uploadFileAttempts(). An etag of "" records that
+// the file did not exist. Does nothing if we're not detecting conflicts, or if
+// we already saw the file.
+func (r *remote) observeETag(remotePath, etag string) {
+	if r.conflictSuffix == "" {
+		return
+	}
+	r.etagMutex.Lock()
+	defer r.etagMutex.Unlock()
+	if _, seen := r.etags[remotePath]; !seen {
+		r.etags[remotePath] = normalizeETag(etag)
+	}
+}
+
+// forgetETag stops us checking for conflicts when the given remote file is
+// next uploaded, for when we changed it remotely ourselves.
+func (r *remote) forgetETag(remotePath string) {
+	if r.conflictSuffix == "" {
+		return
+	}
+	r.etagMutex.Lock()
+	defer r.etagMutex.Unlock()
+	delete(r.etags, remotePath)
+}
+
+// expectETag sets the ETag we expect the given remote file to have when we next
+// upload it, as recorded in a journal. Does nothing if we're not detecting
+// conflicts.
+func (r *remote) expectETag(remotePath, etag string) {
+	if r.conflictSuffix == "" {
+		return
+	}
+	r.etagMutex.Lock()
+	defer r.etagMutex.Unlock()
+	r.etags[remotePath] = etag
+}
+
+// expectedETag returns the ETag we expect the given remote file to have (""
+// if we expect it not to exist), and true, if we're checking it for
+// conflicts.
+func (r *remote) expectedETag(remotePath string) (string, bool) {
+	if r.conflictSuffix == "" {
+		return "", false
+	}
+	r.etagMutex.Lock()
+	defer r.etagMutex.Unlock()
+	etag, seen := r.etags[remotePath]
+	return etag, seen
+}
+
+// uploadedETag is called after we successfully uploaded to the given remote
+// path, to update our expected ETag to that of our own upload. etag is the ETag
+// the upload told us about, if any; otherwise we ask the remote for it.
+func (r *remote) uploadedETag(remotePath, etag string) {
+	if r.conflictSuffix == "" {
+		return
+	}
+	status := fuse.OK
+	if etag == "" {
+		etag, status = r.currentETag(remotePath)
+	} else {
+		etag = normalizeETag(etag)
+	}
+	r.etagMutex.Lock()
+	defer r.etagMutex.Unlock()
+	if status != fuse.OK || etag == "" {
+		delete(r.etags, remotePath)
+		return
+	}
+	r.etags[remotePath] = etag
+}
+
+// currentETag asks the remote for the current ETag of the given file, returning
+// "" if it doesn't exist. The returned status is only not OK if we couldn't
+// find out.
+func (r *remote) currentETag(remotePath string) (string, fuse.Status) {
+	stater := r.accessor.(ETagStater)
+	var etag string
+	status := r.retry("ETag", remotePath, func() error {
+		var err error
+		etag, err = stater.ETag(remotePath)
+		return err
+	})
+	if status == fuse.ENOENT {
+		return "", fuse.OK
+	}
+	return normalizeETag(etag), status
+}
+
+// changedRemotely returns true if the given remote file no longer has the
+// expected ETag. If we can't tell, we assume it wasn't changed.
+func (r *remote) changedRemotely(remotePath, expected string) bool {
+	current, status := r.currentETag(remotePath)
+	if status != fuse.OK {
+		r.Warn("Could not check for an upload conflict", "path", remotePath, "status", status)
+		return false
+	}
+	return current != expected
+}
+
+// conflictPath returns the path we upload to instead of the given remote path
+// when there is a conflict.
+func (r *remote) conflictPath(remotePath string) string {
+	return remotePath + r.conflictSuffix
+}
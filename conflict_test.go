@@ -0,0 +1,210 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of muxfys.
+//
+//  muxfys is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  muxfys is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with muxfys. If not, see <http://www.gnu.org/licenses/>.
+
+package muxfys
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// etagAccessor is a localAccessor that implements ETagStater, using the md5 of
+// file contents as their ETag.
+type etagAccessor struct {
+	*localAccessor
+	stats int
+}
+
+func (a *etagAccessor) ETag(path string) (string, error) {
+	a.stats++
+	return md5ETag(path)
+}
+
+// md5ETag returns the md5 of the contents of the given file as an ETag.
+func md5ETag(path string) (string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(`"%x"`, md5.Sum(content)), nil
+}
+
+// conditionalAccessor is an etagAccessor that also implements
+// ConditionalUploader and ETagUploader.
+type conditionalAccessor struct {
+	*etagAccessor
+	conditionalUploads int
+}
+
+func (a *conditionalAccessor) UploadFileIfMatch(source, dest, contentType, etag string) (string, error) {
+	a.conditionalUploads++
+	current, err := md5ETag(dest)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	if normalizeETag(current) != etag {
+		return "", ErrUploadConflict
+	}
+	return a.UploadFileETag(source, dest, contentType, nil)
+}
+
+func (a *conditionalAccessor) UploadFileETag(source, dest, contentType string, progress func(bytes int64)) (string, error) {
+	err := a.UploadFile(source, dest, contentType)
+	if err != nil {
+		return "", err
+	}
+	return md5ETag(dest)
+}
+
+func TestConflicts(t *testing.T) {
+	Convey("Given a local file and a remote dir", t, func() {
+		tmpdir, err := ioutil.TempDir("", "muxfys_conflict_testing")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(tmpdir)
+		remoteDir := filepath.Join(tmpdir, "remote")
+		err = os.MkdirAll(remoteDir, os.FileMode(dirMode))
+		So(err, ShouldBeNil)
+
+		write := func(path, content string) {
+			errw := ioutil.WriteFile(path, []byte(content), os.FileMode(fileMode))
+			So(errw, ShouldBeNil)
+		}
+		read := func(path string) string {
+			content, errr := ioutil.ReadFile(path)
+			if errr != nil {
+				return ""
+			}
+			return string(content)
+		}
+		local := filepath.Join(tmpdir, "local")
+		write(local, "ours")
+		dest := filepath.Join(remoteDir, "file")
+		conflict := dest + ".conflict"
+		local2 := filepath.Join(tmpdir, "local2")
+		write(local2, "ours again")
+
+		la := &localAccessor{target: remoteDir}
+		ea := &etagAccessor{localAccessor: la}
+		newConflictRemote := func(accessor RemoteAccessor) *remote {
+			r, errn := newRemote(&RemoteConfig{Accessor: accessor, CacheData: true, Write: true, ConflictSuffix: ".conflict"}, remoteOptions{cacheBase: tmpdir})
+			So(errn, ShouldBeNil)
+			return r
+		}
+
+		Convey("A ConflictSuffix requires an ETagStater", func() {
+			_, err = newRemote(&RemoteConfig{Accessor: la, CacheData: true, Write: true, ConflictSuffix: ".conflict"}, remoteOptions{cacheBase: tmpdir})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Without a ConflictSuffix, nothing is checked", func() {
+			r, errn := newRemote(&RemoteConfig{Accessor: ea, CacheData: true, Write: true}, remoteOptions{cacheBase: tmpdir})
+			So(errn, ShouldBeNil)
+			defer r.deleteCache()
+			r.observeETag(dest, "")
+			write(dest, "theirs")
+			status := r.uploadFile(local, dest)
+			So(status, ShouldEqual, fuse.OK)
+			So(read(dest), ShouldEqual, "ours")
+		})
+
+		for _, conditional := range []bool{false, true} {
+			var accessor RemoteAccessor = ea
+			ca := &conditionalAccessor{etagAccessor: ea}
+			desc := "checking before upload"
+			if conditional {
+				accessor = ca
+				desc = "conditional uploads"
+			}
+
+			Convey("With a ConflictSuffix and "+desc, func() {
+				r := newConflictRemote(accessor)
+				defer r.deleteCache()
+
+				Convey("Files that someone else created are uploaded to the conflict path", func() {
+					localPath := r.getLocalPath(dest)
+					err = os.MkdirAll(filepath.Dir(localPath), os.FileMode(dirMode))
+					So(err, ShouldBeNil)
+					write(localPath, "cached")
+
+					r.observeETag(dest, "")
+					write(dest, "theirs")
+					result := uploadWithResult(r, "file", 0)
+					So(result.Err, ShouldBeNil)
+					So(result.RemotePath, ShouldEqual, dest)
+					So(result.ConflictPath, ShouldEqual, conflict)
+					So(read(dest), ShouldEqual, "theirs")
+					So(read(conflict), ShouldEqual, "cached")
+
+					write(localPath, "cached again")
+					result = uploadWithResult(r, "file", 0)
+					So(result.ConflictPath, ShouldEqual, conflict)
+					So(read(dest), ShouldEqual, "theirs")
+					So(read(conflict), ShouldEqual, "cached again")
+				})
+
+				Convey("Files nobody else changed are uploaded normally, repeatedly", func() {
+					write(dest, "original")
+					etag, errt := ea.ETag(dest)
+					So(errt, ShouldBeNil)
+					r.observeETag(dest, etag)
+					r.observeETag(dest, "ignored")
+					ea.stats = 0
+
+					status := r.uploadFile(local, dest)
+					So(status, ShouldEqual, fuse.OK)
+					So(read(dest), ShouldEqual, "ours")
+					status = r.uploadFile(local2, dest)
+					So(status, ShouldEqual, fuse.OK)
+					So(read(dest), ShouldEqual, "ours again")
+					_, err = os.Stat(conflict)
+					So(os.IsNotExist(err), ShouldBeTrue)
+					if conditional {
+						So(ca.conditionalUploads, ShouldEqual, 2)
+						So(ea.stats, ShouldEqual, 0)
+					} else {
+						So(ea.stats, ShouldEqual, 4)
+					}
+
+					Convey("But not once someone else changes them", func() {
+						write(dest, "theirs")
+						status = r.uploadFile(local, dest)
+						So(status, ShouldEqual, fuse.OK)
+						So(read(dest), ShouldEqual, "theirs")
+						So(read(conflict), ShouldEqual, "ours")
+					})
+				})
+
+				Convey("Forgotten files are not checked", func() {
+					r.observeETag(dest, "")
+					write(dest, "theirs")
+					r.forgetETag(dest)
+					status := r.uploadFile(local, dest)
+					So(status, ShouldEqual, fuse.OK)
+					So(read(dest), ShouldEqual, "ours")
+				})
+			})
+		}
+	})
+}
@@ -0,0 +1,257 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of muxfys.
+//
+//  muxfys is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  muxfys is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with muxfys. If not, see <http://www.gnu.org/licenses/>.
+
+package muxfys
+
+// This file implements downloading of whole files as concurrent ranged reads,
+// resumable after failure, for use by RemoteAccessor implementations.
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// downloadProgressPrefix is the prefix of the basename of the file that
+	// records which parts of a download in to a partial file have completed.
+	downloadProgressPrefix = ".muxfys_download."
+
+	// downloadPartialSuffix is appended to the destination path to name the
+	// file that parts are downloaded in to. It differs from minio's
+	// partialFileSuffix, since minio would misinterpret our sparse partial
+	// files.
+	downloadPartialSuffix = ".part.muxfys"
+
+	// downloadBufferSize is how much data each connection reads at a time
+	// before writing it to the partial file.
+	downloadBufferSize = 1048576 // 1MB
+)
+
+// rangeGetter is a function that returns a reader of length bytes of some
+// remote file starting at offset. It's used by downloadInParts(), and should
+// fail if the remote file is no longer the version that was being downloaded.
+type rangeGetter func(offset, length int64) (io.ReadCloser, error)
+
+// downloadProgressPath returns the path of the file used to record the
+// progress of downloading to dest.
+func downloadProgressPath(dest string) string {
+	return filepath.Join(filepath.Dir(dest), downloadProgressPrefix+filepath.Base(dest))
+}
+
+// downloadInParts downloads a remote file of the given size to dest, by
+// splitting it in to parts of partSize bytes and getting up to connections of
+// them at once using get. Data is first written to dest with
+// downloadPartialSuffix appended, and completed parts are recorded in a progress
+// file, so that if this returns an error, calling it again will only download
+// the parts that didn't complete, as long as version (eg. an ETag) is
+// unchanged and the partial file is still intact. On success, the partial file
+// is renamed to dest.
+func downloadInParts(dest string, size int64, version string, partSize int64, connections int, get rangeGetter) (err error) {
+	if partSize <= 0 {
+		return fmt.Errorf("invalid part size %d", partSize)
+	}
+	if connections < 1 {
+		connections = 1
+	}
+	partial := dest + downloadPartialSuffix
+	progressPath := downloadProgressPath(dest)
+	header := fmt.Sprintf("%d %d %s", size, partSize, version)
+
+	done := readDownloadProgress(progressPath, header)
+	if done != nil {
+		// only trust the progress if the parts it refers to are still there
+		if info, errs := os.Stat(partial); errs != nil || info.Size() != size {
+			done = nil
+		}
+	}
+	if done == nil {
+		errr := os.Remove(partial)
+		if errr != nil && !os.IsNotExist(errr) {
+			return errr
+		}
+		done = make(map[int64]bool)
+		errw := ioutil.WriteFile(progressPath, []byte(header+"\n"), os.FileMode(fileMode))
+		if errw != nil {
+			return errw
+		}
+	}
+
+	f, err := os.OpenFile(partial, os.O_RDWR|os.O_CREATE, os.FileMode(fileMode))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		errc := f.Close()
+		if errc != nil && err == nil {
+			err = errc
+		}
+	}()
+	err = f.Truncate(size)
+	if err != nil {
+		return err
+	}
+
+	progress, err := os.OpenFile(progressPath, os.O_WRONLY|os.O_APPEND, os.FileMode(fileMode))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		errc := progress.Close()
+		if errc != nil && err == nil {
+			err = errc
+		}
+	}()
+
+	parts := make(chan int64)
+	var mutex sync.Mutex
+	var firstErr error
+	var wg sync.WaitGroup
+	for i := 0; i < connections; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, downloadBufferSize)
+			for part := range parts {
+				mutex.Lock()
+				failed := firstErr != nil
+				mutex.Unlock()
+				if failed {
+					continue
+				}
+
+				errd := downloadPart(f, part, partSize, size, buf, get)
+				if errd == nil {
+					// make sure the part is on disk before we say it is
+					errd = f.Sync()
+				}
+
+				mutex.Lock()
+				if errd == nil {
+					_, errd = fmt.Fprintf(progress, "%d\n", part)
+				}
+				if errd != nil && firstErr == nil {
+					firstErr = errd
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+	numParts := (size + partSize - 1) / partSize
+	for part := int64(0); part < numParts; part++ {
+		if !done[part] {
+			parts <- part
+		}
+	}
+	close(parts)
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+
+	err = f.Sync()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(partial, dest)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(progressPath)
+	if err != nil && os.IsNotExist(err) {
+		err = nil
+	}
+	return err
+}
+
+// downloadPart gets the given part of a file using get and writes it at the
+// correct offset in f, using buf for temporary storage.
+func downloadPart(f *os.File, part, partSize, size int64, buf []byte, get rangeGetter) error {
+	offset := part * partSize
+	length := partSize
+	if offset+length > size {
+		length = size - offset
+	}
+
+	rc, err := get(offset, length)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		errc := rc.Close()
+		if errc != nil {
+			pkgLogger.Warn("download part reader close failed", "err", errc)
+		}
+	}()
+
+	var written int64
+	for written < length {
+		want := int64(len(buf))
+		if length-written < want {
+			want = length - written
+		}
+		n, errr := io.ReadFull(rc, buf[:want])
+		if n > 0 {
+			_, errw := f.WriteAt(buf[:n], offset+written)
+			if errw != nil {
+				return errw
+			}
+			written += int64(n)
+		}
+		if errr != nil {
+			if written < length {
+				return fmt.Errorf("part %d ended after %d of %d bytes: %s", part, written, length, errr)
+			}
+			break
+		}
+	}
+	return nil
+}
+
+// readDownloadProgress parses a progress file written by downloadInParts(),
+// returning the parts that completed. Returns nil if the file doesn't exist or
+// was for a different header (a different size, part size or version of the
+// remote file).
+func readDownloadProgress(progressPath, header string) map[int64]bool {
+	content, err := ioutil.ReadFile(progressPath)
+	if err != nil {
+		return nil
+	}
+
+	// the last element is whatever follows the final newline, which should be
+	// nothing, or an incomplete record if we crashed while writing it
+	lines := strings.Split(string(content), "\n")
+	if len(lines) < 2 || lines[0] != header {
+		return nil
+	}
+	done := make(map[int64]bool)
+	for _, line := range lines[1 : len(lines)-1] {
+		part, err := strconv.ParseInt(line, 10, 64)
+		if err != nil {
+			continue
+		}
+		done[part] = true
+	}
+	return done
+}
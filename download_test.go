@@ -0,0 +1,137 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of muxfys.
+//
+//  muxfys is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  muxfys is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with muxfys. If not, see <http://www.gnu.org/licenses/>.
+
+package muxfys
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDownloadInParts(t *testing.T) {
+	Convey("Given a remote file and a range getter", t, func() {
+		tmpdir, err := ioutil.TempDir("", "muxfys_download_testing")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(tmpdir)
+		dest := filepath.Join(tmpdir, "dest.file")
+
+		size := int64(1000)
+		file := make([]byte, size)
+		for i := range file {
+			file[i] = byte(i % 251)
+		}
+
+		var mutex sync.Mutex
+		var gets []int64
+		failAt := int64(-1)
+		get := func(offset, length int64) (io.ReadCloser, error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			gets = append(gets, offset)
+			if offset == failAt {
+				return nil, errors.New("fail")
+			}
+			return ioutil.NopCloser(bytes.NewReader(file[offset : offset+length])), nil
+		}
+		sortedGets := func() []int64 {
+			mutex.Lock()
+			defer mutex.Unlock()
+			sort.Slice(gets, func(i, j int) bool { return gets[i] < gets[j] })
+			return gets
+		}
+
+		Convey("You can download it in parts", func() {
+			err = downloadInParts(dest, size, "v1", 300, 3, get)
+			So(err, ShouldBeNil)
+			So(sortedGets(), ShouldResemble, []int64{0, 300, 600, 900})
+			content, err := ioutil.ReadFile(dest)
+			So(err, ShouldBeNil)
+			So(bytes.Equal(content, file), ShouldBeTrue)
+
+			_, err = os.Stat(dest + downloadPartialSuffix)
+			So(os.IsNotExist(err), ShouldBeTrue)
+			_, err = os.Stat(downloadProgressPath(dest))
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+
+		Convey("A failed download can be resumed", func() {
+			failAt = 600
+			err = downloadInParts(dest, size, "v1", 300, 1, get)
+			So(err, ShouldNotBeNil)
+			_, err = os.Stat(dest)
+			So(os.IsNotExist(err), ShouldBeTrue)
+			_, err = os.Stat(dest + downloadPartialSuffix)
+			So(err, ShouldBeNil)
+
+			failAt = -1
+			gets = nil
+			err = downloadInParts(dest, size, "v1", 300, 2, get)
+			So(err, ShouldBeNil)
+			So(sortedGets(), ShouldResemble, []int64{600, 900})
+			content, err := ioutil.ReadFile(dest)
+			So(err, ShouldBeNil)
+			So(bytes.Equal(content, file), ShouldBeTrue)
+		})
+
+		Convey("A failed download starts again if its partial file is gone", func() {
+			failAt = 600
+			err = downloadInParts(dest, size, "v1", 300, 1, get)
+			So(err, ShouldNotBeNil)
+			err = os.Remove(dest + downloadPartialSuffix)
+			So(err, ShouldBeNil)
+
+			failAt = -1
+			gets = nil
+			err = downloadInParts(dest, size, "v1", 300, 2, get)
+			So(err, ShouldBeNil)
+			So(sortedGets(), ShouldResemble, []int64{0, 300, 600, 900})
+			content, err := ioutil.ReadFile(dest)
+			So(err, ShouldBeNil)
+			So(bytes.Equal(content, file), ShouldBeTrue)
+		})
+
+		Convey("A failed download starts again if the remote file changed", func() {
+			failAt = 600
+			err = downloadInParts(dest, size, "v1", 300, 1, get)
+			So(err, ShouldNotBeNil)
+
+			failAt = -1
+			gets = nil
+			err = downloadInParts(dest, size, "v2", 300, 2, get)
+			So(err, ShouldBeNil)
+			So(sortedGets(), ShouldResemble, []int64{0, 300, 600, 900})
+		})
+
+		Convey("Incomplete progress records are ignored", func() {
+			progressPath := downloadProgressPath(dest)
+			err = ioutil.WriteFile(progressPath, []byte("1000 300 v1\n0\n3"), os.FileMode(fileMode))
+			So(err, ShouldBeNil)
+			So(readDownloadProgress(progressPath, "1000 300 v1"), ShouldResemble, map[int64]bool{0: true})
+			So(readDownloadProgress(progressPath, "1000 300 v2"), ShouldBeNil)
+		})
+	})
+}
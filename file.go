@@ -23,10 +23,12 @@ package muxfys
 // This file implements pathfs.File methods for remote and cached files.
 
 import (
+	"fmt"
 	"io"
 	"os"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/hanwen/go-fuse/fuse"
@@ -50,7 +52,11 @@ type remoteFile struct {
 	wpipe         *io.PipeWriter
 	writeOffset   int64
 	writeComplete chan bool
+	stager        *writeStager
 	skips         map[int64][]byte
+	memKey        string
+	seqReads      int
+	ahead         *readAhead
 	log15.Logger
 }
 
@@ -67,15 +73,87 @@ func newRemoteFile(r *remote, path string, attr *fuse.Attr, create bool, logger
 	}
 
 	if create {
-		f.rpipe, f.wpipe = io.Pipe()
-		ready, finished := r.uploadData(f.rpipe, path)
-		<-ready
-		f.writeComplete = finished
+		f.startWriting()
 	}
 
 	return f
 }
 
+// startWriting gets us ready to Write(). If our remote's accessor is a
+// MultipartUploader, writes are staged with stageWrites() so that they can be
+// in any order. Otherwise they are piped to an upload, and so must be serial.
+func (f *remoteFile) startWriting() {
+	if mu, ok := f.r.accessor.(MultipartUploader); ok {
+		f.stageWrites(mu, 0)
+		return
+	}
+	f.rpipe, f.wpipe = io.Pipe()
+	ready, finished := f.r.uploadData(f.rpipe, f.path)
+	<-ready
+	f.writeComplete = finished
+}
+
+// finishStream closes the pipe we've been writing to, waiting for the upload
+// to complete. Returns true if it worked. Must be called while you hold the
+// mutex.
+func (f *remoteFile) finishStream() bool {
+	errc := f.wpipe.Close()
+	if errc != nil {
+		f.Warn("Flush wpipe close failed", "err", errc)
+	}
+	f.writeOffset = 0
+	worked := <-f.writeComplete
+	if worked {
+		errc = f.rpipe.Close()
+		if errc != nil {
+			f.Warn("Flush rpipe close failed", "err", errc)
+		}
+	}
+	f.wpipe = nil
+	f.rpipe = nil
+	return worked
+}
+
+// stageWrites makes us stage writes for a multipart upload with mu, so that
+// they can be in any order. The first base bytes of the file are whatever is
+// already at our remote path, and will be read back by the stager as needed.
+func (f *remoteFile) stageWrites(mu MultipartUploader, base int64) {
+	retry := func(clientMethod string, rf retryFunc) fuse.Status {
+		return f.r.retry(clientMethod, f.path, rf)
+	}
+	f.stager = newWriteStager(mu, f.path, f.r.writePartSize, f.r.stageBudget, f.r.stageDir, retry, f.Logger)
+	f.stager.readBase = f.readBack
+	f.stager.resume(base)
+	f.stager.track = f.r.newUploadTracker(f.path, -1)
+}
+
+// readBack reads what our stager uploaded to our remote file before its last
+// sync() in to data, starting at the given offset. We don't read from replicas,
+// since they may not have it yet.
+func (f *remoteFile) readBack(data []byte, offset int64) error {
+	var reader io.ReadCloser
+	status := f.r.retry("OpenFile", f.path, func() error {
+		var err error
+		reader, err = f.r.accessor.OpenFile(f.path, offset)
+		return err
+	})
+	if status != fuse.OK {
+		return fmt.Errorf("could not open %s: %s", f.path, status)
+	}
+	defer logClose(f.Logger, reader, "read back", "path", f.path)
+	_, err := io.ReadFull(reader, data)
+	return err
+}
+
+// useMemCache makes subsequent Read()s go via the remote's in-memory block
+// cache, if it has one. It should not be used when this remoteFile is itself
+// being read from by a cachedFile, since that does its own memory caching.
+func (f *remoteFile) useMemCache() {
+	if f.r.memCache != nil {
+		f.memKey = f.r.memKey(f.path)
+	}
+}
+
 // Read supports random reading of data from the file. This gets called as many
 // times as are needed to get through all the desired data len(buf) bytes at a
 // time.
@@ -88,6 +166,44 @@ func (f *remoteFile) Read(buf []byte, offset int64) (fuse.ReadResult, fuse.Statu
 		return nil, fuse.OK
 	}
 
+	if f.memKey != "" {
+		n, status := f.r.memCache.readThrough(f.memKey, buf, offset, int64(f.attr.Size), f.fillBlock)
+		if status != fuse.OK {
+			return nil, status
+		}
+		return fuse.ReadResultData(buf[:n]), fuse.OK
+	}
+
+	return f.read(buf, offset)
+}
+
+// fillBlock is a blockFetcher for our remote's in-memory block cache.
+func (f *remoteFile) fillBlock(dest []byte, offset int64) (int, fuse.Status) {
+	rr, status := f.read(dest, offset)
+	if status != fuse.OK {
+		return 0, status
+	}
+	return rr.Size(), status
+}
+
+// read is the implementation of Read(), which you must call while holding the
+// mutex.
+func (f *remoteFile) read(buf []byte, offset int64) (fuse.ReadResult, fuse.Status) {
+	// if we're reading ahead, get the data from that (or what we skipped
+	// before we started) if we can, otherwise go back to reading on demand
+	// with a new reader
+	if f.ahead != nil {
+		if skipped, existed := f.skips[offset]; existed && len(buf) == len(skipped) {
+			copy(buf, skipped)
+			delete(f.skips, offset)
+			return fuse.ReadResultData(buf), fuse.OK
+		}
+		if n, ok := f.ahead.read(buf, offset); ok {
+			return fuse.ReadResultData(buf[:n]), fuse.OK
+		}
+		f.stopReadAhead()
+	}
+
 	// handle out-of-order reads, which happen even when the user request is a
 	// serial read: we get offsets out of order
 	if f.readOffset != offset {
@@ -102,7 +218,7 @@ func (f *remoteFile) Read(buf []byte, offset int64) (fuse.ReadResult, fuse.Statu
 				skippedPos := f.readOffset
 				skipSize := offset - f.readOffset
 				skipped := make([]byte, skipSize)
-				status := f.fillBuffer(skipped, f.readOffset)
+				_, status := f.fillBuffer(skipped, f.readOffset)
 				if status != fuse.OK {
 					return nil, status
 				}
@@ -127,6 +243,7 @@ func (f *remoteFile) Read(buf []byte, offset int64) (fuse.ReadResult, fuse.Statu
 				return fuse.ReadResultData(buf), fuse.OK
 			} else {
 				// we'll have to seek and wipe our skips
+				f.seqReads = 0
 				var status fuse.Status
 				f.reader, status = f.r.seek(f.reader, offset, f.path)
 				if status != fuse.OK {
@@ -140,8 +257,12 @@ func (f *remoteFile) Read(buf []byte, offset int64) (fuse.ReadResult, fuse.Statu
 
 	// if opened previously, read from existing reader and return
 	if f.reader != nil {
-		status := f.fillBuffer(buf, offset)
-		return fuse.ReadResultData(buf), status
+		n, status := f.fillBuffer(buf, offset)
+		if status == fuse.OK {
+			f.seqReads++
+			f.startReadAhead(len(buf))
+		}
+		return fuse.ReadResultData(buf[:n]), status
 	}
 
 	// otherwise open remote object (if it doesn't exist, we only get an error
@@ -153,20 +274,45 @@ func (f *remoteFile) Read(buf []byte, offset int64) (fuse.ReadResult, fuse.Statu
 
 	// store the reader to read from later
 	f.reader = reader
+	f.seqReads = 0
 
-	status = f.fillBuffer(buf, offset)
+	n, status := f.fillBuffer(buf, offset)
 	if status != fuse.OK {
 		return fuse.ReadResultData([]byte{}), status
 	}
-	return fuse.ReadResultData(buf), status
+	return fuse.ReadResultData(buf[:n]), status
+}
+
+// startReadAhead hands our reader over to a readAhead if our remote has
+// ReadAhead enabled and we've seen enough sequential reads. readSize is the
+// size of the most recent read. You must call it while holding the mutex.
+func (f *remoteFile) startReadAhead(readSize int) {
+	if f.r.readAhead <= 0 || f.seqReads < readAheadTrigger || f.reader == nil || f.readOffset >= int64(f.attr.Size) {
+		return
+	}
+	f.ahead = newReadAhead(f.reader, f.readOffset, int64(f.attr.Size), 4*int64(readSize), f.r.readAhead, f.r.aheadBudget, f.Logger)
+	f.reader = nil
 }
 
-// fillBuffer reads from our remote reader to the Read() buffer.
-func (f *remoteFile) fillBuffer(buf []byte, offset int64) (status fuse.Status) {
+// stopReadAhead stops any readAhead we started, so that subsequent reads will
+// open a new reader. You must call it while holding the mutex.
+func (f *remoteFile) stopReadAhead() {
+	if f.ahead == nil {
+		return
+	}
+	f.ahead.stop()
+	f.ahead = nil
+	f.readOffset = 0
+	f.seqReads = 0
+	f.skips = make(map[int64][]byte)
+}
+
+// fillBuffer reads from our remote reader to the Read() buffer, returning the
+// number of bytes read, which is less than len(buf) at the end of the file.
+func (f *remoteFile) fillBuffer(buf []byte, offset int64) (bytesRead int, status fuse.Status) {
 	// io.ReadFull throws away errors if enough bytes were read; implement our
 	// own just in case weird stuff happens. It's also annoying in converting
 	// EOF errors to ErrUnexpectedEOF, which we don't do here
-	var bytesRead int
 	min := len(buf)
 	var err error
 	for bytesRead < min && err == nil {
@@ -176,6 +322,7 @@ func (f *remoteFile) fillBuffer(buf []byte, offset int64) (status fuse.Status) {
 	}
 
 	if err != nil {
+		failedReader := f.reader
 		errc := f.reader.Close()
 		if errc != nil {
 			f.Warn("fillBuffer reader close failed", "err", errc)
@@ -186,10 +333,13 @@ func (f *remoteFile) fillBuffer(buf []byte, offset int64) (status fuse.Status) {
 			status = fuse.OK
 		} else {
 			f.Error("fillBuffer read failed", "err", err, "bytesRead", bytesRead, "readOffset", f.readOffset, "offset", offset, "buffer", len(buf), "atEOF", err == io.EOF)
-			if f.readWorked && f.readRetries <= 20 && strings.Contains(err.Error(), "reset by peer") {
+			failover := f.r.readFailed(failedReader, err)
+			if f.readRetries <= 20 && (failover || (f.readWorked && strings.Contains(err.Error(), "reset by peer"))) {
 				// if connection reset by peer and a read previously worked
 				// we try getting a new object before trying again, to cope with
-				// temporary networking issues
+				// temporary networking issues. With replicas we do the same
+				// for any error, since a replica that keeps failing will be
+				// failed over from
 				reader, goStatus := f.r.getObject(f.path, offset)
 				if goStatus == fuse.OK {
 					f.Info("fillBuffer retry got the object")
@@ -207,16 +357,18 @@ func (f *remoteFile) fillBuffer(buf []byte, offset int64) (status fuse.Status) {
 		return
 	}
 	f.readWorked = true
+	f.r.readSucceeded(f.reader)
 	if f.readRetries > 0 {
 		f.Warn("fillBuffer read succeeded after retrying", "retries", f.readRetries)
 		f.readRetries = 0
 	}
 	f.readOffset += int64(bytesRead)
-	return fuse.OK
+	return bytesRead, fuse.OK
 }
 
-// Write supports serial writes of data directly to a remote file, where
-// remoteFile was made with newRemoteFile() with the create boolean set to true.
+// Write supports writes of data directly to a remote file, where remoteFile
+// was made with newRemoteFile() with the create boolean set to true. Writes
+// must be serial unless our remote's accessor is a MultipartUploader.
 func (f *remoteFile) Write(data []byte, offset int64) (uint32, fuse.Status) {
 	f.mutex.Lock()
 	defer f.mutex.Unlock()
@@ -226,6 +378,10 @@ func (f *remoteFile) Write(data []byte, offset int64) (uint32, fuse.Status) {
 		return uint32(0), fuse.OK
 	}
 
+	if f.stager != nil {
+		return f.stagedWrite(data, offset)
+	}
+
 	if offset != f.writeOffset {
 		// we can't handle non-serial writes
 		f.Warn("Write can't handle non-serial writes")
@@ -240,6 +396,7 @@ func (f *remoteFile) Write(data []byte, offset int64) (uint32, fuse.Status) {
 	}
 
 	n, err := f.wpipe.Write(data)
+	f.r.memCache.evictRange(f.r.memKey(f.path), NewInterval(offset, int64(n)))
 
 	f.writeOffset += int64(n)
 	f.attr.Size += uint64(n)
@@ -250,6 +407,30 @@ func (f *remoteFile) Write(data []byte, offset int64) (uint32, fuse.Status) {
 	return uint32(n), fuse.ToStatus(err)
 }
 
+// stagedWrite is Write() for when we have a stager. Must be called while you
+// hold the mutex.
+func (f *remoteFile) stagedWrite(data []byte, offset int64) (uint32, fuse.Status) {
+	err := f.stager.write(data, offset)
+	if err != nil {
+		if _, rewrite := err.(errAlreadyUploaded); rewrite {
+			f.Error("Write to data that was already uploaded", "err", err)
+			return uint32(0), fuse.Status(syscall.ESPIPE)
+		}
+		f.Error("Staged write failed", "err", err)
+		return uint32(0), fuse.EIO
+	}
+	f.r.memCache.evictRange(f.r.memKey(f.path), NewInterval(offset, int64(len(data))))
+
+	if end := uint64(offset) + uint64(len(data)); end > f.attr.Size {
+		f.attr.Size = end
+	}
+	mTime := uint64(time.Now().Unix())
+	f.attr.Mtime = mTime
+	f.attr.Atime = mTime
+
+	return uint32(len(data)), fuse.OK
+}
+
 // Flush, despite the name, is called for close() calls on file descriptors. It
 // may be called more than once at the end, and may be called at the start,
 // however.
@@ -257,6 +438,7 @@ func (f *remoteFile) Flush() fuse.Status {
 	f.mutex.Lock()
 	defer f.mutex.Unlock()
 
+	f.stopReadAhead()
 	if f.readOffset > 0 && f.reader != nil {
 		errc := f.reader.Close()
 		if errc != nil {
@@ -266,20 +448,16 @@ func (f *remoteFile) Flush() fuse.Status {
 	}
 
 	if f.writeOffset > 0 && f.wpipe != nil {
-		errc := f.wpipe.Close()
-		if errc != nil {
-			f.Warn("Flush wpipe close failed", "err", errc)
-		}
-		f.writeOffset = 0
-		worked := <-f.writeComplete
-		if worked {
-			errc = f.rpipe.Close()
-			if errc != nil {
-				f.Warn("Flush rpipe close failed", "err", errc)
-			}
+		f.finishStream()
+	}
+
+	if f.stager != nil && f.stager.size > 0 {
+		err := f.stager.finish()
+		f.stager = nil
+		if err != nil {
+			f.Error("Upload of staged writes failed", "err", err)
+			return fuse.EIO
 		}
-		f.wpipe = nil
-		f.rpipe = nil
 	}
 
 	return fuse.OK
@@ -291,11 +469,34 @@ func (f *remoteFile) Release() {
 	f.mutex.Lock()
 	defer f.mutex.Unlock()
 	f.skips = make(map[int64][]byte)
+	f.stopReadAhead()
+	if f.stager != nil {
+		f.stager.abort()
+		f.stager = nil
+	}
 }
 
 // Fsync always returns OK as opposed to "not implemented" so that write-sync-
-// write works.
+// write works. If our remote was configured with UploadOnFsync and we are
+// staging writes, the upload of what was written so far is completed first, so
+// that the file exists remotely; later writes are staged and uploaded along
+// with the rest of the file when it is next synced or closed.
 func (f *remoteFile) Fsync(flags int) fuse.Status {
+	if !f.r.uploadOnFsync {
+		return fuse.OK
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.stager == nil {
+		return fuse.OK
+	}
+	err := f.stager.sync()
+	if err != nil {
+		f.Error("Fsync upload of staged writes failed", "err", err)
+		f.stager = nil
+		return fuse.EIO
+	}
+	f.stager.track = f.r.newUploadTracker(f.path, -1)
 	return fuse.OK
 }
 
@@ -305,11 +506,9 @@ func (f *remoteFile) Truncate(size uint64) fuse.Status {
 	f.mutex.Lock()
 	defer f.mutex.Unlock()
 	f.attr.Size = size
-	if f.wpipe == nil {
-		f.rpipe, f.wpipe = io.Pipe()
-		ready, finished := f.r.uploadData(f.rpipe, f.path)
-		<-ready
-		f.writeComplete = finished
+	f.r.memCache.evict(f.r.memKey(f.path), int64(size))
+	if f.wpipe == nil && f.stager == nil {
+		f.startWriting()
 	}
 	return fuse.OK
 }
@@ -326,8 +525,11 @@ type cachedFile struct {
 	flags      int
 	attr       *fuse.Attr
 	remoteFile *remoteFile
+	remoteSize int64
 	openedRW   bool
 	mutex      sync.Mutex
+	onRelease  func()
+	onFsync    func() fuse.Status
 	log15.Logger
 }
 
@@ -340,6 +542,7 @@ func newCachedFile(r *remote, remotePath, localPath string, attr *fuse.Attr, fla
 		localPath:  localPath,
 		flags:      int(flags),
 		attr:       attr,
+		remoteSize: int64(attr.Size),
 		Logger:     logger.New("rpath", remotePath, "lpath", localPath),
 	}
 	f.makeLoopback()
@@ -368,8 +571,16 @@ func (f *cachedFile) InnerFile() nodefs.File {
 }
 
 // Write passes the real work to our InnerFile(), also updating our cached
-// attr.
+// attr. If our remote tracks the cache in blocks, any uncached blocks that the
+// write only partially covers are first cached from the remote file, so that
+// the whole of every block we record as cached is valid.
 func (f *cachedFile) Write(data []byte, offset int64) (uint32, fuse.Status) {
+	if f.r.CacheBlockSize() > 0 {
+		if status := f.cacheBlocksAround(NewInterval(offset, int64(len(data)))); status != fuse.OK {
+			return 0, status
+		}
+	}
+
 	n, s := f.InnerFile().Write(data, offset)
 	size := uint64(offset) + uint64(n)
 	if size > f.attr.Size {
@@ -378,10 +589,94 @@ func (f *cachedFile) Write(data []byte, offset int64) (uint32, fuse.Status) {
 	mTime := uint64(time.Now().Unix())
 	f.attr.Mtime = mTime
 	f.attr.Atime = mTime
-	f.r.Cached(f.localPath, NewInterval(offset, int64(n)))
+	iv := NewInterval(offset, int64(n))
+	f.r.Cached(f.localPath, iv)
+	f.r.memCache.evictRange(f.localPath, iv)
 	return n, s
 }
 
+// cacheBlocksAround caches from the remote file the uncached blocks at either
+// end of the given interval, if the interval does not completely cover them.
+// Only the data the remote file had when we were opened, and that hasn't since
+// been truncated away, is considered.
+func (f *cachedFile) cacheBlocksAround(iv Interval) fuse.Status {
+	if iv.Length() <= 0 || f.remoteSize == 0 {
+		return fuse.OK
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	blockSize := f.r.CacheBlockSize()
+	ends := []int64{iv.Start / blockSize}
+	if last := iv.End / blockSize; last != ends[0] {
+		ends = append(ends, last)
+	}
+	for _, i := range ends {
+		block := NewInterval(i*blockSize, blockSize)
+		if block.Start >= f.remoteSize {
+			continue
+		}
+		if block.End >= f.remoteSize {
+			block.End = f.remoteSize - 1
+		}
+		if block.Start >= iv.Start && block.End <= iv.End {
+			continue
+		}
+		if len(f.r.Uncached(f.localPath, block)) == 0 {
+			continue
+		}
+		if status := f.cacheInterval(block); status != fuse.OK {
+			return status
+		}
+	}
+	return fuse.OK
+}
+
+// Truncate passes the real work to our InnerFile(), also updating our cached
+// attr and what our remote has recorded as cached. Data beyond the new size
+// will never again come from the remote file, even if we are later extended
+// or written to there.
+func (f *cachedFile) Truncate(size uint64) fuse.Status {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	status := f.InnerFile().Truncate(size)
+	if status != fuse.OK {
+		return status
+	}
+	f.r.CacheTruncate(f.localPath, int64(size))
+	if int64(size) < f.remoteSize {
+		f.remoteSize = int64(size)
+	}
+	f.attr.Size = size
+	mTime := uint64(time.Now().Unix())
+	f.attr.Mtime = mTime
+	f.attr.Atime = mTime
+	return fuse.OK
+}
+
+// Release stops any reading ahead our remoteFile was doing, before releasing
+// our InnerFile(). If we were opened for writing, this also lets the file be
+// uploaded in the background.
+func (f *cachedFile) Release() {
+	f.remoteFile.Release()
+	f.InnerFile().Release()
+	if f.onRelease != nil {
+		f.onRelease()
+	}
+}
+
+// Fsync syncs our InnerFile() to local disk, then if we were opened for writing
+// on a remote configured with UploadOnFsync, uploads it.
+func (f *cachedFile) Fsync(flags int) fuse.Status {
+	status := f.InnerFile().Fsync(flags)
+	if status != fuse.OK || f.onFsync == nil {
+		return status
+	}
+	return f.onFsync()
+}
+
 // Utimens gets called by things like `touch -d "2006-01-02 15:04:05" filename`,
 // and we need to update our cached attr as well as the local file.
 func (f *cachedFile) Utimens(Atime *time.Time, Mtime *time.Time) (status fuse.Status) {
@@ -393,7 +688,8 @@ func (f *cachedFile) Utimens(Atime *time.Time, Mtime *time.Time) (status fuse.St
 	return status
 }
 
-// Read checks to see if we've previously stored these bytes in our local
+// Read first checks our remote's in-memory block cache (if any) for the data.
+// Otherwise checks to see if we've previously stored these bytes in our local
 // cached file, and if so just defers to our InnerFile(). If not, gets the data
 // from the remote file and stores it in the cache file.
 func (f *cachedFile) Read(buf []byte, offset int64) (fuse.ReadResult, fuse.Status) {
@@ -405,6 +701,35 @@ func (f *cachedFile) Read(buf []byte, offset int64) (fuse.ReadResult, fuse.Statu
 		return nil, fuse.OK
 	}
 
+	if f.r.memCache != nil {
+		n, status := f.r.memCache.readThrough(f.localPath, buf, offset, int64(f.attr.Size), f.fillBlock)
+		if status != fuse.OK {
+			return nil, status
+		}
+		return fuse.ReadResultData(buf[:n]), fuse.OK
+	}
+
+	return f.read(buf, offset)
+}
+
+// fillBlock is a blockFetcher for our remote's in-memory block cache, that
+// reads from our cache file (first caching remote data in it if necessary).
+func (f *cachedFile) fillBlock(dest []byte, offset int64) (int, fuse.Status) {
+	rr, status := f.read(dest, offset)
+	if status != fuse.OK {
+		return 0, status
+	}
+	defer rr.Done()
+	data, status := rr.Bytes(dest)
+	if status != fuse.OK {
+		return 0, status
+	}
+	return copy(dest, data), fuse.OK
+}
+
+// read is the implementation of Read() when not using a memory cache. You must
+// call it while holding the mutex.
+func (f *cachedFile) read(buf []byte, offset int64) (fuse.ReadResult, fuse.Status) {
 	// find which bytes we haven't previously read
 	request := NewInterval(offset, int64(len(buf)))
 	if request.End >= int64(f.attr.Size-1) {
@@ -417,30 +742,43 @@ func (f *cachedFile) Read(buf []byte, offset int64) (fuse.ReadResult, fuse.Statu
 	// letting different reads on the same file interleave
 
 	// read remote data and store in cache file for the previously unread parts
+	// (which for a block tracker may extend beyond the end of the file)
 	for _, iv := range newIvs {
-		ivBuf := make([]byte, iv.Length())
-		_, status := f.remoteFile.Read(ivBuf, iv.Start)
-		if status != fuse.OK {
-			// we warn instead of error because this is a "normal" situation
-			// when trying to read from non-existent files
-			f.Warn("Read failed", "status", status)
-			return nil, status
+		if iv.End >= int64(f.attr.Size) {
+			iv.End = int64(f.attr.Size - 1)
 		}
-
-		// write the data to our cache file
-		if !f.openedRW {
-			f.flags = f.flags | os.O_RDWR
-			f.makeLoopback()
-		}
-		n, s := f.InnerFile().Write(ivBuf, iv.Start)
-		if s == fuse.OK && int64(n) == iv.Length() {
-			f.r.Cached(f.localPath, iv)
-		} else {
-			f.Error("Failed to write bytes to cache file", "read", iv.Length(), "wrote", n, "status", s)
-			return nil, s
+		if status := f.cacheInterval(iv); status != fuse.OK {
+			return nil, status
 		}
 	}
 
 	// read the whole region from the cache file and return
 	return f.InnerFile().Read(buf, offset)
 }
+
+// cacheInterval reads the given interval from our remote file and stores it in
+// our cache file. You must call it while holding the mutex.
+func (f *cachedFile) cacheInterval(iv Interval) fuse.Status {
+	ivBuf := make([]byte, iv.Length())
+	_, status := f.remoteFile.Read(ivBuf, iv.Start)
+	if status != fuse.OK {
+		// we warn instead of error because this is a "normal" situation
+		// when trying to read from non-existent files
+		f.Warn("Read failed", "status", status)
+		return status
+	}
+
+	// write the data to our cache file
+	if !f.openedRW {
+		f.flags = f.flags | os.O_RDWR
+		f.makeLoopback()
+	}
+	n, s := f.InnerFile().Write(ivBuf, iv.Start)
+	if s == fuse.OK && int64(n) == iv.Length() {
+		f.r.Cached(f.localPath, iv)
+	} else {
+		f.Error("Failed to write bytes to cache file", "read", iv.Length(), "wrote", n, "status", s)
+		return s
+	}
+	return fuse.OK
+}
@@ -0,0 +1,186 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of muxfys.
+//
+//  muxfys is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  muxfys is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with muxfys. If not, see <http://www.gnu.org/licenses/>.
+
+package muxfys
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCachedFile(t *testing.T) {
+	Convey("Given a cachedFile in a remote with a cache block size", t, func() {
+		tmpdir, err := ioutil.TempDir("", "muxfys_file_testing")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(tmpdir)
+		remoteDir := filepath.Join(tmpdir, "remote")
+		err = os.MkdirAll(remoteDir, os.FileMode(dirMode))
+		So(err, ShouldBeNil)
+		err = ioutil.WriteFile(filepath.Join(remoteDir, "file"), []byte("abcdefghij"), os.FileMode(fileMode))
+		So(err, ShouldBeNil)
+
+		r, err := newRemote(&RemoteConfig{Accessor: &localAccessor{target: remoteDir}, CacheData: true, CacheBlockSize: 4}, remoteOptions{cacheBase: tmpdir})
+		So(err, ShouldBeNil)
+		remotePath := r.getRemotePath("file")
+		localPath := r.getLocalPath(remotePath)
+		err = os.MkdirAll(filepath.Dir(localPath), os.FileMode(dirMode))
+		So(err, ShouldBeNil)
+		attr := &fuse.Attr{Size: 10}
+		f := newCachedFile(r, remotePath, localPath, attr, uint32(os.O_RDWR|os.O_CREATE), pkgLogger)
+		defer f.Release()
+
+		Convey("Writing after a Truncate() doesn't bring back remote data beyond the new size", func() {
+			status := f.Truncate(6)
+			So(status, ShouldEqual, fuse.OK)
+			So(attr.Size, ShouldEqual, 6)
+
+			n, status := f.Write([]byte("X"), 7)
+			So(status, ShouldEqual, fuse.OK)
+			So(n, ShouldEqual, 1)
+			So(attr.Size, ShouldEqual, 8)
+
+			buf := make([]byte, 8)
+			rr, status := f.Read(buf, 0)
+			So(status, ShouldEqual, fuse.OK)
+			data, status := rr.Bytes(buf)
+			So(status, ShouldEqual, fuse.OK)
+			So(string(data), ShouldEqual, "abcdef\x00X")
+		})
+	})
+}
+
+// multipartAccessor is a localAccessor that is also a MultipartUploader,
+// writing the uploads assembled by its fakeMultipart to their local dest, and
+// counting the files it opens.
+type multipartAccessor struct {
+	*localAccessor
+	*fakeMultipart
+	opens int
+}
+
+// OpenFile implements RemoteAccessor, counting the calls.
+func (a *multipartAccessor) OpenFile(path string, offset int64) (io.ReadCloser, error) {
+	a.opens++
+	return a.localAccessor.OpenFile(path, offset)
+}
+
+func (a *multipartAccessor) CompleteMultipartUpload(dest, uploadID string, parts []UploadedPart) error {
+	err := a.fakeMultipart.CompleteMultipartUpload(dest, uploadID, parts)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dest, a.completed, os.FileMode(fileMode))
+}
+
+func TestRemoteFileWrites(t *testing.T) {
+	Convey("Given a remoteFile being written without caching", t, func() {
+		tmpdir, err := ioutil.TempDir("", "muxfys_file_testing")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(tmpdir)
+		remoteDir := filepath.Join(tmpdir, "remote")
+		err = os.MkdirAll(remoteDir, os.FileMode(dirMode))
+		So(err, ShouldBeNil)
+
+		accessor := &multipartAccessor{localAccessor: &localAccessor{target: remoteDir}, fakeMultipart: &fakeMultipart{}}
+		opts := remoteOptions{cacheBase: tmpdir, stageBudget: newWriteStageBudget(0)}
+		create := func(rc *RemoteConfig) *remoteFile {
+			r, errn := newRemote(rc, opts)
+			So(errn, ShouldBeNil)
+			return newRemoteFile(r, r.getRemotePath("file"), &fuse.Attr{}, true, pkgLogger).(*remoteFile)
+		}
+		write := func(f *remoteFile, data string, offset int64) fuse.Status {
+			n, status := f.Write([]byte(data), offset)
+			if status == fuse.OK {
+				So(n, ShouldEqual, len(data))
+			}
+			return status
+		}
+		remoteContent := func() string {
+			content, errr := ioutil.ReadFile(filepath.Join(remoteDir, "file"))
+			So(errr, ShouldBeNil)
+			return string(content)
+		}
+
+		Convey("Writes are staged, so the first part can be rewritten without reading anything back", func() {
+			f := create(&RemoteConfig{Accessor: accessor, Write: true})
+			defer f.Release()
+			So(f.stager, ShouldNotBeNil)
+			So(write(f, "hello ", 0), ShouldEqual, fuse.OK)
+			So(write(f, "world", 6), ShouldEqual, fuse.OK)
+			So(write(f, "H", 0), ShouldEqual, fuse.OK)
+			So(write(f, "!", 11), ShouldEqual, fuse.OK)
+			So(accessor.uploads, ShouldBeEmpty)
+
+			So(f.Flush(), ShouldEqual, fuse.OK)
+			So(remoteContent(), ShouldEqual, "Hello world!")
+			So(accessor.uploads, ShouldResemble, []int{1})
+			So(accessor.opens, ShouldEqual, 0)
+			So(len(opts.stageBudget), ShouldEqual, 0)
+		})
+
+		Convey("Rewriting an uploaded part after serial writes fails with ESPIPE", func() {
+			f := create(&RemoteConfig{Accessor: accessor, Write: true, WritePartSize: minWritePartSize})
+			defer f.Release()
+			part := make([]byte, minWritePartSize)
+			for i := int64(0); i < 3; i++ {
+				n, status := f.Write(part, i*minWritePartSize)
+				So(status, ShouldEqual, fuse.OK)
+				So(n, ShouldEqual, minWritePartSize)
+			}
+			So(accessor.uploads, ShouldResemble, []int{2, 3})
+			So(write(f, "X", minWritePartSize+1), ShouldEqual, fuse.Status(syscall.ESPIPE))
+			So(write(f, "H", 0), ShouldEqual, fuse.OK)
+
+			So(f.Flush(), ShouldEqual, fuse.OK)
+			So(accessor.uploads, ShouldResemble, []int{2, 3, 1})
+			So(accessor.opens, ShouldEqual, 0)
+			So(len(accessor.completed), ShouldEqual, 3*minWritePartSize)
+			So(string(accessor.completed[:1]), ShouldEqual, "H")
+		})
+
+		Convey("Fsync with UploadOnFsync completes the upload so far", func() {
+			f := create(&RemoteConfig{Accessor: accessor, Write: true, UploadOnFsync: true})
+			defer f.Release()
+			So(write(f, "hello", 0), ShouldEqual, fuse.OK)
+			So(f.Fsync(0), ShouldEqual, fuse.OK)
+			So(remoteContent(), ShouldEqual, "hello")
+
+			So(write(f, " world", 5), ShouldEqual, fuse.OK)
+			So(f.Fsync(0), ShouldEqual, fuse.OK)
+			So(remoteContent(), ShouldEqual, "hello world")
+			So(f.Flush(), ShouldEqual, fuse.OK)
+			So(remoteContent(), ShouldEqual, "hello world")
+		})
+
+		Convey("Non-serial writes fail without a MultipartUploader", func() {
+			f := create(&RemoteConfig{Accessor: accessor.localAccessor, Write: true})
+			defer f.Release()
+			So(write(f, "hello", 0), ShouldEqual, fuse.OK)
+			So(write(f, "H", 0), ShouldEqual, fuse.EIO)
+			So(f.Flush(), ShouldEqual, fuse.OK)
+			So(remoteContent(), ShouldEqual, "hello")
+		})
+	})
+}
@@ -30,11 +30,11 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"syscall"
 	"time"
 
-	"github.com/alexflint/go-filemutex"
 	"github.com/hanwen/go-fuse/fuse"
 	"github.com/hanwen/go-fuse/fuse/nodefs"
 	"github.com/hanwen/go-fuse/fuse/pathfs"
@@ -60,7 +60,7 @@ func (fs *MuxFys) fileDetails(name string, shouldBeWritable bool) (*fuse.Attr, *
 
 	r := fs.fileToRemote[name]
 	status := fuse.OK
-	if shouldBeWritable && !r.write {
+	if _, shadowed := fs.shadows[name]; shouldBeWritable && (!r.write || shadowed) {
 		status = fuse.EPERM
 	}
 
@@ -91,15 +91,19 @@ func (fs *MuxFys) OnMount(nodeFs *pathfs.PathNodeFs) {
 	// we need to establish that the root directory is a directory; the next
 	// attempt by the user to get it's contents will actually do the remote call
 	// to get the directory entries
-	fs.dirs[""] = fs.remotes
+	fs.addMountPaths()
+	fs.nodeFs = nodeFs
 }
 
-// GetAttr finds out about a given object, returning information from a
-// permanent cache if possible. context is not currently used.
+// GetAttr finds out about a given object, returning information from a cache if
+// possible (see Config.MetadataTTL). context is not currently used.
 func (fs *MuxFys) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
 	fs.mapMutex.Lock()
 	defer fs.mapMutex.Unlock()
 
+	parent := parentDir(name)
+	fs.refreshDirIfExpired(parent)
+
 	if _, isDir := fs.dirs[name]; isDir {
 		return fs.dirAttr, fuse.OK
 	}
@@ -108,14 +112,14 @@ func (fs *MuxFys) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.
 		return attr, fuse.OK
 	}
 
+	if fs.missing.has(name) {
+		return nil, fuse.ENOENT
+	}
+
 	// rather than call StatObject on name to see if its a file, it's more
 	// efficient to try and open it's parent directory and see if that resulted
 	// in us caching name as one of the parent's contents
-	parent := filepath.Dir(name)
-	if parent == "/" || parent == "." {
-		parent = ""
-	}
-	if _, cached := fs.dirContents[parent]; !cached {
+	if _, cached := fs.dirContents[parent]; !cached && !fs.unlistable.has(parent) {
 		// we must populate the contents of parent first, doing the essential
 		// part of OpenDir()
 		if remotes, exists := fs.dirs[parent]; exists {
@@ -125,6 +129,10 @@ func (fs *MuxFys) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.
 					fs.Warn("GetAttr openDir failed", "path", parent, "status", status)
 				}
 			}
+			fs.openMountDir(parent)
+			if _, cached = fs.dirContents[parent]; !cached {
+				fs.unlistable.add(parent)
+			}
 		}
 
 		if _, isDir := fs.dirs[name]; isDir {
@@ -135,6 +143,7 @@ func (fs *MuxFys) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.
 			return attr, fuse.OK
 		}
 	}
+	fs.missing.add(name)
 	return nil, fuse.ENOENT
 }
 
@@ -145,6 +154,8 @@ func (fs *MuxFys) OpenDir(name string, context *fuse.Context) ([]fuse.DirEntry,
 	fs.mapMutex.Lock()
 	defer fs.mapMutex.Unlock()
 
+	fs.refreshDirIfExpired(name)
+
 	remotes, exists := fs.dirs[name]
 	if !exists {
 		return nil, fuse.ENOENT
@@ -163,6 +174,7 @@ func (fs *MuxFys) OpenDir(name string, context *fuse.Context) ([]fuse.DirEntry,
 			fs.Warn("GetAttr openDir failed", "path", name, "status", status)
 		}
 	}
+	fs.openMountDir(name)
 
 	entries, cached = fs.dirContents[name]
 	if cached {
@@ -175,20 +187,35 @@ func (fs *MuxFys) OpenDir(name string, context *fuse.Context) ([]fuse.DirEntry,
 // caching the attributes of its contents. Must be called while you have the
 // mapMutex Locked.
 func (fs *MuxFys) openDir(r *remote, name string) fuse.Status {
+	objects, listed, status := r.listDir(dirRemotePath(r, name))
+	return fs.cacheDir(r, name, objects, listed, status)
+}
+
+// dirRemotePath returns the remote path of the given directory, suitable for
+// listing its contents.
+func dirRemotePath(r *remote, name string) string {
 	remotePath := r.getRemotePath(name)
 	if remotePath != "" {
 		remotePath += "/"
 	}
+	return remotePath
+}
 
-	objects, status := r.findObjects(remotePath)
+// cacheDir does the work of openDir() given the result of listing the
+// directory's contents in the given remote at the given time. Must be called
+// while you have the mapMutex Locked.
+func (fs *MuxFys) cacheDir(r *remote, name string, objects []RemoteAttr, listed time.Time, status fuse.Status) fuse.Status {
+	remotePath := dirRemotePath(r, name)
 
 	if status != fuse.OK || len(objects) == 0 {
-		if name == "" {
+		if name == r.mountPath {
 			// allow the root to be a non-existent directory
-			fs.dirs[name] = append(fs.dirs[name], r)
+			fs.addDirRemote(name, r)
 			if _, exists := fs.dirContents[name]; !exists {
 				fs.dirContents[name] = []fuse.DirEntry{}
 			}
+			fs.addMountEntries(name)
+			fs.listed(name, listed)
 			return fuse.OK
 		} else if status == fuse.OK {
 			return fuse.ENOENT
@@ -196,6 +223,12 @@ func (fs *MuxFys) openDir(r *remote, name string) fuse.Status {
 		return status
 	}
 
+	// other remotes may have already given us entries with the same names
+	seen := make(map[string]bool, len(fs.dirContents[name]))
+	for _, entry := range fs.dirContents[name] {
+		seen[entry.Name] = true
+	}
+
 	var isDir bool
 	for _, object := range objects {
 		if object.Name == name {
@@ -214,10 +247,29 @@ func (fs *MuxFys) openDir(r *remote, name string) fuse.Status {
 			d.Mode = uint32(fuse.S_IFDIR)
 			d.Name = d.Name[0 : len(d.Name)-1]
 			thisPath := filepath.Join(name, d.Name)
-			fs.dirs[thisPath] = append(fs.dirs[thisPath], r)
+			if !r.allows(thisPath, true) {
+				continue
+			}
+			fs.addDirRemote(thisPath, r)
 		} else {
 			d.Mode = uint32(fuse.S_IFREG)
 			thisPath := filepath.Join(name, d.Name)
+			if r.write {
+				if hidden, isWhiteout := whitedOut(name, d.Name); isWhiteout {
+					fs.whiteouts[hidden] = r
+					fs.hideWhitedOut(hidden)
+					delete(seen, filepath.Base(hidden))
+					continue
+				}
+			} else if fs.whiteouts[thisPath] != nil {
+				continue
+			}
+			if !r.allows(thisPath, false) {
+				continue
+			}
+			if r.write && object.MD5 != "" {
+				r.observeETag(r.getRemotePath(thisPath), object.MD5)
+			}
 			mTime := uint64(object.MTime.Unix())
 			attr := &fuse.Attr{
 				Mode:  fuse.S_IFREG | uint32(fileMode),
@@ -226,28 +278,76 @@ func (fs *MuxFys) openDir(r *remote, name string) fuse.Status {
 				Atime: mTime,
 				Ctime: mTime,
 			}
-			fs.files[thisPath] = attr
-			fs.fileToRemote[thisPath] = r
+			existing, exists := fs.fileToRemote[thisPath]
+			if exists && existing != r && r.write != existing.write {
+				fs.overlaid[thisPath] = true
+			}
+			switch {
+			case fs.createdFiles[thisPath]:
+				// keep the attributes of our own version of the file, which
+				// may be open and being written to
+				if existing != r {
+					fs.addShadowed(thisPath, r, attr)
+				}
+			case exists && existing != r && !fs.outranks(r, existing):
+				fs.addShadowed(thisPath, r, attr)
+			default:
+				if exists && existing != r {
+					fs.addShadowed(thisPath, existing, fs.files[thisPath])
+				}
+				fs.files[thisPath] = attr
+				fs.fileToRemote[thisPath] = r
+			}
+		}
+		if seen[d.Name] {
+			continue
 		}
+		seen[d.Name] = true
 		fs.dirContents[name] = append(fs.dirContents[name], d)
 
 		// for efficiency, instead of breaking here, we'll keep looping and
-		// cache all the dir contents; this does mean we'll never see externally
-		// added new entries for this dir in the future
+		// cache all the dir contents; this does mean we won't see externally
+		// added new entries for this dir until the listing expires or is
+		// invalidated
 	}
 
 	if !isDir {
 		return fuse.ENOENT
 	}
 
-	fs.dirs[name] = append(fs.dirs[name], r)
+	fs.addDirRemote(name, r)
 	if _, exists := fs.dirContents[name]; !exists {
 		// empty dir, we must create an entry in this map
 		fs.dirContents[name] = []fuse.DirEntry{}
 	}
+	fs.addMountEntries(name)
+	fs.listed(name, listed)
 	return fuse.OK
 }
 
+// listed should be called when we have just cached the contents of the given
+// directory, as listed at the given time. When the directory is in multiple
+// remotes, the oldest listing time is kept. Must be called while you have the
+// mapMutex Locked.
+func (fs *MuxFys) listed(name string, at time.Time) {
+	if previous, exists := fs.dirListed[name]; !exists || (!previous.IsZero() && at.Before(previous)) {
+		fs.dirListed[name] = at
+	}
+	fs.unlistable.forget(name)
+	fs.missing.forgetWithin(name)
+}
+
+// addDirRemote notes that the given directory exists in the given remote, if
+// we hadn't already. Must be called while you have the mapMutex Locked.
+func (fs *MuxFys) addDirRemote(name string, r *remote) {
+	for _, existing := range fs.dirs[name] {
+		if existing == r {
+			return
+		}
+	}
+	fs.dirs[name] = append(fs.dirs[name], r)
+}
+
 // Open is what is called when any request to read a file is made. The file must
 // already have been stat'ed (eg. with a GetAttr() call), or we report the file
 // doesn't exist. context is not currently used. If CacheData has been
@@ -258,16 +358,26 @@ func (fs *MuxFys) Open(name string, flags uint32, context *fuse.Context) (nodefs
 	if int(flags)&os.O_WRONLY != 0 || int(flags)&os.O_RDWR != 0 || int(flags)&os.O_APPEND != 0 || int(flags)&os.O_CREATE != 0 || int(flags)&os.O_TRUNC != 0 {
 		checkWritable = true
 	}
-	attr, r, status := fs.fileDetails(name, checkWritable)
+	var attr *fuse.Attr
+	var r *remote
+	var status fuse.Status
+	if checkWritable {
+		attr, r, status = fs.writableDetails(name, int(flags)&os.O_TRUNC != 0)
+	} else {
+		attr, r, status = fs.fileDetails(name, false)
+	}
 	var file nodefs.File
 	if status != fuse.OK {
 		return file, status
 	}
+	name, _ = fs.unshadow(name)
 
 	if r.cacheData {
 		file, status = fs.openCached(r, name, flags, context, attr, checkWritable)
 	} else {
-		file = newRemoteFile(r, r.getRemotePath(name), attr, false, fs.Logger)
+		rf := newRemoteFile(r, r.getRemotePath(name), attr, false, fs.Logger).(*remoteFile)
+		rf.useMemCache()
+		file = rf
 	}
 
 	if !r.write || (int(flags)&os.O_WRONLY == 0 && int(flags)&os.O_RDWR == 0) {
@@ -292,6 +402,13 @@ func (fs *MuxFys) openCached(r *remote, name string, flags uint32, context *fuse
 		fs.Error("openCached file mutex lock failed", "err", err)
 	}
 
+	if fs.takeStaleCache(localPath) {
+		err = os.Remove(localPath)
+		if err != nil && !os.IsNotExist(err) {
+			fs.Warn("openCached remove stale cache file failed", "path", localPath, "err", err)
+		}
+	}
+
 	localStats, err := os.Stat(localPath)
 	var create bool
 	if err != nil {
@@ -477,11 +594,18 @@ func (fs *MuxFys) Chown(name string, uid uint32, gid uint32, context *fuse.Conte
 // configured with CacheData: you can create and use symlinks but they don't get
 // uploaded. context is not currently used.
 func (fs *MuxFys) Symlink(source string, dest string, context *fuse.Context) (status fuse.Status) {
-	if fs.writeRemote == nil || !fs.writeRemote.cacheData {
+	if !fs.cachesWrites() {
+		return fuse.ENOSYS
+	}
+	r := fs.routeWrite(dest, false)
+	if r == nil {
+		return fuse.EPERM
+	}
+	if !r.cacheData {
 		return fuse.ENOSYS
 	}
 
-	localPathDest := fs.writeRemote.getLocalPath(fs.writeRemote.getRemotePath(dest))
+	localPathDest := r.getLocalPath(r.getRemotePath(dest))
 	fmutex, err := fs.getFileMutex(localPathDest)
 	if err != nil {
 		return fuse.EIO
@@ -495,7 +619,7 @@ func (fs *MuxFys) Symlink(source string, dest string, context *fuse.Context) (st
 	// symlink from mount point source to cached dest file
 	err = os.Symlink(source, localPathDest)
 	if err != nil {
-		fs.writeRemote.Error("Could not create symlink", "source", source, "dest", localPathDest, "err", err)
+		r.Error("Could not create symlink", "source", source, "dest", localPathDest, "err", err)
 		return fuse.ToStatus(err)
 	}
 
@@ -511,7 +635,8 @@ func (fs *MuxFys) Symlink(source string, dest string, context *fuse.Context) (st
 		Ctime: mTime,
 	}
 	fs.files[dest] = attr
-	fs.fileToRemote[dest] = fs.writeRemote
+	fs.fileToRemote[dest] = r
+	fs.addRouteDirs(dest, r)
 	fs.mapMutex.Unlock()
 
 	return fuse.OK
@@ -563,7 +688,7 @@ func (fs *MuxFys) RemoveXAttr(name string, attr string, context *fuse.Context) f
 // like os.Chtimes() (that don't first Open()/Create() the file). context is not
 // currently used.
 func (fs *MuxFys) Utimens(name string, Atime *time.Time, Mtime *time.Time, context *fuse.Context) fuse.Status {
-	attr, r, status := fs.fileDetails(name, true)
+	attr, r, status := fs.writableDetails(name, false)
 	if status == fuse.ENOENT {
 		fs.mapMutex.RLock()
 		defer fs.mapMutex.RUnlock()
@@ -593,7 +718,7 @@ func (fs *MuxFys) Utimens(name string, Atime *time.Time, Mtime *time.Time, conte
 // are only uploaded at Unmount() time. If offset is > size of file, does
 // nothing and returns OK. context is not currently used.
 func (fs *MuxFys) Truncate(name string, offset uint64, context *fuse.Context) fuse.Status {
-	attr, r, status := fs.fileDetails(name, true)
+	attr, r, status := fs.writableDetails(name, offset == 0)
 	if status != fuse.OK {
 		return status
 	}
@@ -669,7 +794,8 @@ func (fs *MuxFys) Truncate(name string, offset uint64, context *fuse.Context) fu
 		attr.Size = offset
 		attr.Mtime = uint64(time.Now().Unix())
 		fs.mapMutex.Lock()
-		fs.createdFiles[name] = true
+		fs.setCreated(name)
+		fs.uploader.modified(name)
 		fs.mapMutex.Unlock()
 
 		return fuse.OK
@@ -680,7 +806,8 @@ func (fs *MuxFys) Truncate(name string, offset uint64, context *fuse.Context) fu
 // Mkdir for a directory that doesn't exist yet. neither mode nor context are
 // currently used.
 func (fs *MuxFys) Mkdir(name string, mode uint32, context *fuse.Context) fuse.Status {
-	if fs.writeRemote == nil {
+	r := fs.routeWrite(name, true)
+	if r == nil {
 		return fuse.EPERM
 	}
 
@@ -700,10 +827,10 @@ func (fs *MuxFys) Mkdir(name string, mode uint32, context *fuse.Context) fuse.St
 		return fuse.ENOENT
 	}
 
-	remotePath := fs.writeRemote.getRemotePath(name)
+	remotePath := r.getRemotePath(name)
 	var err error
-	if fs.writeRemote.cacheData {
-		localPath := fs.writeRemote.getLocalPath(remotePath)
+	if r.cacheData {
+		localPath := r.getLocalPath(remotePath)
 
 		// make all the parent directories. We use our dirMode constant here
 		// instead of the supplied mode because of strange permission problems
@@ -722,11 +849,12 @@ func (fs *MuxFys) Mkdir(name string, mode uint32, context *fuse.Context) fuse.St
 
 	// we mark its existence internally but don't do anything "physical"
 	// to create the dir remotely (applies for cached and uncached modes)
-	fs.dirs[name] = append(fs.dirs[name], fs.writeRemote)
+	fs.addDirRemote(name, r)
+	fs.addRouteDirs(name, r)
 	if _, exists := fs.dirContents[name]; !exists {
 		fs.dirContents[name] = []fuse.DirEntry{}
 	}
-	if fs.writeRemote.cacheData {
+	if r.cacheData {
 		fs.createdDirs[name] = true
 	}
 	fs.addNewEntryToItsDir(name, fuse.S_IFDIR)
@@ -736,7 +864,8 @@ func (fs *MuxFys) Mkdir(name string, mode uint32, context *fuse.Context) fuse.St
 // Rmdir only works for non-existent or empty dirs. context is not currently
 // used.
 func (fs *MuxFys) Rmdir(name string, context *fuse.Context) fuse.Status {
-	if fs.writeRemote == nil {
+	r := fs.routeWrite(name, true)
+	if r == nil || fs.mountDirs[name] {
 		return fuse.EPERM
 	}
 
@@ -749,10 +878,10 @@ func (fs *MuxFys) Rmdir(name string, context *fuse.Context) fuse.Status {
 		return fuse.ENOSYS
 	}
 
-	remotePath := fs.writeRemote.getRemotePath(name)
+	remotePath := r.getRemotePath(name)
 	var err error
-	if fs.writeRemote.cacheData {
-		localPath := fs.writeRemote.getLocalPath(remotePath)
+	if r.cacheData {
+		localPath := r.getLocalPath(remotePath)
 		err = syscall.Rmdir(localPath)
 		if err != nil {
 			fs.Error("Rmdir failed", "path", localPath, "err", err)
@@ -769,28 +898,66 @@ func (fs *MuxFys) Rmdir(name string, context *fuse.Context) fuse.Status {
 	return fuse.OK
 }
 
-// Rename only works where oldPath is found in the writeable remote. For files,
+// Rename only works where oldPath is found in a writeable remote. For files,
 // first remotely copies oldPath to newPath (ignoring any local changes to
 // oldPath), renames any local cached (and possibly modified) copy of oldPath to
 // newPath, and finally deletes the remote oldPath; if oldPath had been
-// modified, its changes will only be uploaded to newPath at Unmount() time. For
+// modified, its changes will only be uploaded to newPath at Unmount() time (or
+// in the background if Config.WriteBackDelay was set). For
 // directories, is only capable of renaming directories you have created whilst
 // mounted. context is not currently used.
 func (fs *MuxFys) Rename(oldPath string, newPath string, context *fuse.Context) fuse.Status {
-	if fs.writeRemote == nil {
+	if len(fs.writeableRemotes()) == 0 {
 		return fuse.EPERM
 	}
 
-	fs.mapMutex.Lock()
-	defer fs.mapMutex.Unlock()
+	for {
+		// the cached files must be locked before the mapMutex, so we first
+		// find out which remote they are in, then check that still holds
+		fs.mapMutex.RLock()
+		r, isDir, status := fs.renameSource(oldPath, newPath)
+		fs.mapMutex.RUnlock()
+		if status != fuse.OK {
+			return status
+		}
+		var fmutexes []*fileMutex
+		if !isDir && r.cacheData {
+			fmutexes, status = fs.lockFileMutexes(r.getLocalPath(r.getRemotePath(oldPath)), r.getLocalPath(r.getRemotePath(newPath)))
+			if status != fuse.OK {
+				return status
+			}
+		}
+
+		fs.mapMutex.Lock()
+		rNow, isDirNow, status := fs.renameSource(oldPath, newPath)
+		changed := status == fuse.OK && (rNow != r || isDirNow != isDir)
+		if status == fuse.OK && !changed {
+			status = fs.rename(r, isDir, oldPath, newPath)
+		}
+		fs.mapMutex.Unlock()
+		fs.closeFileMutexes(fmutexes)
+		if !changed {
+			return status
+		}
+	}
+}
 
+// renameSource checks that oldPath can be renamed to newPath, returning the
+// remote it is in, and whether it is a directory. Must be called while you have
+// the mapMutex (R)Locked.
+func (fs *MuxFys) renameSource(oldPath, newPath string) (*remote, bool, fuse.Status) {
 	var isDir bool
+	var r *remote
 	if _, isDir = fs.dirs[oldPath]; !isDir {
-		if _, isFile := fs.fileToRemote[oldPath]; !isFile {
-			return fuse.ENOENT
+		var isFile bool
+		if r, isFile = fs.fileToRemote[oldPath]; !isFile {
+			return nil, false, fuse.ENOENT
+		}
+		if _, shadowed := fs.shadows[oldPath]; shadowed || !r.write {
+			return nil, false, fuse.EPERM
 		}
 	} else if _, created := fs.createdDirs[oldPath]; !created {
-		return fuse.ENOSYS
+		return nil, true, fuse.ENOSYS
 	} else {
 		// the directory's new parent dir must exist
 		parent := filepath.Dir(newPath)
@@ -798,23 +965,38 @@ func (fs *MuxFys) Rename(oldPath string, newPath string, context *fuse.Context)
 			parent = ""
 		}
 		if _, exists := fs.dirs[parent]; !exists {
-			return fuse.ENOENT
+			return nil, true, fuse.ENOENT
 		}
+
+		// and it must stay in the remote it was created in
+		r = fs.routeWrite(oldPath, true)
+		if r == nil || fs.routeWrite(newPath, true) != r {
+			return nil, true, fuse.EPERM
+		}
+	}
+	if !r.allows(newPath, isDir) {
+		return nil, isDir, fuse.EPERM
 	}
+	return r, isDir, fuse.OK
+}
 
-	remotePathOld := fs.writeRemote.getRemotePath(oldPath)
-	remotePathNew := fs.writeRemote.getRemotePath(newPath)
+// rename is the implementation of Rename() once renameSource() has found the
+// remote oldPath is in. Must be called while you have the mapMutex Locked, and,
+// for CacheData files, the file mutexes of both paths.
+func (fs *MuxFys) rename(r *remote, isDir bool, oldPath, newPath string) fuse.Status {
+	remotePathOld := r.getRemotePath(oldPath)
+	remotePathNew := r.getRemotePath(newPath)
 	if isDir {
-		if fs.writeRemote.cacheData {
+		if r.cacheData {
 			// first create the newPaths's cached parent dir
-			localPathNew := fs.writeRemote.getLocalPath(remotePathNew)
+			localPathNew := r.getLocalPath(remotePathNew)
 
 			// *** should we try and lock the old and new directories first?
 
 			var err error
 			if err = os.MkdirAll(filepath.Dir(localPathNew), os.FileMode(dirMode)); err == nil {
 				// now try and rename the cached dir
-				if err = os.Rename(fs.writeRemote.getLocalPath(remotePathOld), localPathNew); err == nil {
+				if err = os.Rename(r.getLocalPath(remotePathOld), localPathNew); err == nil {
 					// update our knowledge of what dirs we have
 					fs.dirs[newPath] = fs.dirs[oldPath]
 					fs.dirContents[newPath] = fs.dirContents[oldPath]
@@ -829,63 +1011,43 @@ func (fs *MuxFys) Rename(oldPath string, newPath string, context *fuse.Context)
 			fs.Error("Rename mkdir failed", "path", localPathNew, "err", err)
 			return fuse.ToStatus(err)
 		}
+	} else if _, created := fs.createdFiles[oldPath]; created && r.cacheData {
+		return fs.renameCreated(r, oldPath, newPath, remotePathOld, remotePathNew)
 	} else {
+		// journal the remote half of the rename
+		defer r.journal.finish(r.journal.begin(&JournalOp{Op: JournalRename, Path: remotePathNew, OldPath: remotePathOld}))
+
 		// first trigger a remote copy of oldPath to newPath
-		status := fs.writeRemote.copyFile(remotePathOld, remotePathNew)
+		status := r.copyFile(remotePathOld, remotePathNew)
 		if status != fuse.OK {
 			return status
 		}
+		r.forgetETag(remotePathOld)
+		r.forgetETag(remotePathNew)
 
-		if fs.writeRemote.cacheData {
-			localPathOld := fs.writeRemote.getLocalPath(remotePathOld)
-			localPathNew := fs.writeRemote.getLocalPath(remotePathNew)
-
-			fmutex, err := fs.getFileMutex(localPathOld)
-			if err != nil {
-				return fuse.EIO
-			}
-			err = fmutex.Lock()
-			if err != nil {
-				fs.Error("Rename file mutex lock failed", "path", localPathOld, "err", err)
-				return fuse.EIO
-			}
-			defer logClose(fs.Logger, fmutex, "Rename file mutex")
-			fmutex2, err := fs.getFileMutex(localPathNew)
-			if err != nil {
-				return fuse.EIO
+		if r.cacheData {
+			if status = fs.renameCached(r, remotePathOld, remotePathNew); status != fuse.OK {
+				return status
 			}
-			err = fmutex2.Lock()
-			if err != nil {
-				fs.Error("Rename file mutex lock failed", "path", localPathNew, "err", err)
-				return fuse.EIO
-			}
-			defer logClose(fs.Logger, fmutex2, "Rename file mutex")
-
-			// if we've cached oldPath, move to new cached file
-			err = os.Rename(localPathOld, localPathNew)
-			if err != nil {
-				fs.Error("Rename of cached files failed", "source", localPathOld, "dest", localPathNew, "err", err)
-			}
-			fs.writeRemote.CacheRename(localPathOld, localPathNew)
 		}
 
 		// cache the existence of the new file
 		fs.files[newPath] = fs.files[oldPath]
-		fs.fileToRemote[newPath] = fs.fileToRemote[oldPath]
+		fs.fileToRemote[newPath] = r
 		if _, created := fs.createdFiles[oldPath]; created {
-			fs.createdFiles[newPath] = true
-			delete(fs.createdFiles, oldPath)
+			fs.setCreated(newPath)
+			fs.clearCreated(oldPath)
 		}
+		fs.renameHandles(oldPath, newPath)
 		fs.addNewEntryToItsDir(newPath, fuse.S_IFREG)
 
 		// finally unlink oldPath remotely
-		r := fs.fileToRemote[oldPath]
-		if r != nil {
-			r.deleteFile(remotePathOld)
-		}
+		r.deleteFile(remotePathOld)
+		r.memCache.evict(r.memKey(remotePathOld), 0)
+		r.memCache.evict(r.memKey(remotePathNew), 0)
 		delete(fs.files, oldPath)
 		delete(fs.fileToRemote, oldPath)
-		delete(fs.createdFiles, oldPath)
+		fs.clearCreated(oldPath)
 		fs.rmEntryFromItsDir(oldPath)
 
 		return fuse.OK
@@ -893,41 +1055,132 @@ func (fs *MuxFys) Rename(oldPath string, newPath string, context *fuse.Context)
 	return fuse.ENOSYS
 }
 
+// renameCached moves the locally cached copy of a file in the given writeable
+// remote (if any) from its old to its new location. You must hold the file
+// mutexes of both locations.
+func (fs *MuxFys) renameCached(r *remote, remotePathOld, remotePathNew string) fuse.Status {
+	localPathOld := r.getLocalPath(remotePathOld)
+	localPathNew := r.getLocalPath(remotePathNew)
+
+	// if we've cached oldPath, move to new cached file
+	err := os.Rename(localPathOld, localPathNew)
+	if err != nil {
+		fs.Error("Rename of cached files failed", "source", localPathOld, "dest", localPathNew, "err", err)
+	}
+	r.CacheRename(localPathOld, localPathNew)
+	return fuse.OK
+}
+
+// renameCreated is Rename() for a file we created or modified in the given
+// CacheData writeable remote. Since the file will get uploaded under its new name, nothing
+// is copied remotely: the rename is purely local, unless an older version of
+// the file exists remotely under the old name, in which case that gets
+// deleted. Must be called while you hold the mapMutex and the file mutexes of
+// both paths.
+func (fs *MuxFys) renameCreated(r *remote, oldPath, newPath, remotePathOld, remotePathNew string) fuse.Status {
+	_, localOnly := fs.localOnlyFiles[oldPath]
+	if !localOnly {
+		defer r.journal.finish(r.journal.begin(&JournalOp{Op: JournalDelete, Path: remotePathOld}))
+	}
+
+	if status := fs.renameCached(r, remotePathOld, remotePathNew); status != fuse.OK {
+		return status
+	}
+
+	// the new file only exists remotely if it did before and we didn't make it
+	_, newExisted := fs.files[newPath]
+	_, newLocalOnly := fs.localOnlyFiles[newPath]
+	fs.files[newPath] = fs.files[oldPath]
+	fs.fileToRemote[newPath] = r
+	fs.setCreated(newPath)
+	fs.clearCreated(oldPath)
+	fs.renameHandles(oldPath, newPath)
+	if !newExisted || newLocalOnly {
+		fs.localOnlyFiles[newPath] = true
+	}
+	if !newExisted {
+		fs.addNewEntryToItsDir(newPath, fuse.S_IFREG)
+	}
+	r.observeETag(remotePathNew, "")
+
+	if !localOnly {
+		r.deleteFile(remotePathOld)
+	}
+	r.forgetETag(remotePathOld)
+	r.memCache.evict(r.memKey(remotePathOld), 0)
+	r.memCache.evict(r.memKey(remotePathNew), 0)
+	delete(fs.files, oldPath)
+	delete(fs.fileToRemote, oldPath)
+	fs.rmEntryFromItsDir(oldPath)
+
+	return fuse.OK
+}
+
 // Unlink deletes a file from the remote system, as well as any locally cached
 // copy. context is not currently used.
 func (fs *MuxFys) Unlink(name string, context *fuse.Context) fuse.Status {
 	_, r, status := fs.fileDetails(name, true)
+	if status == fuse.EPERM {
+		if w := fs.overlayRemote(name, r); w != nil {
+			return fs.whiteout(name, w)
+		}
+	}
 	if status != fuse.OK {
 		return status
 	}
 
 	remotePath := r.getRemotePath(name)
+	defer r.journal.finish(r.journal.begin(&JournalOp{Op: JournalDelete, Path: remotePath}))
 	if r.cacheData {
 		localPath := r.getLocalPath(remotePath)
-		// *** we could file lock here, but that is a little wasteful if
-		// localPath doesn't actually exist, and we'd have to file unlock eg.
-		// Rename() and anything else that calls us
+		if fs.uploader != nil {
+			// a background upload of the file must not recreate it after we
+			// delete it, so wait for any in progress, and make any about to
+			// start find the local file gone
+			fmutex, err := fs.getFileMutex(localPath)
+			if err != nil {
+				return fuse.EIO
+			}
+			err = fmutex.Lock()
+			if err != nil {
+				fs.Error("Unlink file mutex lock failed", "path", localPath, "err", err)
+				logClose(fs.Logger, fmutex, "Unlink file mutex")
+				return fuse.EIO
+			}
+			defer logClose(fs.Logger, fmutex, "Unlink file mutex")
+		}
+		// *** otherwise we could file lock here, but that is a little wasteful
+		// if localPath doesn't actually exist, and we'd have to file unlock
+		// eg. Rename() and anything else that calls us
 		err := syscall.Unlink(localPath)
 		if err != nil {
 			fs.Warn("Unlink failed", "path", localPath, "err", err)
 		}
 		r.CacheDelete(localPath)
 	}
+	status = r.deleteFile(remotePath)
 
 	fs.mapMutex.Lock()
-	defer fs.mapMutex.Unlock()
-
-	delete(fs.createdFiles, name)
+	fs.clearCreated(name)
+	fs.uploader.forget(name)
+	r.forgetETag(remotePath)
 
-	status = r.deleteFile(remotePath)
 	if status != fuse.OK {
+		fs.mapMutex.Unlock()
 		return status
 	}
+	r.memCache.evict(r.memKey(remotePath), 0)
 
 	delete(fs.files, name)
 	delete(fs.fileToRemote, name)
 	fs.rmEntryFromItsDir(name)
+	overlaid := fs.overlaid[name]
+	fs.mapMutex.Unlock()
 
+	if overlaid {
+		// don't let a read-only remote's copy reappear
+		return fs.whiteout(name, r)
+	}
 	return fuse.OK
 }
 
@@ -938,15 +1191,16 @@ func (fs *MuxFys) Access(name string, mode uint32, context *fuse.Context) fuse.S
 
 // Create creates a new file. mode and context are not currently used. When
 // configured with CacheData the contents of the created file are only uploaded
-// at Unmount() time.
+// at Unmount() time, or in the background once closed if
+// Config.WriteBackDelay was set.
 func (fs *MuxFys) Create(name string, flags uint32, mode uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
 	return fs.create(name, flags, mode)
 }
 
 // create is the implementation of Create() that also takes an optional
 // filemutex that should be Lock()ed (it will be Close()d).
-func (fs *MuxFys) create(name string, flags uint32, mode uint32, fmutex ...*filemutex.FileMutex) (nodefs.File, fuse.Status) {
-	r := fs.writeRemote
+func (fs *MuxFys) create(name string, flags uint32, mode uint32, fmutex ...*fileMutex) (nodefs.File, fuse.Status) {
+	r := fs.writeTarget(name)
 	if r == nil {
 		return nil, fuse.EPERM
 	}
@@ -972,6 +1226,18 @@ func (fs *MuxFys) create(name string, flags uint32, mode uint32, fmutex ...*file
 		}
 	}
 
+	// delete any whiteout marker hiding a read-only remote's copy of the file
+	// before we take the mapMutex for the rest
+	fs.mapMutex.Lock()
+	_, existed := fs.files[name]
+	w := fs.whiteouts[name]
+	fs.mapMutex.Unlock()
+	if !existed && w != nil {
+		if status := fs.unwhiteout(name, w); status != fuse.OK {
+			return nil, status
+		}
+	}
+
 	fs.mapMutex.Lock()
 	defer fs.mapMutex.Unlock()
 
@@ -990,6 +1256,11 @@ func (fs *MuxFys) create(name string, flags uint32, mode uint32, fmutex ...*file
 		}
 		fs.files[name] = attr
 		fs.fileToRemote[name] = r
+		fs.addRouteDirs(name, r)
+		r.observeETag(remotePath, "")
+		if r.cacheData {
+			fs.localOnlyFiles[name] = true
+		}
 	} else {
 		attr.Mtime = mTime
 		attr.Atime = mTime
@@ -1003,10 +1274,22 @@ func (fs *MuxFys) create(name string, flags uint32, mode uint32, fmutex ...*file
 		// 	attr.Size = uint64(0)
 		// }
 	}
-	fs.createdFiles[name] = true
+	fs.setCreated(name)
 
 	if r.cacheData {
-		return newCachedFile(r, remotePath, localPath, attr, uint32(int(flags)|os.O_CREATE), fs.Logger), fuse.OK
+		f := newCachedFile(r, remotePath, localPath, attr, uint32(int(flags)|os.O_CREATE), fs.Logger)
+		if fs.uploader != nil || r.uploadOnFsync {
+			h := fs.trackHandle(name)
+			f.(*cachedFile).onRelease = func() {
+				fs.releaseHandle(h)
+			}
+			if r.uploadOnFsync {
+				f.(*cachedFile).onFsync = func() fuse.Status {
+					return fs.uploadOnFsync(fs.handleName(h))
+				}
+			}
+		}
+		return f, fuse.OK
 	}
 	return newRemoteFile(r, remotePath, attr, true, fs.Logger), fuse.OK
 }
@@ -1015,6 +1298,11 @@ func (fs *MuxFys) create(name string, flags uint32, mode uint32, fmutex ...*file
 // object's containing directory entries. mode should be fuse.S_IFREG or
 // fuse.S_IFDIR. Must be called while you have the mapMutex Locked.
 func (fs *MuxFys) addNewEntryToItsDir(name string, mode int) {
+	fs.missing.forget(name)
+	if mode == fuse.S_IFDIR {
+		fs.missing.forgetWithin(name)
+	}
+
 	d := fuse.DirEntry{
 		Name: filepath.Base(name),
 		Mode: uint32(mode),
@@ -1034,6 +1322,7 @@ func (fs *MuxFys) addNewEntryToItsDir(name string, mode int) {
 					fs.Warn("addNewEntryToItsDir openDir failed", "path", parent, "status", status)
 				}
 			}
+			fs.openMountDir(parent)
 		}
 	}
 	fs.dirContents[parent] = append(fs.dirContents[parent], d)
@@ -1065,8 +1354,10 @@ func (fs *MuxFys) rmEntryFromItsDir(name string) {
 
 // getFileMutex prepares a lock file for the given local path (in that path's
 // directory, creating the directory first if necessary), and returns a mutex
-// that you should Lock() and Close().
-func (fs *MuxFys) getFileMutex(localPath string) (*filemutex.FileMutex, error) {
+// that you should Lock() and Close(). You must Lock() it before, and never
+// while holding, the mapMutex (though you can TryLock() it while holding the
+// mapMutex, since that doesn't wait).
+func (fs *MuxFys) getFileMutex(localPath string) (*fileMutex, error) {
 	parent := filepath.Dir(localPath)
 	if _, err := os.Stat(parent); err != nil && os.IsNotExist(err) {
 		err = os.MkdirAll(parent, dirMode)
@@ -1075,9 +1366,46 @@ func (fs *MuxFys) getFileMutex(localPath string) (*filemutex.FileMutex, error) {
 			return nil, err
 		}
 	}
-	mutex, err := filemutex.New(filepath.Join(parent, ".muxfys_lock."+filepath.Base(localPath)))
+	mutex, err := newFileMutex(filepath.Join(parent, lockFilePrefix+filepath.Base(localPath)))
 	if err != nil {
 		fs.Error("Could not create lock file", "path", localPath, "err", err)
 	}
 	return mutex, err
 }
+
+// lockFileMutexes gets and Lock()s the file mutexes for the given local paths,
+// in a consistent order so that we can't deadlock with others locking the same
+// paths. Pass the returned mutexes to closeFileMutexes() when you're done.
+func (fs *MuxFys) lockFileMutexes(localPaths ...string) ([]*fileMutex, fuse.Status) {
+	sorted := make([]string, len(localPaths))
+	copy(sorted, localPaths)
+	sort.Strings(sorted)
+
+	var fmutexes []*fileMutex
+	for i, localPath := range sorted {
+		if i > 0 && localPath == sorted[i-1] {
+			continue
+		}
+		fmutex, err := fs.getFileMutex(localPath)
+		if err != nil {
+			fs.closeFileMutexes(fmutexes)
+			return nil, fuse.EIO
+		}
+		err = fmutex.Lock()
+		if err != nil {
+			fs.Error("File mutex lock failed", "path", localPath, "err", err)
+			logClose(fs.Logger, fmutex, "file mutex", "path", localPath)
+			fs.closeFileMutexes(fmutexes)
+			return nil, fuse.EIO
+		}
+		fmutexes = append(fmutexes, fmutex)
+	}
+	return fmutexes, fuse.OK
+}
+
+// closeFileMutexes Close()s the mutexes returned by lockFileMutexes().
+func (fs *MuxFys) closeFileMutexes(fmutexes []*fileMutex) {
+	for i := len(fmutexes) - 1; i >= 0; i-- {
+		logClose(fs.Logger, fmutexes[i], "file mutex")
+	}
+}
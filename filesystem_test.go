@@ -0,0 +1,153 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of muxfys.
+//
+//  muxfys is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  muxfys is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with muxfys. If not, see <http://www.gnu.org/licenses/>.
+
+package muxfys
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRenameCreated(t *testing.T) {
+	Convey("Given a CacheData writeable remote with an existing file", t, func() {
+		tmpdir, err := ioutil.TempDir("", "muxfys_rename_testing")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(tmpdir)
+		remoteDir := filepath.Join(tmpdir, "remote")
+		err = os.MkdirAll(remoteDir, os.FileMode(dirMode))
+		So(err, ShouldBeNil)
+		err = ioutil.WriteFile(filepath.Join(remoteDir, "existing"), []byte("old"), os.FileMode(fileMode))
+		So(err, ShouldBeNil)
+
+		fs, err := New(&Config{Mount: filepath.Join(tmpdir, "mnt"), CacheBase: tmpdir})
+		So(err, ShouldBeNil)
+		r, err := newRemote(&RemoteConfig{Accessor: &localAccessor{target: remoteDir}, CacheData: true, Write: true}, remoteOptions{cacheBase: tmpdir, logger: fs.Logger})
+		So(err, ShouldBeNil)
+		fs.remotes = []*remote{r}
+		fs.writeRemote = r
+		fs.mapMutex.Lock()
+		status := fs.openDir(r, "")
+		fs.mapMutex.Unlock()
+		So(status, ShouldEqual, fuse.OK)
+
+		write := func(name, content string) {
+			f, status := fs.create(name, uint32(os.O_RDWR|os.O_TRUNC), uint32(fileMode))
+			So(status, ShouldEqual, fuse.OK)
+			f.Release()
+			errw := ioutil.WriteFile(r.getLocalPath(r.getRemotePath(name)), []byte(content), os.FileMode(fileMode))
+			So(errw, ShouldBeNil)
+		}
+		remoteFiles := func() []string {
+			entries, errr := ioutil.ReadDir(remoteDir)
+			So(errr, ShouldBeNil)
+			var names []string
+			for _, entry := range entries {
+				names = append(names, entry.Name())
+			}
+			return names
+		}
+		read := func(name string) string {
+			content, errr := ioutil.ReadFile(filepath.Join(remoteDir, name))
+			So(errr, ShouldBeNil)
+			return string(content)
+		}
+
+		Convey("Renaming a new file is purely local, and only the new name gets uploaded", func() {
+			write("out.tmp", "new")
+			status = fs.Rename("out.tmp", "out", &fuse.Context{})
+			So(status, ShouldEqual, fuse.OK)
+			So(remoteFiles(), ShouldResemble, []string{"existing"})
+			So(fs.createdFiles, ShouldResemble, map[string]bool{"out": true})
+			So(fs.localOnlyFiles, ShouldResemble, map[string]bool{"out": true})
+			_, exists := fs.files["out.tmp"]
+			So(exists, ShouldBeFalse)
+
+			err = fs.Unmount()
+			So(err, ShouldBeNil)
+			So(remoteFiles(), ShouldResemble, []string{"existing", "out"})
+			So(read("out"), ShouldEqual, "new")
+		})
+
+		Convey("Renaming a new file over an existing one replaces it at upload", func() {
+			write("existing.tmp", "replacement")
+			status = fs.Rename("existing.tmp", "existing", &fuse.Context{})
+			So(status, ShouldEqual, fuse.OK)
+			So(remoteFiles(), ShouldResemble, []string{"existing"})
+			So(read("existing"), ShouldEqual, "old")
+			So(fs.localOnlyFiles["existing"], ShouldBeFalse)
+			entries, status := fs.OpenDir("", &fuse.Context{})
+			So(status, ShouldEqual, fuse.OK)
+			So(len(entries), ShouldEqual, 1)
+
+			err = fs.Unmount()
+			So(err, ShouldBeNil)
+			So(read("existing"), ShouldEqual, "replacement")
+		})
+
+		Convey("Concurrent creates and renames of the same files don't deadlock", func() {
+			done := make(chan bool)
+			go func() {
+				var wg sync.WaitGroup
+				for i := 0; i < 100; i++ {
+					wg.Add(2)
+					go func() {
+						defer wg.Done()
+						f, status := fs.Create("a", uint32(os.O_RDWR), uint32(fileMode), &fuse.Context{})
+						if status == fuse.OK {
+							f.Release()
+						}
+					}()
+					go func() {
+						defer wg.Done()
+						fs.Rename("a", "b", &fuse.Context{})
+						fs.Rename("b", "a", &fuse.Context{})
+					}()
+				}
+				wg.Wait()
+				close(done)
+			}()
+
+			finished := false
+			select {
+			case <-done:
+				finished = true
+			case <-time.After(30 * time.Second):
+			}
+			So(finished, ShouldBeTrue)
+		})
+
+		Convey("Renaming an altered existing file deletes the old remote file", func() {
+			write("existing", "altered")
+			status = fs.Rename("existing", "moved", &fuse.Context{})
+			So(status, ShouldEqual, fuse.OK)
+			So(len(remoteFiles()), ShouldEqual, 0)
+
+			err = fs.Unmount()
+			So(err, ShouldBeNil)
+			So(remoteFiles(), ShouldResemble, []string{"moved"})
+			So(read("moved"), ShouldEqual, "altered")
+		})
+	})
+}
@@ -0,0 +1,105 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of muxfys.
+//
+//  muxfys is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  muxfys is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with muxfys. If not, see <http://www.gnu.org/licenses/>.
+
+package muxfys
+
+// This file implements the filtering of which paths in a remote are visible in
+// the mount.
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// pathFilter decides which paths of a remote are visible, based on the
+// Include, Exclude, IncludeRegexp and ExcludeRegexp options of a RemoteConfig.
+// All methods are safe to call on a nil *pathFilter, which allows everything.
+type pathFilter struct {
+	include   []string
+	exclude   []string
+	includeRe *regexp.Regexp
+	excludeRe *regexp.Regexp
+}
+
+// newPathFilter creates a pathFilter from the given glob patterns and regular
+// expressions. Returns nil if none were supplied, or an error if any are
+// invalid.
+func newPathFilter(include, exclude []string, includeRegexp, excludeRegexp string) (*pathFilter, error) {
+	if len(include) == 0 && len(exclude) == 0 && includeRegexp == "" && excludeRegexp == "" {
+		return nil, nil
+	}
+	f := &pathFilter{include: include, exclude: exclude}
+	for _, pattern := range append(append([]string{}, include...), exclude...) {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("bad Include or Exclude pattern %q: %s", pattern, err)
+		}
+	}
+	var err error
+	if includeRegexp != "" {
+		f.includeRe, err = regexp.Compile(includeRegexp)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if excludeRegexp != "" {
+		f.excludeRe, err = regexp.Compile(excludeRegexp)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// allows returns true if the given path (relative to the root of the remote)
+// should be visible. Directories are only subject to the exclusions, so that
+// the files within them that are included can still be reached.
+func (f *pathFilter) allows(path string, isDir bool) bool {
+	if f == nil {
+		return true
+	}
+	rePath := path
+	if isDir {
+		rePath += "/"
+	}
+	if matchesGlobs(f.exclude, path) || (f.excludeRe != nil && f.excludeRe.MatchString(rePath)) {
+		return false
+	}
+	if isDir || (len(f.include) == 0 && f.includeRe == nil) {
+		return true
+	}
+	return matchesGlobs(f.include, path) || (f.includeRe != nil && f.includeRe.MatchString(rePath))
+}
+
+// matchesGlobs returns true if path matches any of the given glob patterns.
+// Patterns without a "/" are matched against the basename of path, others
+// against the whole path.
+func matchesGlobs(patterns []string, path string) bool {
+	base := filepath.Base(path)
+	for _, pattern := range patterns {
+		subject := base
+		if strings.Contains(pattern, "/") {
+			subject = path
+		}
+		if matched, _ := filepath.Match(pattern, subject); matched {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,129 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of muxfys.
+//
+//  muxfys is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  muxfys is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with muxfys. If not, see <http://www.gnu.org/licenses/>.
+
+package muxfys
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPathFilter(t *testing.T) {
+	Convey("A nil pathFilter allows everything", t, func() {
+		f, err := newPathFilter(nil, nil, "", "")
+		So(err, ShouldBeNil)
+		So(f, ShouldBeNil)
+		So(f.allows("a/b.txt", false), ShouldBeTrue)
+		So(f.allows("a", true), ShouldBeTrue)
+	})
+
+	Convey("Bad patterns are rejected", t, func() {
+		_, err := newPathFilter([]string{"[a"}, nil, "", "")
+		So(err, ShouldNotBeNil)
+		_, err = newPathFilter(nil, nil, "", "(")
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Globs match basenames or whole paths", t, func() {
+		f, err := newPathFilter([]string{"*.cram", "data/*/manifest.tsv"}, []string{"tmp", "*.tmp.cram"}, "", "")
+		So(err, ShouldBeNil)
+		So(f.allows("a/b.cram", false), ShouldBeTrue)
+		So(f.allows("a/b.bam", false), ShouldBeFalse)
+		So(f.allows("data/x/manifest.tsv", false), ShouldBeTrue)
+		So(f.allows("other/x/manifest.tsv", false), ShouldBeFalse)
+		So(f.allows("a/b.tmp.cram", false), ShouldBeFalse)
+		So(f.allows("a", true), ShouldBeTrue)
+		So(f.allows("a/tmp", true), ShouldBeFalse)
+	})
+
+	Convey("Regexps match anywhere, with dirs given a trailing slash", t, func() {
+		f, err := newPathFilter(nil, nil, `\.cram$`, `^tmp/`)
+		So(err, ShouldBeNil)
+		So(f.allows("a/b.cram", false), ShouldBeTrue)
+		So(f.allows("a/b.bam", false), ShouldBeFalse)
+		So(f.allows("tmp", true), ShouldBeFalse)
+		So(f.allows("tmp.cram", false), ShouldBeTrue)
+		So(f.allows("a/tmp", true), ShouldBeTrue)
+	})
+
+	Convey("Given a filtered writeable remote", t, func() {
+		tmpdir, err := ioutil.TempDir("", "muxfys_filter_testing")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(tmpdir)
+		remoteDir := filepath.Join(tmpdir, "remote")
+		for _, dir := range []string{"a", "tmp"} {
+			err = os.MkdirAll(filepath.Join(remoteDir, dir), os.FileMode(dirMode))
+			So(err, ShouldBeNil)
+		}
+		for _, name := range []string{"a/b.cram", "a/c.bam", "d.cram", "tmp/e.cram"} {
+			err = ioutil.WriteFile(filepath.Join(remoteDir, name), []byte(name), os.FileMode(fileMode))
+			So(err, ShouldBeNil)
+		}
+
+		fs, err := New(&Config{Mount: filepath.Join(tmpdir, "mnt"), CacheBase: tmpdir})
+		So(err, ShouldBeNil)
+		r, err := newRemote(&RemoteConfig{
+			Accessor:  &localAccessor{target: remoteDir},
+			CacheData: true,
+			Write:     true,
+			Include:   []string{"*.cram"},
+			Exclude:   []string{"tmp"},
+		}, remoteOptions{cacheBase: tmpdir, logger: fs.Logger})
+		So(err, ShouldBeNil)
+		fs.remotes = []*remote{r}
+		fs.writeRemote = r
+		fs.OnMount(nil)
+
+		ls := func(dir string) []string {
+			entries, status := fs.OpenDir(dir, &fuse.Context{})
+			So(status, ShouldEqual, fuse.OK)
+			var names []string
+			for _, entry := range entries {
+				names = append(names, entry.Name)
+			}
+			sort.Strings(names)
+			return names
+		}
+
+		Convey("Only unfiltered paths are listed and statted", func() {
+			So(ls(""), ShouldResemble, []string{"a", "d.cram"})
+			So(ls("a"), ShouldResemble, []string{"b.cram"})
+			_, status := fs.GetAttr("a/c.bam", &fuse.Context{})
+			So(status, ShouldEqual, fuse.ENOENT)
+			_, status = fs.GetAttr("tmp", &fuse.Context{})
+			So(status, ShouldEqual, fuse.ENOENT)
+			_, status = fs.OpenDir("tmp", &fuse.Context{})
+			So(status, ShouldEqual, fuse.ENOENT)
+		})
+
+		Convey("Filtered paths can't be created", func() {
+			ls("")
+			_, status := fs.Create("f.bam", uint32(os.O_WRONLY), uint32(fileMode), &fuse.Context{})
+			So(status, ShouldEqual, fuse.EPERM)
+			So(fs.Mkdir("tmp", uint32(dirMode), &fuse.Context{}), ShouldEqual, fuse.EPERM)
+			So(fs.Rename("d.cram", "d.bam", &fuse.Context{}), ShouldEqual, fuse.EPERM)
+			So(ls(""), ShouldResemble, []string{"a", "d.cram"})
+		})
+	})
+}
@@ -0,0 +1,512 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of muxfys.
+//
+//  muxfys is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  muxfys is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with muxfys. If not, see <http://www.gnu.org/licenses/>.
+
+package muxfys
+
+// This file implements a journal of the remote operations a writeable remote
+// with a permanent CacheDir still has to carry out, so that they can be
+// completed by a later mount if we crash before Unmount().
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/inconshreveable/log15"
+)
+
+// journalPrefix is the prefix of the basename of journal files in a CacheDir.
+const journalPrefix = ".muxfys_journal."
+
+// The kinds of JournalOp.
+const (
+	// JournalUpload is an upload of a created or modified local file.
+	JournalUpload = "upload"
+
+	// JournalRename is the remote half of a rename: a copy followed by a
+	// delete of the old path.
+	JournalRename = "rename"
+
+	// JournalDelete is the deletion of a remote file.
+	JournalDelete = "delete"
+)
+
+// JournalOp describes a remote operation that was journaled.
+type JournalOp struct {
+	// Op is one of JournalUpload, JournalRename or JournalDelete.
+	Op string `json:"op"`
+
+	// Target is the Target() of the RemoteAccessor the operation is for.
+	Target string `json:"target"`
+
+	// Path is the absolute remote path being uploaded to, renamed to or
+	// deleted.
+	Path string `json:"path"`
+
+	// OldPath is the absolute remote path being renamed from.
+	OldPath string `json:"old,omitempty"`
+
+	// LocalPath is the local cache file that should be uploaded to Path. For
+	// renames it is only set if the file being renamed had not yet been
+	// uploaded.
+	LocalPath string `json:"local,omitempty"`
+
+	// CheckETag is true for uploads to a remote with a ConflictSuffix, in
+	// which case ETag is what Path was expected to have (blank if it was
+	// expected not to exist). Recovery then uploads to the conflict path if
+	// Path was changed by someone else.
+	CheckETag bool   `json:"check_etag,omitempty"`
+	ETag      string `json:"etag,omitempty"`
+
+	// Time is when the operation was journaled.
+	Time time.Time `json:"time"`
+
+	// Err is set when recovery of the operation failed.
+	Err error `json:"-"`
+}
+
+// journalRecord is a line in a journal file: either the start of an operation
+// or a note that the operation with that ID completed.
+type journalRecord struct {
+	ID   uint64     `json:"id"`
+	Op   *JournalOp `json:"op,omitempty"`
+	Done bool       `json:"done,omitempty"`
+}
+
+// journal records JournalOps in a file that it holds an exclusive lock on for
+// as long as it is open. All methods are safe to call on a nil *journal, which
+// does nothing.
+type journal struct {
+	mutex   sync.Mutex
+	file    *os.File
+	path    string
+	target  string
+	lastID  uint64
+	pending map[uint64]bool
+	log15.Logger
+}
+
+// newJournal creates a new journal file in dir for operations on the given
+// target.
+func newJournal(dir, target string, logger log15.Logger) (*journal, error) {
+	path := filepath.Join(dir, fmt.Sprintf("%s%d.%d", journalPrefix, time.Now().UnixNano(), os.Getpid()))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_APPEND, os.FileMode(fileMode))
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		logClose(logger, f, "journal")
+		return nil, err
+	}
+	return &journal{
+		file:    f,
+		path:    path,
+		target:  target,
+		pending: make(map[uint64]bool),
+		Logger:  logger,
+	}, nil
+}
+
+// begin durably records that we are about to carry out the given operation,
+// returning an ID to finish() it with once it has been carried out.
+func (j *journal) begin(op *JournalOp) uint64 {
+	if j == nil {
+		return 0
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.lastID++
+	op.Target = j.target
+	op.Time = time.Now()
+	j.pending[j.lastID] = true
+	err := j.write(&journalRecord{ID: j.lastID, Op: op})
+	if err == nil {
+		err = j.file.Sync()
+	}
+	if err != nil {
+		j.Error("Journal write failed", "op", op.Op, "path", op.Path, "err", err)
+	}
+	return j.lastID
+}
+
+// finish records that the operation with the given ID no longer needs to be
+// carried out.
+func (j *journal) finish(id uint64) {
+	if j == nil || id == 0 {
+		return
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if !j.pending[id] {
+		return
+	}
+	delete(j.pending, id)
+
+	// we don't need to sync this; at worst a later mount repeats the operation
+	var err error
+	if len(j.pending) == 0 {
+		err = j.file.Truncate(0)
+	} else {
+		err = j.write(&journalRecord{ID: id, Done: true})
+	}
+	if err != nil {
+		j.Error("Journal write failed", "id", id, "err", err)
+	}
+}
+
+// write appends a record to our file. Must be called while you hold the mutex.
+func (j *journal) write(rec *journalRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	_, err = j.file.Write(append(line, '\n'))
+	return err
+}
+
+// close closes and unlocks the journal file, so that any operations that have
+// not finished can be recovered by a later mount. If there are no such
+// operations, or discard is true, the file is deleted instead.
+func (j *journal) close(discard bool) {
+	if j == nil {
+		return
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if discard || len(j.pending) == 0 {
+		err := os.Remove(j.path)
+		if err != nil {
+			j.Warn("Journal removal failed", "path", j.path, "err", err)
+		}
+	} else {
+		j.Warn("Journal has unfinished operations", "path", j.path, "ops", len(j.pending))
+	}
+	logClose(j.Logger, j.file, "journal")
+}
+
+// readJournal parses a journal file, returning the operations that were begun
+// but not finished, in the order they were begun.
+func readJournal(path string) ([]*JournalOp, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// the final line will be incomplete if we crashed while writing it, and so
+	// won't decode
+	ops := make(map[uint64]*JournalOp)
+	for _, line := range bytes.Split(content, []byte("\n")) {
+		var rec journalRecord
+		if json.Unmarshal(line, &rec) != nil {
+			continue
+		}
+		if rec.Done {
+			delete(ops, rec.ID)
+		} else if rec.Op != nil {
+			ops[rec.ID] = rec.Op
+		}
+	}
+
+	ids := make([]uint64, 0, len(ops))
+	for id := range ops {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	pending := make([]*JournalOp, len(ids))
+	for i, id := range ids {
+		pending[i] = ops[id]
+	}
+	return pending, nil
+}
+
+// rewriteJournal replaces the journal file at path with one containing just
+// the given ops, or deletes it if there are none.
+func rewriteJournal(path string, ops []*JournalOp) error {
+	if len(ops) == 0 {
+		err := os.Remove(path)
+		if err != nil && os.IsNotExist(err) {
+			err = nil
+		}
+		return err
+	}
+
+	var buf bytes.Buffer
+	for i, op := range ops {
+		line, err := json.Marshal(&journalRecord{ID: uint64(i + 1), Op: op})
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".muxfys_rewrite.")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(buf.Bytes())
+	if err == nil {
+		err = tmp.Sync()
+	}
+	errc := tmp.Close()
+	if err == nil {
+		err = errc
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), os.FileMode(fileMode))
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// RecoveryReport describes what happened to the operations left in the
+// journals of previous mounts when they were recovered.
+type RecoveryReport struct {
+	// Completed are the operations that were carried out.
+	Completed []*JournalOp
+
+	// Failed are the operations that could not be carried out, with their Err
+	// set. They are left in the journal to be tried again next time, unless
+	// they were uploads of local files that no longer exist.
+	Failed []*JournalOp
+
+	// Skipped are the operations for other targets that share the CacheDir,
+	// which are left for a mount of that target to recover.
+	Skipped []*JournalOp
+}
+
+// RecoverJournals carries out any operations left unfinished by previous
+// mounts that used the given RemoteConfig's CacheDir as a writeable remote
+// but did not successfully Unmount(), eg. because they crashed. Remote calls
+// are retried the given number of times.
+//
+// You don't normally need to call this, since Mount() will do the same thing,
+// reporting the results in Recovery(); it's for when you want to finish off
+// pending uploads without mounting again. Journals of currently mounted
+// MuxFys are ignored.
+func RecoverJournals(rc *RemoteConfig, retries int) (*RecoveryReport, error) {
+	if rc.CacheDir == "" {
+		return nil, fmt.Errorf("RemoteConfig has no CacheDir")
+	}
+	r, err := newRemote(&RemoteConfig{
+		Accessor:       rc.Accessor,
+		CacheDir:       rc.CacheDir,
+		Write:          true,
+		ConflictSuffix: rc.ConflictSuffix,
+	}, remoteOptions{maxAttempts: retries + 1})
+	if err != nil {
+		return nil, err
+	}
+	return recoverJournals(r)
+}
+
+// recoverJournals carries out the unfinished operations for r's target in any
+// unlocked journal files in its cacheDir.
+func recoverJournals(r *remote) (*RecoveryReport, error) {
+	report := &RecoveryReport{}
+	paths, err := filepath.Glob(filepath.Join(r.cacheDir, journalPrefix+"*"))
+	if err != nil {
+		return report, err
+	}
+	sort.Strings(paths)
+
+	target := r.accessor.Target()
+	for _, path := range paths {
+		lock, err := tryLockFile(path)
+		if err != nil {
+			return report, err
+		}
+		if lock == nil {
+			// belongs to a MuxFys that is still mounted
+			continue
+		}
+
+		ops, err := readJournal(path)
+		if err != nil {
+			logClose(r.Logger, lock, "journal lock")
+			return report, err
+		}
+
+		var keep []*JournalOp
+		for _, op := range ops {
+			if op.Target != target {
+				report.Skipped = append(report.Skipped, op)
+				keep = append(keep, op)
+				continue
+			}
+
+			var retry bool
+			retry, op.Err = r.replay(op)
+			if op.Err == nil {
+				r.Info("Recovered journaled operation", "op", op.Op, "path", op.Path)
+				report.Completed = append(report.Completed, op)
+				continue
+			}
+			r.Error("Recovery of journaled operation failed", "op", op.Op, "path", op.Path, "err", op.Err)
+			report.Failed = append(report.Failed, op)
+			if retry {
+				keep = append(keep, op)
+			}
+		}
+
+		err = rewriteJournal(path, keep)
+		logClose(r.Logger, lock, "journal lock")
+		if err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// replay carries out a journaled operation. If it fails, also returns true if
+// trying again later might work.
+func (r *remote) replay(op *JournalOp) (bool, error) {
+	switch op.Op {
+	case JournalUpload:
+		if _, err := os.Stat(op.LocalPath); err != nil {
+			return false, err
+		}
+		if op.CheckETag {
+			r.expectETag(op.Path, op.ETag)
+		}
+		if status := r.uploadFile(op.LocalPath, op.Path); status != fuse.OK {
+			return true, fmt.Errorf("upload of %s failed: %s", op.LocalPath, status)
+		}
+		return false, nil
+	case JournalRename:
+		copied := false
+		if op.LocalPath != "" {
+			if _, err := os.Stat(op.LocalPath); err == nil {
+				if status := r.uploadFile(op.LocalPath, op.Path); status != fuse.OK {
+					return true, fmt.Errorf("upload of %s failed: %s", op.LocalPath, status)
+				}
+				copied = true
+			}
+		}
+		if !copied {
+			status := r.copyFile(op.OldPath, op.Path)
+			if status == fuse.ENOENT {
+				// the old path was already deleted, so the rename completed
+				return false, nil
+			}
+			if status != fuse.OK {
+				return true, fmt.Errorf("copy from %s failed: %s", op.OldPath, status)
+			}
+		}
+		if status := r.deleteFile(op.OldPath); status != fuse.OK && status != fuse.ENOENT {
+			return true, fmt.Errorf("delete of %s failed: %s", op.OldPath, status)
+		}
+		return false, nil
+	case JournalDelete:
+		if status := r.deleteFile(op.Path); status != fuse.OK && status != fuse.ENOENT {
+			return true, fmt.Errorf("delete failed: %s", status)
+		}
+		return false, nil
+	}
+	return false, fmt.Errorf("unknown journal operation %q", op.Op)
+}
+
+// journalID identifies a pending operation in a particular remote's journal.
+type journalID struct {
+	journal *journal
+	id      uint64
+}
+
+// recoverAndJournal carries out any operations left undone by previous mounts
+// in the permanent caches of our writeable remotes, reporting on them in
+// fs.recovery, then starts a new journal for each of them.
+func (fs *MuxFys) recoverAndJournal() error {
+	fs.recovery = nil
+	var journaled []*remote
+	targets := make(map[string]bool)
+	for _, r := range fs.writeableRemotes() {
+		if !r.cacheData || r.cacheIsTmp {
+			continue
+		}
+		journaled = append(journaled, r)
+		targets[r.accessor.Target()] = true
+
+		fs.releaseFailedUploads(r.cacheDir)
+		report, err := recoverJournals(r)
+		if err != nil {
+			r.Warn("Journal recovery failed", "err", err)
+		}
+		if fs.recovery == nil {
+			fs.recovery = &RecoveryReport{}
+		}
+		fs.recovery.Completed = append(fs.recovery.Completed, report.Completed...)
+		fs.recovery.Failed = append(fs.recovery.Failed, report.Failed...)
+		fs.recovery.Skipped = append(fs.recovery.Skipped, report.Skipped...)
+	}
+	if fs.recovery != nil {
+		// another of our remotes sharing a CacheDir will have recovered the
+		// operations one of them skipped
+		var skipped []*JournalOp
+		for _, op := range fs.recovery.Skipped {
+			if !targets[op.Target] {
+				skipped = append(skipped, op)
+			}
+		}
+		fs.recovery.Skipped = skipped
+	}
+
+	for _, r := range journaled {
+		var err error
+		r.journal, err = newJournal(r.cacheDir, r.accessor.Target(), r.Logger)
+		if err != nil {
+			fs.closeJournals(true)
+			return err
+		}
+		if fs.journalIDs == nil {
+			fs.journalIDs = make(map[string]journalID)
+		}
+	}
+	return nil
+}
+
+// closeJournals closes the journals of all our writeable remotes, deleting them
+// if discard is true.
+func (fs *MuxFys) closeJournals(discard bool) {
+	for _, r := range fs.writeableRemotes() {
+		r.journal.close(discard)
+		r.journal = nil
+	}
+}
+
+// Recovery returns a report on the operations left over from previous mounts
+// that the most recent Mount() found in the journals in the CacheDirs of the
+// writeable remotes, and tried to carry out. Returns nil if no writeable remote
+// has a CacheDir.
+func (fs *MuxFys) Recovery() *RecoveryReport {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	return fs.recovery
+}
@@ -0,0 +1,200 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of muxfys.
+//
+//  muxfys is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  muxfys is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with muxfys. If not, see <http://www.gnu.org/licenses/>.
+
+package muxfys
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestJournal(t *testing.T) {
+	Convey("Given a remote and a permanent cache dir", t, func() {
+		tmpdir, err := ioutil.TempDir("", "muxfys_journal_testing")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(tmpdir)
+		remoteDir := filepath.Join(tmpdir, "remote")
+		cacheDir := filepath.Join(tmpdir, "cache")
+		for _, dir := range []string{remoteDir, cacheDir} {
+			err = os.MkdirAll(dir, os.FileMode(dirMode))
+			So(err, ShouldBeNil)
+		}
+		rc := &RemoteConfig{
+			Accessor: &localAccessor{target: remoteDir},
+			CacheDir: cacheDir,
+		}
+		journals := func() []string {
+			paths, errg := filepath.Glob(filepath.Join(cacheDir, journalPrefix+"*"))
+			So(errg, ShouldBeNil)
+			return paths
+		}
+
+		Convey("A journal records unfinished operations", func() {
+			j, err := newJournal(cacheDir, remoteDir, pkgLogger)
+			So(err, ShouldBeNil)
+			id1 := j.begin(&JournalOp{Op: JournalUpload, Path: "/a", LocalPath: "/local/a"})
+			id2 := j.begin(&JournalOp{Op: JournalDelete, Path: "/b"})
+			j.finish(id1)
+
+			ops, err := readJournal(j.path)
+			So(err, ShouldBeNil)
+			So(len(ops), ShouldEqual, 1)
+			So(ops[0].Op, ShouldEqual, JournalDelete)
+			So(ops[0].Path, ShouldEqual, "/b")
+			So(ops[0].Target, ShouldEqual, remoteDir)
+
+			Convey("An incomplete final record is ignored", func() {
+				f, err := os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND, 0)
+				So(err, ShouldBeNil)
+				_, err = f.WriteString(`{"id":3,"op":{"op":"upl`)
+				So(err, ShouldBeNil)
+				f.Close()
+
+				ops, err = readJournal(j.path)
+				So(err, ShouldBeNil)
+				So(len(ops), ShouldEqual, 1)
+				j.close(true)
+			})
+
+			Convey("It isn't recovered while open", func() {
+				report, err := RecoverJournals(rc, 0)
+				So(err, ShouldBeNil)
+				So(len(report.Completed), ShouldEqual, 0)
+				So(len(report.Failed), ShouldEqual, 0)
+				So(journals(), ShouldResemble, []string{j.path})
+				j.close(true)
+			})
+
+			Convey("Finishing everything empties it, and closing deletes it", func() {
+				j.finish(id2)
+				info, err := os.Stat(j.path)
+				So(err, ShouldBeNil)
+				So(info.Size(), ShouldEqual, 0)
+				j.close(false)
+				So(len(journals()), ShouldEqual, 0)
+			})
+
+			Convey("Closing keeps it unless discarding", func() {
+				j.close(false)
+				So(journals(), ShouldResemble, []string{j.path})
+
+				j2, err := newJournal(cacheDir, remoteDir, pkgLogger)
+				So(err, ShouldBeNil)
+				j2.begin(&JournalOp{Op: JournalDelete, Path: "/c"})
+				j2.close(true)
+				So(journals(), ShouldResemble, []string{j.path})
+			})
+		})
+
+		Convey("Leftover operations can be recovered", func() {
+			write := func(path, content string) {
+				errw := ioutil.WriteFile(path, []byte(content), os.FileMode(fileMode))
+				So(errw, ShouldBeNil)
+			}
+			local := filepath.Join(cacheDir, "up.file")
+			write(local, "up")
+			write(filepath.Join(remoteDir, "old.file"), "old")
+			write(filepath.Join(remoteDir, "gone.file"), "gone")
+
+			j, err := newJournal(cacheDir, remoteDir, pkgLogger)
+			So(err, ShouldBeNil)
+			j.begin(&JournalOp{Op: JournalUpload, Path: filepath.Join(remoteDir, "up.file"), LocalPath: local})
+			j.begin(&JournalOp{Op: JournalUpload, Path: filepath.Join(remoteDir, "missing.file"), LocalPath: filepath.Join(cacheDir, "missing.file")})
+			j.begin(&JournalOp{Op: JournalRename, Path: filepath.Join(remoteDir, "renamed.file"), OldPath: filepath.Join(remoteDir, "old.file")})
+			j.begin(&JournalOp{Op: JournalRename, Path: filepath.Join(remoteDir, "x.file"), OldPath: filepath.Join(remoteDir, "never.file")})
+			j.begin(&JournalOp{Op: JournalDelete, Path: filepath.Join(remoteDir, "gone.file")})
+			j.close(false)
+
+			other, err := newJournal(cacheDir, "other", pkgLogger)
+			So(err, ShouldBeNil)
+			other.begin(&JournalOp{Op: JournalDelete, Path: "/other"})
+			other.close(false)
+			So(len(journals()), ShouldEqual, 2)
+
+			uploadFail = true
+			report, err := RecoverJournals(rc, 0)
+			uploadFail = false
+			So(err, ShouldBeNil)
+			So(len(report.Completed), ShouldEqual, 3)
+			So(len(report.Failed), ShouldEqual, 2)
+			So(report.Failed[0].Path, ShouldEqual, filepath.Join(remoteDir, "up.file"))
+			So(report.Failed[0].Err, ShouldNotBeNil)
+			So(report.Failed[1].Path, ShouldEqual, filepath.Join(remoteDir, "missing.file"))
+			So(len(report.Skipped), ShouldEqual, 1)
+			So(report.Skipped[0].Target, ShouldEqual, "other")
+
+			content, err := ioutil.ReadFile(filepath.Join(remoteDir, "renamed.file"))
+			So(err, ShouldBeNil)
+			So(string(content), ShouldEqual, "old")
+			_, err = os.Stat(filepath.Join(remoteDir, "old.file"))
+			So(os.IsNotExist(err), ShouldBeTrue)
+			_, err = os.Stat(filepath.Join(remoteDir, "gone.file"))
+			So(os.IsNotExist(err), ShouldBeTrue)
+
+			Convey("Failed operations are tried again next time", func() {
+				report, err = RecoverJournals(rc, 0)
+				So(err, ShouldBeNil)
+				So(len(report.Completed), ShouldEqual, 1)
+				So(len(report.Failed), ShouldEqual, 0)
+				So(len(report.Skipped), ShouldEqual, 1)
+
+				content, err = ioutil.ReadFile(filepath.Join(remoteDir, "up.file"))
+				So(err, ShouldBeNil)
+				So(string(content), ShouldEqual, "up")
+				So(journals(), ShouldResemble, []string{other.path})
+			})
+		})
+
+		Convey("Recovered uploads detect conflicts", func() {
+			local := filepath.Join(cacheDir, "c.file")
+			err = ioutil.WriteFile(local, []byte("ours"), os.FileMode(fileMode))
+			So(err, ShouldBeNil)
+			dest := filepath.Join(remoteDir, "c.file")
+			err = ioutil.WriteFile(dest, []byte("theirs"), os.FileMode(fileMode))
+			So(err, ShouldBeNil)
+
+			j, err := newJournal(cacheDir, remoteDir, pkgLogger)
+			So(err, ShouldBeNil)
+			j.begin(&JournalOp{Op: JournalUpload, Path: dest, LocalPath: local, CheckETag: true})
+			j.close(false)
+
+			report, err := RecoverJournals(&RemoteConfig{
+				Accessor:       &etagAccessor{localAccessor: &localAccessor{target: remoteDir}},
+				CacheDir:       cacheDir,
+				ConflictSuffix: ".conflict",
+			}, 0)
+			So(err, ShouldBeNil)
+			So(len(report.Completed), ShouldEqual, 1)
+			content, err := ioutil.ReadFile(dest)
+			So(err, ShouldBeNil)
+			So(string(content), ShouldEqual, "theirs")
+			content, err = ioutil.ReadFile(dest + ".conflict")
+			So(err, ShouldBeNil)
+			So(string(content), ShouldEqual, "ours")
+		})
+
+		Convey("RecoverJournals() requires a CacheDir", func() {
+			_, err := RecoverJournals(&RemoteConfig{Accessor: rc.Accessor}, 0)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,118 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of muxfys.
+//
+//  muxfys is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  muxfys is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with muxfys. If not, see <http://www.gnu.org/licenses/>.
+
+package muxfys
+
+// This file implements the lock files that coordinate access to cache files
+// amongst mounts and PruneCache(), which may be in different processes.
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileMutex is an exclusive lock on a lock file, taken with flock() in the same
+// way as github.com/alexflint/go-filemutex. Unlike that, Lock() copes with
+// PruneCache() deleting the lock file while we had it open but unlocked: in
+// that case we lock the file that is now at the path instead, so that we never
+// think we have the lock while a mount that opened the path later also does.
+type fileMutex struct {
+	path string
+	f    *os.File
+}
+
+// newFileMutex opens (creating if necessary) the given lock file, returning a
+// fileMutex that you should Lock() and Close().
+func newFileMutex(path string) (*fileMutex, error) {
+	f, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, os.FileMode(fileMode))
+	if err != nil {
+		return nil, err
+	}
+	return &fileMutex{path: path, f: f}, nil
+}
+
+// Lock waits until we have the exclusive lock on the file at our path.
+func (m *fileMutex) Lock() error {
+	_, err := m.lock(syscall.LOCK_EX)
+	return err
+}
+
+// TryLock is like Lock(), but returns false instead of waiting if someone else
+// has the lock.
+func (m *fileMutex) TryLock() (bool, error) {
+	return m.lock(syscall.LOCK_EX | syscall.LOCK_NB)
+}
+
+// lock takes the lock with flock() using the given operation, returning false
+// if it would have had to wait but was told not to.
+func (m *fileMutex) lock(how int) (bool, error) {
+	for {
+		err := syscall.Flock(int(m.f.Fd()), how)
+		if err == syscall.EWOULDBLOCK {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+
+		linked, err := m.linked()
+		if err != nil {
+			_ = m.Unlock()
+			return false, err
+		}
+		if linked {
+			return true, nil
+		}
+
+		// PruneCache() removed the file before we locked it
+		err = m.f.Close()
+		if err != nil {
+			return false, err
+		}
+		m.f, err = os.OpenFile(m.path, os.O_RDONLY|os.O_CREATE, os.FileMode(fileMode))
+		if err != nil {
+			return false, err
+		}
+	}
+}
+
+// linked returns true if the file we have open is still the one at our path.
+func (m *fileMutex) linked() (bool, error) {
+	ours, err := m.f.Stat()
+	if err != nil {
+		return false, err
+	}
+	current, err := os.Stat(m.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return os.SameFile(ours, current), nil
+}
+
+// Unlock releases the lock, but keeps the file open so you can Lock() again.
+func (m *fileMutex) Unlock() error {
+	return syscall.Flock(int(m.f.Fd()), syscall.LOCK_UN)
+}
+
+// Close releases the lock (if held) and closes the file.
+func (m *fileMutex) Close() error {
+	return m.f.Close()
+}
@@ -0,0 +1,397 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of muxfys.
+//
+//  muxfys is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  muxfys is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with muxfys. If not, see <http://www.gnu.org/licenses/>.
+
+package muxfys
+
+// This file implements the expiry and invalidation of our cached directory
+// listings and file attributes.
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+)
+
+// defaultKernelTimeout is how long the kernel caches entries and attributes
+// for when there is no shorter Config.MetadataTTL.
+const defaultKernelTimeout = time.Second
+
+// Invalidate forgets what we have cached about the given path, so that it will
+// be fetched again from the remote(s) the next time it is accessed. path can be
+// absolute (within the mount point) or relative to the mount point. If path is
+// a directory, its listing and the attributes of the files within it are
+// forgotten, and if recursive is true, the same is done for all the
+// directories beneath it that we have listed. Otherwise the listing of the
+// directory containing path is forgotten, which is how you can make a newly
+// added remote file visible. Any data of these files that we have cached in
+// memory or on local disk is also forgotten, so that it will be read afresh.
+// Files that you created or modified in a writeable remote and have not yet
+// been uploaded are not forgotten.
+//
+// If mounted, the kernel is also told to forget the affected entries.
+func (fs *MuxFys) Invalidate(path string, recursive bool) error {
+	name, err := fs.mountRelativePath(path)
+	if err != nil {
+		return err
+	}
+
+	fs.mapMutex.Lock()
+	fs.missing.forget(name)
+	fs.missing.forgetWithin(name)
+	dir := name
+	if _, isDir := fs.dirs[name]; !isDir {
+		dir = parentDir(name)
+		recursive = false
+	}
+	fs.unlistable.forget(dir)
+
+	var dirs []string
+	for cached := range fs.dirContents {
+		if cached == dir || (recursive && isWithinDir(cached, dir)) {
+			dirs = append(dirs, cached)
+		}
+	}
+
+	var entries []entryName
+	if name != dir {
+		entries = append(entries, entryName{dir, filepath.Base(name)})
+		if _, isFile := fs.files[name]; isFile && !fs.createdFiles[name] {
+			fs.forgetCachedData(name, fs.fileToRemote[name])
+		}
+	}
+	for _, cached := range dirs {
+		fs.dirListed[cached] = time.Time{}
+		for _, entry := range fs.dirContents[cached] {
+			entries = append(entries, entryName{cached, entry.Name})
+		}
+		if name == dir {
+			fs.forgetCachedDataIn(cached)
+		}
+	}
+	nodeFs := fs.nodeFs
+	fs.mapMutex.Unlock()
+
+	fs.notifyKernel(nodeFs, entries, dirs)
+	return nil
+}
+
+// entryName is the name of an entry within a directory.
+type entryName struct {
+	dir  string
+	name string
+}
+
+// notifyKernel tells the kernel to forget the given directory entries, and the
+// attributes and data of the given paths. Does nothing if nodeFs is nil (we're
+// not mounted). Must NOT be called while you have the mapMutex Locked, since
+// the kernel may ask us about these entries again before this returns.
+func (fs *MuxFys) notifyKernel(nodeFs *pathfs.PathNodeFs, entries []entryName, paths []string) {
+	if nodeFs == nil {
+		return
+	}
+	for _, entry := range entries {
+		status := nodeFs.EntryNotify(entry.dir, entry.name)
+		if status != fuse.OK && status != fuse.ENOENT {
+			fs.Warn("Kernel entry notify failed", "dir", entry.dir, "name", entry.name, "status", status)
+		}
+	}
+	for _, path := range paths {
+		status := nodeFs.Notify(path)
+		if status != fuse.OK && status != fuse.ENOENT {
+			fs.Warn("Kernel notify failed", "path", path, "status", status)
+		}
+	}
+}
+
+// mountRelativePath converts the given absolute path within our mount point,
+// or path relative to it, to the form of name used by our FileSystem methods.
+func (fs *MuxFys) mountRelativePath(path string) (string, error) {
+	name := path
+	if filepath.IsAbs(path) {
+		var err error
+		name, err = filepath.Rel(fs.mountPoint, path)
+		if err != nil {
+			return "", err
+		}
+	}
+	name = filepath.Clean(name)
+	if name == ".." || strings.HasPrefix(name, "../") {
+		return "", fmt.Errorf("%s is not within the mount point %s", path, fs.mountPoint)
+	}
+	if name == "." {
+		name = ""
+	}
+	return name, nil
+}
+
+// parentDir returns the name of the directory containing name, where "" is the
+// root.
+func parentDir(name string) string {
+	parent := filepath.Dir(name)
+	if parent == "/" || parent == "." {
+		parent = ""
+	}
+	return parent
+}
+
+// isWithinDir returns true if name is beneath the directory dir.
+func isWithinDir(name, dir string) bool {
+	if dir == "" {
+		return name != ""
+	}
+	return strings.HasPrefix(name, dir+"/")
+}
+
+// kernelTimeout returns how long the kernel should cache entries and
+// attributes for, which must not be longer than we cache them for ourselves.
+func (fs *MuxFys) kernelTimeout() time.Duration {
+	if fs.metadataTTL > 0 && fs.metadataTTL < defaultKernelTimeout {
+		return fs.metadataTTL
+	}
+	return defaultKernelTimeout
+}
+
+// listingExpired returns true if we have a listing of the given directory that
+// has been invalidated or is older than our metadataTTL. Must be called while
+// you have the mapMutex Locked.
+func (fs *MuxFys) listingExpired(name string) bool {
+	listed, exists := fs.dirListed[name]
+	if !exists {
+		return false
+	}
+	return listed.IsZero() || (fs.metadataTTL > 0 && time.Since(listed) >= fs.metadataTTL)
+}
+
+// refreshDirIfExpired lists the given directory again if our listing of it has
+// expired. Must be called while you have the mapMutex Locked.
+func (fs *MuxFys) refreshDirIfExpired(name string) {
+	if fs.listingExpired(name) {
+		fs.refreshDir(name)
+	}
+}
+
+// dirListing is the result of listing a directory in a remote.
+type dirListing struct {
+	r       *remote
+	objects []RemoteAttr
+	listed  time.Time
+	status  fuse.Status
+}
+
+// refreshDir replaces our cached listing of the given directory with a new one
+// from its remotes. Entries for things we created ourselves are kept. The
+// cached data of files that have changed or gone is forgotten. If any remote
+// can't be listed, the old listing is kept for now. Must be called while you
+// have the mapMutex Locked.
+func (fs *MuxFys) refreshDir(name string) {
+	remotes := fs.dirs[name]
+	listings := make([]dirListing, 0, len(remotes))
+	for _, r := range remotes {
+		objects, listed, status := r.listDir(dirRemotePath(r, name))
+		if status != fuse.OK && status != fuse.ENOENT {
+			fs.Warn("Directory refresh failed, keeping old listing", "path", name, "status", status)
+			fs.dirListed[name] = time.Now()
+			return
+		}
+		listings = append(listings, dirListing{r: r, objects: objects, listed: listed, status: status})
+	}
+
+	before := fs.cacheStates(name)
+	defer fs.forgetChangedData(before)
+	kept, subdirs := fs.forgetListing(name)
+	fs.dirs[name] = nil
+	for _, l := range listings {
+		fs.cacheDir(l.r, name, l.objects, l.listed, l.status)
+	}
+
+	if len(fs.dirs[name]) == 0 {
+		if fs.createdDirs[name] || fs.mountDirs[name] || name == "" {
+			fs.dirs[name] = remotes
+		} else {
+			// it no longer exists
+			delete(fs.dirs, name)
+			for _, subdir := range subdirs {
+				fs.forgetDir(subdir)
+			}
+			return
+		}
+	}
+	if _, exists := fs.dirContents[name]; !exists {
+		fs.dirContents[name] = []fuse.DirEntry{}
+	}
+	if _, exists := fs.dirListed[name]; !exists {
+		fs.dirListed[name] = time.Now()
+	}
+
+	// restore entries for the things we created that aren't (yet) remote
+	listed := make(map[string]bool, len(fs.dirContents[name]))
+	for _, entry := range fs.dirContents[name] {
+		listed[entry.Name] = true
+	}
+	for _, entry := range kept {
+		if !listed[entry.Name] {
+			fs.dirContents[name] = append(fs.dirContents[name], entry)
+		}
+	}
+
+	for _, subdir := range subdirs {
+		if _, exists := fs.dirs[subdir]; !exists {
+			fs.forgetDir(subdir)
+		}
+	}
+}
+
+// forgetListing forgets our listing of the given directory, and the attributes
+// of the files within it. It returns the entries that were kept because we
+// created them, and the paths of the subdirectories that were forgotten. Must
+// be called while you have the mapMutex Locked.
+func (fs *MuxFys) forgetListing(name string) ([]fuse.DirEntry, []string) {
+	var kept []fuse.DirEntry
+	var subdirs []string
+	fs.forgetWhiteouts(name)
+	for _, entry := range fs.dirContents[name] {
+		thisPath := filepath.Join(name, entry.Name)
+		switch {
+		case fs.createdFiles[thisPath] || fs.createdDirs[thisPath] || fs.mountDirs[thisPath] || entry.Mode == uint32(fuse.S_IFLNK):
+			kept = append(kept, entry)
+		case entry.Mode == uint32(fuse.S_IFDIR):
+			delete(fs.dirs, thisPath)
+			subdirs = append(subdirs, thisPath)
+		default:
+			delete(fs.files, thisPath)
+			delete(fs.fileToRemote, thisPath)
+			delete(fs.shadows, thisPath)
+			delete(fs.overlaid, thisPath)
+		}
+	}
+	delete(fs.dirContents, name)
+	delete(fs.dirListed, name)
+	return kept, subdirs
+}
+
+// forgetDir forgets everything we know about the given directory that no longer
+// exists, and everything beneath it. Must be called while you have the mapMutex
+// Locked.
+func (fs *MuxFys) forgetDir(name string) {
+	fs.forgetCachedDataIn(name)
+	_, subdirs := fs.forgetListing(name)
+	delete(fs.dirs, name)
+	for _, subdir := range subdirs {
+		fs.forgetDir(subdir)
+	}
+}
+
+// cacheState is what we knew about a file whose data we may have cached.
+type cacheState struct {
+	r         *remote
+	size      uint64
+	mtime     uint64
+	mtimensec uint32
+}
+
+// cacheStates returns the state of each file in our listing of the given
+// directory that we might have cached the data of, ie. those we didn't create.
+// Must be called while you have the mapMutex Locked.
+func (fs *MuxFys) cacheStates(name string) map[string]cacheState {
+	states := make(map[string]cacheState)
+	for _, entry := range fs.dirContents[name] {
+		thisPath := filepath.Join(name, entry.Name)
+		attr, isFile := fs.files[thisPath]
+		if !isFile || fs.createdFiles[thisPath] {
+			continue
+		}
+		states[thisPath] = cacheState{r: fs.fileToRemote[thisPath], size: attr.Size, mtime: attr.Mtime, mtimensec: attr.Mtimensec}
+	}
+	return states
+}
+
+// forgetChangedData forgets the cached data of the files in the given states
+// that have since changed or gone. Must be called while you have the mapMutex
+// Locked.
+func (fs *MuxFys) forgetChangedData(before map[string]cacheState) {
+	for path, old := range before {
+		attr, exists := fs.files[path]
+		if exists && fs.fileToRemote[path] == old.r && attr.Size == old.size && attr.Mtime == old.mtime && attr.Mtimensec == old.mtimensec {
+			continue
+		}
+		fs.forgetCachedData(path, old.r)
+	}
+}
+
+// forgetCachedDataIn forgets the cached data of all the files in our listing
+// of the given directory that we didn't create. Must be called while you have
+// the mapMutex Locked.
+func (fs *MuxFys) forgetCachedDataIn(name string) {
+	for path, state := range fs.cacheStates(name) {
+		fs.forgetCachedData(path, state.r)
+	}
+}
+
+// forgetCachedData forgets any data of the given file in the given remote that
+// we hold in memory or on local disk, so that it will be read afresh. Must be
+// called while you have the mapMutex Locked, so we can't wait for the file's
+// mutex: if someone else has it, the local copy is instead deleted by the next
+// openCached().
+func (fs *MuxFys) forgetCachedData(name string, r *remote) {
+	if r == nil {
+		return
+	}
+	remotePath := r.getRemotePath(name)
+	r.memCache.evict(r.memKey(remotePath), 0)
+	if !r.cacheData {
+		return
+	}
+
+	localPath := r.getLocalPath(remotePath)
+	r.CacheDelete(localPath)
+	if _, err := os.Stat(localPath); err != nil {
+		return
+	}
+	fmutex, err := fs.getFileMutex(localPath)
+	if err != nil {
+		fs.staleCaches[localPath] = true
+		return
+	}
+	defer logClose(fs.Logger, fmutex, "stale cache file mutex", "path", localPath)
+	locked, err := fmutex.TryLock()
+	if err != nil || !locked {
+		fs.staleCaches[localPath] = true
+		return
+	}
+	err = os.Remove(localPath)
+	if err != nil && !os.IsNotExist(err) {
+		r.Warn("Could not delete stale cache file", "path", localPath, "err", err)
+		fs.staleCaches[localPath] = true
+	}
+}
+
+// takeStaleCache returns true if forgetCachedData() wasn't able to delete the
+// given local copy of a file, and forgets that it wasn't. You should then delete
+// it yourself, while holding its file mutex.
+func (fs *MuxFys) takeStaleCache(localPath string) bool {
+	fs.mapMutex.Lock()
+	defer fs.mapMutex.Unlock()
+	stale := fs.staleCaches[localPath]
+	delete(fs.staleCaches, localPath)
+	return stale
+}
@@ -0,0 +1,245 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of muxfys.
+//
+//  muxfys is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  muxfys is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with muxfys. If not, see <http://www.gnu.org/licenses/>.
+
+package muxfys
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMetadataExpiry(t *testing.T) {
+	Convey("Given a mounted remote with a file and a subdirectory", t, func() {
+		tmpdir, err := ioutil.TempDir("", "muxfys_metadata_testing")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(tmpdir)
+		remoteDir := filepath.Join(tmpdir, "remote")
+		err = os.MkdirAll(filepath.Join(remoteDir, "sub"), os.FileMode(dirMode))
+		So(err, ShouldBeNil)
+
+		write := func(name, content string) {
+			errw := ioutil.WriteFile(filepath.Join(remoteDir, name), []byte(content), os.FileMode(fileMode))
+			So(errw, ShouldBeNil)
+		}
+		write("a", "a")
+		write("sub/b", "b")
+
+		mount := filepath.Join(tmpdir, "mnt")
+		setup := func(ttl time.Duration) *MuxFys {
+			fs, errn := New(&Config{Mount: mount, CacheBase: tmpdir, MetadataTTL: ttl})
+			So(errn, ShouldBeNil)
+			r, errn := newRemote(&RemoteConfig{Accessor: &localAccessor{target: remoteDir}}, remoteOptions{cacheBase: tmpdir, logger: fs.Logger})
+			So(errn, ShouldBeNil)
+			fs.remotes = []*remote{r}
+			fs.OnMount(nil)
+			return fs
+		}
+		ls := func(fs *MuxFys, dir string) []string {
+			entries, status := fs.OpenDir(dir, &fuse.Context{})
+			So(status, ShouldEqual, fuse.OK)
+			var names []string
+			for _, entry := range entries {
+				names = append(names, entry.Name)
+			}
+			sort.Strings(names)
+			return names
+		}
+		size := func(fs *MuxFys, name string) uint64 {
+			attr, status := fs.GetAttr(name, &fuse.Context{})
+			if status != fuse.OK {
+				return 0
+			}
+			return attr.Size
+		}
+
+		Convey("Without a MetadataTTL, listings are kept until invalidated", func() {
+			fs := setup(0)
+			So(fs.kernelTimeout(), ShouldEqual, time.Second)
+			So(ls(fs, ""), ShouldResemble, []string{"a", "sub"})
+			So(ls(fs, "sub"), ShouldResemble, []string{"b"})
+
+			write("c", "c")
+			write("a", "aaa")
+			write("sub/d", "d")
+			So(ls(fs, ""), ShouldResemble, []string{"a", "sub"})
+			So(size(fs, "a"), ShouldEqual, 1)
+			_, status := fs.GetAttr("c", &fuse.Context{})
+			So(status, ShouldEqual, fuse.ENOENT)
+
+			Convey("Invalidating a new file makes it visible", func() {
+				err = fs.Invalidate("c", false)
+				So(err, ShouldBeNil)
+				So(size(fs, "c"), ShouldEqual, 1)
+				So(size(fs, "a"), ShouldEqual, 3)
+				So(ls(fs, "sub"), ShouldResemble, []string{"b"})
+			})
+
+			Convey("Invalidating a dir by absolute path refreshes it", func() {
+				err = fs.Invalidate(mount, false)
+				So(err, ShouldBeNil)
+				So(ls(fs, ""), ShouldResemble, []string{"a", "c", "sub"})
+				So(ls(fs, "sub"), ShouldResemble, []string{"b"})
+			})
+
+			Convey("Invalidating recursively refreshes subdirectories", func() {
+				err = os.Remove(filepath.Join(remoteDir, "a"))
+				So(err, ShouldBeNil)
+				err = fs.Invalidate("", true)
+				So(err, ShouldBeNil)
+				So(ls(fs, ""), ShouldResemble, []string{"c", "sub"})
+				So(ls(fs, "sub"), ShouldResemble, []string{"b", "d"})
+				_, status = fs.GetAttr("a", &fuse.Context{})
+				So(status, ShouldEqual, fuse.ENOENT)
+			})
+
+			Convey("Deleted subdirectories are forgotten", func() {
+				err = os.RemoveAll(filepath.Join(remoteDir, "sub"))
+				So(err, ShouldBeNil)
+				err = fs.Invalidate("", false)
+				So(err, ShouldBeNil)
+				So(ls(fs, ""), ShouldResemble, []string{"a", "c"})
+				_, status = fs.OpenDir("sub", &fuse.Context{})
+				So(status, ShouldEqual, fuse.ENOENT)
+				_, status = fs.GetAttr("sub/b", &fuse.Context{})
+				So(status, ShouldEqual, fuse.ENOENT)
+			})
+
+			Convey("Paths outside the mount point can't be invalidated", func() {
+				err = fs.Invalidate(tmpdir, false)
+				So(err, ShouldNotBeNil)
+				err = fs.Invalidate("../foo", false)
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("With a MetadataTTL, listings are refreshed once they expire", func() {
+			ttl := 100 * time.Millisecond
+			fs := setup(ttl)
+			So(fs.kernelTimeout(), ShouldEqual, ttl)
+			So(ls(fs, ""), ShouldResemble, []string{"a", "sub"})
+
+			write("c", "c")
+			So(ls(fs, ""), ShouldResemble, []string{"a", "sub"})
+			<-time.After(ttl)
+			So(ls(fs, ""), ShouldResemble, []string{"a", "c", "sub"})
+			So(size(fs, "c"), ShouldEqual, 1)
+		})
+
+		Convey("Cached data of files rewritten with the same size is forgotten", func() {
+			read := func(fs *MuxFys, name string) string {
+				f, status := fs.Open(name, uint32(os.O_RDONLY), &fuse.Context{})
+				So(status, ShouldEqual, fuse.OK)
+				defer f.Release()
+				buf := make([]byte, 10)
+				rr, status := f.Read(buf, 0)
+				So(status, ShouldEqual, fuse.OK)
+				content, status := rr.Bytes(buf)
+				So(status, ShouldEqual, fuse.OK)
+				return string(content)
+			}
+			cacheDir := filepath.Join(tmpdir, "cache")
+			setupCached := func(ttl time.Duration, rc *RemoteConfig) *MuxFys {
+				fs, errn := New(&Config{Mount: mount, CacheBase: tmpdir, MetadataTTL: ttl, MemoryCacheSize: 1048576})
+				So(errn, ShouldBeNil)
+				rc.Accessor = &localAccessor{target: remoteDir}
+				r, errn := newRemote(rc, remoteOptions{cacheBase: tmpdir, memCache: fs.memCache, logger: fs.Logger})
+				So(errn, ShouldBeNil)
+				fs.remotes = []*remote{r}
+				fs.OnMount(nil)
+				So(read(fs, "a"), ShouldEqual, "a")
+				write("a", "b")
+				So(read(fs, "a"), ShouldEqual, "a")
+				return fs
+			}
+
+			Convey("When the file is invalidated", func() {
+				for _, rc := range []*RemoteConfig{{CacheDir: cacheDir}, {CacheData: true}, {}} {
+					write("a", "a")
+					fs := setupCached(0, rc)
+					err = fs.Invalidate("a", false)
+					So(err, ShouldBeNil)
+					So(read(fs, "a"), ShouldEqual, "b")
+				}
+			})
+
+			Convey("When its directory is invalidated", func() {
+				fs := setupCached(0, &RemoteConfig{CacheDir: cacheDir})
+				err = fs.Invalidate("", false)
+				So(err, ShouldBeNil)
+				So(read(fs, "a"), ShouldEqual, "b")
+			})
+
+			Convey("When a refreshed listing shows its mtime changed", func() {
+				ttl := 100 * time.Millisecond
+				fs := setupCached(ttl, &RemoteConfig{CacheDir: cacheDir})
+				later := time.Now().Add(time.Hour)
+				err = os.Chtimes(filepath.Join(remoteDir, "a"), later, later)
+				So(err, ShouldBeNil)
+				<-time.After(ttl)
+				So(size(fs, "a"), ShouldEqual, 1)
+				So(read(fs, "a"), ShouldEqual, "b")
+				r := fs.remotes[0]
+				content, errr := ioutil.ReadFile(r.getLocalPath(r.getRemotePath("a")))
+				So(errr, ShouldBeNil)
+				So(string(content), ShouldEqual, "b")
+			})
+		})
+	})
+
+	Convey("Refreshing a writeable remote's listing keeps created files", t, func() {
+		tmpdir, err := ioutil.TempDir("", "muxfys_metadata_testing")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(tmpdir)
+		remoteDir := filepath.Join(tmpdir, "remote")
+		err = os.MkdirAll(remoteDir, os.FileMode(dirMode))
+		So(err, ShouldBeNil)
+
+		fs, err := New(&Config{Mount: filepath.Join(tmpdir, "mnt"), CacheBase: tmpdir})
+		So(err, ShouldBeNil)
+		r, err := newRemote(&RemoteConfig{Accessor: &localAccessor{target: remoteDir}, CacheData: true, Write: true}, remoteOptions{cacheBase: tmpdir, logger: fs.Logger})
+		So(err, ShouldBeNil)
+		defer r.deleteCache()
+		fs.remotes = []*remote{r}
+		fs.writeRemote = r
+		fs.OnMount(nil)
+
+		f, status := fs.create("new", uint32(os.O_RDWR|os.O_TRUNC), uint32(fileMode))
+		So(status, ShouldEqual, fuse.OK)
+		f.Release()
+		attr, status := fs.GetAttr("new", &fuse.Context{})
+		So(status, ShouldEqual, fuse.OK)
+
+		err = fs.Invalidate("", false)
+		So(err, ShouldBeNil)
+		entries, status := fs.OpenDir("", &fuse.Context{})
+		So(status, ShouldEqual, fuse.OK)
+		So(len(entries), ShouldEqual, 1)
+		So(entries[0].Name, ShouldEqual, "new")
+		attr2, status := fs.GetAttr("new", &fuse.Context{})
+		So(status, ShouldEqual, fuse.OK)
+		So(attr2 == attr, ShouldBeTrue)
+		So(fs.dirs[""], ShouldResemble, []*remote{r})
+	})
+}
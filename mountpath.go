@@ -0,0 +1,126 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of muxfys.
+//
+//  muxfys is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  muxfys is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with muxfys. If not, see <http://www.gnu.org/licenses/>.
+
+package muxfys
+
+// This file implements mounting remotes beneath sub-paths of the mount point.
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// cleanMountPath checks and normalises a RemoteConfig.MountPath, returning it
+// without leading or trailing slashes.
+func cleanMountPath(mountPath string) (string, error) {
+	cleaned := strings.Trim(filepath.Clean("/"+mountPath), "/")
+	for _, part := range strings.Split(mountPath, "/") {
+		if part == ".." {
+			return "", fmt.Errorf("MountPath %q may not contain ..", mountPath)
+		}
+	}
+	return cleaned, nil
+}
+
+// within returns true if the given path relative to the mount point is our
+// mountPath or is beneath it.
+func (r *remote) within(name string) bool {
+	return r.mountPath == "" || name == r.mountPath || isWithinDir(name, r.mountPath)
+}
+
+// relPath converts the given path relative to the mount point to a path
+// relative to the root of our remote, which is mounted at our mountPath. name
+// must be within() our mountPath.
+func (r *remote) relPath(name string) string {
+	if r.mountPath == "" || !r.within(name) {
+		return name
+	}
+	return strings.TrimPrefix(strings.TrimPrefix(name, r.mountPath), "/")
+}
+
+// allows returns true if the given path relative to the mount point is within()
+// our mountPath and is not hidden by our Include and Exclude filters.
+func (r *remote) allows(name string, isDir bool) bool {
+	return r.within(name) && r.filter.allows(r.relPath(name), isDir)
+}
+
+// addMountPaths notes which of our remotes are mounted in which directories,
+// creating the parent directories of any remotes that have a mountPath. Those
+// directories are also associated with any remotes mounted above them, since
+// they might have real directories of the same name. Must be called while you
+// have the mapMutex Locked.
+func (fs *MuxFys) addMountPaths() {
+	fs.mountDirs = make(map[string]bool)
+	fs.dirs[""] = []*remote{}
+	for _, r := range fs.remotes {
+		for dir := r.mountPath; dir != ""; dir = parentDir(dir) {
+			fs.mountDirs[dir] = true
+			if _, exists := fs.dirs[dir]; !exists {
+				fs.dirs[dir] = []*remote{}
+			}
+		}
+	}
+	for _, r := range fs.remotes {
+		if r.mountPath == "" {
+			fs.addDirRemote("", r)
+		}
+		for dir := range fs.mountDirs {
+			if r.within(dir) {
+				fs.addDirRemote(dir, r)
+			}
+		}
+	}
+}
+
+// openMountDir gives the given directory contents consisting of just its
+// mount entries (see addMountEntries()) if it is the root or a parent of a
+// mountPath, and none of its remotes had it. Must be called while you have the
+// mapMutex Locked.
+func (fs *MuxFys) openMountDir(name string) {
+	if _, cached := fs.dirContents[name]; cached || (name != "" && !fs.mountDirs[name]) {
+		return
+	}
+	fs.dirContents[name] = []fuse.DirEntry{}
+	fs.addMountEntries(name)
+}
+
+// addMountEntries adds entries to the contents of the given directory for any
+// of its subdirectories that are, or lead to, the mountPath of a remote, if
+// they're not already there. Must be called while you have the mapMutex
+// Locked.
+func (fs *MuxFys) addMountEntries(name string) {
+	for dir := range fs.mountDirs {
+		if parentDir(dir) != name {
+			continue
+		}
+		entry := fuse.DirEntry{Name: filepath.Base(dir), Mode: uint32(fuse.S_IFDIR)}
+		present := false
+		for _, existing := range fs.dirContents[name] {
+			if existing.Name == entry.Name {
+				present = true
+				break
+			}
+		}
+		if !present {
+			fs.dirContents[name] = append(fs.dirContents[name], entry)
+		}
+	}
+}
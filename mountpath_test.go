@@ -0,0 +1,132 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of muxfys.
+//
+//  muxfys is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  muxfys is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with muxfys. If not, see <http://www.gnu.org/licenses/>.
+
+package muxfys
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMountPath(t *testing.T) {
+	Convey("MountPaths are cleaned and checked", t, func() {
+		for path, expected := range map[string]string{"": "", "/": "", "/a/b/": "a/b", "a//b": "a/b", "./a": "a"} {
+			cleaned, err := cleanMountPath(path)
+			So(err, ShouldBeNil)
+			So(cleaned, ShouldEqual, expected)
+		}
+		_, err := cleanMountPath("a/../b")
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Given remotes with different MountPaths", t, func() {
+		tmpdir, err := ioutil.TempDir("", "muxfys_mountpath_testing")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(tmpdir)
+		makeRemote := func(name string, files ...string) string {
+			dir := filepath.Join(tmpdir, name)
+			for _, file := range files {
+				errm := os.MkdirAll(filepath.Dir(filepath.Join(dir, file)), os.FileMode(dirMode))
+				So(errm, ShouldBeNil)
+				errm = ioutil.WriteFile(filepath.Join(dir, file), []byte(file), os.FileMode(fileMode))
+				So(errm, ShouldBeNil)
+			}
+			return dir
+		}
+
+		fs, err := New(&Config{Mount: filepath.Join(tmpdir, "mnt"), CacheBase: tmpdir})
+		So(err, ShouldBeNil)
+		addRemote := func(dir, mountPath string, write bool) *remote {
+			r, errn := newRemote(&RemoteConfig{Accessor: &localAccessor{target: dir}, CacheData: true, Write: write, MountPath: mountPath}, remoteOptions{cacheBase: tmpdir, logger: fs.Logger})
+			So(errn, ShouldBeNil)
+			fs.remotes = append(fs.remotes, r)
+			if write {
+				fs.writeRemote = r
+			}
+			return r
+		}
+
+		ls := func(dir string) []string {
+			entries, status := fs.OpenDir(dir, &fuse.Context{})
+			So(status, ShouldEqual, fuse.OK)
+			var names []string
+			for _, entry := range entries {
+				names = append(names, entry.Name)
+			}
+			sort.Strings(names)
+			return names
+		}
+
+		Convey("Each appears beneath its own synthetic directory", func() {
+			addRemote(makeRemote("public", "hg38/ref.fa"), "refs", false)
+			addRemote(makeRemote("input", "sample.cram"), "data/in", false)
+			w := addRemote(makeRemote("output"), "data/out", true)
+			fs.OnMount(nil)
+
+			So(ls(""), ShouldResemble, []string{"data", "refs"})
+			So(ls("data"), ShouldResemble, []string{"in", "out"})
+			So(ls("refs"), ShouldResemble, []string{"hg38"})
+			So(ls("refs/hg38"), ShouldResemble, []string{"ref.fa"})
+			So(ls("data/in"), ShouldResemble, []string{"sample.cram"})
+			So(ls("data/out"), ShouldBeEmpty)
+			attr, status := fs.GetAttr("refs/hg38/ref.fa", &fuse.Context{})
+			So(status, ShouldEqual, fuse.OK)
+			So(attr.Size, ShouldEqual, 11)
+			_, status = fs.GetAttr("ref.fa", &fuse.Context{})
+			So(status, ShouldEqual, fuse.ENOENT)
+
+			So(w.getRemotePath("data/out/result.txt"), ShouldEqual, filepath.Join(tmpdir, "output", "result.txt"))
+
+			Convey("Only the writeable remote's directory can be written to", func() {
+				_, status = fs.Create("data/out/result.txt", uint32(os.O_WRONLY), uint32(fileMode), &fuse.Context{})
+				So(status, ShouldEqual, fuse.OK)
+				So(ls("data/out"), ShouldResemble, []string{"result.txt"})
+				_, status = fs.Create("data/result.txt", uint32(os.O_WRONLY), uint32(fileMode), &fuse.Context{})
+				So(status, ShouldEqual, fuse.EPERM)
+				So(fs.Mkdir("refs/new", uint32(dirMode), &fuse.Context{}), ShouldEqual, fuse.EPERM)
+				So(fs.Rmdir("data/out", &fuse.Context{}), ShouldEqual, fuse.EPERM)
+			})
+
+			Convey("Synthetic directories survive being refreshed", func() {
+				err = fs.Invalidate("", true)
+				So(err, ShouldBeNil)
+				So(ls(""), ShouldResemble, []string{"data", "refs"})
+				So(ls("data"), ShouldResemble, []string{"in", "out"})
+				So(ls("refs/hg38"), ShouldResemble, []string{"ref.fa"})
+			})
+		})
+
+		Convey("They can be mounted within a remote at the root", func() {
+			addRemote(makeRemote("root", "refs/local.fa", "top.txt"), "", false)
+			addRemote(makeRemote("public", "hg38/ref.fa"), "refs", false)
+			addRemote(makeRemote("input", "sample.cram"), "data/in", false)
+			fs.OnMount(nil)
+
+			So(ls("refs"), ShouldResemble, []string{"hg38", "local.fa"})
+			So(ls(""), ShouldResemble, []string{"data", "refs", "top.txt"})
+			So(ls("data"), ShouldResemble, []string{"in"})
+			So(ls("data/in"), ShouldResemble, []string{"sample.cram"})
+		})
+	})
+}
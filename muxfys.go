@@ -181,6 +181,94 @@ type Config struct {
 	// Verbose results in every remote request getting an entry in the output of
 	// Logs(). Errors always appear there.
 	Verbose bool
+
+	// MemoryCacheSize is the maximum number of bytes of file data that will be
+	// held in an in-memory block cache shared by all remotes. Reads are then
+	// satisfied from memory where possible, before falling back to the on-disk
+	// cache (for remotes with CacheData) or the remote itself. The default of
+	// 0 disables the in-memory cache. See CacheStats() for how effective it is.
+	MemoryCacheSize int64
+
+	// ReadAheadMemory is the maximum number of bytes of prefetched file data
+	// that will be held in memory at once by all the remotes you Mount() that
+	// have RemoteConfig.ReadAhead set. Prefetching beyond this only happens
+	// for data that has actually been asked for. Defaults to 256MB.
+	ReadAheadMemory int64
+
+	// WriteStageMemory is the maximum number of bytes of parts (see
+	// RemoteConfig.WritePartSize) that will be held in memory at once by all
+	// the files being written without CacheData to the remotes you Mount();
+	// beyond this, parts are held in temporary files in CacheBase instead.
+	// Defaults to 256MB.
+	WriteStageMemory int64
+
+	// WriteBackDelay, if greater than 0, makes files you create or modify in
+	// a writeable remote with CacheData get uploaded in the background once
+	// they have been closed and left unmodified for this long, instead of only
+	// being uploaded when you Unmount(). Unmount() will then only have to
+	// upload whatever is still waiting. Files are not opened for writing while
+	// they are being uploaded.
+	WriteBackDelay time.Duration
+
+	// UploadWorkers is the maximum number of files that will be uploaded at
+	// once, both in the background when WriteBackDelay is set, and at
+	// Unmount(). Defaults to 4. At Unmount(), files are uploaded in the order
+	// they were last modified, in batches of this many, and a batch is only
+	// started once the batch of older files has completed, so that files still
+	// get uploaded in close to the order they were last modified. Set to 1 to
+	// upload one file at a time, in exactly that order.
+	UploadWorkers int
+
+	// UploadHook, if set, is called with an UploadEvent when each upload to a
+	// writeable remote starts, periodically as it progresses, and when it
+	// completes or fails. This covers uploads of files cached on local disk
+	// (including those done at Unmount()) as well as uploads of files being
+	// written without CacheData. Per-byte progress for cached files is only
+	// reported if the remote's Accessor implements ProgressUploader (as
+	// S3Accessor does). The hook is called synchronously from the uploading
+	// goroutine, potentially for several uploads at once, so it should
+	// return quickly.
+	UploadHook func(UploadEvent)
+
+	// MetadataTTL, if greater than 0, is how long directory listings and the
+	// attributes of the files within them are cached for. Once expired, they
+	// are fetched again from the remote the next time they are needed, so that
+	// files added, changed or deleted by others become visible. The kernel is
+	// told not to cache entries and attributes for longer than this either.
+	// The default of 0 means they are cached until Unmount(), though you can
+	// force them to be refreshed at any time with Invalidate().
+	MetadataTTL time.Duration
+
+	// WatchInterval, if greater than 0, is how often the directories you
+	// Watch() are listed again while mounted, to notice and report on changes
+	// made remotely by others.
+	WatchInterval time.Duration
+
+	// NegativeCacheTTL, if greater than 0, is how long we remember that a path
+	// did not exist, so that repeatedly looking for it (as tools often do for
+	// optional index or config files) doesn't keep asking the remotes. We also
+	// remember directories that could not be listed for this long. Creating
+	// the path through the mount, or it being seen in a new directory listing
+	// (see MetadataTTL and Invalidate()), makes us forget it early.
+	NegativeCacheTTL time.Duration
+
+	// NegativeCacheSize is the maximum number of paths remembered because of
+	// NegativeCacheTTL, beyond which the oldest are forgotten. Defaults to
+	// 10000.
+	NegativeCacheSize int
+
+	// Precedence decides whose copy of a file you see when multiple remotes
+	// have a file with the same path: the default of PrecedenceFirst means the
+	// first of the RemoteConfigs supplied to Mount() that has the file,
+	// PrecedenceLast means the last. A writeable remote's copy is always
+	// seen in preference to a read-only remote's.
+	Precedence Precedence
+
+	// ShowShadowed makes the copies of files that are hidden by Precedence
+	// appear alongside the visible one, read-only, with names like
+	// "name@target", where target is the Target() of the remote the copy is
+	// in, with slashes converted to underscores.
+	ShowShadowed bool
 }
 
 // MuxFys struct is the main filey system object.
@@ -197,7 +285,24 @@ type MuxFys struct {
 	files           map[string]*fuse.Attr
 	fileToRemote    map[string]*remote
 	createdFiles    map[string]bool
+	localOnlyFiles  map[string]bool
 	createdDirs     map[string]bool
+	mountDirs       map[string]bool
+	shadows         map[string]string
+	whiteouts       map[string]*remote
+	overlaid        map[string]bool
+	precedence      Precedence
+	showShadowed    bool
+	dirListed       map[string]time.Time
+	staleCaches     map[string]bool
+	metadataTTL     time.Duration
+	nodeFs          *pathfs.PathNodeFs
+	watchInterval   time.Duration
+	watches         map[string]bool
+	watcher         *watcher
+	changes         chan ChangeEvent
+	missing         *negativeCache
+	unlistable      *negativeCache
 	mounted         bool
 	handlingSignals bool
 	deathSignals    chan os.Signal
@@ -205,6 +310,19 @@ type MuxFys struct {
 	remotes         []*remote
 	writeRemote     *remote
 	maxAttempts     int
+	memCache        *blockCache
+	aheadBudget     readAheadBudget
+	stageBudget     writeStageBudget
+	writeBackDelay  time.Duration
+	uploadWorkers   int
+	uploadHook      func(UploadEvent)
+	uploader        *uploader
+	openHandles     map[*openHandle]bool
+	journalIDs      map[string]journalID
+	recovery        *RecoveryReport
+	uploadResults   *UploadResults
+	earlyUploads    []*UploadResult
+	failedUploads   []*failedUploads
 	logStore        *l15h.Store
 	log15.Logger
 }
@@ -263,18 +381,39 @@ func New(config *Config) (*MuxFys, error) {
 
 	// initialize ourselves
 	fs := &MuxFys{
-		FileSystem:   pathfs.NewDefaultFileSystem(),
-		mountPoint:   mountPoint,
-		cacheBase:    cacheBase,
-		dirs:         make(map[string][]*remote),
-		dirContents:  make(map[string][]fuse.DirEntry),
-		files:        make(map[string]*fuse.Attr),
-		fileToRemote: make(map[string]*remote),
-		createdFiles: make(map[string]bool),
-		createdDirs:  make(map[string]bool),
-		maxAttempts:  config.Retries + 1,
-		logStore:     store,
-		Logger:       logger,
+		FileSystem:     pathfs.NewDefaultFileSystem(),
+		mountPoint:     mountPoint,
+		cacheBase:      cacheBase,
+		dirs:           make(map[string][]*remote),
+		dirContents:    make(map[string][]fuse.DirEntry),
+		files:          make(map[string]*fuse.Attr),
+		fileToRemote:   make(map[string]*remote),
+		createdFiles:   make(map[string]bool),
+		localOnlyFiles: make(map[string]bool),
+		openHandles:    make(map[*openHandle]bool),
+		createdDirs:    make(map[string]bool),
+		shadows:        make(map[string]string),
+		whiteouts:      make(map[string]*remote),
+		overlaid:       make(map[string]bool),
+		staleCaches:    make(map[string]bool),
+		precedence:     config.Precedence,
+		showShadowed:   config.ShowShadowed,
+		dirListed:      make(map[string]time.Time),
+		metadataTTL:    config.MetadataTTL,
+		watchInterval:  config.WatchInterval,
+		watches:        make(map[string]bool),
+		changes:        make(chan ChangeEvent, changeBufferSize),
+		missing:        newNegativeCache(config.NegativeCacheTTL, config.NegativeCacheSize),
+		unlistable:     newNegativeCache(config.NegativeCacheTTL, config.NegativeCacheSize),
+		maxAttempts:    config.Retries + 1,
+		memCache:       newBlockCache(config.MemoryCacheSize),
+		aheadBudget:    newReadAheadBudget(config.ReadAheadMemory),
+		stageBudget:    newWriteStageBudget(config.WriteStageMemory),
+		writeBackDelay: config.WriteBackDelay,
+		uploadWorkers:  config.UploadWorkers,
+		uploadHook:     config.UploadHook,
+		logStore:       store,
+		Logger:         logger,
 	}
 
 	// we'll always use the same attributes for our directories
@@ -300,8 +439,19 @@ func New(config *Config) (*MuxFys, error) {
 // your mount point will show the combined contents of all your remote systems.
 // If multiple remotes have a directory with the same name, that directory's
 // contents will in in turn show the contents of all those directories. If
-// multiple remotes have a file with the same name in the same directory, reads
-// will come from the first remote you configured that has that file.
+// multiple remotes have a file with the same name in the same directory, it is
+// only listed once, and reads will come from the first remote you configured
+// that has that file (see Config.Precedence and Config.ShowShadowed). Remotes
+// with a MountPath are multiplexed in the same way, but only beneath that
+// directory.
+//
+// Only one of the remotes can be writeable, unless you give the others
+// WriteRules to decide which new files are created in them (see
+// RemoteConfig.WriteRules).
+//
+// If a writeable remote has a CacheDir that was previously used by a mount
+// that did not cleanly Unmount(), any uploads, renames and deletes it left
+// unfinished are first carried out; see Recovery() for how that went.
 func (fs *MuxFys) Mount(rcs ...*RemoteConfig) error {
 	if len(rcs) == 0 {
 		return fmt.Errorf("At least one RemoteConfig must be supplied")
@@ -313,31 +463,86 @@ func (fs *MuxFys) Mount(rcs ...*RemoteConfig) error {
 		return fmt.Errorf("Can't mount more that once at a time")
 	}
 
+	// abandon undoes what we do below if we then fail to mount, so that we can
+	// be mounted again
+	abandon := func() {
+		fs.closeJournals(true)
+		fs.uploader.stop()
+		fs.uploader = nil
+		for _, r := range fs.remotes {
+			if r.cacheIsTmp {
+				errd := r.deleteCache()
+				if errd != nil {
+					r.Warn("Mount failure cache deletion failed", "err", errd)
+				}
+			}
+		}
+		fs.remotes = nil
+		fs.writeRemote = nil
+		fs.journalIDs = nil
+	}
+
 	// create a remote for every RemoteConfig
+	ropts := remoteOptions{
+		cacheBase:   fs.cacheBase,
+		maxAttempts: fs.maxAttempts,
+		memCache:    fs.memCache,
+		aheadBudget: fs.aheadBudget,
+		stageBudget: fs.stageBudget,
+		uploadHook:  fs.uploadHook,
+		logger:      fs.Logger,
+	}
 	for _, c := range rcs {
-		r, err := newRemote(c.Accessor, c.CacheData, c.CacheDir, fs.cacheBase, c.Write, fs.maxAttempts, fs.Logger)
+		r, err := newRemote(c, ropts)
 		if err != nil {
+			abandon()
 			return err
 		}
-
 		fs.remotes = append(fs.remotes, r)
-		if r.write {
+
+		var loaded bool
+		if c.MetadataSnapshot {
+			loaded, err = r.enableSnapshot(c.MetadataSnapshotMaxAge, fs.metadataTTL)
+			if err != nil {
+				abandon()
+				return err
+			}
+		}
+		if c.PrefetchTree && !loaded {
+			r.prefetchTree(c.PrefetchLimit, fs.metadataTTL)
+		}
+
+		if r.write && len(r.writeRules) == 0 {
 			if fs.writeRemote != nil {
-				return fmt.Errorf("You can't have more than one writeable remote")
+				abandon()
+				return fmt.Errorf("You can't have more than one writeable remote without WriteRules")
 			}
 			fs.writeRemote = r
 		}
 	}
+	if fs.cachesWrites() {
+		fs.uploader = newUploader(fs.writeBackDelay, fs.uploadWorkers, fs.uploadInBackground)
+	}
+
+	// finish off anything previous mounts of our writeable remotes' permanent
+	// caches left undone, and start journaling what we do ourselves
+	err := fs.recoverAndJournal()
+	if err != nil {
+		abandon()
+		return err
+	}
 
 	uid, gid, err := userAndGroup()
 	if err != nil {
+		abandon()
 		return err
 	}
 
+	timeout := fs.kernelTimeout()
 	opts := &nodefs.Options{
-		NegativeTimeout: time.Second,
-		AttrTimeout:     time.Second,
-		EntryTimeout:    time.Second,
+		NegativeTimeout: timeout,
+		AttrTimeout:     timeout,
+		EntryTimeout:    timeout,
 		Owner: &fuse.Owner{
 			Uid: uid,
 			Gid: gid,
@@ -358,16 +563,19 @@ func (fs *MuxFys) Mount(rcs ...*RemoteConfig) error {
 	}
 	fs.server, err = fuse.NewServer(conn.RawFS(), fs.mountPoint, mOpts)
 	if err != nil {
+		abandon()
 		return err
 	}
 
 	go fs.server.Serve()
 	err = fs.server.WaitMount()
 	if err != nil {
+		abandon()
 		return err
 	}
 
 	fs.mounted = true
+	fs.watcher = newWatcher(fs.watchInterval, fs.pollWatched)
 	return err
 }
 
@@ -439,11 +647,22 @@ func (fs *MuxFys) UnmountOnDeath() {
 // UnmountOnDeath().
 //
 // In CacheData mode, it is only at Unmount() that any files you created or
-// altered get uploaded, so this may take some time. You can optionally supply a
-// bool which if true prevents any uploads.
+// altered get uploaded (unless Config.WriteBackDelay was set, in which case
+// only files not yet uploaded in the background are), so this may take some
+// time. You can optionally supply a bool which if true prevents any uploads.
+// If any uploads fail, the returned error will be an *UploadError that tells
+// you which files failed and why. Either way, UploadResults() will tell you
+// what happened to each file. Failed uploads can be tried again with
+// RetryUploads().
+//
+// If a writeable remote has a CacheDir, uploads to it that fail (or that don't
+// happen because we crashed before Unmount() was called) are remembered in a
+// journal in that CacheDir, and will be tried again the next time you Mount()
+// with the same CacheDir; see Recovery().
 //
 // If a remote was not configured with a specific CacheDir but CacheData was
-// true, the CacheDir will be deleted.
+// true, the CacheDir will be deleted (for writeable remotes, only once there
+// are no failed uploads to them left to RetryUploads()).
 func (fs *MuxFys) Unmount(doNotUpload ...bool) error {
 	fs.mutex.Lock()
 	defer fs.mutex.Unlock()
@@ -452,6 +671,9 @@ func (fs *MuxFys) Unmount(doNotUpload ...bool) error {
 		fs.ignoreSignals <- true
 	}
 
+	fs.watcher.stop()
+	fs.watcher = nil
+
 	var err error
 	if fs.mounted {
 		err = fs.server.Unmount()
@@ -461,9 +683,15 @@ func (fs *MuxFys) Unmount(doNotUpload ...bool) error {
 		// <-time.After(10 * time.Second)
 	}
 
-	if !(len(doNotUpload) == 1 && doNotUpload[0]) {
-		// upload files that got opened for writing
-		uerr := fs.uploadCreated()
+	// wait for any in-progress background uploads, then upload whatever is
+	// left of the files that got opened for writing (including those still
+	// waiting to be uploaded in the background) in mtime order
+	upload := !(len(doNotUpload) == 1 && doNotUpload[0])
+	fs.uploader.stop()
+	fs.uploader = nil
+	results := &UploadResults{Uploaded: fs.takeEarlyUploads()}
+	if upload {
+		uerr := fs.uploadCreated(results)
 		if uerr != nil {
 			if err == nil {
 				err = uerr
@@ -471,11 +699,23 @@ func (fs *MuxFys) Unmount(doNotUpload ...bool) error {
 				err = fmt.Errorf("%s; %s", err.Error(), uerr.Error())
 			}
 		}
+	} else {
+		results.Skipped = fs.skippedUploads()
+	}
+	fs.uploadResults = results
+
+	// hang on to the cached data of any failed uploads, so they can be retried
+	held := fs.holdFailedUploads(results.Failed)
+	for _, r := range fs.writeableRemotes() {
+		if !held[r] {
+			r.journal.close(!upload)
+		}
+		r.journal = nil
 	}
 
 	// delete any cachedirs we created
 	for _, remote := range fs.remotes {
-		if remote.cacheIsTmp {
+		if remote.cacheIsTmp && !held[remote] {
 			errd := remote.deleteCache()
 			if errd != nil {
 				remote.Warn("Unmount cache deletion failed", "err", errd)
@@ -495,8 +735,26 @@ func (fs *MuxFys) Unmount(doNotUpload ...bool) error {
 	fs.files = make(map[string]*fuse.Attr)
 	fs.fileToRemote = make(map[string]*remote)
 	fs.createdFiles = make(map[string]bool)
+	fs.localOnlyFiles = make(map[string]bool)
+	fs.openHandles = make(map[*openHandle]bool)
 	fs.createdDirs = make(map[string]bool)
+	fs.shadows = make(map[string]string)
+	fs.whiteouts = make(map[string]*remote)
+	fs.overlaid = make(map[string]bool)
+	fs.dirListed = make(map[string]time.Time)
+	fs.missing.clear()
+	fs.unlistable.clear()
+	fs.nodeFs = nil
+	fs.journalIDs = nil
 	fs.mapMutex.Unlock()
+	fs.memCache.wipe()
+
+	for _, r := range fs.remotes {
+		errs := r.saveSnapshot()
+		if errs != nil {
+			r.Warn("Unmount metadata snapshot save failed", "err", errs)
+		}
+	}
 
 	// forget our remotes so we can be remounted with other remotes
 	fs.remotes = nil
@@ -505,45 +763,203 @@ func (fs *MuxFys) Unmount(doNotUpload ...bool) error {
 	return err
 }
 
-// uploadCreated uploads any files that previously got created. Only functions
-// in CacheData mode.
-func (fs *MuxFys) uploadCreated() error {
-	if fs.writeRemote != nil && fs.writeRemote.cacheData {
-		fails := 0
+// uploadCreated uploads any files that previously got created, adding the
+// outcome for each to results. Only functions in CacheData mode. Returns an
+// *UploadError if any uploads failed.
+func (fs *MuxFys) uploadCreated(results *UploadResults) error {
+	if !fs.cachesWrites() {
+		return nil
+	}
 
-		// since mtimes in S3 are stored as the upload time, we sort our created
-		// files by their mtime to at least upload them in the correct order
-		var createdFiles []string
-		fs.mapMutex.Lock()
-		for name := range fs.createdFiles {
-			createdFiles = append(createdFiles, name)
+	for _, batch := range fs.createdBatches() {
+		for _, result := range fs.uploadBatch(batch) {
+			if result.Err == nil {
+				results.Uploaded = append(results.Uploaded, result)
+			} else {
+				results.Failed = append(results.Failed, result)
+			}
+		}
+	}
+	if len(results.Failed) > 0 {
+		return &UploadError{Failed: results.Failed}
+	}
+	return nil
+}
+
+// cachesWrites returns true if any of our writeable remotes has CacheData
+// enabled, so that files written to it are uploaded later.
+func (fs *MuxFys) cachesWrites() bool {
+	for _, r := range fs.writeableRemotes() {
+		if r.cacheData {
+			return true
+		}
+	}
+	return false
+}
+
+// setCreated records that the given file was created or modified, and so needs
+// to be uploaded. Must be called while you hold the mapMutex.
+func (fs *MuxFys) setCreated(name string) {
+	fs.createdFiles[name] = true
+	r := fs.createdRemote(name)
+	if r == nil || r.journal == nil {
+		return
+	}
+	if _, journaled := fs.journalIDs[name]; journaled {
+		return
+	}
+	remotePath := r.getRemotePath(name)
+	op := &JournalOp{
+		Op:        JournalUpload,
+		Path:      remotePath,
+		LocalPath: r.getLocalPath(remotePath),
+	}
+	op.ETag, op.CheckETag = r.expectedETag(remotePath)
+	fs.journalIDs[name] = journalID{
+		journal: r.journal,
+		id:      r.journal.begin(op),
+	}
+}
+
+// uploadedCreated records that the given file, which is still created, was
+// uploaded, so that its journaled upload expects the remote file to have the
+// ETag of our own upload. Must be called while you hold the mapMutex.
+func (fs *MuxFys) uploadedCreated(name string) {
+	if _, journaled := fs.journalIDs[name]; !journaled || !fs.createdFiles[name] {
+		return
+	}
+	r := fs.createdRemote(name)
+	if _, checking := r.expectedETag(r.getRemotePath(name)); !checking {
+		return
+	}
+	jid := fs.journalIDs[name]
+	delete(fs.journalIDs, name)
+	fs.setCreated(name)
+	jid.journal.finish(jid.id)
+}
+
+// clearCreated records that the given file no longer needs to be uploaded.
+// Must be called while you hold the mapMutex.
+func (fs *MuxFys) clearCreated(name string) {
+	delete(fs.createdFiles, name)
+	delete(fs.localOnlyFiles, name)
+	if jid, journaled := fs.journalIDs[name]; journaled {
+		jid.journal.finish(jid.id)
+		delete(fs.journalIDs, name)
+	}
+}
+
+// createdBatches returns the names of our created files in the order they
+// were last modified, oldest first, split in to batches of up to uploadWorkers
+// files. Since mtimes in S3 are stored as the upload time, uploading the
+// batches in order at least gets our files uploaded in close to the correct
+// order, while still uploading as many at once as we're allowed.
+func (fs *MuxFys) createdBatches() [][]string {
+	fs.mapMutex.RLock()
+	defer fs.mapMutex.RUnlock()
+
+	names := make([]string, 0, len(fs.createdFiles))
+	mtimes := make(map[string]uint64, len(fs.createdFiles))
+	for name := range fs.createdFiles {
+		names = append(names, name)
+		if attr := fs.files[name]; attr != nil {
+			mtimes[name] = attr.Mtime
 		}
-		if len(createdFiles) > 1 {
-			sort.Slice(createdFiles, func(i, j int) bool {
-				return fs.files[createdFiles[i]].Mtime < fs.files[createdFiles[j]].Mtime
-			})
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if mtimes[names[i]] == mtimes[names[j]] {
+			return names[i] < names[j]
 		}
+		return mtimes[names[i]] < mtimes[names[j]]
+	})
+
+	size := fs.workers()
+	var batches [][]string
+	for len(names) > size {
+		batches = append(batches, names[:size])
+		names = names[size:]
+	}
+	if len(names) > 0 {
+		batches = append(batches, names)
+	}
+	return batches
+}
 
-		for _, name := range createdFiles {
-			remotePath := fs.writeRemote.getRemotePath(name)
-			localPath := fs.writeRemote.getLocalPath(remotePath)
+// uploadBatch uploads the given created files concurrently, and returns the
+// outcome for each, in the same order as names.
+func (fs *MuxFys) uploadBatch(names []string) []*UploadResult {
+	return fs.uploadConcurrently(len(names), func(i int) *UploadResult {
+		return fs.uploadCreatedFile(names[i])
+	})
+}
 
-			// upload file
-			status := fs.writeRemote.uploadFile(localPath, remotePath)
-			if status != fuse.OK {
-				fails++
-				continue
+// uploadConcurrently calls upload for each of 0..n-1, using up to uploadWorkers
+// goroutines at once, and returns the results in order.
+func (fs *MuxFys) uploadConcurrently(n int, upload func(i int) *UploadResult) []*UploadResult {
+	workers := fs.workers()
+	if workers > n {
+		workers = n
+	}
+
+	results := make([]*UploadResult, n)
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				results[i] = upload(i)
 			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+	return results
+}
 
-			delete(fs.createdFiles, name)
-		}
-		fs.mapMutex.Unlock()
+// workers returns the maximum number of files we upload at once.
+func (fs *MuxFys) workers() int {
+	if fs.uploadWorkers <= 0 {
+		return defaultUploadWorkers
+	}
+	return fs.uploadWorkers
+}
 
-		if fails > 0 {
-			return fmt.Errorf("failed to upload %d files", fails)
-		}
+// createdMtime returns the mtime of the given created file. Must not be called
+// while you hold the mapMutex.
+func (fs *MuxFys) createdMtime(name string) uint64 {
+	fs.mapMutex.RLock()
+	defer fs.mapMutex.RUnlock()
+	if attr := fs.files[name]; attr != nil {
+		return attr.Mtime
 	}
-	return nil
+	return 0
+}
+
+// uploadCreatedFile uploads the given created file and, if that worked, stops
+// considering it created.
+func (fs *MuxFys) uploadCreatedFile(name string) *UploadResult {
+	fs.mapMutex.RLock()
+	r := fs.createdRemote(name)
+	fs.mapMutex.RUnlock()
+	result := uploadWithResult(r, name, fs.createdMtime(name))
+	if result.Err == nil {
+		fs.mapMutex.Lock()
+		fs.clearCreated(name)
+		fs.mapMutex.Unlock()
+	}
+	return result
+}
+
+// CacheStats returns statistics on the performance of the in-memory block cache
+// that was enabled by setting Config.MemoryCacheSize. If it wasn't enabled, the
+// returned stats will all be zero. Stats accumulate over multiple mounts.
+func (fs *MuxFys) CacheStats() CacheStats {
+	return fs.memCache.currentStats()
 }
 
 // Logs returns messages generated while mounted; you might call it after
@@ -402,6 +402,172 @@ func TestMuxFys(t *testing.T) {
 			})
 		})
 
+		Convey("You can Mount() with an in-memory block cache", func() {
+			cfg.Mount = filepath.Join(tmpdir, "memMount")
+			mfs, err := New(&Config{
+				Mount:           cfg.Mount,
+				CacheBase:       cacheBase,
+				MemoryCacheSize: 10 * memBlockSize,
+			})
+			So(err, ShouldBeNil)
+			remoteConfig := &RemoteConfig{
+				Accessor:  accessor,
+				CacheData: true,
+			}
+			err = mfs.Mount(remoteConfig)
+			So(err, ShouldBeNil)
+			defer mfs.Unmount()
+
+			data, err := ioutil.ReadFile(filepath.Join(cfg.Mount, "read.file"))
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, "test1\ntest2\n")
+			stats := mfs.CacheStats()
+			So(stats.Misses, ShouldBeGreaterThan, 0)
+			So(stats.Bytes, ShouldEqual, 12)
+
+			Convey("Re-reading comes from memory", func() {
+				data, err = ioutil.ReadFile(filepath.Join(cfg.Mount, "read.file"))
+				So(err, ShouldBeNil)
+				So(string(data), ShouldEqual, "test1\ntest2\n")
+				So(mfs.CacheStats().Hits, ShouldBeGreaterThan, stats.Hits)
+			})
+
+			Convey("Unmount() empties the memory cache", func() {
+				err = mfs.Unmount()
+				So(err, ShouldBeNil)
+				So(mfs.CacheStats().Bytes, ShouldEqual, 0)
+			})
+		})
+
+		Convey("You can Mount() with a cache block size", func() {
+			remoteConfig := &RemoteConfig{
+				Accessor:       accessor,
+				CacheData:      true,
+				CacheBlockSize: 4,
+			}
+			err := fs.Mount(remoteConfig)
+			So(err, ShouldBeNil)
+			defer fs.Unmount()
+
+			r := fs.remotes[0]
+			So(r.CacheBlockSize(), ShouldEqual, 4)
+
+			f, err := os.Open(filepath.Join(explicitMount, "read.file"))
+			So(err, ShouldBeNil)
+			b := make([]byte, 2)
+			_, err = f.ReadAt(b, 5)
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, "\nt")
+			f.Close()
+
+			localPath := r.getLocalPath(r.getRemotePath("read.file"))
+			So(r.Uncached(localPath, NewInterval(0, 12)), ShouldResemble, Intervals{NewInterval(0, 4), NewInterval(8, 4)})
+
+			data, err := ioutil.ReadFile(filepath.Join(explicitMount, "read.file"))
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, "test1\ntest2\n")
+			So(len(r.Uncached(localPath, NewInterval(0, 12))), ShouldEqual, 0)
+		})
+
+		Convey("You can Mount() writable cached with background uploads", func() {
+			cfg.Mount = filepath.Join(tmpdir, "writeBackMount")
+			mfs, err := New(&Config{
+				Mount:          cfg.Mount,
+				CacheBase:      cacheBase,
+				WriteBackDelay: 100 * time.Millisecond,
+				UploadWorkers:  2,
+			})
+			So(err, ShouldBeNil)
+			remoteConfig := &RemoteConfig{
+				Accessor:  accessor,
+				CacheData: true,
+				Write:     true,
+			}
+			err = mfs.Mount(remoteConfig)
+			So(err, ShouldBeNil)
+			defer mfs.Unmount()
+
+			sourceFile := filepath.Join(sourcePoint, "background.file")
+			defer os.Remove(sourceFile)
+			f, err := os.OpenFile(filepath.Join(cfg.Mount, "background.file"), os.O_RDWR|os.O_CREATE, 0666)
+			So(err, ShouldBeNil)
+			_, err = f.WriteString("background\n")
+			So(err, ShouldBeNil)
+
+			// it isn't uploaded while open
+			<-time.After(300 * time.Millisecond)
+			_, err = os.Stat(sourceFile)
+			So(err, ShouldNotBeNil)
+			f.Close()
+
+			// but is once closed and the delay has passed
+			uploaded := false
+			limit := time.After(5 * time.Second)
+			for !uploaded {
+				select {
+				case <-limit:
+					uploaded = true
+				case <-time.After(50 * time.Millisecond):
+					mfs.mapMutex.RLock()
+					uploaded = len(mfs.createdFiles) == 0
+					mfs.mapMutex.RUnlock()
+				}
+			}
+			data, err := ioutil.ReadFile(sourceFile)
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, "background\n")
+
+			err = mfs.Unmount()
+			So(err, ShouldBeNil)
+		})
+
+		Convey("Uploads that fail at Unmount() with a permanent cache happen on the next Mount()", func() {
+			cacheJournal := filepath.Join(tmpdir, "cacheJournal")
+			defer os.RemoveAll(cacheJournal)
+			remoteConfig := &RemoteConfig{
+				Accessor: accessor,
+				CacheDir: cacheJournal,
+				Write:    true,
+			}
+			err := fs.Mount(remoteConfig)
+			So(err, ShouldBeNil)
+			defer fs.Unmount()
+			So(fs.Recovery(), ShouldNotBeNil)
+			So(len(fs.Recovery().Completed), ShouldEqual, 0)
+
+			sourceFile := filepath.Join(sourcePoint, "journaled.file")
+			defer os.Remove(sourceFile)
+			err = ioutil.WriteFile(filepath.Join(explicitMount, "journaled.file"), []byte("journaled\n"), 0644)
+			So(err, ShouldBeNil)
+
+			uploadFail = true
+			err = fs.Unmount()
+			uploadFail = false
+			So(err, ShouldNotBeNil)
+			_, err = os.Stat(sourceFile)
+			So(err, ShouldNotBeNil)
+			journals, err := filepath.Glob(filepath.Join(cacheJournal, journalPrefix+"*"))
+			So(err, ShouldBeNil)
+			So(len(journals), ShouldEqual, 1)
+
+			err = fs.Mount(remoteConfig)
+			So(err, ShouldBeNil)
+			report := fs.Recovery()
+			So(len(report.Completed), ShouldEqual, 1)
+			So(report.Completed[0].Op, ShouldEqual, JournalUpload)
+			So(report.Completed[0].Path, ShouldEqual, sourceFile)
+			So(len(report.Failed), ShouldEqual, 0)
+			data, err := ioutil.ReadFile(sourceFile)
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, "journaled\n")
+
+			err = fs.Unmount()
+			So(err, ShouldBeNil)
+			journals, err = filepath.Glob(filepath.Join(cacheJournal, journalPrefix+"*"))
+			So(err, ShouldBeNil)
+			So(len(journals), ShouldEqual, 0)
+		})
+
 		Convey("You can Mount() writable cached", func() {
 			remoteConfig := &RemoteConfig{
 				Accessor:  accessor,
@@ -493,6 +659,23 @@ func TestMuxFys(t *testing.T) {
 				err = fs.Unmount()
 				So(err, ShouldNotBeNil)
 				So(err.Error(), ShouldEqual, "failed to upload 1 files")
+				uerr, ok := err.(*UploadError)
+				So(ok, ShouldBeTrue)
+				So(len(uerr.Failed), ShouldEqual, 1)
+				So(uerr.Failed[0].Path, ShouldEqual, "created.file")
+				So(uerr.Failed[0].RemotePath, ShouldEqual, sourceFile)
+				defer fs.RetryUploads(true)
+
+				Convey("You can retry the failed uploads", func() {
+					uploadFail = false
+					results, err := fs.RetryUploads()
+					So(err, ShouldBeNil)
+					So(len(results.Uploaded), ShouldEqual, 1)
+					So(results.Uploaded[0].RemotePath, ShouldEqual, sourceFile)
+					_, err = os.Stat(sourceFile)
+					So(err, ShouldBeNil)
+					So(checkEmpty(cacheBase), ShouldBeTrue)
+				})
 
 				Convey("Logs() tells you what happened", func() {
 					logs := fs.Logs()
@@ -932,6 +1115,24 @@ func TestMuxFys(t *testing.T) {
 		So(err, ShouldNotBeNil)
 		So(err.Error(), ShouldContainSubstring, "was not empty")
 	})
+
+	Convey("A failed Mount() leaves nothing behind, so you can Mount() again", t, func() {
+		base := filepath.Join(tmpdir, "failedMountCache")
+		err := os.MkdirAll(base, os.FileMode(0777))
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(base)
+		fs, err := New(&Config{Mount: filepath.Join(tmpdir, "failedMount"), CacheBase: base})
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(filepath.Join(tmpdir, "failedMount"))
+
+		rc := &RemoteConfig{Accessor: &localAccessor{target: sourcePoint}, CacheData: true, Write: true}
+		err = fs.Mount(rc, rc)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "more than one writeable remote")
+		So(fs.remotes, ShouldBeEmpty)
+		So(fs.writeRemote, ShouldBeNil)
+		So(checkEmpty(base), ShouldBeTrue)
+	})
 }
 
 // checkEmpty checks if the given directory is empty.
@@ -0,0 +1,145 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of muxfys.
+//
+//  muxfys is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  muxfys is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with muxfys. If not, see <http://www.gnu.org/licenses/>.
+
+package muxfys
+
+// This file implements a cache of paths we recently found not to exist, so
+// that repeatedly probing for them doesn't keep asking the remotes.
+
+import (
+	"container/list"
+	"time"
+)
+
+// defaultNegativeCacheSize is the number of paths a negativeCache remembers
+// when Config.NegativeCacheSize is not set.
+const defaultNegativeCacheSize = 10000
+
+// negativeCache remembers up to a maximum number of paths for a fixed amount
+// of time, forgetting the oldest when full. It is not thread safe; ours are
+// only used while holding the mapMutex. All methods are safe to call on a nil
+// *negativeCache, which remembers nothing.
+type negativeCache struct {
+	ttl     time.Duration
+	size    int
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+// negativeEntry is the Value of the list.Elements in a negativeCache.
+type negativeEntry struct {
+	path    string
+	expires time.Time
+}
+
+// newNegativeCache creates a negativeCache that remembers up to size paths
+// (defaultNegativeCacheSize if not positive) for ttl. Returns nil if ttl is not
+// positive.
+func newNegativeCache(ttl time.Duration, size int) *negativeCache {
+	if ttl <= 0 {
+		return nil
+	}
+	if size <= 0 {
+		size = defaultNegativeCacheSize
+	}
+	return &negativeCache{
+		ttl:     ttl,
+		size:    size,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// add remembers path, forgetting the oldest path if we're full.
+func (c *negativeCache) add(path string) {
+	if c == nil {
+		return
+	}
+	expires := time.Now().Add(c.ttl)
+	if e, exists := c.entries[path]; exists {
+		e.Value.(*negativeEntry).expires = expires
+		c.order.MoveToBack(e)
+		return
+	}
+	if c.order.Len() >= c.size {
+		c.remove(c.order.Front())
+	}
+	c.entries[path] = c.order.PushBack(&negativeEntry{path: path, expires: expires})
+}
+
+// has returns true if we remember path and it hasn't expired.
+func (c *negativeCache) has(path string) bool {
+	if c == nil {
+		return false
+	}
+	e, exists := c.entries[path]
+	if !exists {
+		return false
+	}
+	if time.Now().After(e.Value.(*negativeEntry).expires) {
+		c.remove(e)
+		return false
+	}
+	return true
+}
+
+// forget stops us remembering path.
+func (c *negativeCache) forget(path string) {
+	if c == nil {
+		return
+	}
+	if e, exists := c.entries[path]; exists {
+		c.remove(e)
+	}
+}
+
+// forgetWithin stops us remembering any path beneath the directory dir.
+func (c *negativeCache) forgetWithin(dir string) {
+	if c == nil {
+		return
+	}
+	for path, e := range c.entries {
+		if isWithinDir(path, dir) {
+			c.remove(e)
+		}
+	}
+}
+
+// clear forgets everything.
+func (c *negativeCache) clear() {
+	if c == nil {
+		return
+	}
+	c.entries = make(map[string]*list.Element)
+	c.order.Init()
+}
+
+// len returns the number of paths we currently remember, including expired
+// ones.
+func (c *negativeCache) len() int {
+	if c == nil {
+		return 0
+	}
+	return c.order.Len()
+}
+
+// remove removes the given element from both our list and map.
+func (c *negativeCache) remove(e *list.Element) {
+	c.order.Remove(e)
+	delete(c.entries, e.Value.(*negativeEntry).path)
+}
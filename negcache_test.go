@@ -0,0 +1,148 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of muxfys.
+//
+//  muxfys is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  muxfys is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with muxfys. If not, see <http://www.gnu.org/licenses/>.
+
+package muxfys
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// listCountingAccessor is a localAccessor that counts calls to ListEntries().
+type listCountingAccessor struct {
+	*localAccessor
+	lists int
+}
+
+func (a *listCountingAccessor) ListEntries(dir string) ([]RemoteAttr, error) {
+	a.lists++
+	return a.localAccessor.ListEntries(dir)
+}
+
+func TestNegativeCache(t *testing.T) {
+	Convey("negativeCache remembers paths for a while", t, func() {
+		c := newNegativeCache(50*time.Millisecond, 3)
+		c.add("a")
+		c.add("b/c")
+		c.add("b/d")
+		So(c.has("a"), ShouldBeTrue)
+		So(c.has("b/c"), ShouldBeTrue)
+		So(c.has("e"), ShouldBeFalse)
+
+		c.add("a")
+		c.add("e")
+		So(c.len(), ShouldEqual, 3)
+		So(c.has("b/c"), ShouldBeFalse)
+		So(c.has("a"), ShouldBeTrue)
+
+		c.forgetWithin("b")
+		So(c.has("b/d"), ShouldBeFalse)
+		c.forget("a")
+		So(c.has("a"), ShouldBeFalse)
+		So(c.len(), ShouldEqual, 1)
+
+		<-time.After(60 * time.Millisecond)
+		So(c.has("e"), ShouldBeFalse)
+		So(c.len(), ShouldEqual, 0)
+
+		So(newNegativeCache(0, 3), ShouldBeNil)
+		var nilCache *negativeCache
+		nilCache.add("a")
+		So(nilCache.has("a"), ShouldBeFalse)
+		nilCache.clear()
+	})
+
+	Convey("Given a writeable remote with a NegativeCacheTTL", t, func() {
+		tmpdir, err := ioutil.TempDir("", "muxfys_negcache_testing")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(tmpdir)
+		remoteDir := filepath.Join(tmpdir, "remote")
+		err = os.MkdirAll(filepath.Join(remoteDir, "sub"), os.FileMode(dirMode))
+		So(err, ShouldBeNil)
+		err = ioutil.WriteFile(filepath.Join(remoteDir, "sub", "a"), []byte("a"), os.FileMode(fileMode))
+		So(err, ShouldBeNil)
+
+		fs, err := New(&Config{Mount: filepath.Join(tmpdir, "mnt"), CacheBase: tmpdir, NegativeCacheTTL: time.Minute})
+		So(err, ShouldBeNil)
+		accessor := &listCountingAccessor{localAccessor: &localAccessor{target: remoteDir}}
+		r, err := newRemote(&RemoteConfig{Accessor: accessor, CacheData: true, Write: true}, remoteOptions{cacheBase: tmpdir, logger: fs.Logger})
+		So(err, ShouldBeNil)
+		defer r.deleteCache()
+		fs.remotes = []*remote{r}
+		fs.writeRemote = r
+		fs.OnMount(nil)
+
+		getAttr := func(name string) fuse.Status {
+			_, status := fs.GetAttr(name, &fuse.Context{})
+			return status
+		}
+		So(getAttr("sub"), ShouldEqual, fuse.OK)
+		So(accessor.lists, ShouldEqual, 1)
+
+		Convey("Directories that can't be listed are not listed again", func() {
+			err = os.RemoveAll(filepath.Join(remoteDir, "sub"))
+			So(err, ShouldBeNil)
+			So(getAttr("sub/a.bai"), ShouldEqual, fuse.ENOENT)
+			So(accessor.lists, ShouldEqual, 2)
+			So(getAttr("sub/a.crai"), ShouldEqual, fuse.ENOENT)
+			So(getAttr("sub/a.bai"), ShouldEqual, fuse.ENOENT)
+			So(accessor.lists, ShouldEqual, 2)
+
+			Convey("Until invalidated", func() {
+				err = os.MkdirAll(filepath.Join(remoteDir, "sub"), os.FileMode(dirMode))
+				So(err, ShouldBeNil)
+				err = ioutil.WriteFile(filepath.Join(remoteDir, "sub", "a.bai"), []byte("a"), os.FileMode(fileMode))
+				So(err, ShouldBeNil)
+				err = fs.Invalidate("sub/a.bai", false)
+				So(err, ShouldBeNil)
+				So(getAttr("sub/a.bai"), ShouldEqual, fuse.OK)
+				So(accessor.lists, ShouldEqual, 3)
+			})
+		})
+
+		Convey("Missing files are remembered until created", func() {
+			So(getAttr("sub/b"), ShouldEqual, fuse.ENOENT)
+			So(fs.missing.has("sub/b"), ShouldBeTrue)
+
+			f, status := fs.create("sub/b", uint32(os.O_RDWR|os.O_TRUNC), uint32(fileMode))
+			So(status, ShouldEqual, fuse.OK)
+			f.Release()
+			So(fs.missing.has("sub/b"), ShouldBeFalse)
+			So(getAttr("sub/b"), ShouldEqual, fuse.OK)
+		})
+
+		Convey("Missing files are forgotten when their directory is listed again", func() {
+			So(getAttr("sub/c"), ShouldEqual, fuse.ENOENT)
+			err = ioutil.WriteFile(filepath.Join(remoteDir, "sub", "c"), []byte("c"), os.FileMode(fileMode))
+			So(err, ShouldBeNil)
+			So(getAttr("sub/c"), ShouldEqual, fuse.ENOENT)
+
+			fs.mapMutex.Lock()
+			fs.refreshDir("sub")
+			fs.mapMutex.Unlock()
+			So(fs.missing.has("sub/c"), ShouldBeFalse)
+			So(getAttr("sub/c"), ShouldEqual, fuse.OK)
+		})
+	})
+}
@@ -0,0 +1,104 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of muxfys.
+//
+//  muxfys is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  muxfys is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with muxfys. If not, see <http://www.gnu.org/licenses/>.
+
+package muxfys
+
+// This file implements deciding which remote's copy of a file is used when
+// multiple multiplexed remotes have a file with the same path.
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// Precedence determines which remote's copy of a file is seen when multiple
+// remotes have a file with the same path.
+type Precedence int
+
+// PrecedenceFirst (the default) means the first remote you Mount() that has a
+// file wins, while PrecedenceLast means the last one does.
+const (
+	PrecedenceFirst Precedence = iota
+	PrecedenceLast
+)
+
+// shadowSeparator separates a file's name from the label of the remote it came
+// from in the names of shadowed copies (see Config.ShowShadowed).
+const shadowSeparator = "@"
+
+// label returns a version of our accessor's Target() that can be used in a
+// file name.
+func (r *remote) label() string {
+	target := r.accessor.Target()
+	if i := strings.Index(target, "://"); i >= 0 {
+		target = target[i+3:]
+	}
+	return strings.Replace(strings.Trim(target, "/"), "/", "_", -1)
+}
+
+// outranks returns true if remote a's copies of files should be seen instead
+// of remote b's, according to our precedence. Writeable remotes always outrank
+// read-only ones, so that files copied up to them are seen.
+func (fs *MuxFys) outranks(a, b *remote) bool {
+	if a.write != b.write {
+		return a.write
+	}
+	for _, r := range fs.remotes {
+		switch r {
+		case a:
+			return fs.precedence == PrecedenceFirst
+		case b:
+			return fs.precedence == PrecedenceLast
+		}
+	}
+	return false
+}
+
+// addShadowed notes that the given remote's copy of the given file is hidden
+// by another remote's copy. If Config.ShowShadowed was set, it becomes
+// accessible (read-only) as name@label in the same directory. Must be called
+// while you have the mapMutex Locked.
+func (fs *MuxFys) addShadowed(name string, r *remote, attr *fuse.Attr) {
+	if !fs.showShadowed {
+		return
+	}
+	shadowPath := name + shadowSeparator + r.label()
+	if _, exists := fs.files[shadowPath]; !exists {
+		parent := parentDir(name)
+		fs.dirContents[parent] = append(fs.dirContents[parent], fuse.DirEntry{
+			Name: filepath.Base(shadowPath),
+			Mode: uint32(fuse.S_IFREG),
+		})
+	}
+	fs.files[shadowPath] = attr
+	fs.fileToRemote[shadowPath] = r
+	fs.shadows[shadowPath] = name
+}
+
+// unshadow returns the real path of the given path if it is a shadowed copy
+// (see addShadowed()), along with true. Otherwise returns name and false.
+func (fs *MuxFys) unshadow(name string) (string, bool) {
+	fs.mapMutex.RLock()
+	defer fs.mapMutex.RUnlock()
+	if real, shadowed := fs.shadows[name]; shadowed {
+		return real, true
+	}
+	return name, false
+}
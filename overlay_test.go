@@ -0,0 +1,133 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of muxfys.
+//
+//  muxfys is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  muxfys is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with muxfys. If not, see <http://www.gnu.org/licenses/>.
+
+package muxfys
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestOverlay(t *testing.T) {
+	Convey("Remote labels can be used in file names", t, func() {
+		r := &remote{accessor: &localAccessor{target: "/a/b/"}}
+		So(r.label(), ShouldEqual, "a_b")
+		r = &remote{accessor: &S3Accessor{target: "https://s3.example.com/bucket/path"}}
+		So(r.label(), ShouldEqual, "s3.example.com_bucket_path")
+	})
+
+	Convey("Given two remotes with files of the same name", t, func() {
+		tmpdir, err := ioutil.TempDir("", "muxfys_overlay_testing")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(tmpdir)
+		makeRemote := func(name string, files map[string]string) string {
+			dir := filepath.Join(tmpdir, name)
+			for file, content := range files {
+				errm := os.MkdirAll(filepath.Dir(filepath.Join(dir, file)), os.FileMode(dirMode))
+				So(errm, ShouldBeNil)
+				errm = ioutil.WriteFile(filepath.Join(dir, file), []byte(content), os.FileMode(fileMode))
+				So(errm, ShouldBeNil)
+			}
+			return dir
+		}
+		dirA := makeRemote("a", map[string]string{"same": "from a", "d/same": "from a", "onlya": "a"})
+		dirB := makeRemote("b", map[string]string{"same": "from bb", "d/same": "from bb", "onlyb": "b"})
+
+		mount := func(config *Config) *MuxFys {
+			config.Mount = filepath.Join(tmpdir, "mnt")
+			config.CacheBase = tmpdir
+			fs, errn := New(config)
+			So(errn, ShouldBeNil)
+			for _, dir := range []string{dirA, dirB} {
+				r, errn := newRemote(&RemoteConfig{Accessor: &localAccessor{target: dir}}, remoteOptions{cacheBase: tmpdir, logger: fs.Logger})
+				So(errn, ShouldBeNil)
+				fs.remotes = append(fs.remotes, r)
+			}
+			fs.OnMount(nil)
+			return fs
+		}
+		ls := func(fs *MuxFys, dir string) []string {
+			entries, status := fs.OpenDir(dir, &fuse.Context{})
+			So(status, ShouldEqual, fuse.OK)
+			var names []string
+			for _, entry := range entries {
+				names = append(names, entry.Name)
+			}
+			sort.Strings(names)
+			return names
+		}
+		read := func(fs *MuxFys, name string) string {
+			file, status := fs.Open(name, uint32(os.O_RDONLY), &fuse.Context{})
+			So(status, ShouldEqual, fuse.OK)
+			defer file.Release()
+			result, status := file.Read(make([]byte, 10), 0)
+			So(status, ShouldEqual, fuse.OK)
+			b, _ := result.Bytes(make([]byte, 10))
+			return strings.TrimRight(string(b), "\x00")
+		}
+
+		Convey("By default the first remote wins and entries aren't duplicated", func() {
+			fs := mount(&Config{})
+			So(ls(fs, ""), ShouldResemble, []string{"d", "onlya", "onlyb", "same"})
+			So(ls(fs, "d"), ShouldResemble, []string{"same"})
+			attr, status := fs.GetAttr("same", &fuse.Context{})
+			So(status, ShouldEqual, fuse.OK)
+			So(attr.Size, ShouldEqual, 6)
+			So(read(fs, "d/same"), ShouldEqual, "from a")
+
+			Convey("Also after being listed again", func() {
+				err = fs.Invalidate("", true)
+				So(err, ShouldBeNil)
+				So(ls(fs, ""), ShouldResemble, []string{"d", "onlya", "onlyb", "same"})
+				So(read(fs, "same"), ShouldEqual, "from a")
+			})
+		})
+
+		Convey("The last remote can be made to win", func() {
+			fs := mount(&Config{Precedence: PrecedenceLast})
+			So(ls(fs, ""), ShouldResemble, []string{"d", "onlya", "onlyb", "same"})
+			So(read(fs, "same"), ShouldEqual, "from bb")
+			So(ls(fs, "d"), ShouldResemble, []string{"same"})
+			So(read(fs, "d/same"), ShouldEqual, "from bb")
+		})
+
+		Convey("Shadowed copies can be shown and read", func() {
+			fs := mount(&Config{ShowShadowed: true})
+			shadow := "same@" + strings.Replace(strings.Trim(dirB, "/"), "/", "_", -1)
+			So(ls(fs, ""), ShouldResemble, []string{"d", "onlya", "onlyb", "same", shadow})
+			So(ls(fs, "d"), ShouldResemble, []string{"same", shadow})
+			So(read(fs, "same"), ShouldEqual, "from a")
+			So(read(fs, shadow), ShouldEqual, "from bb")
+			So(read(fs, "d/"+shadow), ShouldEqual, "from bb")
+
+			_, status := fs.Open(shadow, uint32(os.O_WRONLY), &fuse.Context{})
+			So(status, ShouldEqual, fuse.EPERM)
+
+			err = fs.Invalidate("", false)
+			So(err, ShouldBeNil)
+			So(ls(fs, ""), ShouldResemble, []string{"d", "onlya", "onlyb", "same", shadow})
+		})
+	})
+}
@@ -0,0 +1,147 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of muxfys.
+//
+//  muxfys is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  muxfys is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with muxfys. If not, see <http://www.gnu.org/licenses/>.
+
+package muxfys
+
+// This file implements prefetching the listings of every directory in a remote
+// using a single recursive listing.
+
+import (
+	"strings"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// defaultPrefetchLimit is the maximum number of entries RemoteConfig.PrefetchTree
+// will prefetch if RemoteConfig.PrefetchLimit is not set.
+const defaultPrefetchLimit = 100000
+
+// RecursiveLister is an optional interface that a RemoteAccessor can also
+// implement, to allow RemoteConfig.PrefetchTree to be used.
+type RecursiveLister interface {
+	// ListEntriesRecursive is like ListEntries(), but returns every file
+	// beneath dir, not just those directly within it. Directories need not be
+	// returned. If there are more than max entries, it should stop and return
+	// true for truncated, in which case the returned entries are ignored.
+	ListEntriesRecursive(dir string, max int) (entries []RemoteAttr, truncated bool, err error)
+}
+
+// prefetchTree lists everything in the remote with a single recursive listing,
+// and stores the result so that listDir() can return the listing of each
+// directory once without asking the remote. Nothing is stored if the accessor
+// is not a RecursiveLister, the listing fails, or there are more than max
+// (defaultPrefetchLimit if not positive) entries. The stored listings are not
+// used once older than ttl, if that is positive.
+func (r *remote) prefetchTree(max int, ttl time.Duration) {
+	lister, ok := r.accessor.(RecursiveLister)
+	if !ok {
+		r.Warn("PrefetchTree needs an Accessor that is a RecursiveLister")
+		return
+	}
+	if max <= 0 {
+		max = defaultPrefetchLimit
+	}
+
+	root := dirRemotePath(r, r.mountPath)
+	var objects []RemoteAttr
+	var truncated bool
+	status := r.retry("ListEntriesRecursive", root, func() error {
+		var err error
+		objects, truncated, err = lister.ListEntriesRecursive(root, max)
+		return err
+	})
+	if status != fuse.OK {
+		r.Warn("PrefetchTree listing failed", "status", status)
+		return
+	}
+	if truncated {
+		r.Warn("PrefetchTree skipped because there are too many entries", "max", max)
+		return
+	}
+
+	listed := time.Now()
+	tree := map[string]*snapshotDir{root: {Listed: listed, Entries: []RemoteAttr{}}}
+	addDir := func(parent, dir string) {
+		if _, seen := tree[dir]; !seen {
+			tree[dir] = &snapshotDir{Listed: listed, Entries: []RemoteAttr{}}
+			tree[parent].Entries = append(tree[parent].Entries, RemoteAttr{Name: dir})
+		}
+	}
+	for _, object := range objects {
+		if !strings.HasPrefix(object.Name, root) {
+			continue
+		}
+		rel := object.Name[len(root):]
+		isDir := strings.HasSuffix(rel, "/")
+		parts := strings.Split(strings.TrimSuffix(rel, "/"), "/")
+		if parts[0] == "" {
+			continue
+		}
+
+		dir := root
+		for _, part := range parts[:len(parts)-1] {
+			addDir(dir, dir+part+"/")
+			dir += part + "/"
+		}
+		if isDir {
+			addDir(dir, dir+parts[len(parts)-1]+"/")
+		} else {
+			tree[dir].Entries = append(tree[dir].Entries, object)
+		}
+	}
+
+	r.treeMutex.Lock()
+	defer r.treeMutex.Unlock()
+	r.tree = tree
+	r.treeTTL = ttl
+	r.Info("PrefetchTree", "entries", len(objects), "dirs", len(tree))
+}
+
+// prefetched returns the prefetched listing of the given directory, if we have
+// one that isn't too old, forgetting it so that subsequent listings ask the
+// remote.
+func (r *remote) prefetched(remotePath string) (*snapshotDir, bool) {
+	r.treeMutex.Lock()
+	defer r.treeMutex.Unlock()
+	dir, exists := r.tree[remotePath]
+	if !exists {
+		return nil, false
+	}
+	delete(r.tree, remotePath)
+	if r.treeTTL > 0 && time.Since(dir.Listed) >= r.treeTTL {
+		return nil, false
+	}
+	return dir, true
+}
+
+// listDir is like findObjects(), but uses a prefetched listing (see
+// prefetchTree() and loadSnapshot()) if there is one. It also returns when the
+// listing was made, and remembers it for saveSnapshot().
+func (r *remote) listDir(remotePath string) ([]RemoteAttr, time.Time, fuse.Status) {
+	if dir, prefetched := r.prefetched(remotePath); prefetched {
+		r.rememberListing(remotePath, dir)
+		return dir.Entries, dir.Listed, fuse.OK
+	}
+	listed := time.Now()
+	objects, status := r.findObjects(remotePath)
+	if status == fuse.OK || status == fuse.ENOENT {
+		r.rememberListing(remotePath, &snapshotDir{Listed: listed, Entries: objects})
+	}
+	return objects, listed, status
+}
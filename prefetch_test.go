@@ -0,0 +1,124 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of muxfys.
+//
+//  muxfys is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  muxfys is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with muxfys. If not, see <http://www.gnu.org/licenses/>.
+
+package muxfys
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// recursiveAccessor is a listCountingAccessor that implements RecursiveLister.
+type recursiveAccessor struct {
+	*listCountingAccessor
+}
+
+func (a *recursiveAccessor) ListEntriesRecursive(dir string, max int) ([]RemoteAttr, bool, error) {
+	var ras []RemoteAttr
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		ras = append(ras, RemoteAttr{Name: path, Size: info.Size(), MTime: info.ModTime()})
+		return nil
+	})
+	if len(ras) > max {
+		return nil, true, err
+	}
+	return ras, false, err
+}
+
+func TestPrefetchTree(t *testing.T) {
+	Convey("Given a remote with a tree of files", t, func() {
+		tmpdir, err := ioutil.TempDir("", "muxfys_prefetch_testing")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(tmpdir)
+		remoteDir := filepath.Join(tmpdir, "remote")
+		err = os.MkdirAll(filepath.Join(remoteDir, "a", "b"), os.FileMode(dirMode))
+		So(err, ShouldBeNil)
+		err = os.MkdirAll(filepath.Join(remoteDir, "e"), os.FileMode(dirMode))
+		So(err, ShouldBeNil)
+		for _, name := range []string{"a/b/c", "a/d", "e/f", "g"} {
+			err = ioutil.WriteFile(filepath.Join(remoteDir, name), []byte(name), os.FileMode(fileMode))
+			So(err, ShouldBeNil)
+		}
+
+		fs, err := New(&Config{Mount: filepath.Join(tmpdir, "mnt"), CacheBase: tmpdir})
+		So(err, ShouldBeNil)
+		accessor := &recursiveAccessor{&listCountingAccessor{localAccessor: &localAccessor{target: remoteDir}}}
+		r, err := newRemote(&RemoteConfig{Accessor: accessor}, remoteOptions{cacheBase: tmpdir, logger: fs.Logger})
+		So(err, ShouldBeNil)
+		fs.remotes = []*remote{r}
+		fs.OnMount(nil)
+
+		ls := func(dir string) []string {
+			entries, status := fs.OpenDir(dir, &fuse.Context{})
+			So(status, ShouldEqual, fuse.OK)
+			var names []string
+			for _, entry := range entries {
+				names = append(names, entry.Name)
+			}
+			sort.Strings(names)
+			return names
+		}
+
+		Convey("Prefetching lets every directory be listed once without asking the remote", func() {
+			r.prefetchTree(0, 0)
+			So(ls(""), ShouldResemble, []string{"a", "e", "g"})
+			So(ls("a"), ShouldResemble, []string{"b", "d"})
+			So(ls("a/b"), ShouldResemble, []string{"c"})
+			attr, status := fs.GetAttr("e/f", &fuse.Context{})
+			So(status, ShouldEqual, fuse.OK)
+			So(attr.Size, ShouldEqual, 3)
+			So(accessor.lists, ShouldEqual, 0)
+			So(len(r.tree), ShouldEqual, 0)
+
+			err = fs.Invalidate("a", false)
+			So(err, ShouldBeNil)
+			So(ls("a"), ShouldResemble, []string{"b", "d"})
+			So(accessor.lists, ShouldEqual, 1)
+		})
+
+		Convey("Nothing is prefetched if there are too many entries", func() {
+			r.prefetchTree(3, 0)
+			So(len(r.tree), ShouldEqual, 0)
+			So(ls(""), ShouldResemble, []string{"a", "e", "g"})
+			So(accessor.lists, ShouldEqual, 1)
+		})
+
+		Convey("Prefetched listings expire", func() {
+			r.prefetchTree(0, time.Millisecond)
+			<-time.After(5 * time.Millisecond)
+			So(ls(""), ShouldResemble, []string{"a", "e", "g"})
+			So(accessor.lists, ShouldEqual, 1)
+		})
+
+		Convey("Accessors that aren't RecursiveListers can't prefetch", func() {
+			r.accessor = accessor.listCountingAccessor
+			r.prefetchTree(0, 0)
+			So(len(r.tree), ShouldEqual, 0)
+		})
+	})
+}
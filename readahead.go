@@ -0,0 +1,314 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of muxfys.
+//
+//  muxfys is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  muxfys is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with muxfys. If not, see <http://www.gnu.org/licenses/>.
+
+package muxfys
+
+// This file implements background prefetching of remote file data for
+// remoteFiles that are being read sequentially.
+
+import (
+	"io"
+	"sync"
+
+	"github.com/inconshreveable/log15"
+)
+
+const (
+	// readAheadChunkSize is the unit in which data is prefetched and in which
+	// memory is reserved from a readAheadBudget.
+	readAheadChunkSize = int64(1048576) // 1MB
+
+	// readAheadTrigger is the number of consecutive sequential reads a
+	// remoteFile must see before it starts reading ahead.
+	readAheadTrigger = 4
+
+	// readAheadBehind is how many multiples of the most recent read size we
+	// keep behind the furthest point read, to cope with the slightly
+	// out-of-order offsets that fuse gives us even for serial reads.
+	readAheadBehind = 6
+
+	// defaultReadAheadMemory is used when Config.ReadAheadMemory is not set.
+	defaultReadAheadMemory = int64(268435456) // 256MB
+)
+
+// readAheadBudget limits the total memory used by all readAheads that share
+// it. Each readAheadChunkSize of prefetched data holds a slot in the channel
+// until it is no longer needed.
+type readAheadBudget chan struct{}
+
+// newReadAheadBudget creates a readAheadBudget that allows for limit bytes of
+// prefetched data, or defaultReadAheadMemory if limit is not positive.
+func newReadAheadBudget(limit int64) readAheadBudget {
+	if limit <= 0 {
+		limit = defaultReadAheadMemory
+	}
+	slots := limit / readAheadChunkSize
+	if slots < 1 {
+		slots = 1
+	}
+	return make(readAheadBudget, slots)
+}
+
+// aheadChunk is some prefetched data.
+type aheadChunk struct {
+	offset   int64
+	data     []byte
+	reserved bool
+}
+
+// end returns the offset just beyond this chunk's data.
+func (c *aheadChunk) end() int64 {
+	return c.offset + int64(len(c.data))
+}
+
+// readAhead takes ownership of a reader positioned at some offset of a remote
+// file, and reads from it in the background so that data is ready before it is
+// asked for. The amount it reads ahead of the furthest point asked for (its
+// window) starts small and doubles each time a window's worth of data has been
+// consumed, up to a maximum.
+type readAhead struct {
+	mutex    sync.Mutex
+	cond     *sync.Cond
+	reader   io.ReadCloser
+	size     int64
+	chunks   []*aheadChunk
+	fetched  int64
+	consumed int64
+	wanted   int64
+	grown    int64
+	window   int64
+	max      int64
+	err      error
+	closed   bool
+	budget   readAheadBudget
+	wake     chan struct{}
+	stopped  chan struct{}
+	log15.Logger
+}
+
+// newReadAhead creates a readAhead that takes over the given reader, which must
+// be positioned at offset of a file of the given size, and starts reading ahead
+// with the given initial window, which will grow up to max bytes. Reads beyond
+// what the budget allows are only made when they are asked for.
+func newReadAhead(reader io.ReadCloser, offset, size, window, max int64, budget readAheadBudget, logger log15.Logger) *readAhead {
+	if window < readAheadChunkSize {
+		window = readAheadChunkSize
+	}
+	if max < window {
+		max = window
+	}
+	ra := &readAhead{
+		reader:   reader,
+		size:     size,
+		fetched:  offset,
+		consumed: offset,
+		window:   window,
+		max:      max,
+		budget:   budget,
+		wake:     make(chan struct{}, 1),
+		stopped:  make(chan struct{}),
+		Logger:   logger,
+	}
+	ra.cond = sync.NewCond(&ra.mutex)
+	go ra.fetch()
+	return ra
+}
+
+// fetch is run in a goroutine to read data from our reader in to chunks,
+// staying up to our window ahead of what has been consumed. It closes the
+// reader when done.
+func (ra *readAhead) fetch() {
+	defer func() {
+		errc := ra.reader.Close()
+		if errc != nil {
+			ra.Warn("readahead reader close failed", "err", errc)
+		}
+	}()
+
+	for {
+		ra.mutex.Lock()
+		for !ra.closed && ra.err == nil && ra.fetched < ra.size && ra.fetched-ra.consumed >= ra.window && ra.fetched >= ra.wanted {
+			ra.cond.Wait()
+		}
+		if ra.closed || ra.err != nil || ra.fetched >= ra.size {
+			ra.mutex.Unlock()
+			return
+		}
+		offset := ra.fetched
+		demanded := ra.fetched < ra.wanted
+		ra.mutex.Unlock()
+
+		// reserve memory for the chunk, unless it is already being waited
+		// for, in which case we don't let the budget stop us
+		reserved := true
+		if demanded {
+			select {
+			case ra.budget <- struct{}{}:
+			default:
+				reserved = false
+			}
+		} else {
+			select {
+			case ra.budget <- struct{}{}:
+			case <-ra.wake:
+				continue
+			case <-ra.stopped:
+				return
+			}
+		}
+
+		length := readAheadChunkSize
+		if offset+length > ra.size {
+			length = ra.size - offset
+		}
+		data := make([]byte, length)
+		n, err := io.ReadFull(ra.reader, data)
+
+		ra.mutex.Lock()
+		if ra.closed || n == 0 {
+			if reserved {
+				<-ra.budget
+			}
+		} else {
+			ra.chunks = append(ra.chunks, &aheadChunk{offset: offset, data: data[:n], reserved: reserved})
+			ra.fetched += int64(n)
+		}
+		if err != nil && ra.fetched < ra.size {
+			ra.err = err
+		}
+		ra.cond.Broadcast()
+		ra.mutex.Unlock()
+	}
+}
+
+// read fills buf with data from offset, waiting for it to be fetched if
+// necessary. It returns false if the offset is not one we have or will soon
+// have data for, or if the data could not be fetched, in which case you should
+// stop() this readAhead and read some other way.
+func (ra *readAhead) read(buf []byte, offset int64) (int, bool) {
+	ra.mutex.Lock()
+	defer ra.mutex.Unlock()
+
+	if ra.closed || offset < ra.low() || offset > ra.fetched+readAheadChunkSize {
+		return 0, false
+	}
+
+	end := offset + int64(len(buf))
+	if end > ra.size {
+		end = ra.size
+	}
+	if need := end - offset; need > ra.window {
+		ra.window = need
+	}
+	if offset > ra.consumed {
+		ra.consumed = offset
+	}
+
+	if ra.fetched < end {
+		ra.wanted = end
+		select {
+		case ra.wake <- struct{}{}:
+		default:
+		}
+		ra.cond.Broadcast()
+		for ra.fetched < end && ra.err == nil && !ra.closed {
+			ra.cond.Wait()
+		}
+		ra.wanted = 0
+		if ra.fetched < end {
+			return 0, false
+		}
+	}
+
+	var n int
+	for _, c := range ra.chunks {
+		if c.end() <= offset || c.offset >= end {
+			continue
+		}
+		n += copyBlockData(buf, offset, end, c.offset, c.data)
+	}
+
+	if end > ra.consumed {
+		ra.grown += end - ra.consumed
+		ra.consumed = end
+		if ra.grown >= ra.window && ra.window < ra.max {
+			ra.grown -= ra.window
+			ra.window *= 2
+			if ra.window > ra.max {
+				ra.window = ra.max
+			}
+		}
+	}
+	ra.forget(ra.consumed - readAheadBehind*int64(len(buf)))
+	ra.cond.Broadcast()
+
+	return n, true
+}
+
+// low returns the lowest offset we currently hold data for. Must be called
+// while you hold the mutex.
+func (ra *readAhead) low() int64 {
+	if len(ra.chunks) > 0 {
+		return ra.chunks[0].offset
+	}
+	return ra.fetched
+}
+
+// forget drops chunks that hold no data at or beyond offset, releasing their
+// memory back to the budget. Must be called while you hold the mutex.
+func (ra *readAhead) forget(offset int64) {
+	i := 0
+	for ; i < len(ra.chunks) && ra.chunks[i].end() <= offset; i++ {
+		if ra.chunks[i].reserved {
+			<-ra.budget
+		}
+	}
+	ra.chunks = ra.chunks[i:]
+}
+
+// stop ends any background reading, closes our reader and releases our memory.
+// It is safe to call more than once.
+func (ra *readAhead) stop() {
+	ra.mutex.Lock()
+	defer ra.mutex.Unlock()
+	if ra.closed {
+		return
+	}
+	ra.closed = true
+	ra.forget(ra.size + 1)
+	close(ra.stopped)
+	ra.cond.Broadcast()
+}
+
+// copyBlockData copies the part of data (which starts at dataOffset in some
+// file) that lies between offset and end in to buf, which starts at offset.
+// Returns the number of bytes copied.
+func copyBlockData(buf []byte, offset, end, dataOffset int64, data []byte) int {
+	from := offset
+	if dataOffset > from {
+		from = dataOffset
+	}
+	to := dataOffset + int64(len(data))
+	if end < to {
+		to = end
+	}
+	if from >= to {
+		return 0
+	}
+	return copy(buf[from-offset:to-offset], data[from-dataOffset:to-dataOffset])
+}
@@ -0,0 +1,195 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of muxfys.
+//
+//  muxfys is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  muxfys is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with muxfys. If not, see <http://www.gnu.org/licenses/>.
+
+package muxfys
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/inconshreveable/log15"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// testReader is an io.ReadCloser over some bytes that can be made to fail
+// after a certain number of bytes.
+type testReader struct {
+	mutex  sync.Mutex
+	r      *bytes.Reader
+	failAt int64
+	read   int64
+	closed bool
+}
+
+func (t *testReader) Read(p []byte) (int, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.failAt > 0 && t.read+int64(len(p)) > t.failAt {
+		return 0, errors.New("fail")
+	}
+	n, err := t.r.Read(p)
+	t.read += int64(n)
+	return n, err
+}
+
+func (t *testReader) Close() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.closed = true
+	return nil
+}
+
+func (t *testReader) progress() (int64, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.read, t.closed
+}
+
+func TestReadAhead(t *testing.T) {
+	logger := log15.New()
+	logger.SetHandler(log15.DiscardHandler())
+
+	size := readAheadChunkSize*8 + 10
+	file := make([]byte, size)
+	for i := range file {
+		file[i] = byte(i % 251)
+	}
+	var offset int64 = 100
+	newReader := func() *testReader {
+		r := bytes.NewReader(file)
+		_, err := r.Seek(offset, io.SeekStart)
+		So(err, ShouldBeNil)
+		return &testReader{r: r}
+	}
+	waitFor := func(f func() bool) bool {
+		limit := time.After(5 * time.Second)
+		for !f() {
+			select {
+			case <-limit:
+				return false
+			case <-time.After(time.Millisecond):
+			}
+		}
+		return true
+	}
+
+	Convey("A readAhead prefetches up to its window", t, func() {
+		budget := newReadAheadBudget(readAheadChunkSize * 100)
+		reader := newReader()
+		ra := newReadAhead(reader, offset, size, 1, readAheadChunkSize*4, budget, logger)
+		defer ra.stop()
+
+		So(waitFor(func() bool {
+			read, _ := reader.progress()
+			return read == readAheadChunkSize
+		}), ShouldBeTrue)
+		<-time.After(10 * time.Millisecond)
+		read, _ := reader.progress()
+		So(read, ShouldEqual, readAheadChunkSize)
+		So(len(budget), ShouldEqual, 1)
+
+		Convey("Sequential reads get the right data and grow the window", func() {
+			buf := make([]byte, 1000)
+			for o := offset; o < offset+readAheadChunkSize*3+1000; o += 1000 {
+				n, ok := ra.read(buf, o)
+				So(ok, ShouldBeTrue)
+				So(n, ShouldEqual, 1000)
+				So(bytes.Equal(buf, file[o:o+1000]), ShouldBeTrue)
+			}
+			ra.mutex.Lock()
+			window := ra.window
+			ra.mutex.Unlock()
+			So(window, ShouldEqual, readAheadChunkSize*4)
+
+			Convey("Slightly earlier offsets still work, but far away ones don't", func() {
+				o := offset + readAheadChunkSize*3 - 3000
+				n, ok := ra.read(buf, o)
+				So(ok, ShouldBeTrue)
+				So(n, ShouldEqual, 1000)
+				So(bytes.Equal(buf, file[o:o+1000]), ShouldBeTrue)
+
+				_, ok = ra.read(buf, offset)
+				So(ok, ShouldBeFalse)
+				_, ok = ra.read(buf, size-1000)
+				So(ok, ShouldBeFalse)
+			})
+
+			Convey("Reads at the end are truncated", func() {
+				var n int
+				var ok bool
+				var last int64
+				for o := offset + readAheadChunkSize*3; o < size; o += 1000 {
+					n, ok = ra.read(buf, o)
+					So(ok, ShouldBeTrue)
+					last = o
+				}
+				So(n, ShouldEqual, size-last)
+				So(bytes.Equal(buf[:n], file[last:]), ShouldBeTrue)
+			})
+		})
+
+		Convey("stop() closes the reader and releases memory", func() {
+			ra.stop()
+			So(waitFor(func() bool {
+				_, closed := reader.progress()
+				return closed
+			}), ShouldBeTrue)
+			So(len(budget), ShouldEqual, 0)
+			_, ok := ra.read(make([]byte, 10), offset)
+			So(ok, ShouldBeFalse)
+		})
+	})
+
+	Convey("A readAhead with no budget left only fetches what is asked for", t, func() {
+		budget := newReadAheadBudget(readAheadChunkSize)
+		budget <- struct{}{}
+		reader := newReader()
+		ra := newReadAhead(reader, offset, size, 1, readAheadChunkSize*4, budget, logger)
+		defer ra.stop()
+
+		<-time.After(10 * time.Millisecond)
+		read, _ := reader.progress()
+		So(read, ShouldEqual, 0)
+
+		buf := make([]byte, 1000)
+		n, ok := ra.read(buf, offset)
+		So(ok, ShouldBeTrue)
+		So(n, ShouldEqual, 1000)
+		So(bytes.Equal(buf, file[offset:offset+1000]), ShouldBeTrue)
+		So(len(budget), ShouldEqual, 1)
+	})
+
+	Convey("A readAhead whose reader fails gives up", t, func() {
+		budget := newReadAheadBudget(0)
+		So(cap(budget), ShouldEqual, defaultReadAheadMemory/readAheadChunkSize)
+		reader := newReader()
+		reader.failAt = readAheadChunkSize + 10
+		ra := newReadAhead(reader, offset, size, 1, readAheadChunkSize*4, budget, logger)
+		defer ra.stop()
+
+		buf := make([]byte, 1000)
+		_, ok := ra.read(buf, offset)
+		So(ok, ShouldBeTrue)
+		_, ok = ra.read(buf, offset+readAheadChunkSize)
+		So(ok, ShouldBeFalse)
+	})
+}
@@ -49,6 +49,23 @@ type RemoteConfig struct {
 	// all the connection details for accessing your remote file system.
 	Accessor RemoteAccessor
 
+	// Replicas are RemoteAccessors for mirrors of the files that Accessor
+	// accesses (eg. in another object store), each configured with the
+	// equivalent base path in its own namespace. When reads from Accessor keep
+	// failing, they fail over to the first working replica instead of waiting
+	// for Accessor to come back, and go back to Accessor once it works again.
+	// See MuxFys.ReplicaHealth() for how each has been doing. Replicas are
+	// never written to, so can't be used with Write.
+	Replicas []RemoteAccessor
+
+	// MountPath is the directory beneath the mount point where the root of
+	// this remote will appear, eg. "refs/hg38". The default of "" overlays the
+	// remote at the mount point itself. Any parent directories that aren't in
+	// a remote are created in the mount (but not in any remote), and can't be
+	// removed or renamed. A writeable remote with a MountPath can only be
+	// written to within that directory.
+	MountPath string
+
 	// CacheData enables caching of remote files that you read locally on disk.
 	// Writes will also be staged on local disk prior to upload.
 	CacheData bool
@@ -61,9 +78,131 @@ type RemoteConfig struct {
 	// treated as true.
 	CacheDir string
 
+	// CacheBlockSize, if greater than 0, makes reads of files that are not
+	// already cached fetch and record whole blocks of this many bytes (aligned
+	// to multiples of the block size), instead of exactly the bytes requested.
+	// Values of 4-64MB will greatly reduce the number of remote requests made
+	// when reading in small pieces. This only has an effect when CacheData is
+	// true and CacheDir is not defined (since otherwise whole files are
+	// downloaded).
+	CacheBlockSize int64
+
+	// ReadAhead, if greater than 0, enables prefetching of data in the
+	// background when a file is being read sequentially (directly from the
+	// remote, or in to the cache when CacheData is true). It is the maximum
+	// number of bytes that will be read ahead of the current read position;
+	// the amount starts small and grows while reading stays sequential. The
+	// total memory used for this by all files is limited by
+	// Config.ReadAheadMemory.
+	ReadAhead int64
+
+	// WritePartSize is the size of the parts that files are uploaded in when
+	// writing without CacheData, if the Accessor implements
+	// MultipartUploader. That allows files to be written in any order, not
+	// just serially: each part is held until it has been completely written,
+	// then uploaded (except for the first part, which is held until the file
+	// is closed, so that headers can be rewritten at the end). Writes to other
+	// parts that have already been uploaded fail with ESPIPE. Parts are held
+	// in memory up to Config's WriteStageMemory, and in a temporary file in
+	// MuxFys' CacheBase directory beyond that. The maximum size of a file you
+	// can write is 10,000 times this. Defaults to 16MB; minimum 5MB.
+	WritePartSize int64
+
+	// UploadOnFsync makes fsync() calls on files you are writing make what you
+	// have written so far durable remotely, before they return. When CacheData
+	// is true, the current contents of the file are uploaded (and will be
+	// uploaded again when they are next due to be, eg. at Unmount()).
+	// Otherwise, when the Accessor is a MultipartUploader, the upload of what
+	// has been written so far is completed, so the file appears remotely; the
+	// parts of it that aren't written to again are read back from the remote
+	// and uploaded again when it is next synced or closed, so frequent fsync()s
+	// of large files are expensive. Serial writes to other Accessors are only
+	// durable once the file is closed. Without this, fsync() does nothing.
+	UploadOnFsync bool
+
+	// ConflictSuffix, if set, turns on detection of conflicting writes by
+	// someone else, when CacheData is true. The ETag of each file (or its
+	// absence) is noted when it is first listed or created, and if the remote
+	// file has changed by the time your version is uploaded, your version is
+	// uploaded to the same path with this suffix added instead of overwriting
+	// the other version. Requires an Accessor that implements ETagStater (as
+	// S3Accessor does).
+	ConflictSuffix string
+
+	// PrefetchTree makes Mount() list everything in the remote with a single
+	// recursive listing, which is much quicker than listing each directory as
+	// it is accessed when you have a deep tree of moderate size. Each
+	// directory's prefetched listing is used the first time it is accessed
+	// (and only if that is within Config.MetadataTTL of mounting); after that
+	// directories are listed as normal. Requires an Accessor that implements
+	// RecursiveLister (as S3Accessor does).
+	PrefetchTree bool
+
+	// PrefetchLimit is the maximum number of files that PrefetchTree will
+	// prefetch; if the remote has more, nothing is prefetched and directories
+	// are listed as they are accessed. Defaults to 100000.
+	PrefetchLimit int
+
+	// MetadataSnapshot makes Unmount() save the directory listings of the
+	// remote in its CacheDir (which must be set), so that the next Mount()
+	// with the same CacheDir and target can use them instead of listing the
+	// remote again. This is for remotes that rarely change, such as reference
+	// data, and can't be used with Write. Each directory's listing from the
+	// snapshot is only used the first time it is accessed, and is treated as
+	// having been made when it was originally listed, so with a
+	// Config.MetadataTTL it is listed again once older than that. If a
+	// snapshot is loaded, PrefetchTree is not done.
+	MetadataSnapshot bool
+
+	// MetadataSnapshotMaxAge, if greater than 0, is the maximum age of the
+	// directory listings in a MetadataSnapshot that will be trusted by
+	// Mount(); older ones are listed again from the remote.
+	MetadataSnapshotMaxAge time.Duration
+
+	// Include, if set, limits the files that are visible in the mount to those
+	// matching at least one of these glob patterns (or IncludeRegexp).
+	// Patterns without a "/" are matched against the file's basename (eg.
+	// "*.cram"), others against its whole path relative to the root of the
+	// remote (eg. "data/*/manifest.tsv"). Directories are always visible
+	// unless excluded, so that the included files within them can be reached,
+	// though this means they can look empty.
+	Include []string
+
+	// Exclude hides the files and directories (and everything within them)
+	// that match any of these glob patterns, which are matched in the same way
+	// as for Include. Exclusions take precedence over inclusions.
+	Exclude []string
+
+	// IncludeRegexp is like Include, but is a regular expression that can
+	// match anywhere in a file's path relative to the root of the remote.
+	IncludeRegexp string
+
+	// ExcludeRegexp is like Exclude, but is a regular expression that can
+	// match anywhere in a path relative to the root of the remote. Directory
+	// paths are given a trailing "/", so "^tmp/" hides the tmp directory.
+	ExcludeRegexp string
+
+	// Files and directories hidden by the above filters can't be listed,
+	// statted or created through the mount, so all tools get the same
+	// filtered view.
+
 	// Write enables write operations in the mount. Only set true if you know
-	// you really need to write.
+	// you really need to write. When multiplexed with read-only remotes, the
+	// writeable remote acts like the upper layer of an overlay: modifying a
+	// read-only file first copies it to the writeable remote (if CacheData is
+	// true), and deleting one stores an empty ".wh.<name>" whiteout object in
+	// the writeable remote that hides it, including in future mounts.
 	Write bool
+
+	// WriteRules lets you have multiple writeable remotes, by deciding which
+	// of them new files and directories are created in. Patterns ending in
+	// "/" match that directory and everything beneath it (eg. "results/"),
+	// others are matched like Include patterns (eg. "*.log"), but always
+	// against paths relative to the mount point. New paths go to the first
+	// writeable remote (in the order you Mount() them) with a matching rule,
+	// or else to the one writeable remote without WriteRules, if any. Existing
+	// files are always written back to the remote they came from.
+	WriteRules []string
 }
 
 // RemoteAttr struct describes the attributes of a remote file or directory.
@@ -148,27 +287,84 @@ type RemoteAccessor interface {
 // object store. It embeds a CacheTracker and a RemoteAccessor to do its work.
 type remote struct {
 	*CacheTracker
-	accessor      RemoteAccessor
-	cacheData     bool
-	cacheDir      string
-	cacheIsTmp    bool
-	maxAttempts   int
-	write         bool
-	clientBackoff *backoff.Backoff
-	hasWorked     bool
-	cbMutex       sync.Mutex
+	accessor       RemoteAccessor
+	cacheData      bool
+	cacheDir       string
+	cacheIsTmp     bool
+	maxAttempts    int
+	write          bool
+	clientBackoff  *backoff.Backoff
+	hasWorked      bool
+	cbMutex        sync.Mutex
+	memCache       *blockCache
+	readAhead      int64
+	aheadBudget    readAheadBudget
+	writePartSize  int64
+	stageBudget    writeStageBudget
+	stageDir       string
+	uploadOnFsync  bool
+	uploadHook     func(UploadEvent)
+	conflictSuffix string
+	etags          map[string]string
+	etagMutex      sync.Mutex
+	tree           map[string]*snapshotDir
+	treeTTL        time.Duration
+	listings       map[string]*snapshotDir
+	treeMutex      sync.Mutex
+	filter         *pathFilter
+	mountPath      string
+	writeRules     []string
+	journal        *journal
+	replicas       []*replica
 	log15.Logger
 }
 
-// newRemote creates a remote for use inside MuxFys.
-func newRemote(accessor RemoteAccessor, cacheData bool, cacheDir string, cacheBase string, write bool, maxAttempts int, logger log15.Logger) (*remote, error) {
+// remoteOptions are the settings of a MuxFys that apply to all of its remotes.
+// memCache is optional, and if supplied will be used to hold recently read file
+// data in memory. aheadBudget supplies the memory for RemoteConfig.ReadAhead,
+// and stageBudget the memory for staging writes (see WritePartSize).
+// uploadHook is optional, and if supplied will be sent UploadEvents for every
+// upload. Temporary cache directories are created in cacheBase.
+type remoteOptions struct {
+	cacheBase   string
+	maxAttempts int
+	memCache    *blockCache
+	aheadBudget readAheadBudget
+	stageBudget writeStageBudget
+	uploadHook  func(UploadEvent)
+	logger      log15.Logger
+}
+
+// newRemote creates a remote for use inside MuxFys, configured by the given
+// RemoteConfig. A maxAttempts of less than 1 is treated as 1, and a nil logger
+// as our package logger.
+func newRemote(c *RemoteConfig, opts remoteOptions) (*remote, error) {
+	if _, canStat := c.Accessor.(ETagStater); c.ConflictSuffix != "" && !canStat {
+		return nil, fmt.Errorf("a ConflictSuffix requires an Accessor that is an ETagStater")
+	}
+	if len(c.Replicas) > 0 && c.Write {
+		return nil, fmt.Errorf("Replicas can't be used with a writeable remote")
+	}
+	filter, err := newPathFilter(c.Include, c.Exclude, c.IncludeRegexp, c.ExcludeRegexp)
+	if err != nil {
+		return nil, err
+	}
+	mountPath, err := cleanMountPath(c.MountPath)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkWriteRules(c.WriteRules); err != nil {
+		return nil, err
+	}
+
 	// handle cacheData option, creating cache dir if necessary
+	cacheData := c.CacheData
+	cacheDir := c.CacheDir
 	if !cacheData && cacheDir != "" {
 		cacheData = true
 	}
 
 	if cacheDir != "" {
-		var err error
 		cacheDir, err = homedir.Expand(cacheDir)
 		if err != nil {
 			return nil, err
@@ -186,30 +382,58 @@ func newRemote(accessor RemoteAccessor, cacheData bool, cacheDir string, cacheBa
 	cacheIsTmp := false
 	if cacheData && cacheDir == "" {
 		// decide on our own cache directory
-		var err error
-		cacheDir, err = ioutil.TempDir(cacheBase, ".muxfys_cache")
+		cacheDir, err = ioutil.TempDir(opts.cacheBase, ".muxfys_cache")
 		if err != nil {
 			return nil, err
 		}
 		cacheIsTmp = true
 	}
 
-	return &remote{
-		CacheTracker: NewCacheTracker(),
-		accessor:     accessor,
+	tracker := NewBlockCacheTracker(c.CacheBlockSize)
+	tracker.mem = opts.memCache
+
+	maxAttempts := opts.maxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	logger := opts.logger
+	if logger == nil {
+		logger = pkgLogger
+	}
+
+	r := &remote{
+		CacheTracker: tracker,
+		accessor:     c.Accessor,
 		cacheData:    cacheData,
 		cacheDir:     cacheDir,
 		cacheIsTmp:   cacheIsTmp,
 		maxAttempts:  maxAttempts,
-		write:        write,
+		write:        c.Write,
 		clientBackoff: &backoff.Backoff{
 			Min:    100 * time.Millisecond,
 			Max:    10 * time.Second,
 			Factor: 3,
 			Jitter: true,
 		},
-		Logger: logger.New("target", accessor.Target()),
-	}, nil
+		memCache:       opts.memCache,
+		readAhead:      c.ReadAhead,
+		aheadBudget:    opts.aheadBudget,
+		writePartSize:  c.WritePartSize,
+		stageBudget:    opts.stageBudget,
+		stageDir:       opts.cacheBase,
+		uploadOnFsync:  c.UploadOnFsync,
+		uploadHook:     opts.uploadHook,
+		conflictSuffix: c.ConflictSuffix,
+		etags:          make(map[string]string),
+		filter:         filter,
+		mountPath:      mountPath,
+		writeRules:     c.WriteRules,
+		Logger:         logger.New("target", c.Accessor.Target()),
+	}
+	if len(c.Replicas) > 0 {
+		r.setReplicas(c.Replicas)
+	}
+	return r, nil
 }
 
 // retryFunc is used as an argument to remote.retry() - the function is retried
@@ -225,6 +449,25 @@ type retryFunc func() error
 // calls had previously succeeded, potentially exceeding desired number of
 // attempts.
 func (r *remote) retry(clientMethod string, path string, rf retryFunc) fuse.Status {
+	status, _, _ := r.retryAttempts(clientMethod, path, rf)
+	return status
+}
+
+// retryAttempts is like retry(), but also returns the number of attempts that
+// were made and the error from the last one.
+func (r *remote) retryAttempts(clientMethod string, path string, rf retryFunc) (fuse.Status, int, error) {
+	return r.attempt(r.accessor, clientMethod, path, rf, true)
+}
+
+// attempt is the implementation of retryAttempts(), where rf uses the given
+// accessor (our own or one of our replicas). If waitForDown is false, peer
+// resets are only retried the usual number of times, because we have another
+// replica to fail over to.
+func (r *remote) attempt(a RemoteAccessor, clientMethod string, path string, rf retryFunc, waitForDown bool) (fuse.Status, int, error) {
+	logger := r.Logger
+	if a != r.accessor {
+		logger = logger.New("replica", a.Target())
+	}
 	attempts := 0
 	start := time.Now()
 	var lastError error
@@ -236,21 +479,21 @@ ATTEMPTS:
 			lastError = err
 
 			// return immediately if key not found or quota exceeded
-			if r.accessor.ErrorIsNotExists(err) {
-				r.Warn("File doesn't exist", "call", clientMethod, "path", path, "walltime", time.Since(start))
-				return fuse.ENOENT
+			if a.ErrorIsNotExists(err) {
+				logger.Warn("File doesn't exist", "call", clientMethod, "path", path, "walltime", time.Since(start))
+				return fuse.ENOENT, attempts, err
 			}
-			if r.accessor.ErrorIsNoQuota(err) {
-				r.Warn("Quota Exceeded", "call", clientMethod, "path", path, "walltime", time.Since(start))
-				return fuse.ENODATA
+			if a.ErrorIsNoQuota(err) {
+				logger.Warn("Quota Exceeded", "call", clientMethod, "path", path, "walltime", time.Since(start))
+				return fuse.ENODATA, attempts, err
 			}
 
 			if strings.Contains(err.Error(), "reset by peer") {
 				// special-case peer resets which could indicate a temporary but
 				// multi-minute downtime
 				r.cbMutex.Lock()
-				if r.hasWorked && time.Since(start) < downRemoteWaitTime {
-					r.Warn("Connection problem, will retry", "call", clientMethod, "path", path, "retries", attempts-1, "walltime", time.Since(start), "err", err)
+				if waitForDown && r.hasWorked && time.Since(start) < downRemoteWaitTime {
+					logger.Warn("Connection problem, will retry", "call", clientMethod, "path", path, "retries", attempts-1, "walltime", time.Since(start), "err", err)
 					dur := r.clientBackoff.Duration()
 					r.cbMutex.Unlock()
 					<-time.After(dur)
@@ -268,19 +511,19 @@ ATTEMPTS:
 				<-time.After(dur)
 				continue ATTEMPTS
 			}
-			r.Error("Remote call failed", "call", clientMethod, "path", path, "retries", attempts-1, "walltime", time.Since(start), "err", err)
-			return fuse.EIO
+			logger.Error("Remote call failed", "call", clientMethod, "path", path, "retries", attempts-1, "walltime", time.Since(start), "err", err)
+			return fuse.EIO, attempts, err
 		}
 		if attempts-1 > 0 {
-			r.Info("Remote call succeeded", "call", clientMethod, "path", path, "walltime", time.Since(start), "retries", attempts-1, "walltime", time.Since(start), "previous_err", lastError)
+			logger.Info("Remote call succeeded", "call", clientMethod, "path", path, "walltime", time.Since(start), "retries", attempts-1, "walltime", time.Since(start), "previous_err", lastError)
 		} else {
-			r.Info("Remote call succeeded", "call", clientMethod, "path", path, "walltime", time.Since(start))
+			logger.Info("Remote call succeeded", "call", clientMethod, "path", path, "walltime", time.Since(start))
 		}
 		r.cbMutex.Lock()
 		r.clientBackoff.Reset()
 		r.hasWorked = true
 		r.cbMutex.Unlock()
-		return fuse.OK
+		return fuse.OK, attempts, nil
 	}
 }
 
@@ -304,9 +547,9 @@ func (r *remote) statusFromErr(clientMethod string, err error) fuse.Status {
 }
 
 // getRemotePath gets the real complete remote path given the path relative to
-// the configured remote mount point.
+// the configured mount point (which must be within our MountPath).
 func (r *remote) getRemotePath(relPath string) string {
-	return r.accessor.RemotePath(relPath)
+	return r.accessor.RemotePath(r.relPath(relPath))
 }
 
 // getLocalPath gets the path to the local cached file when configured with
@@ -319,37 +562,106 @@ func (r *remote) getLocalPath(remotePath string) string {
 	return ""
 }
 
+// memKey returns the key under which data for the given remote path is stored
+// in our in-memory block cache: the local cache path when in CacheData mode
+// (so that the CacheTracker keeps both in sync), otherwise the remote path
+// qualified by our target.
+func (r *remote) memKey(remotePath string) string {
+	if r.cacheData {
+		return r.getLocalPath(remotePath)
+	}
+	return r.accessor.Target() + ":" + remotePath
+}
+
 // uploadFile uploads the given local file to the given remote path, with
 // automatic retries on failure.
 func (r *remote) uploadFile(localPath, remotePath string) fuse.Status {
+	status, _, _, _ := r.uploadFileAttempts(localPath, remotePath)
+	return status
+}
+
+// uploadFileAttempts is like uploadFile(), but also returns the number of
+// upload attempts that were made, the remote path that was actually uploaded
+// to (which will differ from remotePath if we're detecting conflicts and
+// found one), and the error from the last attempt.
+func (r *remote) uploadFileAttempts(localPath, remotePath string) (fuse.Status, int, string, error) {
 	// get the file's content type
 	file, err := os.Open(localPath)
 	if err != nil {
 		r.Error("Could not open local file", "method", "uploadFile", "path", localPath, "err", err)
-		return fuse.EIO
+		return fuse.EIO, 0, remotePath, err
 	}
 	buffer := make([]byte, 512)
 	n, err := file.Read(buffer)
 	if err != nil && err != io.EOF {
 		r.Error("Could not read local file", "method", "uploadFile", "path", localPath, "err", err)
 		logClose(r.Logger, file, "upload file", "path", localPath)
-		return fuse.EIO
+		return fuse.EIO, 0, remotePath, err
 	}
 	contentType := http.DetectContentType(buffer[:n])
+	size := int64(-1)
+	if info, errs := file.Stat(); errs == nil {
+		size = info.Size()
+	}
 	logClose(r.Logger, file, "upload file", "path", localPath)
 
+	// if someone else changed the remote file since we first saw it, upload
+	// to a different path instead
+	dest := remotePath
+	expected, checking := r.expectedETag(remotePath)
+	cu, conditional := r.accessor.(ConditionalUploader)
+	if checking && !conditional {
+		checking = false
+		if r.changedRemotely(remotePath, expected) {
+			dest = r.conflictPath(remotePath)
+		}
+	}
+
 	// upload, with automatic retries
+	tracker := r.newUploadTracker(remotePath, size)
+	pu, canProgress := r.accessor.(ProgressUploader)
+	eu, canETag := r.accessor.(ETagUploader)
+	var etag string
 	rf := func() error {
-		return r.accessor.UploadFile(localPath, remotePath, contentType)
+		tracker.attempt()
+		var erru error
+		if checking {
+			etag, erru = cu.UploadFileIfMatch(localPath, dest, contentType, expected)
+			if erru != ErrUploadConflict {
+				return erru
+			}
+			checking = false
+			dest = r.conflictPath(remotePath)
+		}
+		if canETag && r.conflictSuffix != "" {
+			var progress func(bytes int64)
+			if tracker != nil {
+				progress = tracker.progress
+			}
+			etag, erru = eu.UploadFileETag(localPath, dest, contentType, progress)
+			return erru
+		}
+		if tracker != nil && canProgress {
+			return pu.UploadFileWithProgress(localPath, dest, contentType, tracker.progress)
+		}
+		return r.accessor.UploadFile(localPath, dest, contentType)
 	}
-	status := r.retry("UploadFile", remotePath, rf)
+	status, attempts, err := r.retryAttempts("UploadFile", remotePath, rf)
+	tracker.finish(statusErr(status, err))
 	if status != fuse.OK {
-		errd := r.accessor.DeleteIncompleteUpload(remotePath)
+		errd := r.accessor.DeleteIncompleteUpload(dest)
 		if errd != nil && !os.IsNotExist(errd) {
 			r.Warn("Deletion of incomplete upload failed", "err", errd)
 		}
+		return status, attempts, dest, err
 	}
-	return status
+
+	if dest == remotePath {
+		r.uploadedETag(remotePath, etag)
+	} else {
+		r.Warn("Remote file was changed by someone else; uploaded to a conflict path instead", "path", remotePath, "conflict", dest)
+	}
+	return status, attempts, dest, err
 }
 
 // uploadData uploads the given data stream to the given remote path, with
@@ -363,8 +675,14 @@ func (r *remote) uploadFile(localPath, remotePath string) fuse.Status {
 // finished receives false.)
 func (r *remote) uploadData(data io.ReadCloser, remotePath string) (ready chan bool, finished chan bool) {
 	// upload, with automatic retries
+	tracker := r.newUploadTracker(remotePath, -1)
+	var reader io.Reader = data
+	if tracker != nil {
+		reader = &progressReader{Reader: data, t: tracker}
+	}
 	rf := func() error {
-		return r.accessor.UploadData(data, remotePath)
+		tracker.attempt()
+		return r.accessor.UploadData(reader, remotePath)
 	}
 
 	ready = make(chan bool)
@@ -376,7 +694,8 @@ func (r *remote) uploadData(data io.ReadCloser, remotePath string) (ready chan b
 			ready <- true
 			sentReady <- true
 		}()
-		status := r.retry("UploadData", remotePath, rf)
+		status, _, err := r.retryAttempts("UploadData", remotePath, rf)
+		tracker.finish(statusErr(status, err))
 		<-sentReady // in case rf completes in less than 50ms
 		if status == fuse.OK {
 			finished <- true
@@ -395,11 +714,12 @@ func (r *remote) uploadData(data io.ReadCloser, remotePath string) (ready chan b
 // downloadFile downloads the given remote file to the given local path, with
 // automatic retries on failure.
 func (r *remote) downloadFile(remotePath, localPath string) fuse.Status {
-	// upload, with automatic retries
-	rf := func() error {
-		return r.accessor.DownloadFile(remotePath, localPath)
+	// download, with automatic retries and failover
+	rf := func(a RemoteAccessor, path string) error {
+		return a.DownloadFile(path, localPath)
 	}
-	return r.retry("DownloadFile", remotePath, rf)
+	_, status := r.retryRead("DownloadFile", remotePath, rf)
+	return status
 }
 
 // findObjects returns details of all files and directories with the same prefix
@@ -407,14 +727,19 @@ func (r *remote) downloadFile(remotePath, localPath string) fuse.Status {
 // it's like a directory listing. Returns the details and fuse.OK if there were
 // no problems getting those details.
 func (r *remote) findObjects(remotePath string) ([]RemoteAttr, fuse.Status) {
-	// find objects, with automatic retries
+	// find objects, with automatic retries and failover
 	var ras []RemoteAttr
-	rf := func() error {
+	rf := func(a RemoteAccessor, path string) error {
 		var err error
-		ras, err = r.accessor.ListEntries(remotePath)
+		ras, err = a.ListEntries(path)
+		if err == nil && path != remotePath {
+			for i := range ras {
+				ras[i].Name = remotePath + strings.TrimPrefix(ras[i].Name, path)
+			}
+		}
 		return err
 	}
-	status := r.retry("ListEntries", remotePath, rf)
+	_, status := r.retryRead("ListEntries", remotePath, rf)
 	return ras, status
 }
 
@@ -422,29 +747,56 @@ func (r *remote) findObjects(remotePath string) ([]RemoteAttr, fuse.Status) {
 // read from. Optionally also seek within it first (to the given number of bytes
 // from the start of the file).
 func (r *remote) getObject(remotePath string, offset int64) (io.ReadCloser, fuse.Status) {
-	// get object and seek, with automatic retries
+	// get object and seek, with automatic retries and failover
 	var reader io.ReadCloser
-	rf := func() error {
+	rf := func(a RemoteAccessor, path string) error {
 		var err error
-		reader, err = r.accessor.OpenFile(remotePath, offset)
+		reader, err = a.OpenFile(path, offset)
 		return err
 	}
-	status := r.retry("OpenFile", remotePath, rf)
+	rep, status := r.retryRead("OpenFile", remotePath, rf)
+	if rep != nil && status == fuse.OK {
+		reader = &replicaReader{ReadCloser: reader, rep: rep}
+	}
 	return reader, status
 }
 
 // seek takes the object returned by getObject and seeks it to the desired
 // offset from the start of the file. This may involve creating a new object,
 // which is why remotePath must be supplied, and why you get back an object.
-// This might be the same object you supplied if there were no problems.
+// This might be the same object you supplied if there were no problems. If the
+// object came from a replica that fails, we fail over to getting a new object
+// from another.
 func (r *remote) seek(rc io.ReadCloser, offset int64, remotePath string) (io.ReadCloser, fuse.Status) {
+	rr, fromReplica := rc.(*replicaReader)
+	if !fromReplica {
+		var reader io.ReadCloser
+		rf := func() error {
+			var err error
+			reader, err = r.accessor.Seek(remotePath, rc, offset)
+			return err
+		}
+		status := r.retry(fmt.Sprintf("Seek(%d)", offset), remotePath, rf)
+		return reader, status
+	}
+
+	a := rr.rep.accessor
+	path := r.pathFor(a, remotePath)
 	var reader io.ReadCloser
 	rf := func() error {
 		var err error
-		reader, err = r.accessor.Seek(remotePath, rc, offset)
+		reader, err = a.Seek(path, rr.ReadCloser, offset)
 		return err
 	}
-	status := r.retry(fmt.Sprintf("Seek(%d)", offset), remotePath, rf)
+	status, _, err := r.attempt(a, fmt.Sprintf("Seek(%d)", offset), path, rf, false)
+	switch status {
+	case fuse.OK:
+		rr.rep.succeeded()
+		return &replicaReader{ReadCloser: reader, rep: rr.rep}, status
+	case fuse.EIO:
+		rr.rep.failed(err, 1)
+		return r.getObject(remotePath, offset)
+	}
 	return reader, status
 }
 
@@ -0,0 +1,256 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of muxfys.
+//
+//  muxfys is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  muxfys is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with muxfys. If not, see <http://www.gnu.org/licenses/>.
+
+package muxfys
+
+// This file implements failing over reads to the replicas of a remote when its
+// accessor (or another replica) stops working, and tracking the health of
+// each.
+
+import (
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/inconshreveable/log15"
+)
+
+// replicaRetryInterval is how long we avoid a replica that stopped working
+// before giving it another chance.
+const replicaRetryInterval = 1 * time.Minute
+
+// ReplicaHealth describes how well one of the accessors of a remote with
+// RemoteConfig.Replicas has been working.
+type ReplicaHealth struct {
+	// Target is the accessor's Target().
+	Target string
+
+	// Primary is true for the RemoteConfig's Accessor, and false for its
+	// Replicas.
+	Primary bool
+
+	// Healthy is false if reads failed over from this accessor and haven't
+	// worked again since.
+	Healthy bool
+
+	// DownSince is when the accessor stopped being Healthy.
+	DownSince time.Time
+
+	// Successes and Failures count the remote calls and reads that worked
+	// and failed (after any retries).
+	Successes int
+	Failures  int
+
+	// ConsecutiveFailures is the number of Failures since the last Success.
+	ConsecutiveFailures int
+
+	// LastErr is the error of the most recent failure.
+	LastErr error
+}
+
+// replica is one of the accessors that a remote can read from, along with how
+// well it has been working.
+type replica struct {
+	accessor    RemoteAccessor
+	health      ReplicaHealth
+	lastFailure time.Time
+	mutex       sync.Mutex
+	log15.Logger
+}
+
+// setReplicas makes our reads able to fail over from our accessor to the
+// given ones, in order.
+func (r *remote) setReplicas(accessors []RemoteAccessor) {
+	r.replicas = []*replica{{
+		accessor: r.accessor,
+		health:   ReplicaHealth{Target: r.accessor.Target(), Primary: true, Healthy: true},
+		Logger:   r.Logger,
+	}}
+	for _, a := range accessors {
+		r.replicas = append(r.replicas, &replica{
+			accessor: a,
+			health:   ReplicaHealth{Target: a.Target(), Healthy: true},
+			Logger:   r.Logger.New("replica", a.Target()),
+		})
+	}
+}
+
+// succeeded records that a remote call or read using our accessor worked.
+func (rep *replica) succeeded() {
+	rep.mutex.Lock()
+	defer rep.mutex.Unlock()
+	rep.health.Successes++
+	rep.health.ConsecutiveFailures = 0
+	if !rep.health.Healthy {
+		rep.health.Healthy = true
+		rep.health.DownSince = time.Time{}
+		rep.Info("Replica is working again")
+	}
+}
+
+// failed records that a remote call or read using our accessor failed with the
+// given error. Once there have been threshold consecutive failures, we are no
+// longer considered healthy.
+func (rep *replica) failed(err error, threshold int) {
+	rep.mutex.Lock()
+	defer rep.mutex.Unlock()
+	rep.health.Failures++
+	rep.health.ConsecutiveFailures++
+	rep.health.LastErr = err
+	if rep.health.ConsecutiveFailures < threshold {
+		return
+	}
+	rep.lastFailure = time.Now()
+	if rep.health.Healthy {
+		rep.health.Healthy = false
+		rep.health.DownSince = rep.lastFailure
+		rep.Warn("Replica is not working; failing over", "err", err)
+	}
+}
+
+// usable returns true if we're healthy, or it's been long enough since we last
+// failed to try us again.
+func (rep *replica) usable() bool {
+	rep.mutex.Lock()
+	defer rep.mutex.Unlock()
+	return rep.health.Healthy || time.Since(rep.lastFailure) >= replicaRetryInterval
+}
+
+// currentHealth returns a copy of our health.
+func (rep *replica) currentHealth() ReplicaHealth {
+	rep.mutex.Lock()
+	defer rep.mutex.Unlock()
+	return rep.health
+}
+
+// replicaOrder returns our replicas in the order reads should try them: the
+// usable() ones in configured order, followed by the rest.
+func (r *remote) replicaOrder() []*replica {
+	order := make([]*replica, 0, len(r.replicas))
+	var avoided []*replica
+	for _, rep := range r.replicas {
+		if rep.usable() {
+			order = append(order, rep)
+		} else {
+			avoided = append(avoided, rep)
+		}
+	}
+	return append(order, avoided...)
+}
+
+// pathFor converts the given remote path for our own accessor to the
+// equivalent path for the given accessor, which is one of our replicas.
+func (r *remote) pathFor(a RemoteAccessor, remotePath string) string {
+	if a == r.accessor {
+		return remotePath
+	}
+	rel := remotePath
+	if base := r.accessor.RemotePath(""); base != "" && base != "." {
+		rel = strings.TrimPrefix(remotePath, base)
+	}
+	path := a.RemotePath(strings.TrimPrefix(rel, "/"))
+	if path != "" && strings.HasSuffix(remotePath, "/") && !strings.HasSuffix(path, "/") {
+		path += "/"
+	}
+	return path
+}
+
+// readFunc is like retryFunc, but does its work using the given accessor and
+// remote path for that accessor, so it can be done with any of our replicas.
+type readFunc func(a RemoteAccessor, remotePath string) error
+
+// retryRead is like retry(), but for calls that only read, which fail over to
+// our next replica if the current one gives EIO, returning the replica that
+// was used. The last replica we try waits for peer resets to resolve like
+// retry() does, but the others don't. Without replicas, this is just retry()
+// and the returned replica is nil.
+func (r *remote) retryRead(clientMethod string, remotePath string, rf readFunc) (*replica, fuse.Status) {
+	if len(r.replicas) == 0 {
+		return nil, r.retry(clientMethod, remotePath, func() error {
+			return rf(r.accessor, remotePath)
+		})
+	}
+
+	order := r.replicaOrder()
+	status := fuse.EIO
+	for i, rep := range order {
+		a := rep.accessor
+		path := r.pathFor(a, remotePath)
+		last := i == len(order)-1
+		var err error
+		status, _, err = r.attempt(a, clientMethod, path, func() error {
+			return rf(a, path)
+		}, last)
+		if status != fuse.EIO {
+			// even if the file doesn't exist, the replica is working
+			rep.succeeded()
+			return rep, status
+		}
+		rep.failed(err, 1)
+		if !last {
+			r.Warn("Failing over to replica", "call", clientMethod, "path", remotePath, "from", a.Target(), "to", order[i+1].accessor.Target())
+		}
+	}
+	return nil, status
+}
+
+// replicaReader is what getObject() returns when we have replicas, so that we
+// know which one the object came from.
+type replicaReader struct {
+	io.ReadCloser
+	rep *replica
+}
+
+// readFailed records that reading from the given object returned by
+// getObject() failed with the given error. It returns true if the object came
+// from one of our replicas and the error could be avoided by getting the
+// object again, which will come from another replica if this one keeps
+// failing.
+func (r *remote) readFailed(rc io.ReadCloser, err error) bool {
+	rr, fromReplica := rc.(*replicaReader)
+	if !fromReplica || err == io.EOF || rr.rep.accessor.ErrorIsNotExists(err) || rr.rep.accessor.ErrorIsNoQuota(err) {
+		return false
+	}
+	rr.rep.failed(err, r.maxAttempts)
+	return true
+}
+
+// readSucceeded records that reading from the given object returned by
+// getObject() worked.
+func (r *remote) readSucceeded(rc io.ReadCloser) {
+	if rr, fromReplica := rc.(*replicaReader); fromReplica {
+		rr.rep.succeeded()
+	}
+}
+
+// ReplicaHealth returns the health of the accessors of all the currently
+// mounted remotes that were configured with RemoteConfig.Replicas. Each
+// remote's primary Accessor is followed by its Replicas.
+func (fs *MuxFys) ReplicaHealth() []ReplicaHealth {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	var health []ReplicaHealth
+	for _, r := range fs.remotes {
+		for _, rep := range r.replicas {
+			health = append(health, rep.currentHealth())
+		}
+	}
+	return health
+}
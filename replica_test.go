@@ -0,0 +1,214 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of muxfys.
+//
+//  muxfys is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  muxfys is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with muxfys. If not, see <http://www.gnu.org/licenses/>.
+
+package muxfys
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// downAccessor is a localAccessor that can be made to fail all reads, either
+// immediately or only once an opened file is read from.
+type downAccessor struct {
+	*localAccessor
+	mutex     sync.Mutex
+	down      bool
+	readsFail bool
+}
+
+func (a *downAccessor) setDown(down, readsFail bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.down = down
+	a.readsFail = readsFail
+}
+
+func (a *downAccessor) err() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.down {
+		return fmt.Errorf("service unavailable")
+	}
+	return nil
+}
+
+// ListEntries implements RemoteAccessor unless we're down.
+func (a *downAccessor) ListEntries(dir string) ([]RemoteAttr, error) {
+	if err := a.err(); err != nil {
+		return nil, err
+	}
+	return a.localAccessor.ListEntries(dir)
+}
+
+// OpenFile implements RemoteAccessor unless we're down.
+func (a *downAccessor) OpenFile(path string, offset int64) (io.ReadCloser, error) {
+	if err := a.err(); err != nil {
+		return nil, err
+	}
+	rc, err := a.localAccessor.OpenFile(path, offset)
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if err == nil && a.readsFail {
+		return &failingObject{rc}, nil
+	}
+	return rc, err
+}
+
+// DownloadFile implements RemoteAccessor unless we're down.
+func (a *downAccessor) DownloadFile(source, dest string) error {
+	if err := a.err(); err != nil {
+		return err
+	}
+	return a.localAccessor.DownloadFile(source, dest)
+}
+
+// failingObject is an opened file whose reads always fail.
+type failingObject struct {
+	io.ReadCloser
+}
+
+func (f *failingObject) Read(b []byte) (int, error) {
+	return 0, fmt.Errorf("connection reset by peer")
+}
+
+func TestReplicas(t *testing.T) {
+	Convey("Given a remote with a replica", t, func() {
+		tmpdir, err := ioutil.TempDir("", "muxfys_replica_testing")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(tmpdir)
+		primaryDir := filepath.Join(tmpdir, "primary")
+		replicaDir := filepath.Join(tmpdir, "mirror", "replica")
+		for _, dir := range []string{primaryDir, replicaDir} {
+			err = os.MkdirAll(filepath.Join(dir, "d"), os.FileMode(dirMode))
+			So(err, ShouldBeNil)
+			for _, name := range []string{"a", "d/b"} {
+				err = ioutil.WriteFile(filepath.Join(dir, name), []byte(filepath.Base(dir)+" "+name), os.FileMode(fileMode))
+				So(err, ShouldBeNil)
+			}
+		}
+
+		primary := &downAccessor{localAccessor: &localAccessor{target: primaryDir}}
+		fs, err := New(&Config{Mount: filepath.Join(tmpdir, "mnt"), CacheBase: tmpdir})
+		So(err, ShouldBeNil)
+		r, err := newRemote(&RemoteConfig{Accessor: primary, Replicas: []RemoteAccessor{&localAccessor{target: replicaDir}}}, remoteOptions{cacheBase: tmpdir, logger: fs.Logger})
+		So(err, ShouldBeNil)
+		fs.remotes = []*remote{r}
+		fs.OnMount(nil)
+
+		ls := func(dir string) []string {
+			entries, status := fs.OpenDir(dir, &fuse.Context{})
+			So(status, ShouldEqual, fuse.OK)
+			var names []string
+			for _, entry := range entries {
+				names = append(names, entry.Name)
+			}
+			sort.Strings(names)
+			return names
+		}
+		read := func(name string) string {
+			f, status := fs.Open(name, uint32(os.O_RDONLY), &fuse.Context{})
+			So(status, ShouldEqual, fuse.OK)
+			defer f.Release()
+			buf := make([]byte, 20)
+			result, status := f.Read(buf, 0)
+			So(status, ShouldEqual, fuse.OK)
+			b, _ := result.Bytes(buf)
+			return strings.TrimRight(string(b), "\x00")
+		}
+		health := func() (ReplicaHealth, ReplicaHealth) {
+			h := fs.ReplicaHealth()
+			So(h, ShouldHaveLength, 2)
+			So(h[0].Primary, ShouldBeTrue)
+			So(h[1].Primary, ShouldBeFalse)
+			return h[0], h[1]
+		}
+
+		Convey("Paths are converted to the replica's namespace", func() {
+			a := r.replicas[1].accessor
+			So(r.pathFor(primary, primaryDir+"/d/b"), ShouldEqual, primaryDir+"/d/b")
+			So(r.pathFor(a, primaryDir+"/d/b"), ShouldEqual, replicaDir+"/d/b")
+			So(r.pathFor(a, primaryDir+"/d/"), ShouldEqual, replicaDir+"/d/")
+		})
+
+		Convey("Reads use the primary while it works", func() {
+			So(ls(""), ShouldResemble, []string{"a", "d"})
+			So(read("a"), ShouldEqual, "primary a")
+			p, rep := health()
+			So(p.Healthy, ShouldBeTrue)
+			So(p.Successes, ShouldBeGreaterThan, 0)
+			So(rep.Successes, ShouldEqual, 0)
+		})
+
+		Convey("Reads fail over to the replica when the primary is down", func() {
+			primary.setDown(true, false)
+			So(ls(""), ShouldResemble, []string{"a", "d"})
+			So(ls("d"), ShouldResemble, []string{"b"})
+			So(read("d/b"), ShouldEqual, "replica d/b")
+			p, rep := health()
+			So(p.Healthy, ShouldBeFalse)
+			So(p.Failures, ShouldEqual, 1)
+			So(p.LastErr, ShouldNotBeNil)
+			So(p.DownSince.IsZero(), ShouldBeFalse)
+			So(rep.Healthy, ShouldBeTrue)
+			So(rep.Successes, ShouldBeGreaterThan, 0)
+
+			Convey("And go back to the primary once it works again", func() {
+				primary.setDown(false, false)
+				So(read("a"), ShouldEqual, "replica a")
+				r.replicas[0].mutex.Lock()
+				r.replicas[0].lastFailure = time.Now().Add(-replicaRetryInterval)
+				r.replicas[0].mutex.Unlock()
+				So(read("a"), ShouldEqual, "primary a")
+				p, _ = health()
+				So(p.Healthy, ShouldBeTrue)
+				So(p.ConsecutiveFailures, ShouldEqual, 0)
+			})
+		})
+
+		Convey("Reads that fail part way fail over to the replica", func() {
+			So(ls(""), ShouldResemble, []string{"a", "d"})
+			primary.setDown(false, true)
+			So(read("a"), ShouldEqual, "replica a")
+			p, _ := health()
+			So(p.Healthy, ShouldBeFalse)
+		})
+
+		Convey("Mount() rejects replicas of a writeable remote", func() {
+			fs2, errn := New(&Config{Mount: filepath.Join(tmpdir, "mnt2"), CacheBase: tmpdir})
+			So(errn, ShouldBeNil)
+			err = fs2.Mount(&RemoteConfig{
+				Accessor: &localAccessor{target: primaryDir},
+				Replicas: []RemoteAccessor{&localAccessor{target: replicaDir}},
+				Write:    true,
+			})
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
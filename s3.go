@@ -42,7 +42,10 @@ import (
 )
 
 const (
-	defaultS3Domain = "s3.amazonaws.com"
+	defaultS3Domain         = "s3.amazonaws.com"
+	defaultDownloadPartSize = int64(67108864) // 64MB
+	uploadPartSize          = int64(67108864) // 64MB
+	maxUploadParts          = 10000
 )
 
 // S3Config struct lets you provide details of the S3 bucket you wish to mount.
@@ -62,6 +65,18 @@ type S3Config struct {
 	// strings for access to a public bucket.
 	AccessKey string
 	SecretKey string
+
+	// DownloadConnections is the number of concurrent ranged requests used to
+	// download files larger than DownloadPartSize when whole files are cached
+	// (because a RemoteConfig has an explicit CacheDir, or a cached file is
+	// appended to). If such a download fails part way, the next attempt will
+	// only get the parts that didn't complete. The default of 0 (or 1) means
+	// each file is downloaded in a single stream, as a single request.
+	DownloadConnections int
+
+	// DownloadPartSize is the number of bytes each ranged request gets when
+	// DownloadConnections is greater than 1. Defaults to 64MB.
+	DownloadPartSize int64
 }
 
 // S3ConfigFromEnvironment makes an S3Config with Target, AccessKey, SecretKey
@@ -212,11 +227,13 @@ func S3ConfigFromEnvironment(profile, path string) (*S3Config, error) {
 
 // S3Accessor implements the RemoteAccessor interface by embedding minio-go.
 type S3Accessor struct {
-	client   *minio.Client
-	bucket   string
-	target   string
-	host     string
-	basePath string
+	client      *minio.Client
+	bucket      string
+	target      string
+	host        string
+	basePath    string
+	connections int
+	partSize    int64
 }
 
 // NewS3Accessor creates an S3Accessor for interacting with S3-like object
@@ -254,10 +271,15 @@ func NewS3Accessor(config *S3Config) (*S3Accessor, error) {
 	}
 
 	a := &S3Accessor{
-		target:   config.Target,
-		bucket:   bucket,
-		host:     host,
-		basePath: basePath,
+		target:      config.Target,
+		bucket:      bucket,
+		host:        host,
+		basePath:    basePath,
+		connections: config.DownloadConnections,
+		partSize:    config.DownloadPartSize,
+	}
+	if a.partSize <= 0 {
+		a.partSize = defaultDownloadPartSize
 	}
 
 	// create a client for interacting with S3 (we do this here instead of
@@ -280,17 +302,121 @@ func NewS3Accessor(config *S3Config) (*S3Accessor, error) {
 	return a, err
 }
 
-// DownloadFile implements RemoteAccessor by deferring to minio.
+// DownloadFile implements RemoteAccessor by deferring to minio. Files larger
+// than the configured DownloadPartSize are downloaded using multiple
+// concurrent ranged requests.
 func (a *S3Accessor) DownloadFile(source, dest string) error {
+	if a.connections > 1 {
+		info, err := a.client.StatObject(a.bucket, source, minio.StatObjectOptions{})
+		if err != nil {
+			return err
+		}
+		if info.Size > a.partSize {
+			return downloadInParts(dest, info.Size, info.ETag, a.partSize, a.connections, func(offset, length int64) (io.ReadCloser, error) {
+				return a.openRange(source, offset, length, info.ETag)
+			})
+		}
+	}
 	return a.client.FGetObject(a.bucket, source, dest, minio.GetObjectOptions{})
 }
 
+// openRange opens a remote file for reading length bytes from offset. If etag
+// is not blank, this fails if the file no longer has that ETag.
+func (a *S3Accessor) openRange(path string, offset, length int64, etag string) (io.ReadCloser, error) {
+	opts := minio.GetObjectOptions{}
+	err := opts.SetRange(offset, offset+length-1)
+	if err != nil {
+		return nil, err
+	}
+	if etag != "" {
+		err = opts.SetMatchETag(etag)
+		if err != nil {
+			return nil, err
+		}
+	}
+	core := minio.Core{Client: a.client}
+	reader, _, err := core.GetObject(a.bucket, path, opts)
+	return reader, err
+}
+
 // UploadFile implements RemoteAccessor by deferring to minio.
 func (a *S3Accessor) UploadFile(source, dest, contentType string) error {
 	_, err := a.client.FPutObject(a.bucket, dest, source, minio.PutObjectOptions{ContentType: contentType})
 	return err
 }
 
+// UploadFileWithProgress implements ProgressUploader by deferring to minio.
+func (a *S3Accessor) UploadFileWithProgress(source, dest, contentType string, progress func(bytes int64)) error {
+	_, err := a.client.FPutObject(a.bucket, dest, source, minio.PutObjectOptions{ContentType: contentType, Progress: progressFunc(progress)})
+	return err
+}
+
+// progressFunc lets a progress callback be used as the Progress io.Reader that
+// minio reads from (without using the result) as it uploads.
+type progressFunc func(bytes int64)
+
+// Read implements io.Reader by reporting len(b) bytes of progress.
+func (p progressFunc) Read(b []byte) (int, error) {
+	p(int64(len(b)))
+	return len(b), nil
+}
+
+// Write implements io.Writer by reporting len(b) bytes of progress, so that we
+// can also be used with io.TeeReader.
+func (p progressFunc) Write(b []byte) (int, error) {
+	p(int64(len(b)))
+	return len(b), nil
+}
+
+// UploadFileETag implements ETagUploader by uploading the file as a multipart
+// upload, since completing one tells us the resulting ETag. Parts are 64MB,
+// or larger for files that would otherwise need too many parts. If this fails,
+// DeleteIncompleteUpload() should be called to clean up.
+func (a *S3Accessor) UploadFileETag(source, dest, contentType string, progress func(bytes int64)) (etag string, err error) {
+	file, err := os.Open(source)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		errc := file.Close()
+		if err == nil {
+			err = errc
+		}
+	}()
+	info, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+	size := info.Size()
+	partSize := uploadPartSize
+	for size > partSize*maxUploadParts {
+		partSize *= 2
+	}
+
+	core := minio.Core{Client: a.client}
+	uploadID, err := core.NewMultipartUpload(a.bucket, dest, minio.PutObjectOptions{ContentType: contentType})
+	if err != nil {
+		return "", err
+	}
+	var parts []minio.CompletePart
+	for number, offset := 1, int64(0); number == 1 || offset < size; number, offset = number+1, offset+partSize {
+		length := partSize
+		if offset+length > size {
+			length = size - offset
+		}
+		var data io.Reader = io.NewSectionReader(file, offset, length)
+		if progress != nil {
+			data = io.TeeReader(data, progressFunc(progress))
+		}
+		part, errp := core.PutObjectPart(a.bucket, dest, uploadID, number, data, length, "", "", nil)
+		if errp != nil {
+			return "", errp
+		}
+		parts = append(parts, minio.CompletePart{PartNumber: number, ETag: part.ETag})
+	}
+	return core.CompleteMultipartUpload(a.bucket, dest, uploadID, parts)
+}
+
 // UploadData implements RemoteAccessor by deferring to minio.
 func (a *S3Accessor) UploadData(data io.Reader, dest string) error {
 	//*** try and do our own buffered read to initially get the mime type?
@@ -298,6 +424,49 @@ func (a *S3Accessor) UploadData(data io.Reader, dest string) error {
 	return err
 }
 
+// NewMultipartUpload implements MultipartUploader by starting a multipart
+// upload to the given remote object path.
+func (a *S3Accessor) NewMultipartUpload(dest string) (string, error) {
+	core := minio.Core{Client: a.client}
+	return core.NewMultipartUpload(a.bucket, dest, minio.PutObjectOptions{})
+}
+
+// UploadPart implements MultipartUploader by uploading a part of the given
+// multipart upload.
+func (a *S3Accessor) UploadPart(dest, uploadID string, partNumber int, data io.Reader, size int64) (string, error) {
+	core := minio.Core{Client: a.client}
+	part, err := core.PutObjectPart(a.bucket, dest, uploadID, partNumber, data, size, "", "", nil)
+	return part.ETag, err
+}
+
+// CompleteMultipartUpload implements MultipartUploader by assembling the
+// given parts of a multipart upload.
+func (a *S3Accessor) CompleteMultipartUpload(dest, uploadID string, parts []UploadedPart) error {
+	completed := make([]minio.CompletePart, len(parts))
+	for i, part := range parts {
+		completed[i] = minio.CompletePart{PartNumber: part.Number, ETag: part.ETag}
+	}
+	core := minio.Core{Client: a.client}
+	_, err := core.CompleteMultipartUpload(a.bucket, dest, uploadID, completed)
+	return err
+}
+
+// AbortMultipartUpload implements MultipartUploader by abandoning a multipart
+// upload.
+func (a *S3Accessor) AbortMultipartUpload(dest, uploadID string) error {
+	core := minio.Core{Client: a.client}
+	return core.AbortMultipartUpload(a.bucket, dest, uploadID)
+}
+
+// ETag implements ETagStater by deferring to minio.
+func (a *S3Accessor) ETag(path string) (string, error) {
+	info, err := a.client.StatObject(a.bucket, path, minio.StatObjectOptions{})
+	if err != nil {
+		return "", err
+	}
+	return info.ETag, nil
+}
+
 // ListEntries implements RemoteAccessor by deferring to minio.
 func (a *S3Accessor) ListEntries(dir string) ([]RemoteAttr, error) {
 	doneCh := make(chan struct{})
@@ -318,6 +487,29 @@ func (a *S3Accessor) ListEntries(dir string) ([]RemoteAttr, error) {
 	return ras, nil
 }
 
+// ListEntriesRecursive implements RecursiveLister by deferring to minio.
+func (a *S3Accessor) ListEntriesRecursive(dir string, max int) ([]RemoteAttr, bool, error) {
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+	oiCh := a.client.ListObjects(a.bucket, dir, true, doneCh)
+	var ras []RemoteAttr
+	for oi := range oiCh {
+		if oi.Err != nil {
+			return nil, false, oi.Err
+		}
+		if len(ras) == max {
+			return nil, true, nil
+		}
+		ras = append(ras, RemoteAttr{
+			Name:  oi.Key,
+			Size:  oi.Size,
+			MTime: oi.LastModified,
+			MD5:   oi.ETag,
+		})
+	}
+	return ras, false, nil
+}
+
 // OpenFile implements RemoteAccessor by deferring to minio.
 func (a *S3Accessor) OpenFile(path string, offset int64) (io.ReadCloser, error) {
 	opts := minio.GetObjectOptions{}
@@ -1201,6 +1201,32 @@ func s3IntegrationTests(t *testing.T, tmpdir, target, accessKey, secretKey strin
 				So(err, ShouldNotBeNil)
 			})
 
+			Convey("You can write to a new uncached file out of order", func() {
+				rpath := mountPoint + "/random.test"
+				f, err := os.OpenFile(rpath, os.O_CREATE|os.O_WRONLY, 0644)
+				So(err, ShouldBeNil)
+				defer func() {
+					err = os.Remove(rpath)
+					So(err, ShouldBeNil)
+				}()
+
+				_, err = f.WriteAt([]byte("world\n"), 6)
+				So(err, ShouldBeNil)
+				_, err = f.WriteAt([]byte("hello "), 0)
+				So(err, ShouldBeNil)
+				err = f.Close()
+				So(err, ShouldBeNil)
+
+				err = fs.Unmount()
+				So(err, ShouldBeNil)
+				err = fs.Mount(remoteConfig)
+				So(err, ShouldBeNil)
+
+				bytes, err := ioutil.ReadFile(rpath)
+				So(err, ShouldBeNil)
+				So(string(bytes), ShouldEqual, "hello world\n")
+			})
+
 			Convey("You can append to an uncached file", func() {
 				f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
 				So(err, ShouldBeNil)
@@ -2520,6 +2546,64 @@ func s3IntegrationTests(t *testing.T, tmpdir, target, accessKey, secretKey strin
 		})
 	})
 
+	Convey("You can mount without local file caching but with read ahead", t, func() {
+		remoteConfig.CacheData = false
+		remoteConfig.ReadAhead = 8 * readAheadChunkSize
+		defer func() {
+			remoteConfig.ReadAhead = 0
+		}()
+		fs, errc := New(cfg)
+		So(errc, ShouldBeNil)
+
+		errm := fs.Mount(remoteConfig)
+		So(errm, ShouldBeNil)
+
+		defer func() {
+			erru := fs.Unmount()
+			So(erru, ShouldBeNil)
+		}()
+
+		Convey("You can read a very big file", func() {
+			ioutil.ReadDir(mountPoint)
+			path := mountPoint + "/big.file"
+			start := time.Now()
+			read, err := streamFile(path, 0)
+			thisGetTime := time.Since(start)
+			So(err, ShouldBeNil)
+			So(read, ShouldEqual, bigFileSize)
+			So(math.Ceil(thisGetTime.Seconds()), ShouldBeLessThanOrEqualTo, math.Ceil(bigFileGetTimeUncached.Seconds())+2)
+			So(len(fs.aheadBudget), ShouldEqual, 0)
+		})
+
+		Convey("You can read a file sequentially then randomly", func() {
+			path := mountPoint + "/100k.lines"
+			rbig, err := os.Open(path)
+			So(err, ShouldBeNil)
+			defer rbig.Close()
+
+			b := make([]byte, 7)
+			var errr error
+			for i := 1; i <= 20000 && errr == nil; i++ {
+				_, errr = io.ReadFull(rbig, b)
+			}
+			So(errr, ShouldBeNil)
+			So(b, ShouldResemble, []byte("020000\n"))
+
+			rbig.Seek(7, io.SeekStart)
+			b = make([]byte, 6)
+			done, err := io.ReadFull(rbig, b)
+			So(err, ShouldBeNil)
+			So(done, ShouldEqual, 6)
+			So(b, ShouldResemble, []byte("000002"))
+
+			rbig.Seek(350000, io.SeekStart)
+			done, err = io.ReadFull(rbig, b)
+			So(err, ShouldBeNil)
+			So(done, ShouldEqual, 6)
+			So(b, ShouldResemble, []byte("050001"))
+		})
+	})
+
 	Convey("You can mount in write mode without any caching", t, func() {
 		remoteConfig.Write = true
 		remoteConfig.CacheData = false
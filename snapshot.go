@@ -0,0 +1,166 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of muxfys.
+//
+//  muxfys is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  muxfys is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with muxfys. If not, see <http://www.gnu.org/licenses/>.
+
+package muxfys
+
+// This file implements saving the directory listings of a remote to its
+// CacheDir at Unmount(), so that the next Mount() can use them instead of
+// listing everything again.
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// snapshotPrefix is the start of the basename of metadata snapshot files; the
+// rest is a hash of the remote's target.
+const snapshotPrefix = ".muxfys_metadata."
+
+// snapshotDir is the listing of a directory in a remote, as made at a certain
+// time.
+type snapshotDir struct {
+	Listed  time.Time    `json:"listed"`
+	Entries []RemoteAttr `json:"entries"`
+}
+
+// metadataSnapshot is what gets stored in a metadata snapshot file: the
+// listings of the directories of a remote target, keyed on the remote path of
+// the directory.
+type metadataSnapshot struct {
+	Target string                  `json:"target"`
+	Dirs   map[string]*snapshotDir `json:"dirs"`
+}
+
+// snapshotPath returns the path of the metadata snapshot file for the given
+// target in the given cache directory.
+func snapshotPath(cacheDir, target string) string {
+	return filepath.Join(cacheDir, fmt.Sprintf("%s%x", snapshotPrefix, sha1.Sum([]byte(target))))
+}
+
+// enableSnapshot makes us remember our directory listings so that they can be
+// saved with saveSnapshot(), and loads any existing snapshot for our target
+// that was saved less than maxAge ago (any age if maxAge is not positive). The
+// loaded listings are used by listDir() as long as they are younger than ttl
+// (if positive). Returns true if a snapshot was loaded. Only remotes with a
+// permanent CacheDir that aren't writeable can use snapshots.
+func (r *remote) enableSnapshot(maxAge, ttl time.Duration) (bool, error) {
+	if r.write {
+		return false, fmt.Errorf("a MetadataSnapshot can't be used with a writeable remote")
+	}
+	if r.cacheDir == "" || r.cacheIsTmp {
+		return false, fmt.Errorf("a MetadataSnapshot requires a CacheDir")
+	}
+
+	r.treeMutex.Lock()
+	defer r.treeMutex.Unlock()
+	r.listings = make(map[string]*snapshotDir)
+
+	path := snapshotPath(r.cacheDir, r.accessor.Target())
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			r.Warn("Could not read metadata snapshot", "path", path, "err", err)
+		}
+		return false, nil
+	}
+	snapshot := &metadataSnapshot{}
+	err = json.Unmarshal(content, snapshot)
+	if err != nil || snapshot.Target != r.accessor.Target() {
+		r.Warn("Ignoring bad metadata snapshot", "path", path, "err", err)
+		return false, nil
+	}
+
+	tree := make(map[string]*snapshotDir)
+	for remotePath, dir := range snapshot.Dirs {
+		if maxAge > 0 && time.Since(dir.Listed) >= maxAge {
+			continue
+		}
+		tree[remotePath] = dir
+	}
+	if len(tree) == 0 {
+		return false, nil
+	}
+	r.tree = tree
+	r.treeTTL = ttl
+	r.Info("Loaded metadata snapshot", "dirs", len(tree))
+	return true, nil
+}
+
+// rememberListing notes the given listing of the given directory for
+// saveSnapshot(), if enableSnapshot() was called.
+func (r *remote) rememberListing(remotePath string, dir *snapshotDir) {
+	r.treeMutex.Lock()
+	defer r.treeMutex.Unlock()
+	if r.listings != nil {
+		r.listings[remotePath] = dir
+	}
+}
+
+// saveSnapshot stores the directory listings we made or used since
+// enableSnapshot() was called, along with any loaded or prefetched listings we
+// didn't use, in our CacheDir. Does nothing if enableSnapshot() wasn't called.
+func (r *remote) saveSnapshot() error {
+	r.treeMutex.Lock()
+	defer r.treeMutex.Unlock()
+	if r.listings == nil {
+		return nil
+	}
+
+	snapshot := &metadataSnapshot{
+		Target: r.accessor.Target(),
+		Dirs:   make(map[string]*snapshotDir, len(r.listings)+len(r.tree)),
+	}
+	for remotePath, dir := range r.listings {
+		snapshot.Dirs[remotePath] = dir
+	}
+	for remotePath, dir := range r.tree {
+		if _, listed := snapshot.Dirs[remotePath]; !listed {
+			snapshot.Dirs[remotePath] = dir
+		}
+	}
+	content, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	// write to a temp file first so that other processes using the same
+	// CacheDir never see a partial snapshot
+	path := snapshotPath(r.cacheDir, snapshot.Target)
+	tmp, err := ioutil.TempFile(r.cacheDir, snapshotPrefix+"tmp.")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(content)
+	if errc := tmp.Close(); err == nil {
+		err = errc
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		if errr := os.Remove(tmp.Name()); errr != nil && !os.IsNotExist(errr) {
+			r.Warn("Could not remove temporary metadata snapshot", "path", tmp.Name(), "err", errr)
+		}
+	}
+	return err
+}
@@ -0,0 +1,155 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of muxfys.
+//
+//  muxfys is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  muxfys is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with muxfys. If not, see <http://www.gnu.org/licenses/>.
+
+package muxfys
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMetadataSnapshot(t *testing.T) {
+	Convey("Given a read-only remote with a CacheDir", t, func() {
+		tmpdir, err := ioutil.TempDir("", "muxfys_snapshot_testing")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(tmpdir)
+		remoteDir := filepath.Join(tmpdir, "remote")
+		err = os.MkdirAll(filepath.Join(remoteDir, "a"), os.FileMode(dirMode))
+		So(err, ShouldBeNil)
+		write := func(name string) {
+			errw := ioutil.WriteFile(filepath.Join(remoteDir, name), []byte(name), os.FileMode(fileMode))
+			So(errw, ShouldBeNil)
+		}
+		write("a/b")
+		write("c")
+		cacheDir := filepath.Join(tmpdir, "cache")
+
+		mount := func(ttl, maxAge time.Duration) (*MuxFys, *remote, *listCountingAccessor, bool) {
+			fs, errn := New(&Config{Mount: filepath.Join(tmpdir, "mnt"), CacheBase: tmpdir, MetadataTTL: ttl})
+			So(errn, ShouldBeNil)
+			accessor := &listCountingAccessor{localAccessor: &localAccessor{target: remoteDir}}
+			r, errn := newRemote(&RemoteConfig{Accessor: accessor, CacheData: true, CacheDir: cacheDir}, remoteOptions{cacheBase: tmpdir, logger: fs.Logger})
+			So(errn, ShouldBeNil)
+			loaded, errn := r.enableSnapshot(maxAge, ttl)
+			So(errn, ShouldBeNil)
+			fs.remotes = []*remote{r}
+			fs.OnMount(nil)
+			return fs, r, accessor, loaded
+		}
+		ls := func(fs *MuxFys, dir string) []string {
+			entries, status := fs.OpenDir(dir, &fuse.Context{})
+			So(status, ShouldEqual, fuse.OK)
+			var names []string
+			for _, entry := range entries {
+				names = append(names, entry.Name)
+			}
+			sort.Strings(names)
+			return names
+		}
+
+		fs, r, accessor, loaded := mount(0, 0)
+		So(loaded, ShouldBeFalse)
+		So(ls(fs, ""), ShouldResemble, []string{"a", "c"})
+		So(ls(fs, "a"), ShouldResemble, []string{"b"})
+		So(accessor.lists, ShouldEqual, 2)
+		err = r.saveSnapshot()
+		So(err, ShouldBeNil)
+		_, err = os.Stat(snapshotPath(cacheDir, remoteDir))
+		So(err, ShouldBeNil)
+		write("d")
+
+		Convey("The next mount uses the snapshot instead of listing the remote", func() {
+			fs, r, accessor, loaded = mount(0, 0)
+			So(loaded, ShouldBeTrue)
+			So(ls(fs, ""), ShouldResemble, []string{"a", "c"})
+			So(ls(fs, "a"), ShouldResemble, []string{"b"})
+			attr, status := fs.GetAttr("a", &fuse.Context{})
+			So(status, ShouldEqual, fuse.OK)
+			So(attr.Mode&fuse.S_IFDIR, ShouldNotEqual, 0)
+			attr, status = fs.GetAttr("a/b", &fuse.Context{})
+			So(status, ShouldEqual, fuse.OK)
+			So(attr.Mode&fuse.S_IFREG, ShouldNotEqual, 0)
+			So(attr.Size, ShouldEqual, 3)
+			info, errs := os.Stat(filepath.Join(remoteDir, "a", "b"))
+			So(errs, ShouldBeNil)
+			So(attr.Mtime, ShouldEqual, uint64(info.ModTime().Unix()))
+			attr, status = fs.GetAttr("c", &fuse.Context{})
+			So(status, ShouldEqual, fuse.OK)
+			So(attr.Size, ShouldEqual, 1)
+			_, status = fs.GetAttr("d", &fuse.Context{})
+			So(status, ShouldEqual, fuse.ENOENT)
+			So(accessor.lists, ShouldEqual, 0)
+
+			Convey("Until invalidated", func() {
+				err = fs.Invalidate("", false)
+				So(err, ShouldBeNil)
+				So(ls(fs, ""), ShouldResemble, []string{"a", "c", "d"})
+				So(accessor.lists, ShouldEqual, 1)
+			})
+
+			Convey("Unused listings are saved again", func() {
+				err = r.saveSnapshot()
+				So(err, ShouldBeNil)
+				fs, _, accessor, loaded = mount(0, 0)
+				So(loaded, ShouldBeTrue)
+				So(ls(fs, ""), ShouldResemble, []string{"a", "c"})
+				So(ls(fs, "a"), ShouldResemble, []string{"b"})
+				attr, status = fs.GetAttr("a/b", &fuse.Context{})
+				So(status, ShouldEqual, fuse.OK)
+				So(attr.Size, ShouldEqual, 3)
+				So(accessor.lists, ShouldEqual, 0)
+			})
+		})
+
+		Convey("Snapshots older than the max age are not used", func() {
+			<-time.After(10 * time.Millisecond)
+			fs, _, accessor, loaded = mount(0, 5*time.Millisecond)
+			So(loaded, ShouldBeFalse)
+			So(ls(fs, ""), ShouldResemble, []string{"a", "c", "d"})
+			So(accessor.lists, ShouldEqual, 1)
+		})
+
+		Convey("Snapshot listings older than the MetadataTTL are listed again", func() {
+			<-time.After(10 * time.Millisecond)
+			fs, _, accessor, loaded = mount(5*time.Millisecond, 0)
+			So(loaded, ShouldBeTrue)
+			So(ls(fs, ""), ShouldResemble, []string{"a", "c", "d"})
+			So(accessor.lists, ShouldEqual, 1)
+		})
+
+		Convey("Snapshots can't be used by writeable or uncached remotes", func() {
+			w, errn := newRemote(&RemoteConfig{Accessor: accessor, CacheData: true, CacheDir: cacheDir, Write: true}, remoteOptions{cacheBase: tmpdir, logger: fs.Logger})
+			So(errn, ShouldBeNil)
+			_, err = w.enableSnapshot(0, 0)
+			So(err, ShouldNotBeNil)
+
+			u, errn := newRemote(&RemoteConfig{Accessor: accessor}, remoteOptions{cacheBase: tmpdir, logger: fs.Logger})
+			So(errn, ShouldBeNil)
+			_, err = u.enableSnapshot(0, 0)
+			So(err, ShouldNotBeNil)
+			So(u.saveSnapshot(), ShouldBeNil)
+		})
+	})
+}
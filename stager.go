@@ -0,0 +1,502 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of muxfys.
+//
+//  muxfys is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  muxfys is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with muxfys. If not, see <http://www.gnu.org/licenses/>.
+
+package muxfys
+
+// This file implements staging of non-serial writes to remote files when not
+// caching data, so that they can be uploaded as the parts of a multipart
+// upload.
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/inconshreveable/log15"
+)
+
+const (
+	// defaultWritePartSize is used when RemoteConfig.WritePartSize is not set.
+	defaultWritePartSize = int64(16777216) // 16MB
+
+	// minWritePartSize is the smallest part S3 allows, other than the last.
+	minWritePartSize = int64(5242880) // 5MB
+
+	// defaultWriteStageMemory is used when Config.WriteStageMemory is not set.
+	defaultWriteStageMemory = int64(268435456) // 256MB
+
+	// writeStageUnit is the unit in which memory is reserved from a
+	// writeStageBudget.
+	writeStageUnit = int64(1048576) // 1MB
+)
+
+// writeStageBudget limits the total memory used by all writeStagers that share
+// it. Each writeStageUnit of a staged part holds a slot in the channel until
+// the part is uploaded.
+type writeStageBudget chan struct{}
+
+// newWriteStageBudget creates a writeStageBudget that allows for limit bytes of
+// staged parts, or defaultWriteStageMemory if limit is not positive.
+func newWriteStageBudget(limit int64) writeStageBudget {
+	if limit <= 0 {
+		limit = defaultWriteStageMemory
+	}
+	slots := limit / writeStageUnit
+	if slots < 1 {
+		slots = 1
+	}
+	return make(writeStageBudget, slots)
+}
+
+// reserve takes enough slots for the given number of bytes, returning false
+// (having taken none) if they aren't all free. It doesn't wait.
+func (b writeStageBudget) reserve(bytes int64) bool {
+	slots := b.slots(bytes)
+	for i := int64(0); i < slots; i++ {
+		select {
+		case b <- struct{}{}:
+		default:
+			b.release(i * writeStageUnit)
+			return false
+		}
+	}
+	return true
+}
+
+// release gives back the slots taken by reserve() for the given number of
+// bytes.
+func (b writeStageBudget) release(bytes int64) {
+	for i := b.slots(bytes); i > 0; i-- {
+		<-b
+	}
+}
+
+// slots returns the number of slots needed for the given number of bytes.
+func (b writeStageBudget) slots(bytes int64) int64 {
+	return (bytes + writeStageUnit - 1) / writeStageUnit
+}
+
+// MultipartUploader is an optional interface that a RemoteAccessor can also
+// implement, to allow random (not just serial) writes to files when not
+// caching data. Parts are numbered from 1, and all but the last part of an
+// upload will be the same size, at least 5MB.
+type MultipartUploader interface {
+	// NewMultipartUpload starts a multipart upload to the remote dest path,
+	// returning an ID for the upload.
+	NewMultipartUpload(dest string) (uploadID string, err error)
+
+	// UploadPart uploads size bytes read from data as the given part of an
+	// upload, returning the part's ETag. Uploading a part number that was
+	// already uploaded replaces it.
+	UploadPart(dest, uploadID string, partNumber int, data io.Reader, size int64) (etag string, err error)
+
+	// CompleteMultipartUpload assembles the given parts, in the given order,
+	// in to the file at dest.
+	CompleteMultipartUpload(dest, uploadID string, parts []UploadedPart) error
+
+	// AbortMultipartUpload abandons an upload, deleting any uploaded parts.
+	AbortMultipartUpload(dest, uploadID string) error
+}
+
+// UploadedPart describes a part uploaded by a MultipartUploader.
+type UploadedPart struct {
+	Number int
+	ETag   string
+}
+
+// errAlreadyUploaded is returned by writeStager.write() for writes to parts
+// that were already uploaded.
+type errAlreadyUploaded struct {
+	part   int
+	offset int64
+}
+
+// Error implements the error interface.
+func (e errAlreadyUploaded) Error() string {
+	return fmt.Sprintf("can't write at offset %d: part %d was already uploaded", e.offset, e.part)
+}
+
+// stagedPart is the data written so far to a part of a file.
+type stagedPart struct {
+	data    []byte
+	spilled bool
+	written Intervals
+}
+
+// writeStager accepts writes at any offset of a file, holding each fixed-size
+// part of the file in memory (or once its memory limit is reached, in a
+// temporary spill file) until it has been completely written, at which point
+// it uploads it. The first part is held until the end, so that headers can be
+// rewritten. Writes to other parts that were already uploaded fail.
+//
+// sync() completes the upload so far and starts a new one, after which the
+// first base bytes of the file are whatever is at dest; the parts of that which
+// aren't written to again are read back with readBase and uploaded as part of
+// the new upload.
+type writeStager struct {
+	mu       MultipartUploader
+	dest     string
+	retry    func(clientMethod string, rf retryFunc) fuse.Status
+	partSize int64
+	budget   writeStageBudget
+	memUsed  int64
+	spillDir string
+	spill    *os.File
+	uploadID string
+	parts    map[int]*stagedPart
+	uploaded map[int]string
+	size     int64
+	base     int64
+	changed  bool
+	readBase func(data []byte, offset int64) error
+	track    *uploadTracker
+	log15.Logger
+}
+
+// newWriteStager creates a writeStager that will upload to dest using mu, in
+// parts of partSize bytes (defaultWritePartSize if not positive), holding parts
+// in memory while budget allows and spilling any more to a temporary file in
+// spillDir. Remote calls are made via retry.
+func newWriteStager(mu MultipartUploader, dest string, partSize int64, budget writeStageBudget, spillDir string, retry func(clientMethod string, rf retryFunc) fuse.Status, logger log15.Logger) *writeStager {
+	if partSize <= 0 {
+		partSize = defaultWritePartSize
+	} else if partSize < minWritePartSize {
+		partSize = minWritePartSize
+	}
+	return &writeStager{
+		mu:       mu,
+		dest:     dest,
+		retry:    retry,
+		partSize: partSize,
+		budget:   budget,
+		spillDir: spillDir,
+		parts:    make(map[int]*stagedPart),
+		uploaded: make(map[int]string),
+		Logger:   logger,
+	}
+}
+
+// write stages data at the given offset, uploading any parts other than the
+// first that become completely written.
+func (s *writeStager) write(data []byte, offset int64) error {
+	end := offset + int64(len(data))
+	first, last := s.partOf(offset), s.partOf(end-1)
+	for n := first; n <= last; n++ {
+		if _, done := s.uploaded[n]; done {
+			return errAlreadyUploaded{part: n, offset: offset}
+		}
+	}
+
+	for n := first; n <= last; n++ {
+		partStart := int64(n-1) * s.partSize
+		from, to := offset, end
+		if from < partStart {
+			from = partStart
+		}
+		if partEnd := partStart + s.partSize; to > partEnd {
+			to = partEnd
+		}
+
+		p, err := s.stage(n, to-partStart)
+		if err != nil {
+			return err
+		}
+		chunk := data[from-offset : to-offset]
+		if p.spilled {
+			_, err = s.spill.WriteAt(chunk, from)
+			if err != nil {
+				return err
+			}
+		} else {
+			copy(p.data[from-partStart:], chunk)
+		}
+		p.written = p.written.Merge(NewInterval(from-partStart, to-from))
+
+		if n != 1 && len(p.written) == 1 && p.written[0].Start == 0 && p.written[0].Length() == s.partSize {
+			err = s.uploadPart(n, s.partSize)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if end > s.size {
+		s.size = end
+	}
+	s.changed = true
+	return nil
+}
+
+// partOf returns the number of the part that the given offset falls in.
+func (s *writeStager) partOf(offset int64) int {
+	return int(offset/s.partSize) + 1
+}
+
+// stage returns the stagedPart for the given part number, creating it if
+// necessary, and making sure it can hold at least length bytes.
+func (s *writeStager) stage(n int, length int64) (*stagedPart, error) {
+	p, exists := s.parts[n]
+	if !exists {
+		p = &stagedPart{}
+		if !s.budget.reserve(s.partSize) {
+			if s.spill == nil {
+				var err error
+				s.spill, err = ioutil.TempFile(s.spillDir, ".muxfys_stage.")
+				if err != nil {
+					return nil, err
+				}
+			}
+			p.spilled = true
+		} else {
+			s.memUsed += s.partSize
+		}
+		s.parts[n] = p
+	}
+
+	if !p.spilled && int64(len(p.data)) < length {
+		// grow by doubling, so small files don't need a whole part's memory
+		size := int64(2 * cap(p.data))
+		if size < length {
+			size = length
+		}
+		if size > s.partSize {
+			size = s.partSize
+		}
+		data := make([]byte, size)
+		copy(data, p.data)
+		p.data = data
+	}
+	return p, nil
+}
+
+// uploadPart uploads the first length bytes of the given staged part (with
+// zeros for anything not written), then forgets its data.
+func (s *writeStager) uploadPart(n int, length int64) error {
+	etag, err := s.putPart(n, length)
+	if err != nil {
+		return err
+	}
+	s.completed(n, etag)
+	return nil
+}
+
+// completed records that the given part has been uploaded with the given
+// ETag, and forgets its data.
+func (s *writeStager) completed(n int, etag string) {
+	s.uploaded[n] = etag
+	if p, staged := s.parts[n]; staged {
+		if !p.spilled {
+			s.memUsed -= s.partSize
+			s.budget.release(s.partSize)
+		}
+		delete(s.parts, n)
+	}
+}
+
+// putPart uploads the first length bytes of the given part (with zeros for
+// anything not written, or what was there before our last sync()), starting
+// the multipart upload if necessary, and returns the part's ETag.
+func (s *writeStager) putPart(n int, length int64) (string, error) {
+	if s.uploadID == "" {
+		status := s.retry("NewMultipartUpload", func() error {
+			var err error
+			s.uploadID, err = s.mu.NewMultipartUpload(s.dest)
+			return err
+		})
+		if status != fuse.OK {
+			return "", fmt.Errorf("could not start multipart upload: %s", status)
+		}
+		s.track.start()
+	}
+
+	data, err := s.partData(n, length)
+	if err != nil {
+		return "", err
+	}
+
+	var etag string
+	status := s.retry("UploadPart", func() error {
+		var err error
+		etag, err = s.mu.UploadPart(s.dest, s.uploadID, n, bytes.NewReader(data), length)
+		return err
+	})
+	if status != fuse.OK {
+		return "", fmt.Errorf("could not upload part %d: %s", n, status)
+	}
+	s.track.progress(length)
+	return etag, nil
+}
+
+// partData returns the first length bytes of the given part: what was
+// written to it, over the top of what was there before our last sync().
+func (s *writeStager) partData(n int, length int64) ([]byte, error) {
+	data := make([]byte, length)
+	partStart := int64(n-1) * s.partSize
+	if partStart < s.base {
+		baseLength := s.base - partStart
+		if baseLength > length {
+			baseLength = length
+		}
+		err := s.readBase(data[:baseLength], partStart)
+		if err != nil {
+			return nil, fmt.Errorf("could not read back part %d: %s", n, err)
+		}
+	}
+
+	p, staged := s.parts[n]
+	if !staged {
+		return data, nil
+	}
+	for _, iv := range p.written {
+		if iv.Start >= length {
+			break
+		}
+		end := iv.End + 1
+		if end > length {
+			end = length
+		}
+		if p.spilled {
+			_, err := s.spill.ReadAt(data[iv.Start:end], partStart+iv.Start)
+			if err != nil && err != io.EOF {
+				return nil, err
+			}
+		} else {
+			copy(data[iv.Start:end], p.data[iv.Start:end])
+		}
+	}
+	return data, nil
+}
+
+// sync completes the upload of everything written so far, so that it is held
+// remotely, then starts afresh so that further writes can be made. If the
+// upload fails, the stager can't be used afterwards.
+func (s *writeStager) sync() error {
+	if !s.changed {
+		return nil
+	}
+	err := s.finish()
+	if err != nil {
+		return err
+	}
+	s.resume(s.size)
+	return nil
+}
+
+// resume makes the stager start a new upload, with the first size bytes of the
+// file being whatever is at dest. Must only be called on a new stager, or one
+// with nothing staged.
+func (s *writeStager) resume(size int64) {
+	s.base, s.size = size, size
+	s.uploadID = ""
+	s.parts = make(map[int]*stagedPart)
+	s.uploaded = make(map[int]string)
+	s.changed = false
+	s.track = nil
+}
+
+// partLength returns the length the given part should be uploaded with, given
+// the number of the current last part.
+func (s *writeStager) partLength(n, last int) int64 {
+	if n == last {
+		return s.size - int64(n-1)*s.partSize
+	}
+	return s.partSize
+}
+
+// finish uploads all remaining parts (treating anything never written as
+// zeros) and assembles them in to the final file. It does nothing if nothing
+// was written since the last sync(). The stager can't be used afterwards.
+func (s *writeStager) finish() error {
+	defer s.cleanup()
+	if !s.changed {
+		return nil
+	}
+
+	last := s.partOf(s.size - 1)
+	for n := 1; n <= last; n++ {
+		if _, done := s.uploaded[n]; done {
+			continue
+		}
+		err := s.uploadPart(n, s.partLength(n, last))
+		if err != nil {
+			s.track.finish(err)
+			s.abort()
+			return err
+		}
+	}
+
+	parts := make([]UploadedPart, 0, len(s.uploaded))
+	for n, etag := range s.uploaded {
+		parts = append(parts, UploadedPart{Number: n, ETag: etag})
+	}
+	sort.Slice(parts, func(i, j int) bool { return parts[i].Number < parts[j].Number })
+	status := s.retry("CompleteMultipartUpload", func() error {
+		return s.mu.CompleteMultipartUpload(s.dest, s.uploadID, parts)
+	})
+	if status != fuse.OK {
+		err := fmt.Errorf("could not complete multipart upload: %s", status)
+		s.track.finish(err)
+		s.abort()
+		return err
+	}
+	s.track.finish(nil)
+	return nil
+}
+
+// abort abandons the upload, if one was started. The stager can't be used
+// afterwards.
+func (s *writeStager) abort() {
+	defer s.cleanup()
+	if s.uploadID == "" {
+		return
+	}
+	s.track.finish(errors.New("upload aborted"))
+	status := s.retry("AbortMultipartUpload", func() error {
+		return s.mu.AbortMultipartUpload(s.dest, s.uploadID)
+	})
+	if status != fuse.OK {
+		s.Warn("Abort of multipart upload failed", "upload", s.uploadID)
+	}
+	s.uploadID = ""
+}
+
+// cleanup gives the memory of any staged parts back to our budget, and deletes
+// our spill file, if we made one.
+func (s *writeStager) cleanup() {
+	for n, p := range s.parts {
+		if !p.spilled {
+			s.budget.release(s.partSize)
+		}
+		delete(s.parts, n)
+	}
+	s.memUsed = 0
+	if s.spill == nil {
+		return
+	}
+	logClose(s.Logger, s.spill, "write stager spill file")
+	err := os.Remove(s.spill.Name())
+	if err != nil {
+		s.Warn("Removal of spill file failed", "path", s.spill.Name(), "err", err)
+	}
+	s.spill = nil
+}
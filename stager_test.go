@@ -0,0 +1,290 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of muxfys.
+//
+//  muxfys is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  muxfys is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with muxfys. If not, see <http://www.gnu.org/licenses/>.
+
+package muxfys
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// fakeMultipart is a MultipartUploader that assembles uploads in memory.
+type fakeMultipart struct {
+	parts     map[int][]byte
+	uploads   []int
+	completed []byte
+	aborted   bool
+	failPart  int
+}
+
+func (m *fakeMultipart) NewMultipartUpload(dest string) (string, error) {
+	m.parts = make(map[int][]byte)
+	return "id", nil
+}
+
+func (m *fakeMultipart) UploadPart(dest, uploadID string, partNumber int, data io.Reader, size int64) (string, error) {
+	if partNumber == m.failPart {
+		return "", errors.New("part upload failed")
+	}
+	b, err := ioutil.ReadAll(data)
+	if err != nil {
+		return "", err
+	}
+	if int64(len(b)) != size {
+		return "", fmt.Errorf("read %d bytes, not %d", len(b), size)
+	}
+	m.parts[partNumber] = b
+	m.uploads = append(m.uploads, partNumber)
+	return fmt.Sprintf("etag%d", partNumber), nil
+}
+
+func (m *fakeMultipart) CompleteMultipartUpload(dest, uploadID string, parts []UploadedPart) error {
+	var buf bytes.Buffer
+	for i, part := range parts {
+		if part.Number != i+1 || part.ETag != fmt.Sprintf("etag%d", part.Number) {
+			return fmt.Errorf("bad part %+v", part)
+		}
+		buf.Write(m.parts[part.Number])
+	}
+	m.completed = buf.Bytes()
+	return nil
+}
+
+func (m *fakeMultipart) AbortMultipartUpload(dest, uploadID string) error {
+	m.aborted = true
+	return nil
+}
+
+func TestWriteStager(t *testing.T) {
+	Convey("Given a write stager", t, func() {
+		spillDir, err := ioutil.TempDir("", "muxfys_stager_testing")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(spillDir)
+
+		mu := &fakeMultipart{}
+		retry := func(clientMethod string, rf retryFunc) fuse.Status {
+			if rf() != nil {
+				return fuse.EIO
+			}
+			return fuse.OK
+		}
+		partSize := minWritePartSize
+		budget := newWriteStageBudget(2 * partSize)
+		s := newWriteStager(mu, "dest", partSize, budget, spillDir, retry, pkgLogger)
+		So(s.partSize, ShouldEqual, partSize)
+
+		size := 3*partSize + 1000
+		file := make([]byte, size)
+		for i := range file {
+			file[i] = byte(i % 253)
+		}
+		writeRange := func(from, to int64) {
+			for offset := from; offset < to; offset += 1048576 {
+				end := offset + 1048576
+				if end > to {
+					end = to
+				}
+				errw := s.write(file[offset:end], offset)
+				So(errw, ShouldBeNil)
+			}
+		}
+		spillFiles := func() int {
+			entries, errr := ioutil.ReadDir(spillDir)
+			So(errr, ShouldBeNil)
+			return len(entries)
+		}
+
+		Convey("Serial writes upload parts as they complete, except the first", func() {
+			writeRange(0, size)
+			So(mu.uploads, ShouldResemble, []int{2, 3})
+			So(s.size, ShouldEqual, size)
+
+			Convey("The first part can still be rewritten", func() {
+				err = s.write([]byte("header"), 0)
+				So(err, ShouldBeNil)
+				copy(file, "header")
+
+				err = s.finish()
+				So(err, ShouldBeNil)
+				So(mu.uploads, ShouldResemble, []int{2, 3, 1, 4})
+				So(bytes.Equal(mu.completed, file), ShouldBeTrue)
+				So(mu.aborted, ShouldBeFalse)
+			})
+
+			Convey("Other uploaded parts can't be", func() {
+				err = s.write([]byte("x"), partSize+1)
+				So(err, ShouldNotBeNil)
+				_, rewrite := err.(errAlreadyUploaded)
+				So(rewrite, ShouldBeTrue)
+				So(err.Error(), ShouldContainSubstring, "part 2 was already uploaded")
+
+				err = s.write([]byte("xx"), partSize-1)
+				So(err, ShouldNotBeNil)
+				So(s.size, ShouldEqual, size)
+			})
+		})
+
+		Convey("Writes can be in any order, with unwritten data being zeros", func() {
+			writeRange(2*partSize, 3*partSize)
+			writeRange(10, partSize)
+			So(mu.uploads, ShouldResemble, []int{3})
+			writeRange(3*partSize+500, size)
+
+			err = s.finish()
+			So(err, ShouldBeNil)
+			So(mu.uploads, ShouldResemble, []int{3, 1, 2, 4})
+			expected := make([]byte, size)
+			copy(expected[2*partSize:3*partSize], file[2*partSize:3*partSize])
+			copy(expected[10:partSize], file[10:partSize])
+			copy(expected[3*partSize+500:], file[3*partSize+500:])
+			So(bytes.Equal(mu.completed, expected), ShouldBeTrue)
+		})
+
+		Convey("Parts beyond the memory limit are spilled to disk", func() {
+			writeRange(0, partSize/2)
+			writeRange(partSize, partSize+10)
+			So(spillFiles(), ShouldEqual, 0)
+			So(s.memUsed, ShouldEqual, 2*partSize)
+			writeRange(2*partSize, size)
+			So(spillFiles(), ShouldEqual, 1)
+			So(s.memUsed, ShouldEqual, 2*partSize)
+			writeRange(partSize/2, partSize)
+			writeRange(partSize+10, 2*partSize)
+			So(mu.uploads, ShouldResemble, []int{3, 2})
+
+			err = s.finish()
+			So(err, ShouldBeNil)
+			So(bytes.Equal(mu.completed, file), ShouldBeTrue)
+			So(spillFiles(), ShouldEqual, 0)
+			So(len(budget), ShouldEqual, 0)
+		})
+
+		Convey("The memory limit is shared with other stagers", func() {
+			other := newWriteStager(&fakeMultipart{}, "other", partSize, budget, spillDir, retry, pkgLogger)
+			err = other.write([]byte("other"), 0)
+			So(err, ShouldBeNil)
+			So(other.memUsed, ShouldEqual, partSize)
+			writeRange(0, partSize/2)
+			writeRange(partSize, partSize+10)
+			So(s.memUsed, ShouldEqual, partSize)
+			So(spillFiles(), ShouldEqual, 1)
+
+			other.abort()
+			So(len(budget), ShouldEqual, partSize/writeStageUnit)
+			writeRange(2*partSize, 2*partSize+10)
+			So(s.memUsed, ShouldEqual, 2*partSize)
+
+			s.abort()
+			So(len(budget), ShouldEqual, 0)
+			So(spillFiles(), ShouldEqual, 0)
+		})
+
+		Convey("Small files are uploaded as a single small part", func() {
+			err = s.write([]byte("small"), 0)
+			So(err, ShouldBeNil)
+			So(len(s.parts[1].data), ShouldEqual, 5)
+			err = s.finish()
+			So(err, ShouldBeNil)
+			So(string(mu.completed), ShouldEqual, "small")
+		})
+
+		Convey("Failed part uploads abort the upload", func() {
+			mu.failPart = 1
+			writeRange(0, size)
+			err = s.finish()
+			So(err, ShouldNotBeNil)
+			So(mu.aborted, ShouldBeTrue)
+			So(mu.completed, ShouldBeNil)
+		})
+
+		Convey("Syncing completes the upload, after which writes can continue", func() {
+			var base []byte
+			s.readBase = func(data []byte, offset int64) error {
+				copy(data, base[offset:])
+				return nil
+			}
+			writeRange(0, partSize/2)
+			writeRange(partSize+10, partSize+20)
+			err = s.sync()
+			So(err, ShouldBeNil)
+			So(mu.uploads, ShouldResemble, []int{1, 2})
+			expected := make([]byte, partSize+20)
+			copy(expected, file[:partSize/2])
+			copy(expected[partSize+10:], file[partSize+10:partSize+20])
+			So(bytes.Equal(mu.completed, expected), ShouldBeTrue)
+			base = mu.completed
+
+			err = s.sync()
+			So(err, ShouldBeNil)
+			So(mu.uploads, ShouldResemble, []int{1, 2})
+
+			writeRange(partSize/2, partSize)
+			writeRange(partSize, partSize+10)
+			writeRange(partSize+20, size)
+			So(mu.uploads, ShouldResemble, []int{1, 2, 3})
+			err = s.sync()
+			So(err, ShouldBeNil)
+			So(mu.uploads, ShouldResemble, []int{1, 2, 3, 1, 2, 4})
+			So(bytes.Equal(mu.completed, file), ShouldBeTrue)
+			base = mu.completed
+
+			Convey("Parts not written to again are read back", func() {
+				err = s.write([]byte("header"), 0)
+				So(err, ShouldBeNil)
+				copy(file, "header")
+				err = s.finish()
+				So(err, ShouldBeNil)
+				So(mu.uploads, ShouldResemble, []int{1, 2, 3, 1, 2, 4, 1, 2, 3, 4})
+				So(bytes.Equal(mu.completed, file), ShouldBeTrue)
+				So(mu.aborted, ShouldBeFalse)
+			})
+
+			Convey("Finishing without further writes does nothing", func() {
+				err = s.finish()
+				So(err, ShouldBeNil)
+				So(len(mu.uploads), ShouldEqual, 6)
+			})
+
+			Convey("Failing to read back aborts the upload", func() {
+				s.readBase = func(data []byte, offset int64) error {
+					return errors.New("read failed")
+				}
+				err = s.write([]byte("header"), 0)
+				So(err, ShouldBeNil)
+				err = s.finish()
+				So(err, ShouldNotBeNil)
+				So(mu.aborted, ShouldBeTrue)
+			})
+		})
+
+		Convey("You can abort", func() {
+			writeRange(0, size)
+			s.abort()
+			So(mu.aborted, ShouldBeTrue)
+			So(spillFiles(), ShouldEqual, 0)
+		})
+	})
+}
@@ -0,0 +1,419 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of muxfys.
+//
+//  muxfys is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  muxfys is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with muxfys. If not, see <http://www.gnu.org/licenses/>.
+
+package muxfys
+
+// This file implements background uploading of files created or modified in
+// a CacheData mount, once they have been closed and left alone for a while.
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+const defaultUploadWorkers = 4
+
+// uploadFunc is a function that uploads the file with the given mount-relative
+// name. gen is the generation of the file (see uploader.generation()) at the
+// time it was queued.
+type uploadFunc func(name string, gen uint64)
+
+// uploader queues files for upload once they have no open write handles and
+// have not been modified for a quiet period, and uploads them with a bounded
+// number of workers. All methods are safe to call on a nil *uploader, which
+// does nothing.
+type uploader struct {
+	mutex    sync.Mutex
+	cond     *sync.Cond
+	delay    time.Duration
+	upload   uploadFunc
+	open     map[string]int
+	gens     map[string]uint64
+	timers   map[string]*time.Timer
+	queue    []string
+	busy     int
+	stopping bool
+	workers  sync.WaitGroup
+}
+
+// newUploader creates an uploader that calls upload on files delay after they
+// were last released or modified, using the given number of workers
+// (defaultUploadWorkers if not positive). Returns nil if delay is not
+// positive.
+func newUploader(delay time.Duration, workers int, upload uploadFunc) *uploader {
+	if delay <= 0 {
+		return nil
+	}
+	if workers <= 0 {
+		workers = defaultUploadWorkers
+	}
+	u := &uploader{
+		delay:  delay,
+		upload: upload,
+		open:   make(map[string]int),
+		gens:   make(map[string]uint64),
+		timers: make(map[string]*time.Timer),
+	}
+	u.cond = sync.NewCond(&u.mutex)
+	for i := 0; i < workers; i++ {
+		u.workers.Add(1)
+		go u.work()
+	}
+	return u
+}
+
+// opened should be called when a file is opened for writing. It won't be
+// queued for upload until every opened() has been matched by a released().
+func (u *uploader) opened(name string) {
+	if u == nil {
+		return
+	}
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.open[name]++
+	u.gens[name]++
+	u.unschedule(name)
+}
+
+// released should be called when a handle on a file opened for writing is
+// released.
+func (u *uploader) released(name string) {
+	if u == nil {
+		return
+	}
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if u.open[name] > 1 {
+		u.open[name]--
+		return
+	}
+	delete(u.open, name)
+	u.schedule(name)
+}
+
+// modified should be called when a file was changed other than via an open
+// handle, eg. by being truncated.
+func (u *uploader) modified(name string) {
+	if u == nil {
+		return
+	}
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.gens[name]++
+	if u.open[name] == 0 {
+		u.schedule(name)
+	}
+}
+
+// renamed should be called when a file that may be awaiting upload is renamed.
+func (u *uploader) renamed(oldName, newName string) {
+	if u == nil {
+		return
+	}
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if n, exists := u.open[oldName]; exists {
+		u.open[newName] += n
+		delete(u.open, oldName)
+	}
+	u.gens[newName]++
+	delete(u.gens, oldName)
+	if u.unschedule(oldName) && u.open[newName] == 0 {
+		u.schedule(newName)
+	}
+}
+
+// forget should be called when a file that may be awaiting upload is deleted.
+func (u *uploader) forget(name string) {
+	if u == nil {
+		return
+	}
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.unschedule(name)
+	delete(u.open, name)
+	delete(u.gens, name)
+}
+
+// generation returns a number that changes every time the given file is opened
+// for writing or modified, so an upload can tell if the file changed while it
+// was being uploaded.
+func (u *uploader) generation(name string) uint64 {
+	if u == nil {
+		return 0
+	}
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return u.gens[name]
+}
+
+// schedule (re)starts the quiet period timer for a file. Must be called while
+// you hold the mutex.
+func (u *uploader) schedule(name string) {
+	if u.stopping {
+		return
+	}
+	u.unschedule(name)
+	var t *time.Timer
+	t = time.AfterFunc(u.delay, func() {
+		u.mutex.Lock()
+		defer u.mutex.Unlock()
+		if u.timers[name] != t {
+			// we were unscheduled or rescheduled after firing
+			return
+		}
+		delete(u.timers, name)
+		u.enqueue(name)
+	})
+	u.timers[name] = t
+}
+
+// unschedule stops any quiet period timer for a file, returning true if there
+// was one. Must be called while you hold the mutex.
+func (u *uploader) unschedule(name string) bool {
+	t, exists := u.timers[name]
+	if exists {
+		t.Stop()
+		delete(u.timers, name)
+	}
+	return exists
+}
+
+// enqueue adds a file to the queue for the workers, if it isn't already there.
+// Must be called while you hold the mutex.
+func (u *uploader) enqueue(name string) {
+	for _, queued := range u.queue {
+		if queued == name {
+			return
+		}
+	}
+	u.queue = append(u.queue, name)
+	u.cond.Signal()
+}
+
+// work is run in a goroutine to upload queued files until we're stopped and
+// the queue is empty.
+func (u *uploader) work() {
+	defer u.workers.Done()
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	for {
+		for len(u.queue) == 0 && !u.stopping {
+			u.cond.Wait()
+		}
+		if len(u.queue) == 0 {
+			return
+		}
+		name := u.queue[0]
+		u.queue = u.queue[1:]
+		gen := u.gens[name]
+		u.busy++
+		u.mutex.Unlock()
+
+		u.upload(name, gen)
+
+		u.mutex.Lock()
+		u.busy--
+		u.cond.Broadcast()
+	}
+}
+
+// stop stops accepting new files. Files waiting for their quiet period or
+// queued are forgotten (they remain in createdFiles, so Unmount() will upload
+// them in mtime order along with everything else), and this returns once any
+// in-progress uploads complete.
+func (u *uploader) stop() {
+	if u == nil {
+		return
+	}
+	u.mutex.Lock()
+	for _, t := range u.timers {
+		t.Stop()
+	}
+	u.timers = make(map[string]*time.Timer)
+	u.queue = nil
+	u.stopping = true
+	u.cond.Broadcast()
+	u.mutex.Unlock()
+	u.workers.Wait()
+}
+
+// pending returns the number of files that are waiting for their quiet period,
+// queued or being uploaded.
+func (u *uploader) pending() int {
+	if u == nil {
+		return 0
+	}
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return len(u.timers) + len(u.queue) + u.busy
+}
+
+// openHandle is an open write handle on a file in a CacheData writeable remote
+// that has background or fsync uploads. It knows the current name of its file,
+// which changes if the file is renamed while open. Its name is guarded by the
+// mapMutex.
+type openHandle struct {
+	name string
+}
+
+// trackHandle returns a new openHandle on the given file, telling our uploader
+// that it was opened. Must be called while you have the mapMutex Locked.
+func (fs *MuxFys) trackHandle(name string) *openHandle {
+	h := &openHandle{name: name}
+	fs.openHandles[h] = true
+	fs.uploader.opened(name)
+	return h
+}
+
+// handleName returns the current name of the file the given handle is open on.
+func (fs *MuxFys) handleName(h *openHandle) string {
+	fs.mapMutex.RLock()
+	defer fs.mapMutex.RUnlock()
+	return h.name
+}
+
+// releaseHandle tells our uploader that the given handle on whatever its file is
+// now called was released.
+func (fs *MuxFys) releaseHandle(h *openHandle) {
+	fs.mapMutex.Lock()
+	defer fs.mapMutex.Unlock()
+	delete(fs.openHandles, h)
+	fs.uploader.released(h.name)
+}
+
+// renameHandles updates our openHandles and uploader when a file is renamed.
+// Must be called while you have the mapMutex Locked.
+func (fs *MuxFys) renameHandles(oldName, newName string) {
+	for h := range fs.openHandles {
+		if h.name == oldName {
+			h.name = newName
+		}
+	}
+	fs.uploader.renamed(oldName, newName)
+}
+
+// uploadInBackground is an uploadFunc for our uploader: it uploads the given
+// created file, and if the upload succeeds and the file has not been changed
+// since being queued, stops considering it created.
+func (fs *MuxFys) uploadInBackground(name string, gen uint64) {
+	fs.mapMutex.RLock()
+	r := fs.fileToRemote[name]
+	_, created := fs.createdFiles[name]
+	var mtime uint64
+	if attr := fs.files[name]; attr != nil {
+		mtime = attr.Mtime
+	}
+	fs.mapMutex.RUnlock()
+	if !created || r == nil || !r.cacheData {
+		return
+	}
+
+	remotePath := r.getRemotePath(name)
+	localPath := r.getLocalPath(remotePath)
+	fmutex, err := fs.getFileMutex(localPath)
+	if err != nil {
+		return
+	}
+	err = fmutex.Lock()
+	if err != nil {
+		fs.Error("Background upload file mutex lock failed", "path", localPath, "err", err)
+		logClose(fs.Logger, fmutex, "background upload file mutex")
+		return
+	}
+	defer logClose(fs.Logger, fmutex, "background upload file mutex")
+	if !fs.isCreatedIn(name, r) {
+		// it got renamed or deleted while we waited for the lock
+		return
+	}
+	result := uploadWithResult(r, name, mtime)
+	if result.Err != nil {
+		fs.Warn("Background upload failed; will try again at Unmount()", "path", name, "err", result.Err)
+		return
+	}
+
+	fs.mapMutex.Lock()
+	defer fs.mapMutex.Unlock()
+	fs.earlyUploads = append(fs.earlyUploads, result)
+	if fs.fileToRemote[name] != r {
+		return
+	}
+	delete(fs.localOnlyFiles, name)
+	if fs.uploader.generation(name) == gen {
+		fs.clearCreated(name)
+	} else {
+		fs.uploadedCreated(name)
+	}
+}
+
+// uploadOnFsync uploads the given created file right now, for when it is
+// fsync()ed in a remote with UploadOnFsync set. The file is still considered
+// created, since it remains open for further writes.
+func (fs *MuxFys) uploadOnFsync(name string) fuse.Status {
+	fs.mapMutex.RLock()
+	r := fs.fileToRemote[name]
+	var mtime uint64
+	if attr := fs.files[name]; attr != nil {
+		mtime = attr.Mtime
+	}
+	fs.mapMutex.RUnlock()
+	if r == nil {
+		fs.Error("Fsync upload of a file that no longer exists", "path", name)
+		return fuse.EIO
+	}
+
+	remotePath := r.getRemotePath(name)
+	localPath := r.getLocalPath(remotePath)
+	fmutex, err := fs.getFileMutex(localPath)
+	if err != nil {
+		return fuse.EIO
+	}
+	err = fmutex.Lock()
+	if err != nil {
+		fs.Error("Fsync upload file mutex lock failed", "path", localPath, "err", err)
+		logClose(fs.Logger, fmutex, "fsync upload file mutex")
+		return fuse.EIO
+	}
+	defer logClose(fs.Logger, fmutex, "fsync upload file mutex")
+	result := uploadWithResult(r, name, mtime)
+	if result.Err != nil {
+		fs.Error("Fsync upload failed", "path", name, "err", result.Err)
+		return fuse.EIO
+	}
+
+	fs.mapMutex.Lock()
+	defer fs.mapMutex.Unlock()
+	fs.earlyUploads = append(fs.earlyUploads, result)
+	if fs.fileToRemote[name] != r {
+		return fuse.OK
+	}
+	delete(fs.localOnlyFiles, name)
+	fs.uploadedCreated(name)
+	return fuse.OK
+}
+
+// isCreatedIn returns true if the given file is still a created file in the
+// given remote. Must not be called while you hold the mapMutex.
+func (fs *MuxFys) isCreatedIn(name string, r *remote) bool {
+	fs.mapMutex.RLock()
+	defer fs.mapMutex.RUnlock()
+	_, created := fs.createdFiles[name]
+	return created && fs.fileToRemote[name] == r
+}
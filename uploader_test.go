@@ -0,0 +1,365 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of muxfys.
+//
+//  muxfys is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  muxfys is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with muxfys. If not, see <http://www.gnu.org/licenses/>.
+
+package muxfys
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestUploader(t *testing.T) {
+	Convey("A disabled uploader is nil and safe to use", t, func() {
+		u := newUploader(0, 1, nil)
+		So(u, ShouldBeNil)
+		u.opened("a")
+		u.released("a")
+		u.modified("a")
+		u.renamed("a", "b")
+		u.forget("b")
+		So(u.generation("a"), ShouldEqual, 0)
+		So(u.pending(), ShouldEqual, 0)
+		u.stop()
+	})
+
+	Convey("An uploader uploads files after their quiet period", t, func() {
+		var mutex sync.Mutex
+		var uploaded []string
+		gens := make(map[string]uint64)
+		block := make(chan bool)
+		blocking := false
+		upload := func(name string, gen uint64) {
+			mutex.Lock()
+			b := blocking
+			mutex.Unlock()
+			if b {
+				<-block
+			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			uploaded = append(uploaded, name)
+			gens[name] = gen
+		}
+		getUploaded := func() []string {
+			mutex.Lock()
+			defer mutex.Unlock()
+			sorted := make([]string, len(uploaded))
+			copy(sorted, uploaded)
+			sort.Strings(sorted)
+			return sorted
+		}
+		delay := 50 * time.Millisecond
+		u := newUploader(delay, 2, upload)
+		So(u == nil, ShouldBeFalse)
+
+		u.opened("a")
+		u.opened("a")
+		u.opened("b")
+		u.released("a")
+		u.released("b")
+		So(u.pending(), ShouldEqual, 1)
+		<-time.After(2 * delay)
+		So(getUploaded(), ShouldResemble, []string{"b"})
+		So(gens["b"], ShouldEqual, 1)
+
+		u.released("a")
+		u.modified("c")
+		<-time.After(delay / 2)
+		u.modified("c")
+		So(len(getUploaded()), ShouldEqual, 1)
+		<-time.After(2 * delay)
+		So(getUploaded(), ShouldResemble, []string{"a", "b", "c"})
+		So(gens["a"], ShouldEqual, 2)
+		So(gens["c"], ShouldEqual, 2)
+		So(u.pending(), ShouldEqual, 0)
+
+		Convey("Renamed and forgotten files are handled", func() {
+			u.modified("d")
+			u.modified("e")
+			u.renamed("d", "f")
+			u.forget("e")
+			<-time.After(2 * delay)
+			So(getUploaded(), ShouldResemble, []string{"a", "b", "c", "f"})
+			u.stop()
+		})
+
+		Convey("Reopening a file during its quiet period delays its upload", func() {
+			u.modified("d")
+			u.opened("d")
+			<-time.After(2 * delay)
+			So(len(getUploaded()), ShouldEqual, 3)
+			So(u.pending(), ShouldEqual, 0)
+			u.released("d")
+			So(u.pending(), ShouldEqual, 1)
+			<-time.After(2 * delay)
+			So(getUploaded(), ShouldResemble, []string{"a", "b", "c", "d"})
+			u.stop()
+		})
+
+		Convey("stop() waits for in-progress uploads and forgets the rest", func() {
+			mutex.Lock()
+			blocking = true
+			mutex.Unlock()
+			u.modified("d")
+			u.modified("e")
+			u.modified("f")
+			<-time.After(2 * delay)
+			So(u.pending(), ShouldEqual, 3)
+
+			done := make(chan bool)
+			go func() {
+				u.stop()
+				done <- true
+			}()
+			for u.pending() != 2 {
+				<-time.After(time.Millisecond)
+			}
+			block <- true
+			block <- true
+			<-done
+			So(len(getUploaded()), ShouldEqual, 5)
+		})
+	})
+
+	Convey("Files renamed while open are uploaded under their new name", t, func() {
+		tmpdir, err := ioutil.TempDir("", "muxfys_uploader_testing")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(tmpdir)
+		remoteDir := filepath.Join(tmpdir, "remote")
+		err = os.MkdirAll(remoteDir, os.FileMode(dirMode))
+		So(err, ShouldBeNil)
+
+		fs, err := New(&Config{Mount: filepath.Join(tmpdir, "mnt"), CacheBase: tmpdir})
+		So(err, ShouldBeNil)
+		r, err := newRemote(&RemoteConfig{Accessor: &localAccessor{target: remoteDir}, CacheData: true, Write: true}, remoteOptions{cacheBase: tmpdir, logger: fs.Logger})
+		So(err, ShouldBeNil)
+		r.uploadOnFsync = true
+		fs.remotes = []*remote{r}
+		fs.writeRemote = r
+		fs.uploader = newUploader(time.Hour, 1, fs.uploadInBackground)
+		fs.OnMount(nil)
+		_, status := fs.OpenDir("", &fuse.Context{})
+		So(status, ShouldEqual, fuse.OK)
+
+		f, status := fs.Create("tmp", uint32(os.O_WRONLY), uint32(fileMode), &fuse.Context{})
+		So(status, ShouldEqual, fuse.OK)
+		So(fs.Rename("tmp", "final", &fuse.Context{}), ShouldEqual, fuse.OK)
+		So(f.(*cachedFile).onFsync(), ShouldEqual, fuse.OK)
+		_, err = os.Stat(filepath.Join(remoteDir, "final"))
+		So(err, ShouldBeNil)
+		f.Release()
+		So(fs.uploader.pending(), ShouldEqual, 1)
+		So(fs.openHandles, ShouldBeEmpty)
+
+		fs.uploader.stop()
+		So(fs.uploader.pending(), ShouldEqual, 0)
+		_, err = os.Stat(filepath.Join(remoteDir, "final"))
+		So(err, ShouldBeNil)
+		_, err = os.Stat(filepath.Join(remoteDir, "tmp"))
+		So(os.IsNotExist(err), ShouldBeTrue)
+		So(fs.createdFiles, ShouldResemble, map[string]bool{"final": true})
+
+		err = fs.Unmount()
+		So(err, ShouldBeNil)
+		results := fs.UploadResults()
+		So(len(results.Uploaded), ShouldEqual, 2)
+		for _, result := range results.Uploaded {
+			So(result.Path, ShouldEqual, "final")
+			So(result.Attempts, ShouldEqual, 1)
+		}
+	})
+}
+
+func TestUnmountUploads(t *testing.T) {
+	Convey("Given created files with various mtimes", t, func() {
+		tmpdir, err := ioutil.TempDir("", "muxfys_upload_testing")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(tmpdir)
+		remoteDir := filepath.Join(tmpdir, "remote")
+		err = os.MkdirAll(remoteDir, os.FileMode(dirMode))
+		So(err, ShouldBeNil)
+
+		fs, err := New(&Config{Mount: filepath.Join(tmpdir, "mnt"), CacheBase: tmpdir, UploadWorkers: 3})
+		So(err, ShouldBeNil)
+		r, err := newRemote(&RemoteConfig{Accessor: &localAccessor{target: remoteDir}, CacheData: true, Write: true}, remoteOptions{cacheBase: tmpdir, logger: fs.Logger})
+		So(err, ShouldBeNil)
+		fs.remotes = []*remote{r}
+		fs.writeRemote = r
+
+		mtimes := map[string]uint64{"a": 10, "b": 10, "c": 5, "d": 20, "e": 10}
+		for name, mtime := range mtimes {
+			fs.files[name] = &fuse.Attr{Mtime: mtime}
+			fs.createdFiles[name] = true
+			if name == "e" {
+				continue
+			}
+			localPath := r.getLocalPath(r.getRemotePath(name))
+			err = os.MkdirAll(filepath.Dir(localPath), os.FileMode(dirMode))
+			So(err, ShouldBeNil)
+			err = ioutil.WriteFile(localPath, []byte(name), os.FileMode(fileMode))
+			So(err, ShouldBeNil)
+		}
+
+		Convey("They are batched by upload order, oldest first, up to UploadWorkers at a time", func() {
+			So(fs.createdBatches(), ShouldResemble, [][]string{{"c", "a", "b"}, {"e", "d"}})
+
+			fs.uploadWorkers = 1
+			So(fs.createdBatches(), ShouldResemble, [][]string{{"c"}, {"a"}, {"b"}, {"e"}, {"d"}})
+		})
+
+		Convey("Fsync uploads can upload them before Unmount()", func() {
+			fs.fileToRemote["a"] = r
+			status := fs.uploadOnFsync("a")
+			So(status, ShouldEqual, fuse.OK)
+			content, errr := ioutil.ReadFile(filepath.Join(remoteDir, "a"))
+			So(errr, ShouldBeNil)
+			So(string(content), ShouldEqual, "a")
+			So(fs.createdFiles["a"], ShouldBeTrue)
+
+			status = fs.uploadOnFsync("b")
+			So(status, ShouldEqual, fuse.EIO)
+
+			early := fs.takeEarlyUploads()
+			So(len(early), ShouldEqual, 1)
+			So(early[0].Path, ShouldEqual, "a")
+			So(early[0].RemotePath, ShouldEqual, filepath.Join(remoteDir, "a"))
+		})
+
+		Convey("Unmount() uploads them all, reporting on each", func() {
+			err = fs.Unmount()
+			So(err, ShouldNotBeNil)
+			uerr, ok := err.(*UploadError)
+			So(ok, ShouldBeTrue)
+			So(uerr.Error(), ShouldEqual, "failed to upload 1 files")
+			So(len(uerr.Failed), ShouldEqual, 1)
+			So(uerr.Failed[0].Path, ShouldEqual, "e")
+			So(uerr.Failed[0].RemotePath, ShouldEqual, filepath.Join(remoteDir, "e"))
+			So(uerr.Failed[0].Err, ShouldNotBeNil)
+
+			for _, name := range []string{"a", "b", "c", "d"} {
+				content, errr := ioutil.ReadFile(filepath.Join(remoteDir, name))
+				So(errr, ShouldBeNil)
+				So(string(content), ShouldEqual, name)
+			}
+
+			results := fs.UploadResults()
+			So(results, ShouldNotBeNil)
+			So(len(results.Uploaded), ShouldEqual, 4)
+			So(results.Uploaded[0].Path, ShouldEqual, "c")
+			So(results.Uploaded[3].Path, ShouldEqual, "d")
+			for _, result := range results.Uploaded {
+				So(result.RemotePath, ShouldEqual, filepath.Join(remoteDir, result.Path))
+				So(result.Size, ShouldEqual, 1)
+				So(result.Attempts, ShouldEqual, 1)
+				So(result.Duration, ShouldBeGreaterThan, 0)
+				So(result.Err, ShouldBeNil)
+			}
+			So(results.Failed, ShouldResemble, uerr.Failed)
+			So(len(results.Skipped), ShouldEqual, 0)
+
+			Convey("The failed uploads can be retried from the cache", func() {
+				_, err = os.Stat(r.cacheDir)
+				So(err, ShouldBeNil)
+				localPath := r.getLocalPath(r.getRemotePath("e"))
+				err = ioutil.WriteFile(localPath, []byte("ee"), os.FileMode(fileMode))
+				So(err, ShouldBeNil)
+
+				results, err = fs.RetryUploads()
+				So(err, ShouldBeNil)
+				So(len(results.Uploaded), ShouldEqual, 1)
+				So(results.Uploaded[0].Path, ShouldEqual, "e")
+				So(results.Uploaded[0].Size, ShouldEqual, 2)
+				So(len(results.Failed), ShouldEqual, 0)
+				So(fs.UploadResults(), ShouldEqual, results)
+				content, err := ioutil.ReadFile(filepath.Join(remoteDir, "e"))
+				So(err, ShouldBeNil)
+				So(string(content), ShouldEqual, "ee")
+
+				_, err = os.Stat(r.cacheDir)
+				So(os.IsNotExist(err), ShouldBeTrue)
+
+				results, err = fs.RetryUploads()
+				So(err, ShouldBeNil)
+				So(len(results.Uploaded), ShouldEqual, 0)
+			})
+
+			Convey("Retrying can fail again, or be given up on", func() {
+				results, err = fs.RetryUploads()
+				So(err, ShouldNotBeNil)
+				So(len(results.Failed), ShouldEqual, 1)
+
+				results, err = fs.RetryUploads(true)
+				So(err, ShouldBeNil)
+				So(len(results.Skipped), ShouldEqual, 1)
+				So(results.Skipped[0].Path, ShouldEqual, "e")
+				_, err = os.Stat(r.cacheDir)
+				So(os.IsNotExist(err), ShouldBeTrue)
+			})
+		})
+
+		Convey("Unmount() uploads those waiting for a background upload in mtime order too", func() {
+			var mutex sync.Mutex
+			var started []string
+			r.uploadHook = func(event UploadEvent) {
+				if event.Type != UploadStarted {
+					return
+				}
+				mutex.Lock()
+				defer mutex.Unlock()
+				started = append(started, filepath.Base(event.RemotePath))
+			}
+			fs.uploader = newUploader(time.Hour, 1, fs.uploadInBackground)
+			fs.uploader.modified("d")
+			fs.uploader.modified("c")
+			So(fs.uploader.pending(), ShouldEqual, 2)
+
+			err = fs.Unmount()
+			So(err, ShouldNotBeNil)
+			results := fs.UploadResults()
+			So(len(results.Uploaded), ShouldEqual, 4)
+			So(results.Uploaded[0].Path, ShouldEqual, "c")
+			So(results.Uploaded[3].Path, ShouldEqual, "d")
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			So(len(started), ShouldEqual, 4)
+			So(started[0], ShouldEqual, "c")
+			So(started[3], ShouldEqual, "d")
+		})
+
+		Convey("Unmount() can skip uploading them", func() {
+			err = fs.Unmount(true)
+			So(err, ShouldBeNil)
+			results := fs.UploadResults()
+			So(len(results.Uploaded), ShouldEqual, 0)
+			So(len(results.Skipped), ShouldEqual, 5)
+			So(results.Skipped[0].Path, ShouldEqual, "c")
+			_, err = os.Stat(r.cacheDir)
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+	})
+}
@@ -0,0 +1,224 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of muxfys.
+//
+//  muxfys is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  muxfys is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with muxfys. If not, see <http://www.gnu.org/licenses/>.
+
+package muxfys
+
+// This file implements reporting the progress of uploads to a user-supplied
+// hook.
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// uploadProgressInterval is the minimum time between UploadProgress events for
+// a single upload.
+const uploadProgressInterval = 250 * time.Millisecond
+
+// UploadEventType describes what happened to an upload in an UploadEvent.
+type UploadEventType int
+
+// These are the types of UploadEvent. Every upload that is started ends with
+// either an UploadCompleted or an UploadFailed event.
+const (
+	UploadStarted UploadEventType = iota
+	UploadProgress
+	UploadCompleted
+	UploadFailed
+)
+
+// String returns a name for the event type.
+func (t UploadEventType) String() string {
+	switch t {
+	case UploadStarted:
+		return "started"
+	case UploadProgress:
+		return "progress"
+	case UploadCompleted:
+		return "completed"
+	case UploadFailed:
+		return "failed"
+	}
+	return "unknown"
+}
+
+// UploadEvent is what gets passed to Config.UploadHook.
+type UploadEvent struct {
+	// Type is the type of event.
+	Type UploadEventType
+
+	// RemotePath is the absolute remote path being uploaded to.
+	RemotePath string
+
+	// Size is the total number of bytes to upload, or -1 if that isn't known
+	// in advance because data is being uploaded as it is written.
+	Size int64
+
+	// Bytes is the number of bytes transferred so far during the current
+	// attempt.
+	Bytes int64
+
+	// Attempt is the number of the current attempt, starting from 1.
+	Attempt int
+
+	// Err is the error from the final attempt, for UploadFailed events.
+	Err error
+}
+
+// ProgressUploader is an optional interface that a RemoteAccessor can also
+// implement, to report the progress of UploadFile() calls in UploadEvents.
+type ProgressUploader interface {
+	// UploadFileWithProgress is like UploadFile(), but also calls progress
+	// with the number of bytes transferred each time more data has been
+	// uploaded. progress may be called concurrently.
+	UploadFileWithProgress(source, dest, contentType string, progress func(bytes int64)) error
+}
+
+// uploadTracker sends the UploadEvents for a single upload to a hook. All
+// methods are safe to call on a nil *uploadTracker, which does nothing.
+type uploadTracker struct {
+	mutex    sync.Mutex
+	hook     func(UploadEvent)
+	event    UploadEvent
+	started  bool
+	finished bool
+	reported time.Time
+}
+
+// newUploadTracker returns an uploadTracker for an upload to remotePath of
+// size bytes (-1 if unknown) that reports to our hook. Returns nil if we have
+// no hook.
+func (r *remote) newUploadTracker(remotePath string, size int64) *uploadTracker {
+	if r.uploadHook == nil {
+		return nil
+	}
+	return &uploadTracker{
+		hook:  r.uploadHook,
+		event: UploadEvent{RemotePath: remotePath, Size: size},
+	}
+}
+
+// start sends an UploadStarted event, if we haven't already.
+func (t *uploadTracker) start() {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if !t.started {
+		t.begin()
+	}
+}
+
+// begin sends an UploadStarted event. You must hold the mutex.
+func (t *uploadTracker) begin() {
+	t.started = true
+	t.event.Attempt = 1
+	t.send(UploadStarted)
+}
+
+// attempt should be called at the start of each attempt at the upload. The
+// first call start()s, while subsequent ones send an UploadProgress event
+// with the number of bytes transferred starting again from 0.
+func (t *uploadTracker) attempt() {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if !t.started {
+		t.begin()
+		return
+	}
+	t.event.Attempt++
+	t.event.Bytes = 0
+	t.send(UploadProgress)
+}
+
+// progress adds to the number of bytes transferred, sending an UploadProgress
+// event if we haven't sent one recently.
+func (t *uploadTracker) progress(bytes int64) {
+	if t == nil || bytes == 0 {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.event.Bytes += bytes
+	if time.Since(t.reported) >= uploadProgressInterval || t.event.Bytes == t.event.Size {
+		t.send(UploadProgress)
+	}
+}
+
+// finish sends an UploadCompleted event if err is nil, or an UploadFailed
+// event otherwise. It does nothing if we were never started or were already
+// finished.
+func (t *uploadTracker) finish(err error) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if !t.started || t.finished {
+		return
+	}
+	t.finished = true
+	t.event.Err = err
+	if err != nil {
+		t.send(UploadFailed)
+		return
+	}
+	if t.event.Size >= 0 {
+		t.event.Bytes = t.event.Size
+	}
+	t.send(UploadCompleted)
+}
+
+// send calls our hook with an event of the given type. You must hold the
+// mutex, which means events for an upload are never sent concurrently.
+func (t *uploadTracker) send(eventType UploadEventType) {
+	t.event.Type = eventType
+	t.reported = time.Now()
+	t.hook(t.event)
+}
+
+// progressReader is an io.Reader that reports the bytes read from its Reader
+// to an uploadTracker.
+type progressReader struct {
+	io.Reader
+	t *uploadTracker
+}
+
+// Read implements io.Reader.
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.Reader.Read(b)
+	p.t.progress(int64(n))
+	return n, err
+}
+
+// statusErr returns err, or if that is nil, an error describing status if it
+// isn't OK.
+func statusErr(status fuse.Status, err error) error {
+	if err == nil && status != fuse.OK {
+		err = fmt.Errorf("upload failed: %s", status)
+	}
+	return err
+}
@@ -0,0 +1,164 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of muxfys.
+//
+//  muxfys is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  muxfys is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with muxfys. If not, see <http://www.gnu.org/licenses/>.
+
+package muxfys
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// progressAccessor is a localAccessor that implements ProgressUploader,
+// reporting progress in 2 halves.
+type progressAccessor struct {
+	*localAccessor
+}
+
+func (a *progressAccessor) UploadFileWithProgress(source, dest, contentType string, progress func(bytes int64)) error {
+	err := a.UploadFile(source, dest, contentType)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+	progress(info.Size() / 2)
+	progress(info.Size() - info.Size()/2)
+	return nil
+}
+
+func TestUploadEvents(t *testing.T) {
+	Convey("Given a remote with an upload hook", t, func() {
+		tmpdir, err := ioutil.TempDir("", "muxfys_events_testing")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(tmpdir)
+		remoteDir := filepath.Join(tmpdir, "remote")
+		err = os.MkdirAll(remoteDir, os.FileMode(dirMode))
+		So(err, ShouldBeNil)
+
+		var mutex sync.Mutex
+		var events []UploadEvent
+		hook := func(event UploadEvent) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			events = append(events, event)
+		}
+		getEvents := func() []UploadEvent {
+			mutex.Lock()
+			defer mutex.Unlock()
+			return events
+		}
+		types := func() []UploadEventType {
+			var ts []UploadEventType
+			for _, event := range getEvents() {
+				ts = append(ts, event.Type)
+			}
+			return ts
+		}
+
+		accessor := &localAccessor{target: remoteDir}
+		r, err := newRemote(&RemoteConfig{Accessor: accessor, CacheData: true, Write: true}, remoteOptions{cacheBase: tmpdir, maxAttempts: 2, uploadHook: hook})
+		So(err, ShouldBeNil)
+		defer r.deleteCache()
+
+		source := filepath.Join(tmpdir, "source")
+		err = ioutil.WriteFile(source, []byte("0123456789"), os.FileMode(fileMode))
+		So(err, ShouldBeNil)
+		dest := filepath.Join(remoteDir, "dest")
+
+		Convey("Uploading a file sends start and completion events", func() {
+			status := r.uploadFile(source, dest)
+			So(status, ShouldEqual, fuse.OK)
+			So(types(), ShouldResemble, []UploadEventType{UploadStarted, UploadCompleted})
+			events := getEvents()
+			So(events[0].RemotePath, ShouldEqual, dest)
+			So(events[0].Size, ShouldEqual, 10)
+			So(events[0].Bytes, ShouldEqual, 0)
+			So(events[0].Attempt, ShouldEqual, 1)
+			So(events[1].Bytes, ShouldEqual, 10)
+			So(events[1].Err, ShouldBeNil)
+			So(events[1].Type.String(), ShouldEqual, "completed")
+		})
+
+		Convey("Failed uploads send an event per retry and a failure event", func() {
+			uploadFail = true
+			status := r.uploadFile(source, dest)
+			uploadFail = false
+			So(status, ShouldEqual, fuse.EIO)
+			So(types(), ShouldResemble, []UploadEventType{UploadStarted, UploadProgress, UploadFailed})
+			events := getEvents()
+			So(events[1].Attempt, ShouldEqual, 2)
+			So(events[2].Err, ShouldNotBeNil)
+		})
+
+		Convey("Accessors that are ProgressUploaders report progress", func() {
+			r.accessor = &progressAccessor{accessor}
+			status := r.uploadFile(source, dest)
+			So(status, ShouldEqual, fuse.OK)
+			So(types(), ShouldResemble, []UploadEventType{UploadStarted, UploadProgress, UploadCompleted})
+			So(getEvents()[1].Bytes, ShouldEqual, 10)
+		})
+
+		Convey("Uploading data reports the bytes read", func() {
+			ready, finished := r.uploadData(ioutil.NopCloser(strings.NewReader("streamed")), dest)
+			<-ready
+			So(<-finished, ShouldBeTrue)
+			ts := types()
+			So(ts[0], ShouldEqual, UploadStarted)
+			So(ts[len(ts)-1], ShouldEqual, UploadCompleted)
+			events := getEvents()
+			So(events[0].Size, ShouldEqual, -1)
+			So(events[len(events)-1].Bytes, ShouldEqual, 8)
+		})
+
+		Convey("progressReaders only report progress periodically", func() {
+			tracker := r.newUploadTracker(dest, 1000)
+			tracker.start()
+			pr := &progressReader{Reader: strings.NewReader(strings.Repeat("x", 1000)), t: tracker}
+			b := make([]byte, 10)
+			for {
+				_, errr := pr.Read(b)
+				if errr == io.EOF {
+					break
+				}
+			}
+			So(types(), ShouldResemble, []UploadEventType{UploadStarted, UploadProgress})
+			So(getEvents()[1].Bytes, ShouldEqual, 1000)
+			tracker.finish(nil)
+			tracker.finish(nil)
+			So(len(getEvents()), ShouldEqual, 3)
+		})
+
+		Convey("Without a hook there is no tracker", func() {
+			r.uploadHook = nil
+			So(r.newUploadTracker(dest, 10), ShouldBeNil)
+			status := r.uploadFile(source, dest)
+			So(status, ShouldEqual, fuse.OK)
+			So(len(getEvents()), ShouldEqual, 0)
+		})
+	})
+}
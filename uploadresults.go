@@ -0,0 +1,293 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of muxfys.
+//
+//  muxfys is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  muxfys is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with muxfys. If not, see <http://www.gnu.org/licenses/>.
+
+package muxfys
+
+// This file implements reporting on the uploads done at Unmount(), and
+// retrying the ones that failed.
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// UploadResult describes what happened when a file you created or altered was
+// (or wasn't) uploaded.
+type UploadResult struct {
+	// Path is the path of the file relative to the mount point.
+	Path string
+
+	// RemotePath is the absolute remote path it was uploaded to.
+	RemotePath string
+
+	// Size is the size of the local file that was uploaded.
+	Size int64
+
+	// Duration is how long the upload took, including retries.
+	Duration time.Duration
+
+	// Attempts is the number of upload attempts that were made.
+	Attempts int
+
+	// ConflictPath is set when RemoteConfig.ConflictSuffix is in use and
+	// someone else changed the file at RemotePath since you first saw it. It
+	// is the remote path your version was uploaded to instead.
+	ConflictPath string
+
+	// Err is the error from the final attempt, for failed uploads.
+	Err error
+
+	mtime uint64
+}
+
+// UploadResults describes what happened to the files you created or altered
+// when you called Unmount() or RetryUploads(). Each slice is ordered oldest
+// file first. For Unmount(), Uploaded starts with any uploads that were done
+// before it was called, because of Config.WriteBackDelay or
+// RemoteConfig.UploadOnFsync, in the order they happened.
+type UploadResults struct {
+	// Uploaded are the files that were uploaded successfully.
+	Uploaded []*UploadResult
+
+	// Failed are the files that could not be uploaded. You can try again with
+	// RetryUploads().
+	Failed []*UploadResult
+
+	// Skipped are the files that weren't uploaded because you asked for no
+	// uploads.
+	Skipped []*UploadResult
+}
+
+// UploadError is the error returned by Unmount() and RetryUploads() when some
+// of the files you created or altered could not be uploaded.
+type UploadError struct {
+	// Failed has an entry for each file that could not be uploaded, oldest
+	// first.
+	Failed []*UploadResult
+}
+
+// Error implements the error interface.
+func (e *UploadError) Error() string {
+	return fmt.Sprintf("failed to upload %d files", len(e.Failed))
+}
+
+// newUploadResult creates an UploadResult for the given mount-relative file
+// in r, filling in its paths and size.
+func newUploadResult(r *remote, name string, mtime uint64) *UploadResult {
+	result := &UploadResult{Path: name, RemotePath: r.getRemotePath(name), mtime: mtime}
+	if info, err := os.Stat(r.getLocalPath(result.RemotePath)); err == nil {
+		result.Size = info.Size()
+	}
+	return result
+}
+
+// uploadWithResult uploads the cached copy of the given mount-relative file in
+// r, returning the outcome.
+func uploadWithResult(r *remote, name string, mtime uint64) *UploadResult {
+	result := newUploadResult(r, name, mtime)
+	start := time.Now()
+	status, attempts, dest, err := r.uploadFileAttempts(r.getLocalPath(result.RemotePath), result.RemotePath)
+	result.Duration = time.Since(start)
+	result.Attempts = attempts
+	if dest != result.RemotePath {
+		result.ConflictPath = dest
+	}
+	if status != fuse.OK {
+		result.Err = statusErr(status, err)
+	}
+	return result
+}
+
+// takeEarlyUploads returns the results of the uploads that were done before
+// Unmount() (in the background, or on fsync), oldest first, and forgets them.
+func (fs *MuxFys) takeEarlyUploads() []*UploadResult {
+	fs.mapMutex.Lock()
+	defer fs.mapMutex.Unlock()
+	early := fs.earlyUploads
+	fs.earlyUploads = nil
+	return early
+}
+
+// skippedUploads returns results for all our created files, for when we're
+// not going to upload them.
+func (fs *MuxFys) skippedUploads() []*UploadResult {
+	if !fs.cachesWrites() {
+		return nil
+	}
+	var skipped []*UploadResult
+	for _, batch := range fs.createdBatches() {
+		for _, name := range batch {
+			fs.mapMutex.RLock()
+			r := fs.createdRemote(name)
+			fs.mapMutex.RUnlock()
+			skipped = append(skipped, newUploadResult(r, name, fs.createdMtime(name)))
+		}
+	}
+	return skipped
+}
+
+// failedUploads holds on to the remote (and so its cached data) and journal
+// of an unmounted writeable remote for which some uploads failed.
+type failedUploads struct {
+	r       *remote
+	journal *journal
+	ids     map[string]uint64
+	results []*UploadResult
+}
+
+// release lets go of the remote and journal, deleting the remote's cache dir
+// if it was one we created. If discard is true, the journal is deleted even if
+// uploads are still pending.
+func (f *failedUploads) release(discard bool) {
+	f.journal.close(discard)
+	if f.r.cacheIsTmp {
+		err := f.r.deleteCache()
+		if err != nil {
+			f.r.Warn("Cache deletion failed", "err", err)
+		}
+	}
+}
+
+// holdFailedUploads remembers the writeable remotes and journals of the given
+// failed uploads so that they can be retried after Unmount() with
+// RetryUploads(). Returns the remotes that had failed uploads to hold on to.
+func (fs *MuxFys) holdFailedUploads(failed []*UploadResult) map[*remote]bool {
+	held := make(map[*remote]bool)
+	byRemote := make(map[*remote]*failedUploads)
+	fs.mapMutex.RLock()
+	defer fs.mapMutex.RUnlock()
+	for _, result := range failed {
+		r := fs.createdRemote(result.Path)
+		f, exists := byRemote[r]
+		if !exists {
+			f = &failedUploads{
+				r:       r,
+				journal: r.journal,
+				ids:     make(map[string]uint64),
+			}
+			byRemote[r] = f
+			held[r] = true
+			fs.failedUploads = append(fs.failedUploads, f)
+		}
+		f.ids[result.Path] = fs.journalIDs[result.Path].id
+		f.results = append(f.results, result)
+	}
+	return held
+}
+
+// RetryUploads tries again to upload the files that failed to upload during
+// previous calls to Unmount() (and RetryUploads()), using their still-cached
+// data. You can optionally supply a bool which if true gives up on them
+// instead, without uploading.
+//
+// As with Unmount(), files are uploaded oldest first, concurrently in batches
+// of up to Config.UploadWorkers, and an *UploadError is returned if any uploads fail. The returned
+// results are also available from UploadResults().
+//
+// Once there are no failed uploads left, any CacheDir that muxfys created for
+// them is deleted. If you Mount() again with the same explicit CacheDir
+// instead, the failed uploads will be retried by Mount() (see Recovery()) and
+// are forgotten here.
+func (fs *MuxFys) RetryUploads(doNotUpload ...bool) (*UploadResults, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	discard := len(doNotUpload) == 1 && doNotUpload[0]
+
+	results := &UploadResults{}
+	var still []*failedUploads
+	for _, f := range fs.failedUploads {
+		if discard {
+			for _, previous := range f.results {
+				results.Skipped = append(results.Skipped, newUploadResult(f.r, previous.Path, previous.mtime))
+			}
+			f.release(true)
+			continue
+		}
+
+		var failed []*UploadResult
+		for _, batch := range batchResults(f.results, fs.workers()) {
+			batchResults := fs.uploadConcurrently(len(batch), func(i int) *UploadResult {
+				return uploadWithResult(f.r, batch[i].Path, batch[i].mtime)
+			})
+			for _, result := range batchResults {
+				if result.Err == nil {
+					f.journal.finish(f.ids[result.Path])
+					results.Uploaded = append(results.Uploaded, result)
+				} else {
+					failed = append(failed, result)
+					results.Failed = append(results.Failed, result)
+				}
+			}
+		}
+
+		if len(failed) == 0 {
+			f.release(false)
+			continue
+		}
+		f.results = failed
+		still = append(still, f)
+	}
+	fs.failedUploads = still
+	fs.uploadResults = results
+
+	if len(results.Failed) > 0 {
+		return results, &UploadError{Failed: results.Failed}
+	}
+	return results, nil
+}
+
+// releaseFailedUploads lets go of any failed uploads that were cached in the
+// given explicit CacheDir, leaving them in the journal for recoverJournals() to
+// deal with.
+func (fs *MuxFys) releaseFailedUploads(cacheDir string) {
+	var still []*failedUploads
+	for _, f := range fs.failedUploads {
+		if !f.r.cacheIsTmp && f.r.cacheDir == cacheDir {
+			f.release(false)
+			continue
+		}
+		still = append(still, f)
+	}
+	fs.failedUploads = still
+}
+
+// batchResults splits results that are already sorted by mtime in to batches
+// of up to size results, keeping their order.
+func batchResults(results []*UploadResult, size int) [][]*UploadResult {
+	var batches [][]*UploadResult
+	for len(results) > size {
+		batches = append(batches, results[:size])
+		results = results[size:]
+	}
+	if len(results) > 0 {
+		batches = append(batches, results)
+	}
+	return batches
+}
+
+// UploadResults returns details of what happened to each file you created or
+// altered during the most recent call to Unmount() or RetryUploads(). Returns
+// nil if neither has been called yet.
+func (fs *MuxFys) UploadResults() *UploadResults {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	return fs.uploadResults
+}
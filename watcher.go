@@ -0,0 +1,282 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of muxfys.
+//
+//  muxfys is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  muxfys is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with muxfys. If not, see <http://www.gnu.org/licenses/>.
+
+package muxfys
+
+// This file implements polling of watched directories for changes made
+// remotely by others.
+
+import (
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// changeBufferSize is the capacity of the channel returned by Changes().
+const changeBufferSize = 1024
+
+// ChangeType describes what happened to a file or directory in a ChangeEvent.
+type ChangeType int
+
+// ChangeType* constants are the types of ChangeEvent.
+const (
+	ChangeAdded ChangeType = iota
+	ChangeModified
+	ChangeRemoved
+)
+
+// String returns a lower case description of the ChangeType.
+func (t ChangeType) String() string {
+	switch t {
+	case ChangeAdded:
+		return "added"
+	case ChangeModified:
+		return "modified"
+	case ChangeRemoved:
+		return "removed"
+	}
+	return "unknown"
+}
+
+// ChangeEvent describes a change to a watched directory that was noticed when
+// it was polled. See Watch().
+type ChangeEvent struct {
+	Type ChangeType
+
+	// Path is the path of the file or directory that changed, relative to the
+	// mount point.
+	Path string
+
+	// IsDir is true if Path is a directory.
+	IsDir bool
+}
+
+// Watch makes the given directory get listed again every Config.WatchInterval
+// while mounted, to notice files and directories that others add, modify or
+// delete remotely. Changes are sent on the channel returned by Changes(), and
+// the kernel is told to forget what it cached about them, so that `ls` and
+// inotify-style consumers see them. path can be absolute (within the mount
+// point) or relative to the mount point. If recursive is true, the directories
+// beneath path are also watched, including ones that appear later.
+//
+// You can Watch() before you Mount(), and directories stay watched if you
+// Unmount() and Mount() again. Nothing happens if WatchInterval was not set,
+// and watched directories that don't exist are ignored until they do.
+func (fs *MuxFys) Watch(path string, recursive bool) error {
+	name, err := fs.mountRelativePath(path)
+	if err != nil {
+		return err
+	}
+	fs.mapMutex.Lock()
+	defer fs.mapMutex.Unlock()
+	fs.watches[name] = recursive
+	return nil
+}
+
+// Unwatch stops a directory previously supplied to Watch() from being watched.
+func (fs *MuxFys) Unwatch(path string) error {
+	name, err := fs.mountRelativePath(path)
+	if err != nil {
+		return err
+	}
+	fs.mapMutex.Lock()
+	defer fs.mapMutex.Unlock()
+	delete(fs.watches, name)
+	return nil
+}
+
+// Changes returns a channel that ChangeEvents for watched directories will be
+// sent on (see Watch()). The channel is buffered; if you don't read from it
+// quickly enough, events will be dropped (with a warning in Logs()) rather
+// than holding up polling. The channel is never closed.
+func (fs *MuxFys) Changes() <-chan ChangeEvent {
+	return fs.changes
+}
+
+// pollWatched lists all our watched directories again, telling the kernel and
+// our Changes() channel about anything that changed.
+func (fs *MuxFys) pollWatched() {
+	fs.mapMutex.Lock()
+	var events []ChangeEvent
+	var entries []entryName
+	var paths []string
+	for _, dir := range fs.watchedDirs() {
+		dirEvents := fs.pollDir(dir)
+		if len(dirEvents) == 0 {
+			continue
+		}
+		paths = append(paths, dir)
+		for _, event := range dirEvents {
+			entries = append(entries, entryName{dir, filepath.Base(event.Path)})
+			if event.Type == ChangeModified {
+				paths = append(paths, event.Path)
+			}
+		}
+		events = append(events, dirEvents...)
+	}
+	nodeFs := fs.nodeFs
+	fs.mapMutex.Unlock()
+
+	fs.notifyKernel(nodeFs, entries, paths)
+
+	for _, event := range events {
+		select {
+		case fs.changes <- event:
+		default:
+			fs.Warn("Change event dropped", "type", event.Type, "path", event.Path)
+		}
+	}
+}
+
+// watchedDirs returns the sorted names of the directories we currently know
+// about that are being watched. Must be called while you have the mapMutex
+// Locked.
+func (fs *MuxFys) watchedDirs() []string {
+	watched := make(map[string]bool)
+	for name, recursive := range fs.watches {
+		if _, isDir := fs.dirs[name]; isDir {
+			watched[name] = true
+		}
+		if !recursive {
+			continue
+		}
+		for dir := range fs.dirs {
+			if isWithinDir(dir, name) {
+				watched[dir] = true
+			}
+		}
+	}
+	dirs := make([]string, 0, len(watched))
+	for dir := range watched {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	return dirs
+}
+
+// entryState is what we compare between listings of a directory to see if an
+// entry changed.
+type entryState struct {
+	mode    uint32
+	size    uint64
+	mtime   uint64
+	created bool
+}
+
+// pollDir lists the given directory again and returns events describing how it
+// differs from our previous listing. If we didn't have a previous listing, it
+// just gets listed. Must be called while you have the mapMutex Locked.
+func (fs *MuxFys) pollDir(name string) []ChangeEvent {
+	remotes, isDir := fs.dirs[name]
+	if !isDir {
+		return nil
+	}
+	if _, listed := fs.dirContents[name]; !listed {
+		for _, r := range remotes {
+			status := fs.openDir(r, name)
+			if status != fuse.OK {
+				fs.Warn("pollDir openDir failed", "path", name, "status", status)
+			}
+		}
+		return nil
+	}
+
+	before := fs.entryStates(name)
+	fs.refreshDir(name)
+	after := fs.entryStates(name)
+
+	var events []ChangeEvent
+	for entry, old := range before {
+		path := filepath.Join(name, entry)
+		current, exists := after[entry]
+		switch {
+		case !exists:
+			events = append(events, ChangeEvent{Type: ChangeRemoved, Path: path, IsDir: old.mode == uint32(fuse.S_IFDIR)})
+		case current.mode != old.mode || (!old.created && !current.created && (current.size != old.size || current.mtime != old.mtime)):
+			events = append(events, ChangeEvent{Type: ChangeModified, Path: path, IsDir: current.mode == uint32(fuse.S_IFDIR)})
+		}
+	}
+	for entry, current := range after {
+		if _, existed := before[entry]; !existed {
+			events = append(events, ChangeEvent{Type: ChangeAdded, Path: filepath.Join(name, entry), IsDir: current.mode == uint32(fuse.S_IFDIR)})
+		}
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Path < events[j].Path
+	})
+	return events
+}
+
+// entryStates returns the state of each entry in our listing of the given
+// directory. Must be called while you have the mapMutex Locked.
+func (fs *MuxFys) entryStates(name string) map[string]entryState {
+	states := make(map[string]entryState)
+	for _, entry := range fs.dirContents[name] {
+		thisPath := filepath.Join(name, entry.Name)
+		state := entryState{mode: entry.Mode, created: fs.createdFiles[thisPath]}
+		if attr, exists := fs.files[thisPath]; exists {
+			state.size = attr.Size
+			state.mtime = attr.Mtime
+		}
+		states[entry.Name] = state
+	}
+	return states
+}
+
+// watcher calls a poll function periodically in the background until stopped.
+// All methods are safe to call on a nil *watcher, which does nothing.
+type watcher struct {
+	stopCh chan struct{}
+	done   sync.WaitGroup
+}
+
+// newWatcher creates a watcher that calls poll every interval. Returns nil if
+// interval is not positive.
+func newWatcher(interval time.Duration, poll func()) *watcher {
+	if interval <= 0 {
+		return nil
+	}
+	w := &watcher{stopCh: make(chan struct{})}
+	w.done.Add(1)
+	go func() {
+		defer w.done.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				poll()
+			case <-w.stopCh:
+				return
+			}
+		}
+	}()
+	return w
+}
+
+// stop stops polling, waiting for any poll in progress to complete.
+func (w *watcher) stop() {
+	if w == nil {
+		return
+	}
+	close(w.stopCh)
+	w.done.Wait()
+}
@@ -0,0 +1,155 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of muxfys.
+//
+//  muxfys is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  muxfys is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with muxfys. If not, see <http://www.gnu.org/licenses/>.
+
+package muxfys
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestWatcher(t *testing.T) {
+	Convey("newWatcher polls until stopped", t, func() {
+		var polls int64
+		w := newWatcher(10*time.Millisecond, func() {
+			atomic.AddInt64(&polls, 1)
+		})
+		<-time.After(55 * time.Millisecond)
+		w.stop()
+		done := atomic.LoadInt64(&polls)
+		So(done, ShouldBeGreaterThanOrEqualTo, 3)
+		<-time.After(25 * time.Millisecond)
+		So(atomic.LoadInt64(&polls), ShouldEqual, done)
+
+		So(newWatcher(0, nil), ShouldBeNil)
+		var nilWatcher *watcher
+		nilWatcher.stop()
+	})
+
+	Convey("Given a remote with a file and a subdirectory", t, func() {
+		tmpdir, err := ioutil.TempDir("", "muxfys_watcher_testing")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(tmpdir)
+		remoteDir := filepath.Join(tmpdir, "remote")
+		err = os.MkdirAll(filepath.Join(remoteDir, "sub"), os.FileMode(dirMode))
+		So(err, ShouldBeNil)
+
+		write := func(name, content string) {
+			errw := ioutil.WriteFile(filepath.Join(remoteDir, name), []byte(content), os.FileMode(fileMode))
+			So(errw, ShouldBeNil)
+		}
+		write("a", "a")
+		write("sub/b", "b")
+
+		fs, err := New(&Config{Mount: filepath.Join(tmpdir, "mnt"), CacheBase: tmpdir, WatchInterval: time.Hour})
+		So(err, ShouldBeNil)
+		r, err := newRemote(&RemoteConfig{Accessor: &localAccessor{target: remoteDir}}, remoteOptions{cacheBase: tmpdir, logger: fs.Logger})
+		So(err, ShouldBeNil)
+		fs.remotes = []*remote{r}
+		fs.OnMount(nil)
+
+		changes := func() []ChangeEvent {
+			var events []ChangeEvent
+			for {
+				select {
+				case event := <-fs.Changes():
+					events = append(events, event)
+				default:
+					return events
+				}
+			}
+		}
+
+		Convey("Watched directories report changes when polled", func() {
+			err = fs.Watch("", false)
+			So(err, ShouldBeNil)
+			fs.pollWatched()
+			So(changes(), ShouldBeNil)
+			_, status := fs.GetAttr("a", &fuse.Context{})
+			So(status, ShouldEqual, fuse.OK)
+
+			fs.pollWatched()
+			So(changes(), ShouldBeNil)
+
+			write("a", "changed")
+			write("c", "c")
+			err = os.RemoveAll(filepath.Join(remoteDir, "sub"))
+			So(err, ShouldBeNil)
+			fs.pollWatched()
+			So(changes(), ShouldResemble, []ChangeEvent{
+				{Type: ChangeModified, Path: "a"},
+				{Type: ChangeAdded, Path: "c"},
+				{Type: ChangeRemoved, Path: "sub", IsDir: true},
+			})
+			attr, status := fs.GetAttr("a", &fuse.Context{})
+			So(status, ShouldEqual, fuse.OK)
+			So(attr.Size, ShouldEqual, 7)
+			So(ChangeRemoved.String(), ShouldEqual, "removed")
+
+			Convey("Until unwatched", func() {
+				err = fs.Unwatch(filepath.Join(fs.mountPoint, "."))
+				So(err, ShouldBeNil)
+				write("d", "d")
+				fs.pollWatched()
+				So(changes(), ShouldBeNil)
+			})
+		})
+
+		Convey("Recursive watches cover subdirectories", func() {
+			err = fs.Watch("", true)
+			So(err, ShouldBeNil)
+			fs.pollWatched()
+			fs.pollWatched()
+			So(changes(), ShouldBeNil)
+
+			write("sub/c", "c")
+			err = os.MkdirAll(filepath.Join(remoteDir, "sub", "new"), os.FileMode(dirMode))
+			So(err, ShouldBeNil)
+			write("sub/new/d", "d")
+			fs.pollWatched()
+			So(changes(), ShouldResemble, []ChangeEvent{
+				{Type: ChangeAdded, Path: "sub/c"},
+				{Type: ChangeAdded, Path: "sub/new", IsDir: true},
+			})
+
+			fs.pollWatched()
+			So(changes(), ShouldBeNil)
+			write("sub/new/e", "e")
+			fs.pollWatched()
+			So(changes(), ShouldResemble, []ChangeEvent{
+				{Type: ChangeAdded, Path: "sub/new/e"},
+			})
+		})
+
+		Convey("Non-recursive watches ignore subdirectories", func() {
+			err = fs.Watch("", false)
+			So(err, ShouldBeNil)
+			fs.pollWatched()
+			write("sub/c", "c")
+			fs.pollWatched()
+			So(changes(), ShouldBeNil)
+		})
+	})
+}
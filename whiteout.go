@@ -0,0 +1,217 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of muxfys.
+//
+//  muxfys is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  muxfys is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with muxfys. If not, see <http://www.gnu.org/licenses/>.
+
+package muxfys
+
+// This file implements overlay semantics for files in read-only remotes that
+// are multiplexed with writeable ones: modifying them copies them up to the
+// writeable remote that routeWrite() picks, and deleting them stores a
+// whiteout marker there.
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// whiteoutPrefix is the start of the basename of the (empty) objects stored in
+// the writeable remote to hide the file named by the rest of the basename in
+// the same directory of the read-only remotes.
+const whiteoutPrefix = ".wh."
+
+// whiteoutPath returns the path of the whiteout marker for the given path.
+func whiteoutPath(name string) string {
+	return filepath.Join(filepath.Dir(name), whiteoutPrefix+filepath.Base(name))
+}
+
+// whitedOut returns the path hidden by the given whiteout marker basename in
+// the given directory, and true. If base isn't a whiteout marker, returns
+// false.
+func whitedOut(dir, base string) (string, bool) {
+	if !strings.HasPrefix(base, whiteoutPrefix) || base == whiteoutPrefix {
+		return "", false
+	}
+	return filepath.Join(dir, strings.TrimPrefix(base, whiteoutPrefix)), true
+}
+
+// overlayRemote returns the writeable remote that the given file, which is in
+// the given remote, could be copied up to or whited out in. Returns nil if r
+// isn't read-only, or the file is a shadowed copy, or no writeable remote
+// allows it.
+func (fs *MuxFys) overlayRemote(name string, r *remote) *remote {
+	if r == nil || r.write {
+		return nil
+	}
+	if _, shadowed := fs.unshadow(name); shadowed {
+		return nil
+	}
+	return fs.routeWrite(name, false)
+}
+
+// writableDetails is like fileDetails(name, true), except that if the file is
+// in a read-only remote, it is first copied up to a writeable remote. If
+// truncate is true, the copy starts off empty instead of having the file's
+// data.
+func (fs *MuxFys) writableDetails(name string, truncate bool) (*fuse.Attr, *remote, fuse.Status) {
+	attr, r, status := fs.fileDetails(name, true)
+	if status != fuse.EPERM {
+		return attr, r, status
+	}
+	w := fs.overlayRemote(name, r)
+	if w == nil || !w.cacheData {
+		return attr, r, status
+	}
+	return fs.copyUp(name, r, w, attr, truncate)
+}
+
+// copyUp makes the given file in the given read-only remote belong to the
+// given writeable remote w by placing a copy in w's cache, where it can be
+// modified before being uploaded like any file we created.
+func (fs *MuxFys) copyUp(name string, r, w *remote, attr *fuse.Attr, truncate bool) (*fuse.Attr, *remote, fuse.Status) {
+	localPath := w.getLocalPath(w.getRemotePath(name))
+	fmutex, err := fs.getFileMutex(localPath)
+	if err != nil {
+		return nil, nil, fuse.EIO
+	}
+	err = fmutex.Lock()
+	if err != nil {
+		fs.Error("copyUp file mutex lock failed", "err", err)
+		return nil, nil, fuse.EIO
+	}
+	defer logClose(fs.Logger, fmutex, "copyUp file mutex", "path", localPath)
+
+	fs.mapMutex.Lock()
+	if fs.fileToRemote[name] == w {
+		// someone else copied it up while we waited for the lock
+		defer fs.mapMutex.Unlock()
+		return fs.files[name], w, fuse.OK
+	}
+	fs.mapMutex.Unlock()
+
+	// fill w's cache with only the file mutex held, so that other operations
+	// don't have to wait for the download
+	size := int64(attr.Size)
+	if truncate {
+		size = 0
+		var f *os.File
+		f, err = os.Create(localPath)
+		if err == nil {
+			err = f.Close()
+		}
+		if err != nil {
+			w.Error("copyUp could not create empty file", "path", localPath, "err", err)
+			return nil, nil, fuse.ToStatus(err)
+		}
+	} else if status := r.downloadFile(r.getRemotePath(name), localPath); status != fuse.OK {
+		return nil, nil, status
+	}
+
+	fs.mapMutex.Lock()
+	defer fs.mapMutex.Unlock()
+	current := fs.fileToRemote[name]
+	if current == w {
+		return fs.files[name], w, fuse.OK
+	}
+	if current != r {
+		// the file was deleted or renamed while we downloaded it
+		if errr := os.Remove(localPath); errr != nil {
+			w.Warn("copyUp could not remove abandoned copy", "path", localPath, "err", errr)
+		}
+		return nil, nil, fuse.ENOENT
+	}
+	w.CacheDelete(localPath)
+	w.CacheOverride(localPath, NewInterval(0, size))
+
+	upAttr := *attr
+	upAttr.Size = uint64(size)
+	fs.addShadowed(name, r, attr)
+	fs.files[name] = &upAttr
+	fs.fileToRemote[name] = w
+	fs.addRouteDirs(name, w)
+	fs.overlaid[name] = true
+	fs.setCreated(name)
+	fs.uploader.modified(name)
+	w.Info("Copied up", "path", name, "from", r.accessor.Target())
+	return &upAttr, w, fuse.OK
+}
+
+// whiteout hides the given file from the read-only remotes by storing a
+// whiteout marker for it in the given writeable remote. Must not be called
+// while you have the mapMutex Locked, since the marker is uploaded first.
+func (fs *MuxFys) whiteout(name string, w *remote) fuse.Status {
+	remotePath := w.getRemotePath(whiteoutPath(name))
+	status := w.retry("UploadData", remotePath, func() error {
+		return w.accessor.UploadData(strings.NewReader(""), remotePath)
+	})
+	if status != fuse.OK {
+		return status
+	}
+
+	fs.mapMutex.Lock()
+	defer fs.mapMutex.Unlock()
+	fs.whiteouts[name] = w
+	delete(fs.overlaid, name)
+	fs.hideWhitedOut(name)
+	return fuse.OK
+}
+
+// unwhiteout deletes the whiteout marker for the given file that is stored in
+// w, since we're creating the file in a writeable remote. The read-only
+// remotes' copies remain hidden by our new one. If the marker can't be
+// deleted, we still know about it, and return the error. Must not be called
+// while you have the mapMutex Locked, since the marker is deleted first.
+func (fs *MuxFys) unwhiteout(name string, w *remote) fuse.Status {
+	if status := w.deleteFile(w.getRemotePath(whiteoutPath(name))); status != fuse.OK {
+		w.Warn("Could not delete whiteout marker", "path", name, "status", status)
+		return status
+	}
+
+	fs.mapMutex.Lock()
+	defer fs.mapMutex.Unlock()
+	if fs.whiteouts[name] == w {
+		delete(fs.whiteouts, name)
+		fs.overlaid[name] = true
+	}
+	return fuse.OK
+}
+
+// hideWhitedOut forgets any read-only remote's copy of the given whited out
+// file. Must be called while you have the mapMutex Locked.
+func (fs *MuxFys) hideWhitedOut(name string) {
+	r, exists := fs.fileToRemote[name]
+	if !exists || r.write {
+		return
+	}
+	delete(fs.files, name)
+	delete(fs.fileToRemote, name)
+	delete(fs.shadows, name)
+	fs.rmEntryFromItsDir(name)
+}
+
+// forgetWhiteouts forgets the whiteouts of files in the given directory,
+// because we're about to list it again. Must be called while you have the
+// mapMutex Locked.
+func (fs *MuxFys) forgetWhiteouts(dir string) {
+	for name := range fs.whiteouts {
+		if parentDir(name) == dir {
+			delete(fs.whiteouts, name)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of muxfys.
+//
+//  muxfys is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  muxfys is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with muxfys. If not, see <http://www.gnu.org/licenses/>.
+
+package muxfys
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// blockingAccessor is a localAccessor whose downloads and data uploads wait
+// until released.
+type blockingAccessor struct {
+	*localAccessor
+	started chan bool
+	release chan bool
+}
+
+func (a *blockingAccessor) DownloadFile(source, dest string) error {
+	a.started <- true
+	<-a.release
+	return a.localAccessor.DownloadFile(source, dest)
+}
+
+func (a *blockingAccessor) UploadData(data io.Reader, dest string) error {
+	a.started <- true
+	<-a.release
+	return a.localAccessor.UploadData(data, dest)
+}
+
+// undeletableAccessor is a localAccessor that can't delete files.
+type undeletableAccessor struct {
+	*localAccessor
+}
+
+func (a *undeletableAccessor) DeleteFile(path string) error {
+	return errors.New("delete not allowed")
+}
+
+func TestWhiteouts(t *testing.T) {
+	Convey("Whiteout marker paths can be converted", t, func() {
+		So(whiteoutPath("a"), ShouldEqual, ".wh.a")
+		So(whiteoutPath("d/a"), ShouldEqual, "d/.wh.a")
+		hidden, isWhiteout := whitedOut("d", ".wh.a")
+		So(isWhiteout, ShouldBeTrue)
+		So(hidden, ShouldEqual, "d/a")
+		_, isWhiteout = whitedOut("d", "a")
+		So(isWhiteout, ShouldBeFalse)
+		_, isWhiteout = whitedOut("d", ".wh.")
+		So(isWhiteout, ShouldBeFalse)
+	})
+
+	Convey("Given a read-only remote multiplexed with a writeable one", t, func() {
+		tmpdir, err := ioutil.TempDir("", "muxfys_whiteout_testing")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(tmpdir)
+		lowerDir := filepath.Join(tmpdir, "lower")
+		upperDir := filepath.Join(tmpdir, "upper")
+		for _, dir := range []string{filepath.Join(lowerDir, "d"), upperDir} {
+			err = os.MkdirAll(dir, os.FileMode(dirMode))
+			So(err, ShouldBeNil)
+		}
+		for _, name := range []string{"a", "b", "d/c"} {
+			err = ioutil.WriteFile(filepath.Join(lowerDir, name), []byte("lower "+name), os.FileMode(fileMode))
+			So(err, ShouldBeNil)
+		}
+
+		mount := func() (*MuxFys, *remote) {
+			fs, errn := New(&Config{Mount: filepath.Join(tmpdir, "mnt"), CacheBase: tmpdir})
+			So(errn, ShouldBeNil)
+			lower, errn := newRemote(&RemoteConfig{Accessor: &localAccessor{target: lowerDir}}, remoteOptions{cacheBase: tmpdir, logger: fs.Logger})
+			So(errn, ShouldBeNil)
+			upper, errn := newRemote(&RemoteConfig{Accessor: &localAccessor{target: upperDir}, CacheData: true, Write: true}, remoteOptions{cacheBase: tmpdir, logger: fs.Logger})
+			So(errn, ShouldBeNil)
+			fs.remotes = []*remote{lower, upper}
+			fs.writeRemote = upper
+			fs.OnMount(nil)
+			return fs, upper
+		}
+		ls := func(fs *MuxFys, dir string) []string {
+			entries, status := fs.OpenDir(dir, &fuse.Context{})
+			So(status, ShouldEqual, fuse.OK)
+			var names []string
+			for _, entry := range entries {
+				names = append(names, entry.Name)
+			}
+			sort.Strings(names)
+			return names
+		}
+		readUpper := func(name string) string {
+			content, errr := ioutil.ReadFile(filepath.Join(upperDir, name))
+			So(errr, ShouldBeNil)
+			return string(content)
+		}
+
+		fs, upper := mount()
+		So(ls(fs, ""), ShouldResemble, []string{"a", "b", "d"})
+		So(ls(fs, "d"), ShouldResemble, []string{"c"})
+
+		Convey("Deleting a read-only file stores a whiteout that hides it in future mounts", func() {
+			So(fs.Unlink("a", &fuse.Context{}), ShouldEqual, fuse.OK)
+			So(fs.Unlink("d/c", &fuse.Context{}), ShouldEqual, fuse.OK)
+			So(ls(fs, ""), ShouldResemble, []string{"b", "d"})
+			So(ls(fs, "d"), ShouldBeEmpty)
+			_, err = os.Stat(filepath.Join(upperDir, ".wh.a"))
+			So(err, ShouldBeNil)
+			_, err = os.Stat(filepath.Join(lowerDir, "a"))
+			So(err, ShouldBeNil)
+			err = fs.Unmount()
+			So(err, ShouldBeNil)
+
+			fs, _ = mount()
+			So(ls(fs, ""), ShouldResemble, []string{"b", "d"})
+			So(ls(fs, "d"), ShouldBeEmpty)
+			_, status := fs.GetAttr("a", &fuse.Context{})
+			So(status, ShouldEqual, fuse.ENOENT)
+
+			Convey("Creating the file again removes the whiteout", func() {
+				f, status := fs.Create("a", uint32(os.O_WRONLY), uint32(fileMode), &fuse.Context{})
+				So(status, ShouldEqual, fuse.OK)
+				f.Release()
+				_, err = os.Stat(filepath.Join(upperDir, ".wh.a"))
+				So(os.IsNotExist(err), ShouldBeTrue)
+				err = fs.Unmount()
+				So(err, ShouldBeNil)
+
+				fs, _ = mount()
+				So(ls(fs, ""), ShouldResemble, []string{"a", "b", "d"})
+				attr, status := fs.GetAttr("a", &fuse.Context{})
+				So(status, ShouldEqual, fuse.OK)
+				So(attr.Size, ShouldEqual, 0)
+			})
+		})
+
+		Convey("Writing to a read-only file copies it up to the writeable remote", func() {
+			f, status := fs.Open("b", uint32(os.O_RDWR), &fuse.Context{})
+			So(status, ShouldEqual, fuse.OK)
+			f.Release()
+			So(fs.fileToRemote["b"], ShouldEqual, upper)
+			So(fs.createdFiles["b"], ShouldBeTrue)
+			localPath := upper.getLocalPath(upper.getRemotePath("b"))
+			content, errr := ioutil.ReadFile(localPath)
+			So(errr, ShouldBeNil)
+			So(string(content), ShouldEqual, "lower b")
+			err = ioutil.WriteFile(localPath, []byte("upper b"), os.FileMode(fileMode))
+			So(err, ShouldBeNil)
+			err = fs.Unmount()
+			So(err, ShouldBeNil)
+			So(readUpper("b"), ShouldEqual, "upper b")
+
+			fs, upper = mount()
+			So(ls(fs, ""), ShouldResemble, []string{"a", "b", "d"})
+			So(fs.fileToRemote["b"], ShouldEqual, upper)
+
+			Convey("Deleting the copy also whites out the original", func() {
+				So(fs.Unlink("b", &fuse.Context{}), ShouldEqual, fuse.OK)
+				So(ls(fs, ""), ShouldResemble, []string{"a", "d"})
+				err = fs.Invalidate("", false)
+				So(err, ShouldBeNil)
+				So(ls(fs, ""), ShouldResemble, []string{"a", "d"})
+			})
+		})
+
+		Convey("Other operations don't wait for a copy up to download", func() {
+			lower := fs.remotes[0]
+			accessor := &blockingAccessor{localAccessor: &localAccessor{target: lowerDir}, started: make(chan bool), release: make(chan bool)}
+			lower.accessor = accessor
+			done := make(chan fuse.Status)
+			go func() {
+				f, status := fs.Open("b", uint32(os.O_RDWR), &fuse.Context{})
+				if status == fuse.OK {
+					f.Release()
+				}
+				done <- status
+			}()
+			<-accessor.started
+			So(ls(fs, ""), ShouldResemble, []string{"a", "b", "d"})
+			_, status := fs.GetAttr("a", &fuse.Context{})
+			So(status, ShouldEqual, fuse.OK)
+			fs.mapMutex.Lock()
+			So(fs.fileToRemote["b"], ShouldEqual, lower)
+			fs.mapMutex.Unlock()
+
+			accessor.release <- true
+			So(<-done, ShouldEqual, fuse.OK)
+			So(fs.fileToRemote["b"], ShouldEqual, upper)
+			content, errr := ioutil.ReadFile(upper.getLocalPath(upper.getRemotePath("b")))
+			So(errr, ShouldBeNil)
+			So(string(content), ShouldEqual, "lower b")
+		})
+
+		Convey("Other operations don't wait for a whiteout to upload", func() {
+			accessor := &blockingAccessor{localAccessor: &localAccessor{target: upperDir}, started: make(chan bool), release: make(chan bool)}
+			upper.accessor = accessor
+			done := make(chan fuse.Status)
+			go func() {
+				done <- fs.Unlink("a", &fuse.Context{})
+			}()
+			<-accessor.started
+			So(ls(fs, ""), ShouldResemble, []string{"a", "b", "d"})
+			_, status := fs.GetAttr("b", &fuse.Context{})
+			So(status, ShouldEqual, fuse.OK)
+
+			accessor.release <- true
+			So(<-done, ShouldEqual, fuse.OK)
+			So(ls(fs, ""), ShouldResemble, []string{"b", "d"})
+			_, err = os.Stat(filepath.Join(upperDir, ".wh.a"))
+			So(err, ShouldBeNil)
+		})
+
+		Convey("A whiteout marker that can't be deleted is kept, and the file can't be created", func() {
+			So(fs.Unlink("a", &fuse.Context{}), ShouldEqual, fuse.OK)
+			upper.accessor = &undeletableAccessor{&localAccessor{target: upperDir}}
+			_, status := fs.Create("a", uint32(os.O_WRONLY), uint32(fileMode), &fuse.Context{})
+			So(status, ShouldNotEqual, fuse.OK)
+			So(fs.whiteouts["a"], ShouldEqual, upper)
+			_, status = fs.GetAttr("a", &fuse.Context{})
+			So(status, ShouldEqual, fuse.ENOENT)
+			_, err = os.Stat(filepath.Join(upperDir, ".wh.a"))
+			So(err, ShouldBeNil)
+		})
+
+		Convey("Truncating a read-only file copies up an empty file", func() {
+			So(fs.Truncate("a", 0, &fuse.Context{}), ShouldEqual, fuse.OK)
+			attr, status := fs.GetAttr("a", &fuse.Context{})
+			So(status, ShouldEqual, fuse.OK)
+			So(attr.Size, ShouldEqual, 0)
+			err = fs.Unmount()
+			So(err, ShouldBeNil)
+			So(readUpper("a"), ShouldEqual, "")
+		})
+	})
+}
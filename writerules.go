@@ -0,0 +1,134 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of muxfys.
+//
+//  muxfys is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  muxfys is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with muxfys. If not, see <http://www.gnu.org/licenses/>.
+
+package muxfys
+
+// This file implements deciding which of multiple writeable remotes new files
+// and directories are created in.
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// checkWriteRules checks that the given RemoteConfig.WriteRules are valid glob
+// patterns.
+func checkWriteRules(rules []string) error {
+	for _, rule := range rules {
+		if _, err := filepath.Match(strings.TrimSuffix(rule, "/"), ""); err != nil || rule == "" || rule == "/" {
+			return fmt.Errorf("bad WriteRules pattern %q", rule)
+		}
+	}
+	return nil
+}
+
+// matchesWriteRule returns true if the given path relative to the mount point
+// matches the given rule. Rules ending in "/" match the directories that match
+// the rest of the rule, and everything beneath them. Other rules are matched
+// like Include patterns (see matchesGlobs()).
+func matchesWriteRule(rule, name string) bool {
+	if !strings.HasSuffix(rule, "/") {
+		return matchesGlobs([]string{rule}, name)
+	}
+	pattern := strings.TrimSuffix(rule, "/")
+	for dir := name; dir != ""; dir = parentDir(dir) {
+		if matched, _ := filepath.Match(pattern, dir); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// routes returns true if the given path relative to the mount point matches
+// any of our writeRules.
+func (r *remote) routes(name string) bool {
+	for _, rule := range r.writeRules {
+		if matchesWriteRule(rule, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeableRemotes returns those of our remotes that are writeable, in the
+// order they were mounted.
+func (fs *MuxFys) writeableRemotes() []*remote {
+	var writeable []*remote
+	for _, r := range fs.remotes {
+		if r.write {
+			writeable = append(writeable, r)
+		}
+	}
+	return writeable
+}
+
+// routeWrite returns the writeable remote that the given new file or directory
+// should be created in: the first one with WriteRules that match it, or else
+// our default writeRemote. Returns nil if there is no such remote, or it
+// doesn't allow() the path.
+func (fs *MuxFys) routeWrite(name string, isDir bool) *remote {
+	for _, r := range fs.remotes {
+		if r.write && r.routes(name) && r.allows(name, isDir) {
+			return r
+		}
+	}
+	if w := fs.writeRemote; w != nil && w.allows(name, isDir) {
+		return w
+	}
+	return nil
+}
+
+// writeTarget returns the remote that writes to the given file should go to:
+// the writeable remote it came from if it exists, otherwise the one that
+// routeWrite() picks for it.
+func (fs *MuxFys) writeTarget(name string) *remote {
+	fs.mapMutex.RLock()
+	r := fs.fileToRemote[name]
+	_, shadowed := fs.shadows[name]
+	fs.mapMutex.RUnlock()
+	if r != nil && r.write && !shadowed {
+		return r
+	}
+	return fs.routeWrite(name, false)
+}
+
+// addRouteDirs associates the existing parent directories of the given new file
+// or directory with the given remote it was created in, so that it is found
+// when they are listed again. Must be called while you have the mapMutex
+// Locked.
+func (fs *MuxFys) addRouteDirs(name string, r *remote) {
+	for dir := parentDir(name); r.within(dir); dir = parentDir(dir) {
+		if _, exists := fs.dirs[dir]; exists {
+			fs.addDirRemote(dir, r)
+		}
+		if dir == "" {
+			break
+		}
+	}
+}
+
+// createdRemote returns the remote the given created file will be uploaded to:
+// the one it belongs to, or else our default writeRemote. Must be called while
+// you hold the mapMutex.
+func (fs *MuxFys) createdRemote(name string) *remote {
+	if r := fs.fileToRemote[name]; r != nil {
+		return r
+	}
+	return fs.writeRemote
+}
@@ -0,0 +1,129 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of muxfys.
+//
+//  muxfys is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  muxfys is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with muxfys. If not, see <http://www.gnu.org/licenses/>.
+
+package muxfys
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestWriteRules(t *testing.T) {
+	Convey("WriteRules match paths relative to the mount point", t, func() {
+		So(matchesWriteRule("*.log", "a.log"), ShouldBeTrue)
+		So(matchesWriteRule("*.log", "d/a.log"), ShouldBeTrue)
+		So(matchesWriteRule("*.log", "a.txt"), ShouldBeFalse)
+		So(matchesWriteRule("results/", "results"), ShouldBeTrue)
+		So(matchesWriteRule("results/", "results/a/b.txt"), ShouldBeTrue)
+		So(matchesWriteRule("results/", "other/results"), ShouldBeFalse)
+		So(matchesWriteRule("run*/", "run1/a.txt"), ShouldBeTrue)
+		So(matchesWriteRule("d/*.txt", "d/a.txt"), ShouldBeTrue)
+		So(matchesWriteRule("d/*.txt", "a.txt"), ShouldBeFalse)
+
+		So(checkWriteRules([]string{"*.log", "results/"}), ShouldBeNil)
+		So(checkWriteRules([]string{"[a"}), ShouldNotBeNil)
+		So(checkWriteRules([]string{"/"}), ShouldNotBeNil)
+	})
+
+	Convey("Given multiple writeable remotes", t, func() {
+		tmpdir, err := ioutil.TempDir("", "muxfys_writerules_testing")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(tmpdir)
+		logsDir := filepath.Join(tmpdir, "logs")
+		resultsDir := filepath.Join(tmpdir, "results")
+		scratchDir := filepath.Join(tmpdir, "scratch")
+		for _, dir := range []string{logsDir, resultsDir, scratchDir} {
+			err = os.MkdirAll(dir, os.FileMode(dirMode))
+			So(err, ShouldBeNil)
+		}
+		err = ioutil.WriteFile(filepath.Join(scratchDir, "old.log"), []byte("old"), os.FileMode(fileMode))
+		So(err, ShouldBeNil)
+
+		Convey("Mount() rejects more than one without WriteRules", func() {
+			fs, errn := New(&Config{Mount: filepath.Join(tmpdir, "mnt"), CacheBase: tmpdir})
+			So(errn, ShouldBeNil)
+			err = fs.Mount(
+				&RemoteConfig{Accessor: &localAccessor{target: logsDir}, Write: true},
+				&RemoteConfig{Accessor: &localAccessor{target: scratchDir}, Write: true},
+			)
+			So(err, ShouldNotBeNil)
+
+			fs, errn = New(&Config{Mount: filepath.Join(tmpdir, "mnt"), CacheBase: tmpdir})
+			So(errn, ShouldBeNil)
+			err = fs.Mount(&RemoteConfig{Accessor: &localAccessor{target: logsDir}, Write: true, WriteRules: []string{"[a"}})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("New files are routed by WriteRules", func() {
+			fs, errn := New(&Config{Mount: filepath.Join(tmpdir, "mnt"), CacheBase: tmpdir})
+			So(errn, ShouldBeNil)
+			remotes := make(map[string]*remote)
+			rules := map[string][]string{"logs": {"*.log"}, "results": {"results/"}}
+			for _, dir := range []string{logsDir, resultsDir, scratchDir} {
+				name := filepath.Base(dir)
+				r, errr := newRemote(&RemoteConfig{Accessor: &localAccessor{target: dir}, CacheData: true, Write: true, WriteRules: rules[name]}, remoteOptions{cacheBase: tmpdir, logger: fs.Logger})
+				So(errr, ShouldBeNil)
+				remotes[name] = r
+				fs.remotes = append(fs.remotes, r)
+			}
+			fs.writeRemote = remotes["scratch"]
+			fs.OnMount(nil)
+			_, status := fs.OpenDir("", &fuse.Context{})
+			So(status, ShouldEqual, fuse.OK)
+
+			So(fs.Mkdir("results", uint32(dirMode), &fuse.Context{}), ShouldEqual, fuse.OK)
+			So(fs.dirs["results"], ShouldResemble, []*remote{remotes["results"]})
+			for _, name := range []string{"a.log", "results/r.txt", "s.txt"} {
+				f, status := fs.Create(name, uint32(os.O_WRONLY), uint32(fileMode), &fuse.Context{})
+				So(status, ShouldEqual, fuse.OK)
+				f.Release()
+			}
+			So(fs.fileToRemote["a.log"], ShouldEqual, remotes["logs"])
+			So(fs.fileToRemote["results/r.txt"], ShouldEqual, remotes["results"])
+			So(fs.fileToRemote["s.txt"], ShouldEqual, remotes["scratch"])
+
+			Convey("Existing files are written back to the remote they came from", func() {
+				f, status := fs.Open("old.log", uint32(os.O_RDWR), &fuse.Context{})
+				So(status, ShouldEqual, fuse.OK)
+				f.Release()
+				So(fs.fileToRemote["old.log"], ShouldEqual, remotes["scratch"])
+			})
+
+			Convey("Unmount() uploads each file to its own remote", func() {
+				err = fs.Unmount()
+				So(err, ShouldBeNil)
+				So(fs.UploadResults().Uploaded, ShouldHaveLength, 3)
+				for _, path := range []string{
+					filepath.Join(logsDir, "a.log"),
+					filepath.Join(resultsDir, "results", "r.txt"),
+					filepath.Join(scratchDir, "s.txt"),
+				} {
+					_, err = os.Stat(path)
+					So(err, ShouldBeNil)
+				}
+				_, err = os.Stat(filepath.Join(scratchDir, "a.log"))
+				So(os.IsNotExist(err), ShouldBeTrue)
+			})
+		})
+	})
+}